@@ -0,0 +1,142 @@
+package graphie
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Match reports whether all attributes in filter are present in a with an
+// equal value. A nil or empty filter matches everything.
+func (a Attrs) Match(filter Attrs) bool {
+	for k, want := range filter {
+		have, has := a[k]
+		if !has || !ValueEqual(have, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAny reports whether a matches at least one of the filters. No filters
+// at all match everything.
+func (a Attrs) matchAny(filters []Attrs) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	for _, f := range filters {
+		if a.Match(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValueEqual compares two attribute values. Numbers are compared by value
+// regardless of their concrete type, because drivers usually don't give back
+// the exact integer type that was stored (an int might come back as an int8
+// or a float64, for example).
+func ValueEqual(a, b interface{}) bool {
+	if fa, ok := toFloat(a); ok {
+		if fb, ok := toFloat(b); ok {
+			ia, aInt := toInt(a)
+			ib, bInt := toInt(b)
+			if aInt && bInt {
+				return ia == ib
+			}
+			return fa == fb
+		}
+		return false
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// ValueKey returns a comparable representation of an attribute value which
+// can be used as a key in hash indexes. Values which are equal according to
+// ValueEqual have the same key.
+func ValueKey(v interface{}) interface{} {
+	if i, ok := toInt(v); ok {
+		return i
+	}
+	if f, ok := toFloat(v); ok {
+		if f == float64(int64(f)) {
+			return int64(f)
+		}
+		return f
+	}
+	if v != nil && !reflect.TypeOf(v).Comparable() {
+		return fmt.Sprintf("%#v", v)
+	}
+	return v
+}
+
+// ErrNoKeys is returned by Merge if attrs are empty, so there's nothing to
+// identify the node by.
+var ErrNoKeys = fmt.Errorf("%w: Merge needs at least one attribute", ErrInvalidAttr)
+
+// SplitKeys splits attrs into the key attributes identifying a node on Merge
+// and the remaining ones. isKey reports whether an attribute was declared as
+// a key (using EnsureIndexNodes); if attrs don't contain any declared key,
+// all attributes are keys.
+func SplitKeys(attrs Attrs, isKey func(attr string) bool) (keys, rest Attrs) {
+	keys, rest = make(Attrs), make(Attrs)
+	for k, v := range attrs {
+		if isKey(k) {
+			keys[k] = v
+		} else {
+			rest[k] = v
+		}
+	}
+	if len(keys) == 0 {
+		return rest, keys
+	}
+	return keys, rest
+}
+
+func toInt(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint:
+		return int64(n), true
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	i, ok := toInt(v)
+	return float64(i), ok
+}
+
+// copyAttrs makes sure nobody keeps a reference to attributes handed over.
+func copyAttrs(attrs Attrs) Attrs {
+	if attrs == nil {
+		return nil
+	}
+	c := make(Attrs, len(attrs))
+	for k, v := range attrs {
+		c[k] = v
+	}
+	return c
+}
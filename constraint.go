@@ -0,0 +1,28 @@
+package graphie
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrConstraintViolation matches every ConstraintViolationError when used
+// with errors.Is.
+var ErrConstraintViolation = errors.New("Constraint violation")
+
+// ConstraintViolationError is returned by mutations which would lead to a
+// second node carrying Label with the same value for the unique attribute
+// Attr (see EnsureUnique).
+type ConstraintViolationError struct {
+	Label string
+	Attr  string
+	Value interface{}
+}
+
+func (e *ConstraintViolationError) Error() string {
+	return fmt.Sprintf("Constraint violation: a node with label '%s' and %s=%v exists already",
+		e.Label, e.Attr, e.Value)
+}
+
+func (e *ConstraintViolationError) Is(target error) bool {
+	return target == ErrConstraintViolation
+}
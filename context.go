@@ -0,0 +1,265 @@
+package graphie
+
+import (
+	"context"
+)
+
+// ContextStorage is implemented by storages whose operations can be
+// cancelled. Every method behaves like the Storage method of the same name
+// without the Context suffix, but gives up as soon as ctx is done and
+// returns ctx.Err() in this case. Mutations are either applied completely or
+// not at all; once a driver started to write, it may finish the mutation
+// even if ctx is cancelled.
+//
+// Use WithContext to get a ContextStorage for any storage.
+type ContextStorage interface {
+	Storage
+
+	FindByAttrContext(ctx context.Context, labels []string, key string, value interface{}) ([]NodeID, error)
+	WalkNodesContext(ctx context.Context, labels []string, fn func(id NodeID) error) error
+	LabelsContext(ctx context.Context, id NodeID) ([]string, error)
+	InContext(ctx context.Context, id NodeID) ([]*Link, error)
+	OutContext(ctx context.Context, id NodeID) ([]*Link, error)
+	WalkInContext(ctx context.Context, id NodeID, fn func(l *Link) error) error
+	WalkOutContext(ctx context.Context, id NodeID, fn func(l *Link) error) error
+	WalkInTypesContext(ctx context.Context, id NodeID, types []string, fn func(l *Link) error) error
+	WalkOutTypesContext(ctx context.Context, id NodeID, types []string, fn func(l *Link) error) error
+	GetEdgeContext(ctx context.Context, id EdgeID) (*Edge, error)
+	GetContext(ctx context.Context, id NodeID, key string) (interface{}, error)
+	HasContext(ctx context.Context, id NodeID, key string) (bool, error)
+	AttrsContext(ctx context.Context, id NodeID) (Attrs, error)
+
+	EnsureIndexNodesContext(ctx context.Context, labels []string, attrName string) error
+	EnsureIndexLinksContext(ctx context.Context, labels []string, attrName string) error
+	EnsureUniqueContext(ctx context.Context, labels []string, attrName string) error
+	AddContext(ctx context.Context, labels []string, attrs Attrs) (NodeID, error)
+	MergeContext(ctx context.Context, labels []string, attrs Attrs) (NodeID, error)
+	LinkContext(ctx context.Context, from, to NodeID, typ string, attrs Attrs) (EdgeID, error)
+	UnlinkContext(ctx context.Context, from, to NodeID, attrs Attrs) (int, error)
+	RemoveContext(ctx context.Context, id NodeID) error
+	AddLabelContext(ctx context.Context, id NodeID, label string) error
+	RemoveLabelContext(ctx context.Context, id NodeID, label string) error
+	SetContext(ctx context.Context, id NodeID, key string, value interface{}) error
+	SetEdgeAttrContext(ctx context.Context, id EdgeID, key string, value interface{}) error
+	RemoveEdgeContext(ctx context.Context, id EdgeID) error
+}
+
+// WithContext returns s if it implements ContextStorage. Otherwise s is
+// wrapped; the wrapper checks ctx before every operation and walks check it
+// before every call of fn, but a single operation of s can't be interrupted.
+func WithContext(s Storage) ContextStorage {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs
+	}
+	return contextAdapter{s}
+}
+
+type contextAdapter struct {
+	Storage
+}
+
+func (a contextAdapter) FindByAttrContext(ctx context.Context, labels []string, key string, value interface{}) ([]NodeID, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.FindByAttr(labels, key, value)
+}
+
+func (a contextAdapter) WalkNodesContext(ctx context.Context, labels []string, fn func(id NodeID) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.WalkNodes(labels, func(id NodeID) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(id)
+	})
+}
+
+func (a contextAdapter) LabelsContext(ctx context.Context, id NodeID) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.Labels(id)
+}
+
+func (a contextAdapter) InContext(ctx context.Context, id NodeID) ([]*Link, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.In(id)
+}
+
+func (a contextAdapter) OutContext(ctx context.Context, id NodeID) ([]*Link, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.Out(id)
+}
+
+func (a contextAdapter) WalkInContext(ctx context.Context, id NodeID, fn func(l *Link) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.WalkIn(id, checkContext(ctx, fn))
+}
+
+func (a contextAdapter) WalkOutContext(ctx context.Context, id NodeID, fn func(l *Link) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.WalkOut(id, checkContext(ctx, fn))
+}
+
+func (a contextAdapter) WalkInTypesContext(ctx context.Context, id NodeID, types []string, fn func(l *Link) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.WalkInTypes(id, types, checkContext(ctx, fn))
+}
+
+func (a contextAdapter) WalkOutTypesContext(ctx context.Context, id NodeID, types []string, fn func(l *Link) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.WalkOutTypes(id, types, checkContext(ctx, fn))
+}
+
+func checkContext(ctx context.Context, fn func(l *Link) error) func(l *Link) error {
+	return func(l *Link) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(l)
+	}
+}
+
+func (a contextAdapter) GetEdgeContext(ctx context.Context, id EdgeID) (*Edge, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.GetEdge(id)
+}
+
+func (a contextAdapter) GetContext(ctx context.Context, id NodeID, key string) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.Get(id, key)
+}
+
+func (a contextAdapter) HasContext(ctx context.Context, id NodeID, key string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return a.Has(id, key)
+}
+
+func (a contextAdapter) AttrsContext(ctx context.Context, id NodeID) (Attrs, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.Attrs(id)
+}
+
+func (a contextAdapter) EnsureIndexNodesContext(ctx context.Context, labels []string, attrName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.EnsureIndexNodes(labels, attrName)
+}
+
+func (a contextAdapter) EnsureIndexLinksContext(ctx context.Context, labels []string, attrName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.EnsureIndexLinks(labels, attrName)
+}
+
+func (a contextAdapter) EnsureUniqueContext(ctx context.Context, labels []string, attrName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.EnsureUnique(labels, attrName)
+}
+
+func (a contextAdapter) AddContext(ctx context.Context, labels []string, attrs Attrs) (NodeID, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return a.Add(labels, attrs)
+}
+
+func (a contextAdapter) MergeContext(ctx context.Context, labels []string, attrs Attrs) (NodeID, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return a.Merge(labels, attrs)
+}
+
+func (a contextAdapter) LinkContext(ctx context.Context, from, to NodeID, typ string, attrs Attrs) (EdgeID, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return a.Link(from, to, typ, attrs)
+}
+
+func (a contextAdapter) UnlinkContext(ctx context.Context, from, to NodeID, attrs Attrs) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return a.Unlink(from, to, attrs)
+}
+
+func (a contextAdapter) RemoveContext(ctx context.Context, id NodeID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.Remove(id)
+}
+
+func (a contextAdapter) AddLabelContext(ctx context.Context, id NodeID, label string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.AddLabel(id, label)
+}
+
+func (a contextAdapter) RemoveLabelContext(ctx context.Context, id NodeID, label string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.RemoveLabel(id, label)
+}
+
+func (a contextAdapter) SetContext(ctx context.Context, id NodeID, key string, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.Set(id, key, value)
+}
+
+func (a contextAdapter) SetEdgeAttrContext(ctx context.Context, id EdgeID, key string, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.SetEdgeAttr(id, key, value)
+}
+
+func (a contextAdapter) RemoveEdgeContext(ctx context.Context, id EdgeID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.RemoveEdge(id)
+}
+
+// withContext returns a copy of g whose queries are bound to ctx.
+func (g *Graph) withContext(ctx context.Context) *Graph {
+	return &Graph{
+		name: g.name,
+		s:    g.s,
+		cs:   g.cs,
+		ctx:  ctx,
+	}
+}
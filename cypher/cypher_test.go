@@ -0,0 +1,204 @@
+package cypher_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/flosch/graphie"
+	"github.com/flosch/graphie/cypher"
+	_ "github.com/flosch/graphie/storages/memory"
+)
+
+// newGraph returns a small graph of fields and the persons working in them.
+func newGraph(t *testing.T) *graphie.Graph {
+	t.Helper()
+	g, err := graphie.NewGraph("memory", "", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := func(label string, attrs graphie.Attrs) graphie.NodeID {
+		t.Helper()
+		id, err := g.Storage().Add([]string{label}, attrs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	link := func(from, to graphie.NodeID, typ string, attrs graphie.Attrs) {
+		t.Helper()
+		if _, err := g.Link(from, to, typ, attrs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	science := add("category", graphie.Attrs{"name": "Science"})
+	formal := add("category", graphie.Attrs{"name": "Formal science"})
+	maths := add("category", graphie.Attrs{"name": "Mathematics"})
+	law := add("category", graphie.Attrs{"name": "Law"})
+	numberTheory := add("category", graphie.Attrs{"name": "Number theory"})
+	cantor := add("person", graphie.Attrs{"fullname": "Georg Cantor", "born": 1845})
+	fermat := add("person", graphie.Attrs{"fullname": "Pierre de Fermat", "born": 1607})
+	hilbert := add("person", graphie.Attrs{"fullname": "David Hilbert", "born": 1862})
+	add("person", graphie.Attrs{"fullname": "Nobody"})
+
+	link(formal, science, "instance_of", nil)
+	link(maths, formal, "instance_of", nil)
+	link(law, science, "instance_of", nil)
+	link(maths, numberTheory, "contains", nil)
+	link(cantor, maths, "field_of_profession", graphie.Attrs{"since": 1870})
+	link(fermat, maths, "field_of_profession", nil)
+	link(fermat, law, "field_of_profession", nil)
+	link(hilbert, maths, "field_of_profession", nil)
+	link(hilbert, cantor, "knows", nil)
+	link(cantor, hilbert, "knows", nil)
+	return g
+}
+
+// format renders a result as its columns followed by one line per row.
+func format(res *cypher.Result) string {
+	lines := []string{strings.Join(res.Columns, ", ")}
+	for _, row := range res.Rows {
+		values := make([]string, 0, len(row))
+		for _, v := range row {
+			values = append(values, fmt.Sprint(v))
+		}
+		lines = append(lines, strings.Join(values, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func runTests(t *testing.T, tests []struct{ query, want string }) {
+	t.Helper()
+	g := newGraph(t)
+	defer g.Close()
+	for _, test := range tests {
+		res, err := cypher.Run(g, test.query)
+		if err != nil {
+			t.Errorf("%s: %v", test.query, err)
+			continue
+		}
+		if got := format(res); got != test.want {
+			t.Errorf("%s\ngot:\n%s\nwant:\n%s", test.query, got, test.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	runTests(t, []struct{ query, want string }{
+		{`MATCH (p:person)-[:field_of_profession]->(c:category {name: "Mathematics"}) RETURN p.fullname ORDER BY p.fullname`,
+			"p.fullname\nDavid Hilbert\nGeorg Cantor\nPierre de Fermat"},
+		{`match (c:category {name: "Mathematics"})<-[:field_of_profession]-(p) return p.fullname as n order by n desc`,
+			"n\nPierre de Fermat\nGeorg Cantor\nDavid Hilbert"},
+		{`MATCH (p:person {fullname: "Georg Cantor"})-[r:field_of_profession {since: 1870}]->(c) RETURN type(r), r.since, c.name`,
+			"type(r), r.since, c.name\nfield_of_profession, 1870, Mathematics"},
+		{`MATCH (p:person), (c:category {name: "Law"}) WHERE p.fullname CONTAINS "Fermat" RETURN p.fullname, c.name`,
+			"p.fullname, c.name\nPierre de Fermat, Law"},
+		{`MATCH (p:person)-->(c:category) MATCH (c)<--(q:person) WHERE p.fullname = "Pierre de Fermat" AND q <> p RETURN DISTINCT q.fullname ORDER BY q.fullname`,
+			"q.fullname\nDavid Hilbert\nGeorg Cantor"},
+		{`MATCH (p:nosuch) RETURN p`, "p"},
+
+		// A link is matched once per row: knows-links in both directions
+		// make two rows per pair, but never a row using a link twice.
+		{`MATCH (a:person)-[:knows]-(b:person) RETURN a.fullname, b.fullname ORDER BY a.fullname, b.fullname`,
+			"a.fullname, b.fullname\nDavid Hilbert, Georg Cantor\nDavid Hilbert, Georg Cantor\nGeorg Cantor, David Hilbert\nGeorg Cantor, David Hilbert"},
+		{`MATCH (a:person {fullname: "Georg Cantor"})-[:knows]->(b)-[:knows]->(c) RETURN c.fullname`,
+			"c.fullname\nGeorg Cantor"},
+
+		// Varying-length relationships yield every node reached once.
+		{`MATCH (c {name: "Mathematics"})-[:instance_of*]->(s) RETURN s.name ORDER BY s.name`,
+			"s.name\nFormal science\nScience"},
+		{`MATCH (c {name: "Mathematics"})-[:instance_of*0..1]->(s) RETURN s.name ORDER BY s.name`,
+			"s.name\nFormal science\nMathematics"},
+		{`MATCH (s {name: "Science"})<-[:instance_of*2]-(c) RETURN c.name`,
+			"c.name\nMathematics"},
+		{`MATCH (s {name: "Science"})<-[*..1]-(c) RETURN c.name ORDER BY c.name`,
+			"c.name\nFormal science\nLaw"},
+	})
+}
+
+func TestNull(t *testing.T) {
+	runTests(t, []struct{ query, want string }{
+		{`MATCH (p:person) WHERE p.born IS NULL RETURN p.fullname`, "p.fullname\nNobody"},
+		{`MATCH (p:person) WHERE p.born IS NOT NULL RETURN count(*)`, "count(*)\n3"},
+
+		// Comparisons involving null are null; neither the condition nor
+		// its negation keeps the row.
+		{`MATCH (p:person) WHERE p.born > 1800 RETURN p.fullname ORDER BY p.fullname`,
+			"p.fullname\nDavid Hilbert\nGeorg Cantor"},
+		{`MATCH (p:person) WHERE NOT p.born > 1800 RETURN p.fullname`, "p.fullname\nPierre de Fermat"},
+		{`MATCH (p:person) WHERE p.born = null RETURN p.fullname`, "p.fullname"},
+		{`MATCH (p:person) WHERE p.born <> 1 RETURN count(*)`, "count(*)\n3"},
+
+		// OR is true if either side is true, AND is false if either side
+		// is false.
+		{`MATCH (p:person) WHERE p.born > 1800 OR p.fullname = "Nobody" RETURN count(*)`, "count(*)\n3"},
+		{`MATCH (p:person) WHERE NOT (p.born > 1800 AND p.fullname = "Georg Cantor") RETURN p.fullname ORDER BY p.fullname`,
+			"p.fullname\nDavid Hilbert\nNobody\nPierre de Fermat"},
+
+		{`MATCH (p {born: null}) RETURN p`, "p"},
+		{`MATCH (p:person {fullname: "Nobody"}) RETURN p.fullname, p.born`, "p.fullname, p.born\nNobody, <nil>"},
+	})
+}
+
+func TestOrder(t *testing.T) {
+	runTests(t, []struct{ query, want string }{
+		{`MATCH (p:person) RETURN p.fullname ORDER BY p.fullname`,
+			"p.fullname\nDavid Hilbert\nGeorg Cantor\nNobody\nPierre de Fermat"},
+		{`MATCH (p:person) RETURN p.fullname ORDER BY p.fullname DESC`,
+			"p.fullname\nPierre de Fermat\nNobody\nGeorg Cantor\nDavid Hilbert"},
+		// null comes last in ascending order.
+		{`MATCH (p:person) RETURN p.fullname ORDER BY p.born`,
+			"p.fullname\nPierre de Fermat\nGeorg Cantor\nDavid Hilbert\nNobody"},
+		{`MATCH (p:person) RETURN p.fullname ORDER BY p.born DESC`,
+			"p.fullname\nNobody\nDavid Hilbert\nGeorg Cantor\nPierre de Fermat"},
+		{`MATCH (p:person)-[:field_of_profession]->(c) RETURN c.name, p.fullname ORDER BY c.name DESC, p.fullname`,
+			"c.name, p.fullname\nMathematics, David Hilbert\nMathematics, Georg Cantor\nMathematics, Pierre de Fermat\nLaw, Pierre de Fermat"},
+		{`MATCH (p:person) RETURN p.fullname ORDER BY p.fullname SKIP 1 LIMIT 2`,
+			"p.fullname\nGeorg Cantor\nNobody"},
+		{`MATCH (p:person) RETURN p.fullname ORDER BY p.fullname SKIP 3`, "p.fullname\nPierre de Fermat"},
+		{`MATCH (p:person) RETURN p.fullname ORDER BY p.fullname SKIP 10`, "p.fullname"},
+		{`MATCH (p:person) RETURN p.fullname LIMIT 0`, "p.fullname"},
+		{`MATCH (p:person)-[:field_of_profession]->(c) RETURN DISTINCT c.name ORDER BY c.name`,
+			"c.name\nLaw\nMathematics"},
+	})
+}
+
+func TestCount(t *testing.T) {
+	runTests(t, []struct{ query, want string }{
+		{`MATCH (p:person) RETURN count(*), count(p.born)`, "count(*), count(p.born)\n4, 3"},
+		{`MATCH (p:nosuch) RETURN count(*)`, "count(*)\n0"},
+		{`MATCH (p:person)-[:field_of_profession]->(c) RETURN count(c), count(DISTINCT c)`,
+			"count(c), count(DISTINCT c)\n4, 2"},
+		{`MATCH (p:person) RETURN count(DISTINCT labels(p))`, "count(DISTINCT labels(p))\n1"},
+		{`MATCH (p:person)-[:field_of_profession]->(c) RETURN c.name, count(*) AS n ORDER BY n DESC, c.name`,
+			"c.name, n\nMathematics, 3\nLaw, 1"},
+		{`MATCH (p:person)-[:field_of_profession]->(c) RETURN c.name, count(DISTINCT p.born) AS n ORDER BY c.name`,
+			"c.name, n\nLaw, 1\nMathematics, 3"},
+	})
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	tests := []string{
+		``,
+		`MATCH`,
+		`MATCH (a) RETURN b`,
+		`MATCH (a)-[r*]->(b) RETURN a`,
+		`MATCH (a) WHERE count(*) > 1 RETURN a`,
+		`MATCH (a) RETURN count(*) + 1`,
+		`MATCH (a)-[a]->(b) RETURN a`,
+		`MATCH (a) RETURN a LIMIT x`,
+		`MATCH (a) RETURN "x`,
+		`MATCH (a) RETURN a.x, count(*) ORDER BY a.y`,
+		`MATCH (a)->(b) RETURN a`,
+		`MATCH (a) RETURN a extra`,
+		`MATCH (a) RETURN foo(a)`,
+		`MATCH (a {x: }) RETURN a`,
+		`MATCH (a) RETURN a #`,
+	}
+	for _, query := range tests {
+		if _, err := cypher.Parse(query); !errors.Is(err, cypher.ErrSyntax) {
+			t.Errorf("Parse(%q) returned %v, want a syntax error", query, err)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Package cypher implements a small declarative query language for graphie
+// graphs modelled after Cypher:
+//
+//	MATCH (p:person)-[:field_of_profession]->(c:category {name: "Mathematics"})
+//	RETURN p.fullname
+//
+// A query consists of the following clauses:
+//
+//	MATCH pattern, ...         one or more MATCH clauses
+//	WHERE condition            optional
+//	RETURN [DISTINCT] item, ...
+//	ORDER BY item [DESC], ...  optional
+//	SKIP n                     optional
+//	LIMIT n                    optional
+//
+// A pattern is a chain of nodes and relationships. Nodes are written as
+// (var:label:label {key: value, ...}); relationships as -[var:type|type
+// {key: value}]->, <-[...]- or -[...]- if the direction doesn't matter.
+// Variables, labels, types and properties are all optional; -->, <-- and
+// -- are relationships without any of them. A relationship like
+// -[:type*min..max]-> matches paths of min to max links (*, *n, *n.. and
+// *..m work, too); it yields every node reachable that way once and can't
+// be bound to a variable. Patterns sharing a variable are joined. Like in
+// Cypher, a link is matched at most once per row; since the links of a
+// varying-length relationship aren't bound, they're exempt from that rule.
+//
+// Conditions and returned items are made of variables, properties (var.key),
+// literals ("string", 'string', 42, 1.5, true, false, null), the comparisons
+// =, <>, <, <=, >, >=, IS [NOT] NULL, STARTS WITH, ENDS WITH and CONTAINS,
+// AND, OR, NOT and the functions id(node), id(rel), labels(node) and
+// type(rel). Returning count(*), count(expr) or count(DISTINCT expr) groups
+// the rows by the other returned items. Missing properties are null;
+// comparisons involving null are null, and WHERE keeps the rows for which
+// the condition is true only.
+//
+// Queries are run against the storage of a graph: every pattern starts at
+// its most selective node, which is a node bound by an earlier pattern, a
+// node with properties (looked up using FindByAttr, so the indexes created
+// by EnsureIndexNodes are used) or a node with labels (using WalkNodes).
+// From there, relationships are followed using WalkInTypes and
+// WalkOutTypes, so only links of the requested types are read.
+package cypher
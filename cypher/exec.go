@@ -0,0 +1,334 @@
+package cypher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/flosch/graphie"
+)
+
+var errEnough = errors.New("enough rows")
+
+// Result holds the rows returned by a query; Rows[i][j] is the value of
+// Columns[j]. Nodes are returned as graphie.NodeID, relationships as
+// *graphie.Edge and missing properties as nil.
+type Result struct {
+	Columns []string
+	Rows    [][]interface{}
+}
+
+// Run parses and runs a query on g.
+func Run(g *graphie.Graph, query string) (*Result, error) {
+	return RunContext(context.Background(), g, query)
+}
+
+// RunContext is Run reading the graph with ctx (see graphie.ContextStorage).
+func RunContext(ctx context.Context, g *graphie.Graph, query string) (*Result, error) {
+	st, err := Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	return st.RunContext(ctx, g)
+}
+
+// Run runs the statement on g.
+func (st *Statement) Run(g *graphie.Graph) (*Result, error) {
+	return st.RunContext(context.Background(), g)
+}
+
+// RunContext is Run reading the graph with ctx.
+func (st *Statement) RunContext(ctx context.Context, g *graphie.Graph) (*Result, error) {
+	e := &executor{
+		ctx:       ctx,
+		s:         graphie.WithContext(g.Storage()),
+		st:        st,
+		attrCache: make(map[graphie.NodeID]graphie.Attrs),
+	}
+	return e.run()
+}
+
+// An executor runs a statement once. Rows have a slot for every variable of
+// the statement holding a graphie.NodeID or a *graphie.Edge; nil means the
+// variable isn't bound yet.
+type executor struct {
+	ctx context.Context
+	s   graphie.ContextStorage
+	st  *Statement
+
+	attrCache map[graphie.NodeID]graphie.Attrs
+}
+
+// attrs returns the attributes of a node; they're read once per run.
+func (e *executor) attrs(id graphie.NodeID) (graphie.Attrs, error) {
+	if attrs, has := e.attrCache[id]; has {
+		return attrs, nil
+	}
+	attrs, err := e.s.AttrsContext(e.ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	e.attrCache[id] = attrs
+	return attrs, nil
+}
+
+func (e *executor) labels(id graphie.NodeID) ([]string, error) {
+	return e.s.LabelsContext(e.ctx, id)
+}
+
+// A resultRow is a projected row with the values it's ordered by.
+type resultRow struct {
+	values []interface{}
+	order  []interface{}
+}
+
+func (e *executor) run() (*Result, error) {
+	res := &Result{
+		Columns: make([]string, 0, len(e.st.items)),
+		Rows:    make([][]interface{}, 0),
+	}
+	for _, item := range e.st.items {
+		res.Columns = append(res.Columns, item.name)
+	}
+
+	aggregated := e.st.aggregated()
+	var groups *grouping
+	if aggregated {
+		groups = newGrouping()
+	}
+
+	// Without sorting, deduplication or aggregation the matching stops as
+	// soon as there are enough rows
+	enough := -1
+	if e.st.limit >= 0 && len(e.st.order) == 0 && !e.st.distinct && !aggregated {
+		enough = e.st.skip + e.st.limit
+	}
+	if enough == 0 {
+		return res, nil
+	}
+
+	rows := make([]*resultRow, 0)
+	seen := make(map[string]struct{})
+	err := e.match(0, make([]interface{}, len(e.st.vars)), func(row []interface{}) error {
+		if e.st.where != nil {
+			ok, err := evalBool(e, row, e.st.where)
+			if err != nil {
+				return err
+			}
+			if ok != true {
+				return nil
+			}
+		}
+
+		if aggregated {
+			return groups.add(e, row)
+		}
+		r, err := e.project(row)
+		if err != nil {
+			return err
+		}
+		if e.st.distinct {
+			key := rowKey(r.values)
+			if _, has := seen[key]; has {
+				return nil
+			}
+			seen[key] = struct{}{}
+		}
+		rows = append(rows, r)
+		if len(rows) == enough {
+			return errEnough
+		}
+		return nil
+	})
+	if err != nil && err != errEnough {
+		return nil, err
+	}
+
+	if aggregated {
+		rows, err = groups.rows(e)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(e.st.order) > 0 {
+		sort.SliceStable(rows, func(i, j int) bool {
+			for k, item := range e.st.order {
+				c := orderValues(rows[i].order[k], rows[j].order[k])
+				if c == 0 {
+					continue
+				}
+				return (c < 0) != item.desc
+			}
+			return false
+		})
+	}
+
+	if e.st.skip >= len(rows) {
+		rows = rows[:0]
+	} else {
+		rows = rows[e.st.skip:]
+	}
+	if e.st.limit >= 0 && len(rows) > e.st.limit {
+		rows = rows[:e.st.limit]
+	}
+	for _, r := range rows {
+		res.Rows = append(res.Rows, r.values)
+	}
+	return res, nil
+}
+
+// project evaluates the returned items and the ORDER BY values of a row.
+func (e *executor) project(row []interface{}) (*resultRow, error) {
+	r := &resultRow{
+		values: make([]interface{}, 0, len(e.st.items)),
+	}
+	for _, item := range e.st.items {
+		v, err := item.expr.eval(e, row)
+		if err != nil {
+			return nil, err
+		}
+		r.values = append(r.values, v)
+	}
+	return r, e.order(r, row)
+}
+
+// order evaluates the ORDER BY values of a projected row. row is nil for
+// aggregated rows, which are ordered by their columns only (see Parse).
+func (e *executor) order(r *resultRow, row []interface{}) error {
+	for _, item := range e.st.order {
+		if c, ok := item.expr.(*columnExpr); ok {
+			r.order = append(r.order, r.values[c.column])
+			continue
+		}
+		v, err := item.expr.eval(e, row)
+		if err != nil {
+			return err
+		}
+		r.order = append(r.order, v)
+	}
+	return nil
+}
+
+// rowKey returns a key of the values which is equal for equal values (see
+// graphie.ValueEqual).
+func rowKey(values []interface{}) string {
+	keys := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		if edge, ok := v.(*graphie.Edge); ok {
+			keys = append(keys, [3]uint64{uint64(edge.ID), uint64(edge.From), uint64(edge.To)})
+			continue
+		}
+		keys = append(keys, graphie.ValueKey(v))
+	}
+	return fmt.Sprintf("%#v", keys)
+}
+
+// A grouping aggregates the rows having the same non-aggregated values.
+type grouping struct {
+	keys   map[string]*group
+	groups []*group
+}
+
+type group struct {
+	values []interface{}
+	counts []int
+	seen   []map[string]struct{} // the values counted by count(DISTINCT ...)
+}
+
+func newGrouping() *grouping {
+	return &grouping{
+		keys: make(map[string]*group),
+	}
+}
+
+func (gr *grouping) add(e *executor, row []interface{}) error {
+	values := make([]interface{}, len(e.st.items))
+	keyValues := make([]interface{}, 0, len(e.st.items))
+	for i, item := range e.st.items {
+		if _, ok := item.expr.(*countExpr); ok {
+			continue
+		}
+		v, err := item.expr.eval(e, row)
+		if err != nil {
+			return err
+		}
+		values[i] = v
+		keyValues = append(keyValues, v)
+	}
+
+	key := rowKey(keyValues)
+	g, has := gr.keys[key]
+	if !has {
+		g = &group{
+			values: values,
+			counts: make([]int, len(values)),
+			seen:   make([]map[string]struct{}, len(values)),
+		}
+		gr.keys[key] = g
+		gr.groups = append(gr.groups, g)
+	}
+
+	for i, item := range e.st.items {
+		c, ok := item.expr.(*countExpr)
+		if !ok {
+			continue
+		}
+		v, err := c.eval(e, row)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			continue
+		}
+		if c.distinct {
+			if g.seen[i] == nil {
+				g.seen[i] = make(map[string]struct{})
+			}
+			vk := rowKey([]interface{}{v})
+			if _, has := g.seen[i][vk]; has {
+				continue
+			}
+			g.seen[i][vk] = struct{}{}
+		}
+		g.counts[i]++
+	}
+	return nil
+}
+
+// rows returns a row for every group. Without grouping keys, there is one
+// row even if nothing matched.
+func (gr *grouping) rows(e *executor) ([]*resultRow, error) {
+	groups := gr.groups
+	if len(groups) == 0 && len(gr.keys) == 0 && onlyCounts(e.st) {
+		groups = []*group{{
+			values: make([]interface{}, len(e.st.items)),
+			counts: make([]int, len(e.st.items)),
+		}}
+	}
+
+	rows := make([]*resultRow, 0, len(groups))
+	for _, g := range groups {
+		r := &resultRow{values: g.values}
+		for i, item := range e.st.items {
+			if _, ok := item.expr.(*countExpr); ok {
+				r.values[i] = g.counts[i]
+			}
+		}
+		if err := e.order(r, nil); err != nil {
+			return nil, err
+		}
+		rows = append(rows, r)
+	}
+	return rows, nil
+}
+
+func onlyCounts(st *Statement) bool {
+	for _, item := range st.items {
+		if _, ok := item.expr.(*countExpr); !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,328 @@
+package cypher
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flosch/graphie"
+)
+
+// An expr is evaluated for a matched row. null is represented by nil; the
+// logical operators use three-valued logic like SQL does.
+type expr interface {
+	eval(e *executor, row []interface{}) (interface{}, error)
+}
+
+type literalExpr struct {
+	value interface{}
+}
+
+func (x *literalExpr) eval(e *executor, row []interface{}) (interface{}, error) {
+	return x.value, nil
+}
+
+// varExpr is a node (returned as its id) or a relationship (returned as
+// *graphie.Edge).
+type varExpr struct {
+	slot int
+}
+
+func (x *varExpr) eval(e *executor, row []interface{}) (interface{}, error) {
+	return row[x.slot], nil
+}
+
+type propExpr struct {
+	slot int
+	rel  bool
+	key  string
+}
+
+func (x *propExpr) eval(e *executor, row []interface{}) (interface{}, error) {
+	if x.rel {
+		return row[x.slot].(*graphie.Edge).Attrs[x.key], nil
+	}
+	attrs, err := e.attrs(row[x.slot].(graphie.NodeID))
+	if err != nil {
+		return nil, err
+	}
+	return attrs[x.key], nil
+}
+
+// columnExpr refers to a returned column in ORDER BY.
+type columnExpr struct {
+	column int
+}
+
+func (x *columnExpr) eval(e *executor, row []interface{}) (interface{}, error) {
+	panic("columns are resolved by the executor")
+}
+
+type idExpr struct {
+	slot int
+}
+
+func (x *idExpr) eval(e *executor, row []interface{}) (interface{}, error) {
+	return uint64(row[x.slot].(graphie.NodeID)), nil
+}
+
+type edgeIDExpr struct {
+	slot int
+}
+
+func (x *edgeIDExpr) eval(e *executor, row []interface{}) (interface{}, error) {
+	return uint64(row[x.slot].(*graphie.Edge).ID), nil
+}
+
+type labelsExpr struct {
+	slot int
+}
+
+func (x *labelsExpr) eval(e *executor, row []interface{}) (interface{}, error) {
+	return e.labels(row[x.slot].(graphie.NodeID))
+}
+
+type typeExpr struct {
+	slot int
+}
+
+func (x *typeExpr) eval(e *executor, row []interface{}) (interface{}, error) {
+	return row[x.slot].(*graphie.Edge).Type, nil
+}
+
+// countExpr is aggregated by the executor; evaluating it returns the value
+// to count.
+type countExpr struct {
+	e        expr // nil for count(*)
+	distinct bool
+}
+
+func (x *countExpr) eval(e *executor, row []interface{}) (interface{}, error) {
+	if x.e == nil {
+		return true, nil
+	}
+	return x.e.eval(e, row)
+}
+
+type orExpr struct {
+	left, right expr
+}
+
+func (x *orExpr) eval(e *executor, row []interface{}) (interface{}, error) {
+	l, err := evalBool(e, row, x.left)
+	if err != nil || l == true {
+		return l, err
+	}
+	r, err := evalBool(e, row, x.right)
+	if err != nil || r == true {
+		return r, err
+	}
+	if l == nil || r == nil {
+		return nil, nil
+	}
+	return false, nil
+}
+
+type andExpr struct {
+	left, right expr
+}
+
+func (x *andExpr) eval(e *executor, row []interface{}) (interface{}, error) {
+	l, err := evalBool(e, row, x.left)
+	if err != nil || l == false {
+		return l, err
+	}
+	r, err := evalBool(e, row, x.right)
+	if err != nil || r == false {
+		return r, err
+	}
+	if l == nil || r == nil {
+		return nil, nil
+	}
+	return true, nil
+}
+
+type notExpr struct {
+	e expr
+}
+
+func (x *notExpr) eval(e *executor, row []interface{}) (interface{}, error) {
+	v, err := evalBool(e, row, x.e)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	return !v.(bool), nil
+}
+
+// evalBool evaluates x; everything but a boolean is null.
+func evalBool(e *executor, row []interface{}, x expr) (interface{}, error) {
+	v, err := x.eval(e, row)
+	if err != nil {
+		return nil, err
+	}
+	if b, ok := v.(bool); ok {
+		return b, nil
+	}
+	return nil, nil
+}
+
+type compareExpr struct {
+	op          string
+	left, right expr
+}
+
+func (x *compareExpr) eval(e *executor, row []interface{}) (interface{}, error) {
+	l, err := x.left.eval(e, row)
+	if err != nil {
+		return nil, err
+	}
+	r, err := x.right.eval(e, row)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil || r == nil {
+		return nil, nil
+	}
+
+	switch x.op {
+	case "=":
+		return equal(l, r), nil
+	case "<>":
+		return !equal(l, r), nil
+	}
+	c, ok := compare(l, r)
+	if !ok {
+		return nil, nil
+	}
+	switch x.op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	}
+	return c >= 0, nil
+}
+
+type isNullExpr struct {
+	e   expr
+	not bool
+}
+
+func (x *isNullExpr) eval(e *executor, row []interface{}) (interface{}, error) {
+	v, err := x.e.eval(e, row)
+	if err != nil {
+		return nil, err
+	}
+	return (v == nil) != x.not, nil
+}
+
+type stringExpr struct {
+	op          string // STARTS, ENDS or CONTAINS
+	left, right expr
+}
+
+func (x *stringExpr) eval(e *executor, row []interface{}) (interface{}, error) {
+	l, err := x.left.eval(e, row)
+	if err != nil {
+		return nil, err
+	}
+	r, err := x.right.eval(e, row)
+	if err != nil {
+		return nil, err
+	}
+	ls, lok := l.(string)
+	rs, rok := r.(string)
+	if !lok || !rok {
+		return nil, nil
+	}
+	switch x.op {
+	case "STARTS":
+		return strings.HasPrefix(ls, rs), nil
+	case "ENDS":
+		return strings.HasSuffix(ls, rs), nil
+	}
+	return strings.Contains(ls, rs), nil
+}
+
+// equal compares two values; edges are equal if they're the same link.
+func equal(a, b interface{}) bool {
+	ea, aEdge := a.(*graphie.Edge)
+	eb, bEdge := b.(*graphie.Edge)
+	if aEdge || bEdge {
+		return aEdge && bEdge && sameEdge(ea, eb)
+	}
+	return graphie.ValueEqual(a, b)
+}
+
+func sameEdge(a, b *graphie.Edge) bool {
+	return a.ID == b.ID && a.From == b.From && a.To == b.To
+}
+
+// compare orders numbers and strings; other values can't be compared.
+func compare(a, b interface{}) (int, bool) {
+	if fa, ok := toFloat(a); ok {
+		if fb, ok := toFloat(b); ok {
+			switch {
+			case fa < fb:
+				return -1, true
+			case fa > fb:
+				return 1, true
+			}
+			return 0, true
+		}
+		return 0, false
+	}
+	sa, aok := a.(string)
+	sb, bok := b.(string)
+	if aok && bok {
+		return strings.Compare(sa, sb), true
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch k := graphie.ValueKey(v).(type) {
+	case int64:
+		return float64(k), true
+	case float64:
+		return k, true
+	}
+	return 0, false
+}
+
+// orderValues is a total order of all values for ORDER BY: numbers, strings,
+// booleans, everything else and null last.
+func orderValues(a, b interface{}) int {
+	rank := func(v interface{}) int {
+		if _, ok := toFloat(v); ok {
+			return 0
+		}
+		switch v.(type) {
+		case string:
+			return 1
+		case bool:
+			return 2
+		case nil:
+			return 4
+		}
+		return 3
+	}
+	ra, rb := rank(a), rank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	if c, ok := compare(a, b); ok {
+		return c
+	}
+	if ra == 2 {
+		switch {
+		case a == b:
+			return 0
+		case a == false:
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
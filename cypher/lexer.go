@@ -0,0 +1,149 @@
+package cypher
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokInt
+	tokFloat
+	tokSymbol
+)
+
+type token struct {
+	kind tokenKind
+	text string // the identifier, the decoded string or the symbol
+	pos  int    // byte offset in the query
+	end  int    // byte offset behind the token
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of query"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// Symbols made of more than one character; they're tried before the single
+// character ones.
+var symbols = []string{"<>", "<=", ">=", "..", "->", "<-", "(", ")", "[", "]", "{", "}", ":", ",", ".", "*", "|", "=", "<", ">", "-"}
+
+// lex splits the query into tokens; the last one is always tokEOF.
+func lex(query string) ([]token, error) {
+	tokens := make([]token, 0)
+	pos := 0
+	for {
+		for pos < len(query) {
+			r, size := utf8.DecodeRuneInString(query[pos:])
+			if !unicode.IsSpace(r) {
+				break
+			}
+			pos += size
+		}
+		if pos >= len(query) {
+			return append(tokens, token{kind: tokEOF, pos: pos, end: pos}), nil
+		}
+
+		start := pos
+		r, _ := utf8.DecodeRuneInString(query[pos:])
+		switch {
+		case r == '_' || unicode.IsLetter(r):
+			for pos < len(query) {
+				r, size := utf8.DecodeRuneInString(query[pos:])
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				pos += size
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: query[start:pos], pos: start, end: pos})
+
+		case r == '`':
+			end := strings.IndexByte(query[pos+1:], '`')
+			if end < 0 {
+				return nil, syntaxError(start, "unterminated identifier")
+			}
+			pos += end + 2
+			tokens = append(tokens, token{kind: tokIdent, text: query[start+1 : pos-1], pos: start, end: pos})
+
+		case r == '\'' || r == '"':
+			s, n, err := lexString(query[pos:])
+			if err != nil {
+				return nil, syntaxError(start, "%s", err)
+			}
+			pos += n
+			tokens = append(tokens, token{kind: tokString, text: s, pos: start, end: pos})
+
+		case r >= '0' && r <= '9':
+			kind := tokInt
+			for pos < len(query) && query[pos] >= '0' && query[pos] <= '9' {
+				pos++
+			}
+			// A dot is part of the number unless it's the range operator
+			if pos+1 < len(query) && query[pos] == '.' && query[pos+1] >= '0' && query[pos+1] <= '9' {
+				kind = tokFloat
+				pos++
+				for pos < len(query) && query[pos] >= '0' && query[pos] <= '9' {
+					pos++
+				}
+			}
+			tokens = append(tokens, token{kind: kind, text: query[start:pos], pos: start, end: pos})
+
+		default:
+			found := false
+			for _, sym := range symbols {
+				if strings.HasPrefix(query[pos:], sym) {
+					pos += len(sym)
+					tokens = append(tokens, token{kind: tokSymbol, text: sym, pos: start, end: pos})
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, syntaxError(start, "unexpected character %q", r)
+			}
+		}
+	}
+}
+
+// lexString decodes the quoted string at the beginning of s. It returns the
+// string and the number of bytes it took.
+func lexString(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case quote:
+			return b.String(), i + 1, nil
+		case '\\':
+			i++
+			if i >= len(s) {
+				break
+			}
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case '\\', '\'', '"':
+				b.WriteByte(s[i])
+			default:
+				return "", 0, fmt.Errorf("unknown escape sequence \\%c", s[i])
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
@@ -0,0 +1,253 @@
+package cypher
+
+import (
+	"github.com/flosch/graphie"
+	"github.com/flosch/graphie/internal/walk"
+)
+
+// match matches the patterns from the i-th one on and calls fn for every
+// complete row. Rows passed to fn must not be modified.
+func (e *executor) match(i int, row []interface{}, fn func(row []interface{}) error) error {
+	if i == len(e.st.patterns) {
+		return fn(row)
+	}
+	pat := e.st.patterns[i]
+
+	// The pattern is matched starting at its most selective node, going to
+	// the right end first and to the left one afterwards
+	start := e.plan(pat, row)
+	hops := make([]hop, 0, len(pat.rels))
+	for j := start; j < len(pat.rels); j++ {
+		hops = append(hops, hop{from: pat.nodes[j], rel: pat.rels[j], to: pat.nodes[j+1]})
+	}
+	for j := start - 1; j >= 0; j-- {
+		hops = append(hops, hop{from: pat.nodes[j+1], rel: pat.rels[j], to: pat.nodes[j], reverse: true})
+	}
+
+	np := pat.nodes[start]
+	return e.startNodes(np, row, func(id graphie.NodeID) error {
+		r, err := e.bindNode(np, row, id)
+		if err != nil || r == nil {
+			return err
+		}
+		return e.hop(hops, r, func(r []interface{}) error {
+			return e.match(i+1, r, fn)
+		})
+	})
+}
+
+// plan returns the index of the node of the pattern to start matching at:
+// a node which is bound already, one which can be looked up by a property,
+// one having a label or the first one, in this order.
+func (e *executor) plan(pat *pattern, row []interface{}) int {
+	best, bestCost := 0, -1
+	for i, np := range pat.nodes {
+		cost := 3
+		switch {
+		case row[np.slot] != nil:
+			cost = 0
+		case len(np.props) > 0:
+			cost = 1
+		case len(np.labels) > 0:
+			cost = 2
+		}
+		if bestCost < 0 || cost < bestCost {
+			best, bestCost = i, cost
+		}
+	}
+	return best
+}
+
+// startNodes calls fn for the candidates of the starting node; they're
+// checked by bindNode.
+func (e *executor) startNodes(np *nodePattern, row []interface{}, fn func(id graphie.NodeID) error) error {
+	if id := row[np.slot]; id != nil {
+		return fn(id.(graphie.NodeID))
+	}
+	if len(np.props) > 0 {
+		key := sortedKeys(np.props)[0]
+		if np.props[key] == nil {
+			return nil
+		}
+		ids, err := e.s.FindByAttrContext(e.ctx, np.labels, key, np.props[key])
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := fn(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return e.s.WalkNodesContext(e.ctx, np.labels, fn)
+}
+
+// bindNode checks whether the node matches np and returns a copy of row
+// with the node bound to its variable. It returns nil if it doesn't match.
+func (e *executor) bindNode(np *nodePattern, row []interface{}, id graphie.NodeID) ([]interface{}, error) {
+	if bound := row[np.slot]; bound != nil && bound.(graphie.NodeID) != id {
+		return nil, nil
+	}
+	if len(np.labels) > 0 {
+		labels, err := e.labels(id)
+		if err != nil {
+			return nil, err
+		}
+		if !hasLabels(labels, np.labels) {
+			return nil, nil
+		}
+	}
+	if len(np.props) > 0 {
+		attrs, err := e.attrs(id)
+		if err != nil {
+			return nil, err
+		}
+		if !matchProps(attrs, np.props) {
+			return nil, nil
+		}
+	}
+	return bind(row, np.slot, id), nil
+}
+
+func bind(row []interface{}, slot int, v interface{}) []interface{} {
+	r := make([]interface{}, len(row))
+	copy(r, row)
+	r[slot] = v
+	return r
+}
+
+func hasLabels(labels, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, l := range labels {
+			if l == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// matchProps reports whether attrs has all props; null never matches.
+func matchProps(attrs, props graphie.Attrs) bool {
+	for _, v := range props {
+		if v == nil {
+			return false
+		}
+	}
+	return attrs.Match(props)
+}
+
+// A hop goes from a bound node of a pattern to its neighbour. Hops to the
+// left of the starting node walk the relationship backwards.
+type hop struct {
+	from    *nodePattern
+	rel     *relPattern
+	to      *nodePattern
+	reverse bool
+}
+
+func (e *executor) hop(hops []hop, row []interface{}, fn func(row []interface{}) error) error {
+	if len(hops) == 0 {
+		return fn(row)
+	}
+	h := hops[0]
+	from := row[h.from.slot].(graphie.NodeID)
+
+	follow := func(to graphie.NodeID, edge *graphie.Edge) error {
+		r := row
+		if edge != nil {
+			var ok bool
+			r, ok = e.bindEdge(h.rel, row, edge)
+			if !ok {
+				return nil
+			}
+		}
+		return e.hopTo(hops, r, to, fn)
+	}
+	if h.rel.varying {
+		return e.walkVarying(h.rel, from, h.reverse, follow)
+	}
+	return e.walkRel(h.rel, from, h.reverse, follow)
+}
+
+func (e *executor) hopTo(hops []hop, row []interface{}, to graphie.NodeID, fn func(row []interface{}) error) error {
+	r, err := e.bindNode(hops[0].to, row, to)
+	if err != nil || r == nil {
+		return err
+	}
+	return e.hop(hops[1:], r, fn)
+}
+
+// bindEdge returns a copy of row with the edge bound to the relationship's
+// variable. Like in Cypher, a link is used at most once per row.
+func (e *executor) bindEdge(rp *relPattern, row []interface{}, edge *graphie.Edge) ([]interface{}, bool) {
+	if bound := row[rp.slot]; bound != nil {
+		return row, sameEdge(bound.(*graphie.Edge), edge)
+	}
+	for _, v := range e.st.vars {
+		if bound, ok := row[v.slot].(*graphie.Edge); ok && v.rel && sameEdge(bound, edge) {
+			return nil, false
+		}
+	}
+	return bind(row, rp.slot, edge), true
+}
+
+// walkRel calls fn for the links of a node matching the relationship.
+// reverse walks the relationship from its right to its left end.
+func (e *executor) walkRel(rp *relPattern, id graphie.NodeID, reverse bool, fn func(to graphie.NodeID, edge *graphie.Edge) error) error {
+	out := rp.dir == dirOut || rp.dir == dirBoth
+	in := rp.dir == dirIn || rp.dir == dirBoth
+	if reverse {
+		in, out = out, in
+	}
+	if out {
+		err := e.s.WalkOutTypesContext(e.ctx, id, rp.types, func(l *graphie.Link) error {
+			if !matchProps(l.Attrs, rp.props) {
+				return nil
+			}
+			return fn(l.Other, &graphie.Edge{ID: l.ID, Type: l.Type, From: id, To: l.Other, Attrs: l.Attrs})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if in {
+		err := e.s.WalkInTypesContext(e.ctx, id, rp.types, func(l *graphie.Link) error {
+			// Self-loops were walked as out-links already
+			if (out && l.Other == id) || !matchProps(l.Attrs, rp.props) {
+				return nil
+			}
+			return fn(l.Other, &graphie.Edge{ID: l.ID, Type: l.Type, From: l.Other, To: id, Attrs: l.Attrs})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkVarying calls fn for every node reachable using between rp.min and
+// rp.max links matching the relationship; every node is reported once.
+func (e *executor) walkVarying(rp *relPattern, id graphie.NodeID, reverse bool, fn func(to graphie.NodeID, edge *graphie.Edge) error) error {
+	expand := func(id uint64, fn func(next uint64, step interface{}) error) error {
+		return e.walkRel(rp, graphie.NodeID(id), reverse, func(to graphie.NodeID, edge *graphie.Edge) error {
+			return fn(uint64(to), nil)
+		})
+	}
+	found := make(map[graphie.NodeID]struct{})
+	return walk.Depths(uint64(id), rp.min, rp.max, expand, func(id uint64, path func() ([]uint64, []interface{})) (bool, error) {
+		if _, has := found[graphie.NodeID(id)]; !has {
+			found[graphie.NodeID(id)] = struct{}{}
+			if err := fn(graphie.NodeID(id), nil); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+}
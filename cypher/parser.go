@@ -0,0 +1,761 @@
+package cypher
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/flosch/graphie"
+)
+
+var (
+	ErrSyntax = errors.New("Syntax error")
+)
+
+func syntaxError(pos int, format string, args ...interface{}) error {
+	return fmt.Errorf("%w at offset %d: %s", ErrSyntax, pos, fmt.Sprintf(format, args...))
+}
+
+type direction int
+
+const (
+	dirOut direction = iota
+	dirIn
+	dirBoth
+)
+
+// A nodePattern matches a node like (p:person {name: "Euler"}).
+type nodePattern struct {
+	slot   int // the slot of the variable in a row
+	labels []string
+	props  graphie.Attrs
+}
+
+// A relPattern matches the links between two nodes like -[r:knows]->. A
+// variable length relationship (-[:knows*1..3]->) matches paths of links.
+type relPattern struct {
+	slot     int
+	types    []string
+	props    graphie.Attrs
+	dir      direction
+	varying  bool
+	min, max int // the number of links of a varying relationship; max is -1 for no limit
+}
+
+// A pattern is a chain of nodes linked by relationships; rels[i] links
+// nodes[i] and nodes[i+1].
+type pattern struct {
+	nodes []*nodePattern
+	rels  []*relPattern
+}
+
+type returnItem struct {
+	name string
+	expr expr
+}
+
+type orderItem struct {
+	expr expr
+	desc bool
+}
+
+type variable struct {
+	name string
+	slot int
+	rel  bool
+}
+
+// A Statement is a parsed query; it can be run on several graphs and
+// multiple times.
+type Statement struct {
+	patterns []*pattern
+	vars     []*variable // all variables including the unnamed ones, by slot
+	where    expr
+	distinct bool
+	items    []*returnItem
+	order    []*orderItem
+	skip     int
+	limit    int // -1 if there is no limit
+}
+
+// aggregated reports whether the statement has aggregating return items;
+// the other items are the grouping keys then.
+func (st *Statement) aggregated() bool {
+	for _, item := range st.items {
+		if _, ok := item.expr.(*countExpr); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type parser struct {
+	query  string
+	tokens []token
+	pos    int
+
+	st     *Statement
+	named  map[string]*variable
+	counts int // the number of count() calls parsed
+}
+
+// Parse parses a query; see the package documentation for the syntax.
+func Parse(query string) (*Statement, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{
+		query:  query,
+		tokens: tokens,
+		st:     &Statement{limit: -1},
+		named:  make(map[string]*variable),
+	}
+	err = p.parseStatement()
+	if err != nil {
+		return nil, err
+	}
+	return p.st, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) unexpected(t token) error {
+	return syntaxError(t.pos, "unexpected %s", t)
+}
+
+// isSymbol reports whether the next token is the symbol.
+func (p *parser) isSymbol(sym string) bool {
+	t := p.peek()
+	return t.kind == tokSymbol && t.text == sym
+}
+
+// isKeyword reports whether the next token is the keyword; keywords are
+// case insensitive.
+func (p *parser) isKeyword(kw string) bool {
+	t := p.peek()
+	return t.kind == tokIdent && strings.EqualFold(t.text, kw)
+}
+
+func (p *parser) acceptSymbol(sym string) bool {
+	if p.isSymbol(sym) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) acceptKeyword(kw string) bool {
+	if p.isKeyword(kw) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectSymbol(sym string) error {
+	if !p.acceptSymbol(sym) {
+		return syntaxError(p.peek().pos, "expected %q, found %s", sym, p.peek())
+	}
+	return nil
+}
+
+func (p *parser) expectKeyword(kw string) error {
+	if !p.acceptKeyword(kw) {
+		return syntaxError(p.peek().pos, "expected %s, found %s", kw, p.peek())
+	}
+	return nil
+}
+
+func (p *parser) expectIdent() (token, error) {
+	t := p.next()
+	if t.kind != tokIdent {
+		return t, syntaxError(t.pos, "expected a name, found %s", t)
+	}
+	return t, nil
+}
+
+func (p *parser) parseStatement() error {
+	err := p.expectKeyword("MATCH")
+	if err != nil {
+		return err
+	}
+	for {
+		pat, err := p.parsePattern()
+		if err != nil {
+			return err
+		}
+		p.st.patterns = append(p.st.patterns, pat)
+		if p.acceptSymbol(",") || p.acceptKeyword("MATCH") {
+			continue
+		}
+		break
+	}
+
+	if p.acceptKeyword("WHERE") {
+		start := p.peek().pos
+		p.st.where, err = p.parseExpr(false)
+		if err != nil {
+			return err
+		}
+		if p.counts > 0 {
+			return syntaxError(start, "count() is only allowed in RETURN")
+		}
+	}
+
+	err = p.expectKeyword("RETURN")
+	if err != nil {
+		return err
+	}
+	p.st.distinct = p.acceptKeyword("DISTINCT")
+	for {
+		start := p.peek().pos
+		counts := p.counts
+		e, err := p.parseExpr(false)
+		if err != nil {
+			return err
+		}
+		if _, ok := e.(*countExpr); p.counts > counts+1 || (p.counts > counts && !ok) {
+			return syntaxError(start, "count() must be returned on its own")
+		}
+		item := &returnItem{
+			name: p.query[start:p.tokens[p.pos-1].end],
+			expr: e,
+		}
+		if p.acceptKeyword("AS") {
+			alias, err := p.expectIdent()
+			if err != nil {
+				return err
+			}
+			item.name = alias.text
+		}
+		p.st.items = append(p.st.items, item)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+
+	if p.acceptKeyword("ORDER") {
+		err = p.expectKeyword("BY")
+		if err != nil {
+			return err
+		}
+		for {
+			start, counts := p.peek().pos, p.counts
+			e, err := p.parseExpr(true)
+			if err != nil {
+				return err
+			}
+			if p.counts > counts {
+				return syntaxError(start, "count() is only allowed in RETURN")
+			}
+			// Returned expressions are referred to by their column
+			text := p.query[start:p.tokens[p.pos-1].end]
+			for i, item := range p.st.items {
+				if item.name == text {
+					e = &columnExpr{i}
+				}
+			}
+			if _, ok := e.(*columnExpr); !ok && p.st.aggregated() {
+				return syntaxError(start, "results of count() can only be ordered by their columns")
+			}
+			item := &orderItem{expr: e}
+			if p.acceptKeyword("DESC") || p.acceptKeyword("DESCENDING") {
+				item.desc = true
+			} else if !p.acceptKeyword("ASC") {
+				p.acceptKeyword("ASCENDING")
+			}
+			p.st.order = append(p.st.order, item)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+
+	if p.acceptKeyword("SKIP") {
+		p.st.skip, err = p.parseCount()
+		if err != nil {
+			return err
+		}
+	}
+	if p.acceptKeyword("LIMIT") {
+		p.st.limit, err = p.parseCount()
+		if err != nil {
+			return err
+		}
+	}
+
+	if t := p.peek(); t.kind != tokEOF {
+		return p.unexpected(t)
+	}
+	return nil
+}
+
+func (p *parser) parseCount() (int, error) {
+	t := p.next()
+	if t.kind != tokInt {
+		return 0, syntaxError(t.pos, "expected a number, found %s", t)
+	}
+	n, err := strconv.Atoi(t.text)
+	if err != nil {
+		return 0, syntaxError(t.pos, "invalid number %s", t.text)
+	}
+	return n, nil
+}
+
+// bind returns the slot of the variable; unnamed variables get a slot of
+// their own.
+func (p *parser) bind(name token, rel bool) (int, error) {
+	if name.text != "" {
+		if v, has := p.named[name.text]; has {
+			if v.rel != rel {
+				return 0, syntaxError(name.pos, "%s is used for a node and a relationship", name.text)
+			}
+			return v.slot, nil
+		}
+	}
+	v := &variable{
+		name: name.text,
+		slot: len(p.st.vars),
+		rel:  rel,
+	}
+	p.st.vars = append(p.st.vars, v)
+	if name.text != "" {
+		p.named[name.text] = v
+	}
+	return v.slot, nil
+}
+
+func (p *parser) parsePattern() (*pattern, error) {
+	pat := &pattern{}
+	np, err := p.parseNode()
+	if err != nil {
+		return nil, err
+	}
+	pat.nodes = append(pat.nodes, np)
+	for p.isSymbol("-") || p.isSymbol("<-") {
+		rp, err := p.parseRel()
+		if err != nil {
+			return nil, err
+		}
+		np, err := p.parseNode()
+		if err != nil {
+			return nil, err
+		}
+		pat.rels = append(pat.rels, rp)
+		pat.nodes = append(pat.nodes, np)
+	}
+	return pat, nil
+}
+
+func (p *parser) parseNode() (*nodePattern, error) {
+	err := p.expectSymbol("(")
+	if err != nil {
+		return nil, err
+	}
+	var name token
+	if p.peek().kind == tokIdent {
+		name = p.next()
+	}
+	np := &nodePattern{}
+	np.slot, err = p.bind(name, false)
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptSymbol(":") {
+		label, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		np.labels = append(np.labels, label.text)
+	}
+	if p.isSymbol("{") {
+		np.props, err = p.parseProps()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = p.expectSymbol(")")
+	if err != nil {
+		return nil, err
+	}
+	return np, nil
+}
+
+// parseRel parses -[...]->, <-[...]-, -[...]- and the short forms without
+// brackets.
+func (p *parser) parseRel() (*relPattern, error) {
+	rp := &relPattern{
+		dir: dirBoth,
+		min: 1,
+		max: 1,
+	}
+	var name token
+	if p.next().text == "<-" {
+		rp.dir = dirIn
+	}
+
+	if p.acceptSymbol("[") {
+		if p.peek().kind == tokIdent {
+			name = p.next()
+		}
+		if p.acceptSymbol(":") {
+			for {
+				typ, err := p.expectIdent()
+				if err != nil {
+					return nil, err
+				}
+				rp.types = append(rp.types, typ.text)
+				if !p.acceptSymbol("|") {
+					break
+				}
+				p.acceptSymbol(":")
+			}
+		}
+		if p.isSymbol("*") {
+			err := p.parseLength(rp)
+			if err != nil {
+				return nil, err
+			}
+			if name.text != "" {
+				return nil, syntaxError(name.pos, "variable length relationships can't be bound to a variable")
+			}
+		}
+		if p.isSymbol("{") {
+			var err error
+			rp.props, err = p.parseProps()
+			if err != nil {
+				return nil, err
+			}
+		}
+		err := p.expectSymbol("]")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch t := p.next(); {
+	case t.kind == tokSymbol && t.text == "->":
+		if rp.dir == dirIn {
+			rp.dir = dirBoth
+		} else {
+			rp.dir = dirOut
+		}
+	case t.kind == tokSymbol && t.text == "-":
+	default:
+		return nil, syntaxError(t.pos, "expected \"-\" or \"->\", found %s", t)
+	}
+
+	var err error
+	rp.slot, err = p.bind(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+// parseLength parses *, *n, *n.., *..m and *n..m.
+func (p *parser) parseLength(rp *relPattern) error {
+	p.next()
+	rp.varying = true
+	rp.min, rp.max = 1, -1
+	var err error
+	if p.peek().kind == tokInt {
+		rp.min, err = p.parseCount()
+		if err != nil {
+			return err
+		}
+		if !p.isSymbol("..") {
+			rp.max = rp.min
+			return nil
+		}
+	}
+	if p.acceptSymbol("..") && p.peek().kind == tokInt {
+		rp.max, err = p.parseCount()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *parser) parseProps() (graphie.Attrs, error) {
+	p.next()
+	props := make(graphie.Attrs)
+	if p.acceptSymbol("}") {
+		return props, nil
+	}
+	for {
+		key, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		err = p.expectSymbol(":")
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		props[key.text] = value
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	return props, p.expectSymbol("}")
+}
+
+// parseLiteral parses a string, a number, true, false or null.
+func (p *parser) parseLiteral() (interface{}, error) {
+	neg := p.acceptSymbol("-")
+	t := p.next()
+	switch {
+	case t.kind == tokInt:
+		n, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return nil, syntaxError(t.pos, "invalid number %s", t.text)
+		}
+		if neg {
+			n = -n
+		}
+		return n, nil
+	case t.kind == tokFloat:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, syntaxError(t.pos, "invalid number %s", t.text)
+		}
+		if neg {
+			f = -f
+		}
+		return f, nil
+	case neg:
+		return nil, syntaxError(t.pos, "expected a number, found %s", t)
+	case t.kind == tokString:
+		return t.text, nil
+	case t.kind == tokIdent && strings.EqualFold(t.text, "true"):
+		return true, nil
+	case t.kind == tokIdent && strings.EqualFold(t.text, "false"):
+		return false, nil
+	case t.kind == tokIdent && strings.EqualFold(t.text, "null"):
+		return nil, nil
+	}
+	return nil, syntaxError(t.pos, "expected a value, found %s", t)
+}
+
+// parseExpr parses a WHERE, RETURN or ORDER BY expression. ORDER BY may
+// refer to the names of the returned columns, too.
+func (p *parser) parseExpr(columns bool) (expr, error) {
+	left, err := p.parseAnd(columns)
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("OR") {
+		right, err := p.parseAnd(columns)
+		if err != nil {
+			return nil, err
+		}
+		left = &orExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd(columns bool) (expr, error) {
+	left, err := p.parseNot(columns)
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("AND") {
+		right, err := p.parseNot(columns)
+		if err != nil {
+			return nil, err
+		}
+		left = &andExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot(columns bool) (expr, error) {
+	if p.acceptKeyword("NOT") {
+		e, err := p.parseNot(columns)
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{e}, nil
+	}
+	return p.parseComparison(columns)
+}
+
+var comparisons = map[string]bool{"=": true, "<>": true, "<": true, "<=": true, ">": true, ">=": true}
+
+func (p *parser) parseComparison(columns bool) (expr, error) {
+	left, err := p.parseOperand(columns)
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	switch {
+	case t.kind == tokSymbol && comparisons[t.text]:
+		p.next()
+		right, err := p.parseOperand(columns)
+		if err != nil {
+			return nil, err
+		}
+		return &compareExpr{op: t.text, left: left, right: right}, nil
+
+	case t.kind == tokSymbol && t.text == "<-":
+		// a<-1 is lexed as an arrow
+		p.next()
+		p.tokens[p.pos-1] = token{kind: tokSymbol, text: "-", pos: t.pos + 1, end: t.end}
+		p.pos--
+		right, err := p.parseOperand(columns)
+		if err != nil {
+			return nil, err
+		}
+		return &compareExpr{op: "<", left: left, right: right}, nil
+
+	case p.acceptKeyword("IS"):
+		not := p.acceptKeyword("NOT")
+		err = p.expectKeyword("NULL")
+		if err != nil {
+			return nil, err
+		}
+		return &isNullExpr{e: left, not: not}, nil
+
+	case p.isKeyword("STARTS") || p.isKeyword("ENDS"):
+		op := strings.ToUpper(p.next().text)
+		err = p.expectKeyword("WITH")
+		if err != nil {
+			return nil, err
+		}
+		right, err := p.parseOperand(columns)
+		if err != nil {
+			return nil, err
+		}
+		return &stringExpr{op: op, left: left, right: right}, nil
+
+	case p.acceptKeyword("CONTAINS"):
+		right, err := p.parseOperand(columns)
+		if err != nil {
+			return nil, err
+		}
+		return &stringExpr{op: "CONTAINS", left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *parser) parseOperand(columns bool) (expr, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokSymbol && t.text == "(":
+		p.next()
+		e, err := p.parseExpr(columns)
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expectSymbol(")")
+
+	case t.kind == tokIdent && p.tokens[p.pos+1].kind == tokSymbol && p.tokens[p.pos+1].text == "(":
+		return p.parseCall(columns)
+
+	case t.kind == tokIdent && !isLiteralKeyword(t.text):
+		p.next()
+		v, has := p.named[t.text]
+		if !has {
+			if columns {
+				for i, item := range p.st.items {
+					if item.name == t.text {
+						return &columnExpr{i}, nil
+					}
+				}
+			}
+			return nil, syntaxError(t.pos, "unknown variable %s", t.text)
+		}
+		if p.acceptSymbol(".") {
+			key, err := p.expectIdent()
+			if err != nil {
+				return nil, err
+			}
+			return &propExpr{slot: v.slot, rel: v.rel, key: key.text}, nil
+		}
+		return &varExpr{slot: v.slot}, nil
+	}
+
+	value, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+	return &literalExpr{value}, nil
+}
+
+func isLiteralKeyword(s string) bool {
+	return strings.EqualFold(s, "true") || strings.EqualFold(s, "false") || strings.EqualFold(s, "null")
+}
+
+// parseCall parses the functions id(n), labels(n), type(r) and the
+// aggregation count(*) or count([DISTINCT] e).
+func (p *parser) parseCall(columns bool) (expr, error) {
+	name := p.next()
+	p.next()
+	fn := strings.ToLower(name.text)
+
+	if fn == "count" {
+		p.counts++
+		c := &countExpr{}
+		if !p.acceptSymbol("*") {
+			c.distinct = p.acceptKeyword("DISTINCT")
+			var err error
+			c.e, err = p.parseExpr(columns)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return c, p.expectSymbol(")")
+	}
+
+	arg, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	v, has := p.named[arg.text]
+	if !has {
+		return nil, syntaxError(arg.pos, "unknown variable %s", arg.text)
+	}
+	var e expr
+	switch {
+	case fn == "id" && !v.rel:
+		e = &idExpr{slot: v.slot}
+	case fn == "id" && v.rel:
+		e = &edgeIDExpr{slot: v.slot}
+	case fn == "labels" && !v.rel:
+		e = &labelsExpr{slot: v.slot}
+	case fn == "type" && v.rel:
+		e = &typeExpr{slot: v.slot}
+	default:
+		return nil, syntaxError(name.pos, "unknown function %s(%s)", name.text, arg.text)
+	}
+	return e, p.expectSymbol(")")
+}
+
+// sortedKeys returns the keys of props in a stable order.
+func sortedKeys(props graphie.Attrs) []string {
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
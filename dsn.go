@@ -0,0 +1,152 @@
+package graphie
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidDSN matches every DSNError when used with errors.Is.
+var ErrInvalidDSN = errors.New("Invalid DSN")
+
+// DSNError is returned if driverAttrs can't be parsed or one of its
+// parameters is invalid.
+type DSNError struct {
+	Param  string // empty if the DSN itself is malformed
+	Value  string
+	Reason string
+}
+
+func (e *DSNError) Error() string {
+	if e.Param == "" {
+		return fmt.Sprintf("Invalid DSN: %s", e.Reason)
+	}
+	return fmt.Sprintf("Invalid DSN parameter %s=%s: %s", e.Param, e.Value, e.Reason)
+}
+
+func (e *DSNError) Is(target error) bool {
+	return target == ErrInvalidDSN
+}
+
+// DSN is the parsed form of the driverAttrs passed to NewGraph:
+//
+//	[driver://[host]]path[?key=value&...]
+//
+// for example happy:///data/g?memtable=1000000&sync=batch or
+// mongodb://localhost:27017. Without the driver prefix, driverAttrs is a
+// path followed by the optional parameters. Drivers parse it using ParseDSN
+// and turn the parameters into their options.
+type DSN struct {
+	Driver string // empty if driverAttrs has no driver prefix
+	Host   string
+	Path   string
+	Params url.Values
+}
+
+// ParseDSN parses driverAttrs; see DSN.
+func ParseDSN(driverAttrs string) (*DSN, error) {
+	d := &DSN{
+		Path: driverAttrs,
+	}
+
+	if strings.Contains(driverAttrs, "://") {
+		u, err := url.Parse(driverAttrs)
+		if err != nil {
+			return nil, &DSNError{Reason: err.Error()}
+		}
+		if u.User != nil || u.Fragment != "" {
+			return nil, &DSNError{Reason: "user info and fragments aren't supported"}
+		}
+		d.Driver = u.Scheme
+		d.Host = u.Host
+		d.Path = u.Path
+		d.Params, err = url.ParseQuery(u.RawQuery)
+		if err != nil {
+			return nil, &DSNError{Reason: err.Error()}
+		}
+		return d, nil
+	}
+
+	// A plain path; it's taken as it is, up to the parameters
+	d.Params = make(url.Values)
+	idx := strings.IndexByte(driverAttrs, '?')
+	if idx < 0 {
+		return d, nil
+	}
+	d.Path = driverAttrs[:idx]
+
+	params, err := url.ParseQuery(driverAttrs[idx+1:])
+	if err != nil {
+		return nil, &DSNError{Reason: err.Error()}
+	}
+	d.Params = params
+	return d, nil
+}
+
+// CheckDriver fails if the DSN names another driver than the given one.
+func (d *DSN) CheckDriver(driver string) error {
+	if d.Driver != "" && d.Driver != driver {
+		return &DSNError{Reason: fmt.Sprintf("DSN is for driver '%s', not '%s'", d.Driver, driver)}
+	}
+	return nil
+}
+
+// CheckParams fails if there's a parameter which is not one of the known
+// ones, so typos don't go unnoticed.
+func (d *DSN) CheckParams(known ...string) error {
+	// Sorted, so the same DSN always fails with the same parameter
+	keys := make([]string, 0, len(d.Params))
+	for key := range d.Params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		vals := d.Params[key]
+		found := false
+		for _, k := range known {
+			if key == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &DSNError{
+				Param:  key,
+				Value:  vals[len(vals)-1],
+				Reason: "unknown parameter",
+			}
+		}
+	}
+	return nil
+}
+
+// Param returns the parameter key or def if it isn't set. If the parameter
+// is given multiple times, the last one wins.
+func (d *DSN) Param(key string, def string) string {
+	vals := d.Params[key]
+	if len(vals) == 0 {
+		return def
+	}
+	return vals[len(vals)-1]
+}
+
+// Int returns the parameter key or def if it isn't set. The parameter must
+// be an integer of at least min.
+func (d *DSN) Int(key string, def int, min int) (int, error) {
+	s := d.Param(key, "")
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, &DSNError{Param: key, Value: s, Reason: "not an integer"}
+	}
+	if v < min {
+		return 0, &DSNError{Param: key, Value: s, Reason: fmt.Sprintf("must be at least %d", min)}
+	}
+	return v, nil
+}
@@ -0,0 +1,17 @@
+package graphie
+
+import (
+	"errors"
+)
+
+// The errors returned by all storage drivers. Drivers may wrap them to add
+// details, so they have to be checked using errors.Is. Violated unique
+// constraints are reported as ErrConstraintViolation (see
+// ConstraintViolationError).
+var (
+	ErrNodeNotFound = errors.New("Node not found")
+	ErrEdgeNotFound = errors.New("Edge not found")
+	ErrAttrNotFound = errors.New("Attribute not found")
+	ErrInvalidAttr  = errors.New("Invalid attribute")
+	ErrClosed       = errors.New("Storage has been closed")
+)
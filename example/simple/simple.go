@@ -2,10 +2,11 @@ package main
 
 import (
 	//"encoding/csv"
-	//"fmt"
+	"fmt"
 	"log"
 
 	"github.com/flosch/graphie"
+	"github.com/flosch/graphie/cypher"
 	_ "github.com/flosch/graphie/storages/memory"
 )
 
@@ -15,6 +16,10 @@ func must(err error) {
 	}
 }
 
+func mustLink(_ graphie.EdgeID, err error) {
+	must(err)
+}
+
 func main() {
 	my_graph, err := graphie.NewGraph("memory", "testdb", "test")
 	if err != nil {
@@ -33,7 +38,7 @@ func main() {
 
 	// Create indexes for each label; we're querying on these attributes
 	must(category.EnsureIndexNodes("name"))
-	// must(persons.EnsureIndexNodes("fullname"))
+	must(person.EnsureUnique("fullname"))
 	//must(categories.EnsureIndexNodes
 
 	// Create all nodes
@@ -56,36 +61,43 @@ func main() {
 	pappus := person.MustAdd(graphie.Attrs{"fullname": "Johannes Pappus"})
 
 	// Create connections
-	must(law.Link(science, graphie.Attrs{"name": "instance_of"}))
-	must(theology.Link(science, graphie.Attrs{"name": "instance_of"}))
-	must(formal_science.Link(science, graphie.Attrs{"name": "instance_of"}))
-	must(maths.Link(formal_science, graphie.Attrs{"name": "instance_of"}))
-	must(maths.Link(number_theory, graphie.Attrs{"name": "contains"}))
-	must(maths.Link(analysis, graphie.Attrs{"name": "contains"}))
-	must(maths.Link(algebra, graphie.Attrs{"name": "contains"}))
-	must(cantor.Link(maths, graphie.Attrs{"name": "field_of_profession"}))
-	must(fermat.Link(maths, graphie.Attrs{"name": "field_of_profession"}))
-	must(fermat.Link(law, graphie.Attrs{"name": "field_of_profession"}))
-	must(hilbert.Link(maths, graphie.Attrs{"name": "field_of_profession"}))
-	must(fermat.Link(y_1665, graphie.Attrs{"name": "date_of_death"}))
-	must(cantor.Link(y_1918, graphie.Attrs{"name": "date_of_death"}))
-	must(cantor.Link(d_16january, graphie.Attrs{"name": "date_of_death"}))
-	must(pappus.Link(d_16january, graphie.Attrs{"name": "date_of_birth"}))
-	must(pappus.Link(theology, graphie.Attrs{"name": "field_of_profession"}))
+	mustLink(my_graph.Link(law, science, "instance_of", nil))
+	mustLink(my_graph.Link(theology, science, "instance_of", nil))
+	mustLink(my_graph.Link(formal_science, science, "instance_of", nil))
+	mustLink(my_graph.Link(maths, formal_science, "instance_of", nil))
+	mustLink(my_graph.Link(maths, number_theory, "contains", nil))
+	mustLink(my_graph.Link(maths, analysis, "contains", nil))
+	mustLink(my_graph.Link(maths, algebra, "contains", nil))
+	mustLink(my_graph.Link(cantor, maths, "field_of_profession", nil))
+	mustLink(my_graph.Link(fermat, maths, "field_of_profession", nil))
+	mustLink(my_graph.Link(fermat, law, "field_of_profession", nil))
+	mustLink(my_graph.Link(hilbert, maths, "field_of_profession", nil))
+	mustLink(my_graph.Link(fermat, y_1665, "date_of_death", nil))
+	mustLink(my_graph.Link(cantor, y_1918, "date_of_death", nil))
+	mustLink(my_graph.Link(cantor, d_16january, "date_of_death", nil))
+	mustLink(my_graph.Link(pappus, d_16january, "date_of_birth", nil))
+	mustLink(my_graph.Link(pappus, theology, "field_of_profession", nil))
 
 	// Query
 
 	// Given the number theory, get mathematicians
-	/* mathematicians := category.Nodes(graphie.Attrs{"name": "number_theory"}).
-		In(graphie.Attrs{"name": "contains"}).
-		In(graphie.Attrs{"name": "field_of_profession"}).All()
+	mathematicians, err := category.Query(number_theory).
+		InType("contains").
+		InType("field_of_profession").All()
+	must(err)
 
 	for _, mathematician := range mathematicians {
-		fmt.Println(mathematician)
-	} */
+		fullname, err := my_graph.Get(mathematician, "fullname")
+		must(err)
+		fmt.Println(fullname)
+	}
 
 	// What field of professions did fermat had?
-	// person.QueryNode(fermat).Out(nil).HasLabel("category")
+	fields, err := person.Query(fermat).
+		OutType("field_of_profession").
+		HasLabel("category").All()
+	must(err)
+	fmt.Println(fields)
 
 	// Who is researching on mathematician and at least one other
 
@@ -98,7 +110,31 @@ func main() {
 	// Which subfields does mathematics have?
 
 	// Get all persons with their year of birth and their field of professions
-	/* prepared_path := person.Edges(graphie.Attrs{"name": "field_of_profession"}).
-		Union(person.Query().Out("date_of_birth"))
-	fmt.Println(person.QueryNodes(nil).Follow(prepared_path)) */
+	persons := person.Query(cantor, fermat, hilbert, pappus)
+	related, err := persons.OutType("field_of_profession").
+		Union(persons.OutType("date_of_birth")).All()
+	must(err)
+	fmt.Println(related)
+
+	// Which sciences is mathematics an instance of, transitively?
+	ancestors, err := category.Query(maths).
+		Repeat(my_graph.Morphism().OutType("instance_of")).All()
+	must(err)
+	fmt.Println(ancestors)
+
+	// How is Pappus connected to Hilbert?
+	path, err := my_graph.ShortestPath(pappus, hilbert, graphie.PathOptions{
+		Direction: graphie.DirBoth,
+	})
+	must(err)
+	fmt.Println(path.Nodes)
+
+	// The same as above, written as a query
+	res, err := cypher.Run(my_graph, `
+		MATCH (p:person)-[:field_of_profession]->(:category)-[:contains]->(c:category {name: "Number theory"})
+		RETURN p.fullname`)
+	must(err)
+	for _, row := range res.Rows {
+		fmt.Println(row[0])
+	}
 }
@@ -1,6 +1,7 @@
 package graphie
 
 import (
+	"context"
 	"errors"
 )
 
@@ -11,6 +12,10 @@ var (
 type Graph struct {
 	name string
 	s    Storage
+
+	// The reads of queries use s through cs with ctx (see withContext)
+	cs  ContextStorage
+	ctx context.Context
 }
 
 func NewGraph(driverName string, driverAttrs string, dbname string) (*Graph, error) {
@@ -31,6 +36,8 @@ func NewGraph(driverName string, driverAttrs string, dbname string) (*Graph, err
 		return nil, err
 	}
 	g.s = s
+	g.cs = WithContext(s)
+	g.ctx = context.Background()
 
 	return g, nil
 }
@@ -46,6 +53,75 @@ func (g *Graph) Labels(labels ...string) *LabelGroup {
 	}
 }
 
-func (g *Graph) Link(nodeFrom, nodeTo NodeID, attrs Attrs) error {
-	return g.s.Link(nodeFrom, nodeTo, attrs)
+// Link links nodeFrom to nodeTo using a link of the given type; typ may be
+// empty for an untyped link.
+func (g *Graph) Link(nodeFrom, nodeTo NodeID, typ string, attrs Attrs) (EdgeID, error) {
+	return g.s.Link(nodeFrom, nodeTo, typ, attrs)
+}
+
+func (g *Graph) Unlink(nodeFrom, nodeTo NodeID, attrs Attrs) (int, error) {
+	return g.s.Unlink(nodeFrom, nodeTo, attrs)
+}
+
+// In returns the in-links of the node having one of the types (all in-links
+// if there are none).
+func (g *Graph) In(id NodeID, types ...string) ([]*Link, error) {
+	return collectLinks(g.s.WalkInTypes, id, types)
+}
+
+// Out returns the out-links of the node having one of the types (all
+// out-links if there are none).
+func (g *Graph) Out(id NodeID, types ...string) ([]*Link, error) {
+	return collectLinks(g.s.WalkOutTypes, id, types)
+}
+
+func collectLinks(walk func(id NodeID, types []string, fn func(l *Link) error) error, id NodeID, types []string) ([]*Link, error) {
+	links := make([]*Link, 0)
+	err := walk(id, types, func(l *Link) error {
+		links = append(links, l)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// GetEdge returns the link with the given id.
+func (g *Graph) GetEdge(id EdgeID) (*Edge, error) {
+	return g.s.GetEdge(id)
+}
+
+func (g *Graph) SetEdgeAttr(id EdgeID, key string, value interface{}) error {
+	return g.s.SetEdgeAttr(id, key, value)
+}
+
+func (g *Graph) RemoveEdge(id EdgeID) error {
+	return g.s.RemoveEdge(id)
+}
+
+func (g *Graph) Get(id NodeID, key string) (interface{}, error) {
+	return g.s.Get(id, key)
+}
+
+func (g *Graph) Attrs(id NodeID) (Attrs, error) {
+	return g.s.Attrs(id)
+}
+
+// NodeLabels returns the labels the node carries.
+func (g *Graph) NodeLabels(id NodeID) ([]string, error) {
+	return g.s.Labels(id)
+}
+
+func (g *Graph) AddLabel(id NodeID, label string) error {
+	return g.s.AddLabel(id, label)
+}
+
+func (g *Graph) RemoveLabel(id NodeID, label string) error {
+	return g.s.RemoveLabel(id, label)
+}
+
+// Storage returns the storage driver backing the graph.
+func (g *Graph) Storage() Storage {
+	return g.s
 }
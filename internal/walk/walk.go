@@ -0,0 +1,83 @@
+// Package walk implements the breadth-first walk shared by the repetitions
+// of graphie and the varying-length relationships of its cypher package.
+package walk
+
+// A state is a node reached at a depth. Without a maximum depth all depths
+// beyond the minimum are the same state.
+type state struct {
+	id    uint64
+	depth int
+}
+
+type link struct {
+	prev state
+	step interface{}
+}
+
+// Depths walks breadth-first from start, expanding the nodes up to the depth
+// max (no limit if max is negative). expand calls fn for every node
+// reachable from id in one step; step describes the step taken or is nil.
+// visit is called for every node reached at a depth of at least min, in the
+// order of the depths; path returns the nodes the node was reached by
+// (starting with start) and the steps in between which aren't nil. The node
+// is only expanded further if visit returns true.
+//
+// A node is expanded at most once per depth (once at all beyond min if there
+// is no maximum depth), so cycles don't make the walk loop forever. The same
+// node may be visited at several depths.
+func Depths(start uint64, min, max int, expand func(id uint64, fn func(next uint64, step interface{}) error) error, visit func(id uint64, path func() ([]uint64, []interface{})) (bool, error)) error {
+	first := state{id: start}
+	reached := map[state]link{first: {}}
+	level := []state{first}
+	for depth := 0; len(level) > 0; depth++ {
+		next := make([]state, 0)
+		for _, st := range level {
+			if depth >= min {
+				st := st
+				more, err := visit(st.id, func() ([]uint64, []interface{}) {
+					return path(first, st, reached)
+				})
+				if err != nil {
+					return err
+				}
+				if !more {
+					continue
+				}
+			}
+			if max >= 0 && depth >= max {
+				continue
+			}
+
+			err := expand(st.id, func(n uint64, step interface{}) error {
+				ns := state{id: n, depth: depth + 1}
+				if max < 0 && ns.depth > min {
+					ns.depth = min
+				}
+				if _, has := reached[ns]; has {
+					return nil
+				}
+				reached[ns] = link{prev: st, step: step}
+				next = append(next, ns)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		level = next
+	}
+	return nil
+}
+
+// path follows the links from st back to first.
+func path(first, st state, reached map[state]link) ([]uint64, []interface{}) {
+	nodes := []uint64{st.id}
+	steps := make([]interface{}, 0)
+	for ; st != first; st = reached[st].prev {
+		nodes = append([]uint64{reached[st].prev.id}, nodes...)
+		if step := reached[st].step; step != nil {
+			steps = append([]interface{}{step}, steps...)
+		}
+	}
+	return nodes, steps
+}
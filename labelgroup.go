@@ -29,10 +29,38 @@ func (lg *LabelGroup) EnsureIndexLinks(attr_name string) error {
 	return lg.g.s.EnsureIndexLinks(lg.labels, attr_name)
 }
 
-func (lg *LabelGroup) Query() *Query {
+// EnsureUnique rejects nodes of this label group having the same value for
+// attr_name as an existing one; see Storage.EnsureUnique.
+func (lg *LabelGroup) EnsureUnique(attr_name string) error {
+	return lg.g.s.EnsureUnique(lg.labels, attr_name)
+}
+
+// FindByAttr returns all nodes of this label group whose attribute attr_name
+// equals value.
+func (lg *LabelGroup) FindByAttr(attr_name string, value interface{}) ([]NodeID, error) {
+	return lg.g.s.FindByAttr(lg.labels, attr_name, value)
+}
+
+// Nodes starts a new traversal at all nodes carrying the labels of this label
+// group. The nodes are streamed from the storage when the query is executed.
+func (lg *LabelGroup) Nodes() *Query {
 	return &Query{
-		g: lg.g,
+		g:     lg.g,
+		start: labelSource(lg.labels),
+	}
+}
+
+// Query starts a new traversal at those of the given nodes which carry the
+// labels of this label group. Without ids it's the same as Nodes.
+func (lg *LabelGroup) Query(ids ...NodeID) *Query {
+	if len(ids) == 0 {
+		return lg.Nodes()
+	}
+	q := lg.g.Query(ids...)
+	for _, label := range lg.labels {
+		q = q.HasLabel(label)
 	}
+	return q
 }
 
 /*
@@ -0,0 +1,518 @@
+package graphie
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	ErrNoPath        = errors.New("No path found")
+	ErrInvalidWeight = errors.New("Invalid link weight")
+)
+
+// Direction tells which links a path search follows.
+type Direction int
+
+const (
+	// DirOut follows links from their start to their end node
+	DirOut Direction = iota
+	// DirIn follows links backwards
+	DirIn
+	// DirBoth follows links in both directions
+	DirBoth
+)
+
+// PathOptions configure ShortestPath and KShortestPaths. The zero value
+// follows all out-links of any depth and counts every link with a weight
+// of 1.
+type PathOptions struct {
+	Direction Direction
+
+	// Only links of one of the types are followed (all links if empty)
+	Types []string
+
+	// If given, only links matching at least one of them are followed
+	EdgeAttrs []Attrs
+
+	// Paths have at most MaxDepth links (no limit if 0)
+	MaxDepth int
+
+	// Weight names the link attribute holding the link's weight. Without
+	// it, the search is a bidirectional breadth-first search; with it,
+	// Dijkstra's algorithm is used. Weights must be non-negative numbers;
+	// a link without one fails the search with ErrInvalidWeight.
+	Weight string
+
+	// Heuristic turns the weighted search into A*. It must be consistent:
+	// it must not overestimate the cost of the cheapest path from id to
+	// the target, and for every link from a to b, Heuristic(a) must not
+	// exceed the link's weight plus Heuristic(b). Nodes aren't visited
+	// twice, so with an inconsistent heuristic the path found might not be
+	// the shortest one.
+	Heuristic func(id NodeID) float64
+}
+
+// A Path leads from its first node to its last one. Edges[i] links
+// Nodes[i] and Nodes[i+1]; it points the other way if the path followed it
+// backwards.
+type Path struct {
+	Nodes []NodeID
+	Edges []*Edge
+	Cost  float64 // the sum of the weights or the number of links
+}
+
+// ShortestPath returns the cheapest path from one node to another or
+// ErrNoPath if there is none.
+func (g *Graph) ShortestPath(from, to NodeID, opts PathOptions) (*Path, error) {
+	return g.shortestPath(from, to, &opts)
+}
+
+// ShortestPathContext is ShortestPath reading the graph with ctx.
+func (g *Graph) ShortestPathContext(ctx context.Context, from, to NodeID, opts PathOptions) (*Path, error) {
+	return g.withContext(ctx).shortestPath(from, to, &opts)
+}
+
+func (g *Graph) shortestPath(from, to NodeID, opts *PathOptions) (*Path, error) {
+	if err := g.checkPathEnds(from, to); err != nil {
+		return nil, err
+	}
+	ps := &pathSearch{g: g, opts: opts}
+	return ps.find(from, to, opts.MaxDepth)
+}
+
+// KShortestPaths returns up to k loopless paths from one node to another,
+// cheapest first, using Yen's algorithm. It returns ErrNoPath if there is no
+// path at all.
+func (g *Graph) KShortestPaths(from, to NodeID, k int, opts PathOptions) ([]*Path, error) {
+	return g.kShortestPaths(from, to, k, &opts)
+}
+
+// KShortestPathsContext is KShortestPaths reading the graph with ctx.
+func (g *Graph) KShortestPathsContext(ctx context.Context, from, to NodeID, k int, opts PathOptions) ([]*Path, error) {
+	return g.withContext(ctx).kShortestPaths(from, to, k, &opts)
+}
+
+func (g *Graph) kShortestPaths(from, to NodeID, k int, opts *PathOptions) ([]*Path, error) {
+	if err := g.checkPathEnds(from, to); err != nil {
+		return nil, err
+	}
+	if k <= 0 {
+		return []*Path{}, nil
+	}
+	ps := &pathSearch{g: g, opts: opts}
+	first, err := ps.find(from, to, opts.MaxDepth)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []*Path{first}
+	found := map[string]struct{}{first.key(): {}}
+	candidates := &pathHeap{}
+	for len(paths) < k {
+		last := paths[len(paths)-1]
+
+		// Every node of the last path but the target is a spur node: the
+		// paths sharing the root up to it can't take the same next link
+		// again, and the root's nodes are off limits for the spur path.
+		for i := 0; i < len(last.Edges); i++ {
+			if opts.MaxDepth > 0 && i >= opts.MaxDepth {
+				break
+			}
+			ps.blockedEdges = make(map[edgeKey]struct{})
+			ps.blockedNodes = make(map[NodeID]struct{})
+			for _, p := range paths {
+				if len(p.Edges) > i && p.hasRoot(last, i) {
+					ps.blockedEdges[keyOfEdge(p.Edges[i])] = struct{}{}
+				}
+			}
+			for _, id := range last.Nodes[:i] {
+				ps.blockedNodes[id] = struct{}{}
+			}
+
+			maxDepth := 0
+			if opts.MaxDepth > 0 {
+				maxDepth = opts.MaxDepth - i
+			}
+			spur, err := ps.find(last.Nodes[i], to, maxDepth)
+			if err == ErrNoPath {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			p := last.root(i)
+			p.Nodes = append(p.Nodes, spur.Nodes[1:]...)
+			p.Edges = append(p.Edges, spur.Edges...)
+			p.Cost, err = ps.cost(p)
+			if err != nil {
+				return nil, err
+			}
+			if _, has := found[p.key()]; has {
+				continue
+			}
+			found[p.key()] = struct{}{}
+			heap.Push(candidates, p)
+		}
+		ps.blockedEdges, ps.blockedNodes = nil, nil
+
+		if candidates.Len() == 0 {
+			break
+		}
+		paths = append(paths, heap.Pop(candidates).(*Path))
+	}
+	return paths, nil
+}
+
+// checkPathEnds makes sure both nodes exist, so a search doesn't report
+// ErrNoPath for a node which isn't there.
+func (g *Graph) checkPathEnds(from, to NodeID) error {
+	if _, err := g.cs.AttrsContext(g.ctx, from); err != nil {
+		return err
+	}
+	if _, err := g.cs.AttrsContext(g.ctx, to); err != nil {
+		return err
+	}
+	return nil
+}
+
+// root returns a copy of the first i links of the path.
+func (p *Path) root(i int) *Path {
+	r := &Path{
+		Nodes: make([]NodeID, i+1),
+		Edges: make([]*Edge, i),
+	}
+	copy(r.Nodes, p.Nodes)
+	copy(r.Edges, p.Edges)
+	return r
+}
+
+// hasRoot reports whether the first i links of p are the ones of other.
+func (p *Path) hasRoot(other *Path, i int) bool {
+	for j := 0; j < i; j++ {
+		if keyOfEdge(p.Edges[j]) != keyOfEdge(other.Edges[j]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Path) key() string {
+	k := fmt.Sprint(p.Nodes[0])
+	for i, e := range p.Edges {
+		k += fmt.Sprintf("-%d-%d", e.ID, p.Nodes[i+1])
+	}
+	return k
+}
+
+// edgeKey identifies a link even if the driver doesn't hand out edge ids
+// (which are 0 then).
+type edgeKey struct {
+	id       EdgeID
+	from, to NodeID
+}
+
+func keyOfEdge(e *Edge) edgeKey {
+	return edgeKey{e.ID, e.From, e.To}
+}
+
+// A pathSearch finds the shortest paths in g. Yen's algorithm blocks some
+// nodes and links for the spur paths.
+type pathSearch struct {
+	g    *Graph
+	opts *PathOptions
+
+	blockedNodes map[NodeID]struct{}
+	blockedEdges map[edgeKey]struct{}
+}
+
+// pathLink is a step of a search: the node reached and the link leading
+// there.
+type pathLink struct {
+	prev NodeID
+	edge *Edge
+}
+
+func (ps *pathSearch) find(from, to NodeID, maxDepth int) (*Path, error) {
+	if from == to {
+		return &Path{Nodes: []NodeID{from}, Edges: []*Edge{}}, nil
+	}
+	if ps.opts.Weight == "" {
+		return ps.bfs(from, to, maxDepth)
+	}
+	return ps.dijkstra(from, to, maxDepth)
+}
+
+// neighbours calls fn for every link of id the search may follow. reverse
+// walks the links the other way round (for searching back from the target).
+func (ps *pathSearch) neighbours(id NodeID, reverse bool, fn func(next NodeID, edge *Edge) error) error {
+	in := ps.opts.Direction == DirIn || ps.opts.Direction == DirBoth
+	out := ps.opts.Direction == DirOut || ps.opts.Direction == DirBoth
+	if reverse {
+		in, out = out, in
+	}
+
+	follow := func(edge *Edge, next NodeID) error {
+		if _, has := ps.blockedNodes[next]; has {
+			return nil
+		}
+		if _, has := ps.blockedEdges[keyOfEdge(edge)]; has {
+			return nil
+		}
+		if !edge.Attrs.matchAny(ps.opts.EdgeAttrs) {
+			return nil
+		}
+		return fn(next, edge)
+	}
+	if in {
+		err := ps.g.cs.WalkInTypesContext(ps.g.ctx, id, ps.opts.Types, func(l *Link) error {
+			return follow(&Edge{ID: l.ID, Type: l.Type, From: l.Other, To: id, Attrs: l.Attrs}, l.Other)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if out {
+		err := ps.g.cs.WalkOutTypesContext(ps.g.ctx, id, ps.opts.Types, func(l *Link) error {
+			return follow(&Edge{ID: l.ID, Type: l.Type, From: id, To: l.Other, Attrs: l.Attrs}, l.Other)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A bfsSide is one of the two searches of the bidirectional search; the
+// backward one starts at the target and follows the links the other way
+// round.
+type bfsSide struct {
+	reverse  bool
+	reached  map[NodeID]pathLink
+	frontier []NodeID
+	depth    int
+}
+
+func newBFSSide(start NodeID, reverse bool) *bfsSide {
+	return &bfsSide{
+		reverse:  reverse,
+		reached:  map[NodeID]pathLink{start: {}},
+		frontier: []NodeID{start},
+	}
+}
+
+// bfs runs a breadth-first search from both ends, always expanding the
+// smaller frontier by one level, until the searches meet.
+func (ps *pathSearch) bfs(from, to NodeID, maxDepth int) (*Path, error) {
+	fw, bw := newBFSSide(from, false), newBFSSide(to, true)
+	for len(fw.frontier) > 0 && len(bw.frontier) > 0 {
+		if maxDepth > 0 && fw.depth+bw.depth >= maxDepth {
+			break
+		}
+		side, other := fw, bw
+		if len(bw.frontier) < len(fw.frontier) {
+			side, other = bw, fw
+		}
+
+		// All meetings on this level result in paths of the same length,
+		// so the first one is as good as any.
+		var meet NodeID
+		met := false
+		next := make([]NodeID, 0)
+		for _, id := range side.frontier {
+			err := ps.neighbours(id, side.reverse, func(n NodeID, edge *Edge) error {
+				if _, has := side.reached[n]; has {
+					return nil
+				}
+				side.reached[n] = pathLink{prev: id, edge: edge}
+				if _, has := other.reached[n]; has {
+					meet, met = n, true
+					return errStopIteration
+				}
+				next = append(next, n)
+				return nil
+			})
+			if err == errStopIteration {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		if met {
+			return joinPath(fw.reached, bw.reached, meet), nil
+		}
+		side.frontier = next
+		side.depth++
+	}
+	return nil, ErrNoPath
+}
+
+// joinPath builds the path from the links the forward search took to meet
+// and the ones the backward search took from meet to the target.
+func joinPath(forward, backward map[NodeID]pathLink, meet NodeID) *Path {
+	p := &Path{
+		Nodes: []NodeID{meet},
+		Edges: make([]*Edge, 0),
+	}
+	for id := meet; forward[id].edge != nil; id = forward[id].prev {
+		p.Nodes = append(p.Nodes, forward[id].prev)
+		p.Edges = append(p.Edges, forward[id].edge)
+	}
+	for i, j := 0, len(p.Nodes)-1; i < j; i, j = i+1, j-1 {
+		p.Nodes[i], p.Nodes[j] = p.Nodes[j], p.Nodes[i]
+	}
+	for i, j := 0, len(p.Edges)-1; i < j; i, j = i+1, j-1 {
+		p.Edges[i], p.Edges[j] = p.Edges[j], p.Edges[i]
+	}
+	for id := meet; backward[id].edge != nil; id = backward[id].prev {
+		p.Nodes = append(p.Nodes, backward[id].prev)
+		p.Edges = append(p.Edges, backward[id].edge)
+	}
+	p.Cost = float64(len(p.Edges))
+	return p
+}
+
+// A searchState is a node reached by the weighted search. With a depth
+// limit, the same node reached using a different number of links is a
+// different state, as a more expensive path with less links might be the
+// only one to reach the target in time.
+type searchState struct {
+	id    NodeID
+	depth int
+}
+
+type searchItem struct {
+	state    searchState
+	cost     float64
+	priority float64
+}
+
+type searchHeap []*searchItem
+
+func (h searchHeap) Len() int            { return len(h) }
+func (h searchHeap) Less(i, j int) bool  { return h[i].priority < h[j].priority }
+func (h searchHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *searchHeap) Push(x interface{}) { *h = append(*h, x.(*searchItem)) }
+func (h *searchHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// dijkstra runs Dijkstra's algorithm, or A* if there is a heuristic.
+func (ps *pathSearch) dijkstra(from, to NodeID, maxDepth int) (*Path, error) {
+	heuristic := ps.opts.Heuristic
+	if heuristic == nil {
+		heuristic = func(id NodeID) float64 { return 0 }
+	}
+
+	start := searchState{id: from}
+	costs := map[searchState]float64{start: 0}
+	prev := make(map[searchState]searchState)
+	edges := make(map[searchState]*Edge)
+	done := make(map[searchState]struct{})
+	queue := &searchHeap{{state: start, priority: heuristic(from)}}
+
+	for queue.Len() > 0 {
+		item := heap.Pop(queue).(*searchItem)
+		if _, has := done[item.state]; has {
+			continue
+		}
+		done[item.state] = struct{}{}
+
+		if item.state.id == to {
+			p := &Path{
+				Nodes: []NodeID{to},
+				Edges: make([]*Edge, 0),
+				Cost:  item.cost,
+			}
+			for st := item.state; st != start; st = prev[st] {
+				p.Nodes = append([]NodeID{prev[st].id}, p.Nodes...)
+				p.Edges = append([]*Edge{edges[st]}, p.Edges...)
+			}
+			return p, nil
+		}
+
+		if maxDepth > 0 && item.state.depth >= maxDepth {
+			continue
+		}
+		err := ps.neighbours(item.state.id, false, func(n NodeID, edge *Edge) error {
+			w, err := ps.weight(edge)
+			if err != nil {
+				return err
+			}
+			next := searchState{id: n}
+			if maxDepth > 0 {
+				next.depth = item.state.depth + 1
+			}
+			cost := item.cost + w
+			if c, has := costs[next]; has && c <= cost {
+				return nil
+			}
+			costs[next] = cost
+			prev[next] = item.state
+			edges[next] = edge
+			heap.Push(queue, &searchItem{
+				state:    next,
+				cost:     cost,
+				priority: cost + heuristic(n),
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, ErrNoPath
+}
+
+func (ps *pathSearch) weight(edge *Edge) (float64, error) {
+	v, has := edge.Attrs[ps.opts.Weight]
+	if !has {
+		return 0, fmt.Errorf("%w: link %d has no attribute %q", ErrInvalidWeight, edge.ID, ps.opts.Weight)
+	}
+	w, ok := toFloat(v)
+	if !ok || w < 0 || math.IsNaN(w) {
+		return 0, fmt.Errorf("%w: link %d has the weight %v", ErrInvalidWeight, edge.ID, v)
+	}
+	return w, nil
+}
+
+// cost returns the cost of the path.
+func (ps *pathSearch) cost(p *Path) (float64, error) {
+	if ps.opts.Weight == "" {
+		return float64(len(p.Edges)), nil
+	}
+	sum := 0.0
+	for _, e := range p.Edges {
+		w, err := ps.weight(e)
+		if err != nil {
+			return 0, err
+		}
+		sum += w
+	}
+	return sum, nil
+}
+
+// pathHeap holds Yen's candidate paths, the cheapest (and then shortest)
+// one first.
+type pathHeap []*Path
+
+func (h pathHeap) Len() int { return len(h) }
+func (h pathHeap) Less(i, j int) bool {
+	if h[i].Cost != h[j].Cost {
+		return h[i].Cost < h[j].Cost
+	}
+	return len(h[i].Edges) < len(h[j].Edges)
+}
+func (h pathHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *pathHeap) Push(x interface{}) { *h = append(*h, x.(*Path)) }
+func (h *pathHeap) Pop() interface{} {
+	old := *h
+	p := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return p
+}
@@ -0,0 +1,169 @@
+package graphie_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/flosch/graphie"
+)
+
+// newPathGraph returns a graph of eight nodes with three routes from node 0
+// to node 3: 0-1-2-3 (type a, weight 1 each), 0-4-3 (type b, weight 10
+// each) and 0-5-6-7-3 (type a, weight 0.5 each).
+func newPathGraph(t *testing.T) (*graphie.Graph, []graphie.NodeID) {
+	g := newGraph(t)
+	n := make([]graphie.NodeID, 8)
+	for i := range n {
+		id, err := g.Storage().Add(nil, graphie.Attrs{"i": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n[i] = id
+	}
+	links := []struct {
+		from, to int
+		typ      string
+		weight   float64
+	}{
+		{0, 1, "a", 1}, {1, 2, "a", 1}, {2, 3, "a", 1},
+		{0, 4, "b", 10}, {4, 3, "b", 10},
+		{0, 5, "a", 0.5}, {5, 6, "a", 0.5}, {6, 7, "a", 0.5}, {7, 3, "a", 0.5},
+	}
+	for _, l := range links {
+		if _, err := g.Link(n[l.from], n[l.to], l.typ, graphie.Attrs{"w": l.weight}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return g, n
+}
+
+// checkPath makes sure every edge of p connects the nodes around it.
+func checkPath(t *testing.T, p *graphie.Path) {
+	t.Helper()
+	if len(p.Edges) != len(p.Nodes)-1 {
+		t.Fatalf("path with %d nodes has %d edges", len(p.Nodes), len(p.Edges))
+	}
+	for i, e := range p.Edges {
+		a, b := p.Nodes[i], p.Nodes[i+1]
+		if e.ID == 0 || !(e.From == a && e.To == b || e.From == b && e.To == a) {
+			t.Fatalf("edge %d (%d->%d) doesn't connect %d and %d", e.ID, e.From, e.To, a, b)
+		}
+	}
+}
+
+func TestShortestPath(t *testing.T) {
+	g, n := newPathGraph(t)
+	nodes := func(is ...int) []graphie.NodeID {
+		ids := make([]graphie.NodeID, 0, len(is))
+		for _, i := range is {
+			ids = append(ids, n[i])
+		}
+		return ids
+	}
+	// The heuristic never overestimates the remaining weight to node 3.
+	heuristic := func(id graphie.NodeID) float64 {
+		if id == n[3] {
+			return 0
+		}
+		return 0.5
+	}
+
+	tests := []struct {
+		name     string
+		from, to graphie.NodeID
+		opts     graphie.PathOptions
+		want     []graphie.NodeID
+		cost     float64
+		err      error
+	}{
+		{"bfs", n[0], n[3], graphie.PathOptions{}, nodes(0, 4, 3), 2, nil},
+		{"bfs types", n[0], n[3], graphie.PathOptions{Types: []string{"a"}}, nodes(0, 1, 2, 3), 3, nil},
+		{"bfs edge attrs", n[0], n[3], graphie.PathOptions{EdgeAttrs: []graphie.Attrs{{"w": 0.5}}}, nodes(0, 5, 6, 7, 3), 4, nil},
+		{"bfs in", n[3], n[0], graphie.PathOptions{Direction: graphie.DirIn}, nodes(3, 4, 0), 2, nil},
+		{"bfs both", n[2], n[6], graphie.PathOptions{Direction: graphie.DirBoth}, nodes(2, 3, 7, 6), 3, nil},
+		{"bfs max depth", n[0], n[3], graphie.PathOptions{MaxDepth: 1}, nil, 0, graphie.ErrNoPath},
+		{"bfs wrong direction", n[3], n[0], graphie.PathOptions{}, nil, 0, graphie.ErrNoPath},
+		{"same node", n[0], n[0], graphie.PathOptions{}, nodes(0), 0, nil},
+		{"unknown node", n[0], 999, graphie.PathOptions{}, nil, 0, graphie.ErrNodeNotFound},
+		{"dijkstra", n[0], n[3], graphie.PathOptions{Weight: "w"}, nodes(0, 5, 6, 7, 3), 2, nil},
+		{"dijkstra max depth", n[0], n[3], graphie.PathOptions{Weight: "w", MaxDepth: 3}, nodes(0, 1, 2, 3), 3, nil},
+		{"dijkstra types", n[0], n[3], graphie.PathOptions{Weight: "w", Types: []string{"b"}}, nodes(0, 4, 3), 20, nil},
+		{"dijkstra in", n[3], n[0], graphie.PathOptions{Weight: "w", Direction: graphie.DirIn}, nodes(3, 7, 6, 5, 0), 2, nil},
+		{"a*", n[0], n[3], graphie.PathOptions{Weight: "w", Heuristic: heuristic}, nodes(0, 5, 6, 7, 3), 2, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := g.ShortestPath(test.from, test.to, test.opts)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("ShortestPath returned %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkPath(t, p)
+			if !reflect.DeepEqual(p.Nodes, test.want) || p.Cost != test.cost {
+				t.Errorf("ShortestPath = %v (cost %g), want %v (cost %g)", p.Nodes, p.Cost, test.want, test.cost)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := g.ShortestPathContext(ctx, n[0], n[3], graphie.PathOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("ShortestPathContext with a cancelled context returned %v", err)
+	}
+
+	// Every link must have a numeric weight.
+	if _, err := g.Link(n[1], n[3], "a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.ShortestPath(n[0], n[3], graphie.PathOptions{Weight: "w"}); !errors.Is(err, graphie.ErrInvalidWeight) {
+		t.Errorf("ShortestPath over a link without weight returned %v, want %v", err, graphie.ErrInvalidWeight)
+	}
+}
+
+func TestKShortestPaths(t *testing.T) {
+	g, n := newPathGraph(t)
+
+	tests := []struct {
+		name  string
+		k     int
+		opts  graphie.PathOptions
+		costs []float64
+	}{
+		{"unweighted", 10, graphie.PathOptions{}, []float64{2, 3, 4}},
+		{"weighted", 10, graphie.PathOptions{Weight: "w"}, []float64{2, 3, 20}},
+		{"k", 2, graphie.PathOptions{Weight: "w"}, []float64{2, 3}},
+		{"max depth", 10, graphie.PathOptions{MaxDepth: 3}, []float64{2, 3}},
+		{"types", 10, graphie.PathOptions{Types: []string{"a"}}, []float64{3, 4}},
+		{"both", 10, graphie.PathOptions{Direction: graphie.DirBoth}, []float64{2, 3, 4}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			paths, err := g.KShortestPaths(n[0], n[3], test.k, test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			costs := make([]float64, 0, len(paths))
+			for _, p := range paths {
+				checkPath(t, p)
+				if p.Nodes[0] != n[0] || p.Nodes[len(p.Nodes)-1] != n[3] {
+					t.Fatalf("path %v doesn't lead from %d to %d", p.Nodes, n[0], n[3])
+				}
+				costs = append(costs, p.Cost)
+			}
+			if !reflect.DeepEqual(costs, test.costs) {
+				t.Errorf("KShortestPaths returned paths costing %v, want %v", costs, test.costs)
+			}
+		})
+	}
+
+	if _, err := g.KShortestPaths(n[3], n[0], 3, graphie.PathOptions{}); !errors.Is(err, graphie.ErrNoPath) {
+		t.Errorf("KShortestPaths without any path returned %v, want %v", err, graphie.ErrNoPath)
+	}
+}
@@ -1,5 +1,416 @@
 package graphie
 
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrMorphism = errors.New("A morphism has no starting point and can't be executed")
+
+	errStopIteration = errors.New("stop iteration")
+)
+
+// NodeFilterFn decides whether a node stays in the result set of a query.
+type NodeFilterFn func(id NodeID, attrs Attrs) bool
+
+// A source pushes node ids into yield until it is exhausted or yield returns
+// an error. Sources can be invoked multiple times; every invocation evaluates
+// the traversal again.
+type source func(yield func(id NodeID) error) error
+
+// A step transforms the nodes of one stage into the nodes of the next one.
+type step func(g *Graph, in source) source
+
+// A starter returns the starting nodes of a query executed on g.
+type starter func(g *Graph) source
+
+// Query describes a traversal through the graph. Queries are evaluated lazily:
+// nothing is read from the storage until one of the executors (Count, All,
+// Limit, Iterate or their Context variants) is called.
+//
+// Queries are immutable, every builder method returns a new query. This makes
+// it possible to prepare a partial path once and use it as a base for others
+// or to apply it as a morphism using Follow.
 type Query struct {
-	g *Graph
+	g     *Graph
+	start starter // nil for morphisms
+	steps []step
+}
+
+// Query starts a new traversal at the given nodes.
+func (g *Graph) Query(ids ...NodeID) *Query {
+	return &Query{
+		g:     g,
+		start: idSource(ids),
+	}
+}
+
+// Morphism starts a query without any starting point. It can't be executed
+// itself but applied to other queries using Follow, Union or Intersect.
+func (g *Graph) Morphism() *Query {
+	return &Query{
+		g: g,
+	}
+}
+
+// labelSource streams all nodes carrying the labels from the storage.
+func labelSource(labels []string) starter {
+	return func(g *Graph) source {
+		return func(yield func(id NodeID) error) error {
+			return g.cs.WalkNodesContext(g.ctx, labels, yield)
+		}
+	}
+}
+
+// idSource streams the given nodes; every node is yielded once.
+func idSource(ids []NodeID) starter {
+	return func(g *Graph) source {
+		return func(yield func(id NodeID) error) error {
+			seen := make(map[NodeID]struct{}, len(ids))
+			for _, id := range ids {
+				if _, has := seen[id]; has {
+					continue
+				}
+				seen[id] = struct{}{}
+				if err := yield(id); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+}
+
+func (q *Query) then(st step) *Query {
+	steps := make([]step, len(q.steps), len(q.steps)+1)
+	copy(steps, q.steps)
+	return &Query{
+		g:     q.g,
+		start: q.start,
+		steps: append(steps, st),
+	}
+}
+
+// pipe applies all steps of q to the input nodes. g is the graph the query is
+// executed on; it's q.g unless the query runs with a context.
+func (q *Query) pipe(g *Graph, in source) source {
+	for _, st := range q.steps {
+		in = st(g, in)
+	}
+	return in
+}
+
+// HasLabel keeps all nodes carrying the given label.
+func (q *Query) HasLabel(label string) *Query {
+	return q.then(func(g *Graph, in source) source {
+		return func(yield func(id NodeID) error) error {
+			return in(func(id NodeID) error {
+				labels, err := g.cs.LabelsContext(g.ctx, id)
+				if err != nil {
+					return err
+				}
+				for _, lbl := range labels {
+					if lbl == label {
+						return yield(id)
+					}
+				}
+				return nil
+			})
+		}
+	})
+}
+
+// HasAttrKey keeps all nodes having an attribute with the given key.
+func (q *Query) HasAttrKey(key string) *Query {
+	return q.Filter(func(id NodeID, attrs Attrs) bool {
+		_, has := attrs[key]
+		return has
+	})
+}
+
+// HasAttrValue keeps all nodes having an attribute key with the given value.
+func (q *Query) HasAttrValue(key string, value interface{}) *Query {
+	return q.Filter(func(id NodeID, attrs Attrs) bool {
+		v, has := attrs[key]
+		return has && ValueEqual(v, value)
+	})
+}
+
+// Filter keeps all nodes for which filterFn returns true.
+func (q *Query) Filter(filterFn NodeFilterFn) *Query {
+	return q.then(func(g *Graph, in source) source {
+		return func(yield func(id NodeID) error) error {
+			return in(func(id NodeID) error {
+				attrs, err := g.cs.AttrsContext(g.ctx, id)
+				if err != nil {
+					return err
+				}
+				if filterFn(id, attrs) {
+					return yield(id)
+				}
+				return nil
+			})
+		}
+	})
+}
+
+// Is keeps the given nodes only.
+func (q *Query) Is(ids ...NodeID) *Query {
+	set := make(map[NodeID]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	return q.then(func(g *Graph, in source) source {
+		return func(yield func(id NodeID) error) error {
+			return in(func(id NodeID) error {
+				if _, has := set[id]; has {
+					return yield(id)
+				}
+				return nil
+			})
+		}
+	})
+}
+
+// In follows all incoming links to the nodes pointing towards the current
+// ones. If edgeAttrs are given, only links matching at least one of them
+// are followed.
+func (q *Query) In(edgeAttrs ...Attrs) *Query {
+	return q.then(traverse(true, false, nil, edgeAttrs))
+}
+
+// Out follows all outgoing links. If edgeAttrs are given, only links matching
+// at least one of them are followed.
+func (q *Query) Out(edgeAttrs ...Attrs) *Query {
+	return q.then(traverse(false, true, nil, edgeAttrs))
+}
+
+// Both follows links in both directions. If edgeAttrs are given, only links
+// matching at least one of them are followed.
+func (q *Query) Both(edgeAttrs ...Attrs) *Query {
+	return q.then(traverse(true, true, nil, edgeAttrs))
+}
+
+// InType follows the incoming links having one of the types; links of other
+// types aren't read by the storage.
+func (q *Query) InType(types ...string) *Query {
+	return q.then(traverse(true, false, types, nil))
+}
+
+// OutType follows the outgoing links having one of the types.
+func (q *Query) OutType(types ...string) *Query {
+	return q.then(traverse(false, true, types, nil))
+}
+
+// BothType follows the links having one of the types in both directions.
+func (q *Query) BothType(types ...string) *Query {
+	return q.then(traverse(true, true, types, nil))
+}
+
+func traverse(in, out bool, types []string, edgeAttrs []Attrs) step {
+	return func(g *Graph, nodes source) source {
+		return func(yield func(id NodeID) error) error {
+			seen := make(map[NodeID]struct{})
+			follow := func(lnk *Link) error {
+				if !lnk.Attrs.matchAny(edgeAttrs) {
+					return nil
+				}
+				if _, has := seen[lnk.Other]; has {
+					return nil
+				}
+				seen[lnk.Other] = struct{}{}
+				return yield(lnk.Other)
+			}
+			return nodes(func(id NodeID) error {
+				if in {
+					if err := g.cs.WalkInTypesContext(g.ctx, id, types, follow); err != nil {
+						return err
+					}
+				}
+				if out {
+					if err := g.cs.WalkOutTypesContext(g.ctx, id, types, follow); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+	}
+}
+
+// Intersect keeps all nodes which are part of the result of b, too. If b is
+// a morphism, it's applied to the result of q.
+func (q *Query) Intersect(b *Query) *Query {
+	return &Query{
+		g:     q.g,
+		start: q.start,
+		steps: []step{func(g *Graph, in source) source {
+			return func(yield func(id NodeID) error) error {
+				left, right, err := q.operands(g, in, b)
+				if err != nil {
+					return err
+				}
+				set := make(map[NodeID]struct{})
+				err = right(func(id NodeID) error {
+					set[id] = struct{}{}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				return left(func(id NodeID) error {
+					if _, has := set[id]; has {
+						delete(set, id)
+						return yield(id)
+					}
+					return nil
+				})
+			}
+		}},
+	}
+}
+
+// Union adds all nodes of the result of b. If b is a morphism, it's applied
+// to the result of q.
+func (q *Query) Union(b *Query) *Query {
+	return &Query{
+		g:     q.g,
+		start: q.start,
+		steps: []step{func(g *Graph, in source) source {
+			return func(yield func(id NodeID) error) error {
+				left, right, err := q.operands(g, in, b)
+				if err != nil {
+					return err
+				}
+				seen := make(map[NodeID]struct{})
+				unique := func(id NodeID) error {
+					if _, has := seen[id]; has {
+						return nil
+					}
+					seen[id] = struct{}{}
+					return yield(id)
+				}
+				if err := left(unique); err != nil {
+					return err
+				}
+				return right(unique)
+			}
+		}},
+	}
+}
+
+// operands returns the results of q applied to in and of b. A morphism b is
+// applied to the result of q, which is read once and buffered for both.
+func (q *Query) operands(g *Graph, in source, b *Query) (source, source, error) {
+	left := q.pipe(g, in)
+	if b.start != nil {
+		return left, b.pipe(g, b.start(g)), nil
+	}
+	ids := make([]NodeID, 0)
+	err := left(func(id NodeID) error {
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	buffered := func(yield func(id NodeID) error) error {
+		for _, id := range ids {
+			if err := yield(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return buffered, b.pipe(g, buffered), nil
+}
+
+// Follow applies the morphism m to the current nodes.
+func (q *Query) Follow(m *Query) *Query {
+	return q.then(func(g *Graph, in source) source {
+		return m.pipe(g, in)
+	})
+}
+
+// Iterate calls fn for every resulting node until fn returns false.
+func (q *Query) Iterate(fn func(id NodeID) bool) error {
+	return q.iterate(q.g, fn)
+}
+
+// IterateContext is Iterate reading the graph with ctx (see ContextStorage);
+// it returns ctx.Err() if ctx is done before the traversal finished.
+func (q *Query) IterateContext(ctx context.Context, fn func(id NodeID) bool) error {
+	return q.iterate(q.g.withContext(ctx), fn)
+}
+
+func (q *Query) iterate(g *Graph, fn func(id NodeID) bool) error {
+	if q.start == nil {
+		return ErrMorphism
+	}
+	err := q.pipe(g, q.start(g))(func(id NodeID) error {
+		if !fn(id) {
+			return errStopIteration
+		}
+		return nil
+	})
+	if err == errStopIteration {
+		return nil
+	}
+	return err
+}
+
+// Count counts the resulting nodes.
+func (q *Query) Count() (int, error) {
+	return q.count(q.g)
+}
+
+// CountContext is Count reading the graph with ctx.
+func (q *Query) CountContext(ctx context.Context) (int, error) {
+	return q.count(q.g.withContext(ctx))
+}
+
+func (q *Query) count(g *Graph) (int, error) {
+	c := 0
+	err := q.iterate(g, func(id NodeID) bool {
+		c++
+		return true
+	})
+	return c, err
+}
+
+// All returns all resulting nodes.
+func (q *Query) All() ([]NodeID, error) {
+	return q.Limit(-1)
+}
+
+// AllContext is All reading the graph with ctx.
+func (q *Query) AllContext(ctx context.Context) ([]NodeID, error) {
+	return q.LimitContext(ctx, -1)
+}
+
+// Limit returns at most n resulting nodes in no particular order. The
+// traversal stops as soon as n nodes were found. A negative n means no limit.
+func (q *Query) Limit(n int) ([]NodeID, error) {
+	return q.limit(q.g, n)
+}
+
+// LimitContext is Limit reading the graph with ctx.
+func (q *Query) LimitContext(ctx context.Context, n int) ([]NodeID, error) {
+	return q.limit(q.g.withContext(ctx), n)
+}
+
+func (q *Query) limit(g *Graph, n int) ([]NodeID, error) {
+	ids := make([]NodeID, 0)
+	if n == 0 {
+		return ids, nil
+	}
+	err := q.iterate(g, func(id NodeID) bool {
+		ids = append(ids, id)
+		return n < 0 || len(ids) < n
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
 }
@@ -0,0 +1,114 @@
+package graphie_test
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/flosch/graphie"
+	_ "github.com/flosch/graphie/storages/memory"
+)
+
+// newGraph returns an empty graph on the memory driver.
+func newGraph(t *testing.T) *graphie.Graph {
+	t.Helper()
+	g, err := graphie.NewGraph("memory", "", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func sortIDs(ids []graphie.NodeID) []graphie.NodeID {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func TestQuery(t *testing.T) {
+	g := newGraph(t)
+	categories := g.Labels("category")
+	persons := g.Labels("person")
+
+	maths := categories.MustAdd(graphie.Attrs{"name": "Mathematics"})
+	numberTheory := categories.MustAdd(graphie.Attrs{"name": "Number theory"})
+	law := categories.MustAdd(graphie.Attrs{"name": "Law"})
+	cantor := persons.MustAdd(graphie.Attrs{"fullname": "Georg Cantor", "born": 1845})
+	fermat := persons.MustAdd(graphie.Attrs{"fullname": "Pierre de Fermat", "born": 1607})
+
+	link := func(from, to graphie.NodeID, name string) {
+		t.Helper()
+		if _, err := g.Link(from, to, "", graphie.Attrs{"name": name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link(maths, numberTheory, "contains")
+	link(cantor, maths, "field_of_profession")
+	link(fermat, maths, "field_of_profession")
+	link(fermat, law, "field_of_profession")
+	link(fermat, cantor, "knows")
+
+	contains := graphie.Attrs{"name": "contains"}
+	profession := graphie.Attrs{"name": "field_of_profession"}
+	knows := graphie.Attrs{"name": "knows"}
+
+	tests := []struct {
+		name  string
+		query *graphie.Query
+		want  []graphie.NodeID
+	}{
+		{"in", categories.Query(numberTheory).In(contains).In(profession), []graphie.NodeID{cantor, fermat}},
+		{"out", persons.Query(fermat).Out(), []graphie.NodeID{maths, law, cantor}},
+		{"both", g.Query(fermat).Both(), []graphie.NodeID{maths, law, cantor}},
+		{"has label", persons.Query(fermat).Out().HasLabel("category"), []graphie.NodeID{maths, law}},
+		{"has attr value", g.Query(cantor, fermat).HasAttrValue("born", 1845), []graphie.NodeID{cantor}},
+		{"has attr key", g.Query(maths, cantor, fermat).HasAttrKey("fullname"), []graphie.NodeID{cantor, fermat}},
+		{"filter", persons.Nodes().Filter(func(id graphie.NodeID, attrs graphie.Attrs) bool { return id == fermat }), []graphie.NodeID{fermat}},
+		{"is", g.Query(fermat).Out().Is(law, numberTheory), []graphie.NodeID{law}},
+		{"label nodes", persons.Nodes(), []graphie.NodeID{cantor, fermat}},
+
+		// Every node is part of the result once, no matter how many ways
+		// lead to it.
+		{"dedup", g.Query(cantor, fermat).Out(profession), []graphie.NodeID{maths, law}},
+		{"dedup twice", g.Query(cantor, fermat).Out(profession).Out(contains), []graphie.NodeID{numberTheory}},
+		{"dedup start", g.Query(fermat, fermat, cantor), []graphie.NodeID{cantor, fermat}},
+
+		{"intersect", persons.Query(fermat).Out().Intersect(g.Query(cantor, law, numberTheory)), []graphie.NodeID{law, cantor}},
+		{"intersect morphism", g.Query(cantor, fermat).Intersect(g.Morphism().Out(knows)), []graphie.NodeID{cantor}},
+		{"intersect morphism of the result", g.Query(fermat).Out().Intersect(g.Morphism().HasLabel("person")), []graphie.NodeID{cantor}},
+		{"intersect nothing", g.Query(fermat).Out().Intersect(g.Query(numberTheory)), nil},
+		{"union", g.Query(cantor).Union(g.Query(law, cantor)), []graphie.NodeID{law, cantor}},
+		{"union morphism", g.Query(fermat).Union(g.Morphism().Out(knows)), []graphie.NodeID{cantor, fermat}},
+		{"union morphism of the result", g.Query(fermat).Out(knows).Union(g.Morphism().Out(profession)), []graphie.NodeID{maths, cantor}},
+		{"follow", persons.Query(fermat, cantor).Follow(g.Morphism().Out(knows).Union(g.Morphism().Out(profession))), []graphie.NodeID{maths, cantor}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.query.All()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := sortIDs(append([]graphie.NodeID{}, test.want...))
+			if got = sortIDs(got); len(got) != len(want) || (len(got) > 0 && !reflect.DeepEqual(got, want)) {
+				t.Errorf("All() = %v, want %v", got, want)
+			}
+			count, err := test.query.Count()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != len(want) {
+				t.Errorf("Count() = %d, want %d", count, len(want))
+			}
+		})
+	}
+
+	ids, err := g.Query(fermat).Out().Limit(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 {
+		t.Errorf("Limit(2) returned %d nodes", len(ids))
+	}
+	if _, err := g.Morphism().Out().All(); err != graphie.ErrMorphism {
+		t.Errorf("executing a morphism returned %v, want %v", err, graphie.ErrMorphism)
+	}
+}
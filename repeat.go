@@ -0,0 +1,227 @@
+package graphie
+
+import (
+	"context"
+
+	"github.com/flosch/graphie/internal/walk"
+)
+
+// An expander calls fn for every node reachable from id in one step. edge is
+// the link followed or nil if the step isn't a single link.
+type expander func(g *Graph, id NodeID, fn func(next NodeID, edge *Edge) error) error
+
+// A Repetition is a query applying a step over and over again, e.g. to get
+// all transitive ancestors of a node. It's a Query itself; Until, Times and
+// Emit return repetitions configured differently and Paths returns the paths
+// taken instead of the nodes.
+//
+// A node is expanded at most once per depth (once at all if there is no
+// maximum depth), so cycles don't make the repetition loop forever.
+type Repetition struct {
+	*Query
+
+	base     *Query // the query the repetition is applied to
+	expand   expander
+	min, max int
+	until    NodeFilterFn
+	emit     bool
+}
+
+// Repeat applies the morphism m to the current nodes, then to the resulting
+// nodes and so on until no new nodes are found. It yields all nodes reached
+// by applying m at least once.
+func (q *Query) Repeat(m *Query) *Repetition {
+	return q.repeat(func(g *Graph, id NodeID, fn func(next NodeID, edge *Edge) error) error {
+		return m.pipe(g, idSource([]NodeID{id})(g))(func(next NodeID) error {
+			return fn(next, nil)
+		})
+	}, 1, -1)
+}
+
+// InN follows incoming links at least min and at most max times (no limit
+// if max is negative); it yields all nodes reached in between. If edgeAttrs
+// are given, only links matching at least one of them are followed.
+func (q *Query) InN(min, max int, edgeAttrs ...Attrs) *Repetition {
+	return q.repeat(linkExpander(true, false, edgeAttrs), min, max)
+}
+
+// OutN follows outgoing links at least min and at most max times (see InN).
+func (q *Query) OutN(min, max int, edgeAttrs ...Attrs) *Repetition {
+	return q.repeat(linkExpander(false, true, edgeAttrs), min, max)
+}
+
+// BothN follows links in both directions at least min and at most max times
+// (see InN).
+func (q *Query) BothN(min, max int, edgeAttrs ...Attrs) *Repetition {
+	return q.repeat(linkExpander(true, true, edgeAttrs), min, max)
+}
+
+func linkExpander(in, out bool, edgeAttrs []Attrs) expander {
+	return func(g *Graph, id NodeID, fn func(next NodeID, edge *Edge) error) error {
+		if in {
+			err := g.cs.WalkInContext(g.ctx, id, func(l *Link) error {
+				if !l.Attrs.matchAny(edgeAttrs) {
+					return nil
+				}
+				return fn(l.Other, &Edge{ID: l.ID, Type: l.Type, From: l.Other, To: id, Attrs: l.Attrs})
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if out {
+			err := g.cs.WalkOutContext(g.ctx, id, func(l *Link) error {
+				if !l.Attrs.matchAny(edgeAttrs) {
+					return nil
+				}
+				return fn(l.Other, &Edge{ID: l.ID, Type: l.Type, From: id, To: l.Other, Attrs: l.Attrs})
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func (q *Query) repeat(expand expander, min, max int) *Repetition {
+	r := &Repetition{
+		base:   q,
+		expand: expand,
+		min:    min,
+		max:    max,
+	}
+	r.Query = q.then(r.step)
+	return r
+}
+
+// with returns a copy of r changed by fn.
+func (r *Repetition) with(fn func(c *Repetition)) *Repetition {
+	c := *r
+	fn(&c)
+	c.Query = c.base.then(c.step)
+	return &c
+}
+
+// Times repeats at least min and at most max times (no limit if max is
+// negative). With a minimum of 0, the starting nodes are part of the result.
+func (r *Repetition) Times(min, max int) *Repetition {
+	return r.with(func(c *Repetition) {
+		c.min, c.max = min, max
+	})
+}
+
+// Until stops repeating at the nodes for which filterFn returns true; only
+// those nodes are yielded (unless Emit is used). Nodes are checked once the
+// minimum number of repetitions is reached.
+func (r *Repetition) Until(filterFn NodeFilterFn) *Repetition {
+	return r.with(func(c *Repetition) {
+		c.until = filterFn
+	})
+}
+
+// Emit yields the nodes passed on the way to the ones Until stopped at, too.
+func (r *Repetition) Emit() *Repetition {
+	return r.with(func(c *Repetition) {
+		c.emit = true
+	})
+}
+
+func (r *Repetition) step(g *Graph, in source) source {
+	return func(yield func(id NodeID) error) error {
+		seen := make(map[NodeID]struct{})
+		return in(func(id NodeID) error {
+			return r.walk(g, id, func(id NodeID, path func() *Path) error {
+				if _, has := seen[id]; has {
+					return nil
+				}
+				seen[id] = struct{}{}
+				return yield(id)
+			})
+		})
+	}
+}
+
+// walk repeats starting at start and calls fn for every node which is part
+// of the result.
+func (r *Repetition) walk(g *Graph, start NodeID, fn func(id NodeID, path func() *Path) error) error {
+	expand := func(id uint64, fn func(next uint64, step interface{}) error) error {
+		return r.expand(g, NodeID(id), func(next NodeID, edge *Edge) error {
+			if edge == nil {
+				return fn(uint64(next), nil)
+			}
+			return fn(uint64(next), edge)
+		})
+	}
+	return walk.Depths(uint64(start), r.min, r.max, expand, func(id uint64, path func() ([]uint64, []interface{})) (bool, error) {
+		stop := false
+		if r.until != nil {
+			attrs, err := g.cs.AttrsContext(g.ctx, NodeID(id))
+			if err != nil {
+				return false, err
+			}
+			stop = r.until(NodeID(id), attrs)
+		}
+		if stop || r.until == nil || r.emit {
+			err := fn(NodeID(id), func() *Path {
+				return repeatPath(path())
+			})
+			if err != nil {
+				return false, err
+			}
+		}
+		return !stop, nil
+	})
+}
+
+// Paths returns the path from the starting node of the repetition to every
+// node it yields; of several paths between the same nodes only the
+// shortest one is returned. Repetitions of a morphism don't know the links
+// they followed, so their paths have no edges.
+func (r *Repetition) Paths() ([]*Path, error) {
+	return r.paths(r.g)
+}
+
+// PathsContext is Paths reading the graph with ctx.
+func (r *Repetition) PathsContext(ctx context.Context) ([]*Path, error) {
+	return r.paths(r.g.withContext(ctx))
+}
+
+func (r *Repetition) paths(g *Graph) ([]*Path, error) {
+	if r.base.start == nil {
+		return nil, ErrMorphism
+	}
+	paths := make([]*Path, 0)
+	err := r.base.pipe(g, r.base.start(g))(func(start NodeID) error {
+		ends := make(map[NodeID]struct{})
+		return r.walk(g, start, func(id NodeID, path func() *Path) error {
+			if _, has := ends[id]; has {
+				return nil
+			}
+			ends[id] = struct{}{}
+			paths = append(paths, path())
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// repeatPath converts the nodes and links a walk reached a node by into a
+// path.
+func repeatPath(nodes []uint64, steps []interface{}) *Path {
+	p := &Path{
+		Nodes: make([]NodeID, 0, len(nodes)),
+		Edges: make([]*Edge, 0, len(steps)),
+		Cost:  float64(len(nodes) - 1),
+	}
+	for _, id := range nodes {
+		p.Nodes = append(p.Nodes, NodeID(id))
+	}
+	for _, step := range steps {
+		p.Edges = append(p.Edges, step.(*Edge))
+	}
+	return p
+}
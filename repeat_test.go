@@ -0,0 +1,162 @@
+package graphie_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/flosch/graphie"
+)
+
+// newCycleGraph returns a graph of six nodes: 0->1->2->3->1 forms a cycle
+// (links with the attribute k=1) and 0->4->5 are links of type x.
+func newCycleGraph(t *testing.T) (*graphie.Graph, []graphie.NodeID) {
+	g := newGraph(t)
+	n := make([]graphie.NodeID, 6)
+	for i := range n {
+		id, err := g.Storage().Add(nil, graphie.Attrs{"i": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n[i] = id
+	}
+	links := []struct {
+		from, to int
+		typ      string
+		attrs    graphie.Attrs
+	}{
+		{0, 1, "", graphie.Attrs{"k": 1}},
+		{1, 2, "", graphie.Attrs{"k": 1}},
+		{2, 3, "", graphie.Attrs{"k": 1}},
+		{3, 1, "", graphie.Attrs{"k": 1}},
+		{0, 4, "x", nil},
+		{4, 5, "x", nil},
+	}
+	for _, l := range links {
+		if _, err := g.Link(n[l.from], n[l.to], l.typ, l.attrs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return g, n
+}
+
+func TestRepeat(t *testing.T) {
+	g, n := newCycleGraph(t)
+	nodes := func(is ...int) []graphie.NodeID {
+		ids := make([]graphie.NodeID, 0, len(is))
+		for _, i := range is {
+			ids = append(ids, n[i])
+		}
+		return sortIDs(ids)
+	}
+	is := func(i int) func(id graphie.NodeID, attrs graphie.Attrs) bool {
+		return func(id graphie.NodeID, attrs graphie.Attrs) bool {
+			return graphie.ValueEqual(attrs["i"], i)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query interface {
+			All() ([]graphie.NodeID, error)
+		}
+		want []graphie.NodeID
+	}{
+		{"out", g.Query(n[0]).OutN(1, -1), nodes(1, 2, 3, 4, 5)},
+		{"out with start", g.Query(n[0]).OutN(0, -1), nodes(0, 1, 2, 3, 4, 5)},
+		{"out exactly", g.Query(n[0]).OutN(2, 2), nodes(2, 5)},
+		{"out around the cycle", g.Query(n[0]).OutN(4, 4), nodes(1)},
+		{"out beyond the cycle", g.Query(n[0]).OutN(5, -1), nodes(1, 2, 3)},
+		{"out edge attrs", g.Query(n[0]).OutN(1, -1, graphie.Attrs{"k": 1}), nodes(1, 2, 3)},
+		{"out from the cycle", g.Query(n[1]).OutN(1, -1), nodes(1, 2, 3)},
+		{"in", g.Query(n[5]).InN(1, -1), nodes(0, 4)},
+		{"both", g.Query(n[5]).BothN(2, 2), nodes(0, 5)},
+		{"continued", g.Query(n[0]).OutN(1, 1).Out(), nodes(2, 5)},
+		{"morphism", g.Query(n[0]).Follow(g.Morphism().OutN(2, 2).Query), nodes(2, 5)},
+		{"repeat", g.Query(n[0]).Repeat(g.Morphism().OutType("x")), nodes(4, 5)},
+		{"times", g.Query(n[0]).Repeat(g.Morphism().Out()).Times(1, 1), nodes(1, 4)},
+		{"until", g.Query(n[0]).Repeat(g.Morphism().Out()).Until(is(3)), nodes(3)},
+		{"until never", g.Query(n[0]).Repeat(g.Morphism().Out()).Until(is(9)), nil},
+		{"emit", g.Query(n[0]).Repeat(g.Morphism().Out()).Until(is(2)).Emit(), nodes(1, 2, 4, 5)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.query.All()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got = sortIDs(got); len(got) != len(test.want) || (len(got) > 0 && !reflect.DeepEqual(got, test.want)) {
+				t.Errorf("All() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRepeatPaths(t *testing.T) {
+	g, n := newCycleGraph(t)
+	nodes := func(is ...int) []graphie.NodeID {
+		ids := make([]graphie.NodeID, 0, len(is))
+		for _, i := range is {
+			ids = append(ids, n[i])
+		}
+		return ids
+	}
+
+	tests := []struct {
+		name string
+		rep  *graphie.Repetition
+		want [][]graphie.NodeID // by the last node
+	}{
+		{"out", g.Query(n[0]).OutN(1, -1), [][]graphie.NodeID{
+			nodes(0, 1), nodes(0, 1, 2), nodes(0, 1, 2, 3), nodes(0, 4), nodes(0, 4, 5),
+		}},
+		{"cycle", g.Query(n[1]).OutN(1, -1), [][]graphie.NodeID{
+			nodes(1, 2, 3, 1), nodes(1, 2), nodes(1, 2, 3),
+		}},
+		{"in", g.Query(n[5]).InN(1, 2), [][]graphie.NodeID{
+			nodes(5, 4, 0), nodes(5, 4),
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			paths, err := test.rep.Paths()
+			if err != nil {
+				t.Fatal(err)
+			}
+			byEnd := make(map[graphie.NodeID][]graphie.NodeID)
+			for _, p := range paths {
+				checkPath(t, p)
+				if p.Cost != float64(len(p.Edges)) {
+					t.Errorf("path %v costs %g", p.Nodes, p.Cost)
+				}
+				byEnd[p.Nodes[len(p.Nodes)-1]] = p.Nodes
+			}
+			if len(byEnd) != len(paths) || len(paths) != len(test.want) {
+				t.Fatalf("Paths returned %d paths to %d nodes, want %d", len(paths), len(byEnd), len(test.want))
+			}
+			for _, want := range test.want {
+				if got := byEnd[want[len(want)-1]]; !reflect.DeepEqual(got, want) {
+					t.Errorf("path to %d is %v, want %v", want[len(want)-1], got, want)
+				}
+			}
+		})
+	}
+
+	// The links of a repeated morphism aren't single steps; its paths list
+	// the nodes only.
+	paths, err := g.Query(n[0]).Repeat(g.Morphism().OutType("x")).Paths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range paths {
+		if len(p.Edges) != 0 {
+			t.Errorf("path %v of a morphism has edges", p.Nodes)
+		}
+	}
+	if len(paths) != 2 {
+		t.Errorf("Paths returned %d paths, want 2", len(paths))
+	}
+
+	if _, err := g.Morphism().OutN(1, 2).Paths(); err != graphie.ErrMorphism {
+		t.Errorf("Paths of a morphism returned %v, want %v", err, graphie.ErrMorphism)
+	}
+}
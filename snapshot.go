@@ -0,0 +1,147 @@
+package graphie
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrReadOnly             = errors.New("Snapshots are read-only")
+	ErrSnapshotNotSupported = errors.New("Snapshots are not supported by the storage driver")
+)
+
+// SnapshotStorage is implemented by storages supporting snapshots (see
+// Graph.Snapshot).
+type SnapshotStorage interface {
+	Storage
+
+	// Snapshot pins the current state of the storage; mutations done
+	// afterwards aren't visible in the snapshot.
+	Snapshot() (StorageSnapshot, error)
+}
+
+// StorageSnapshot is a read-only view of a storage pinned to a sequence
+// number.
+type StorageSnapshot interface {
+	StorageReader
+
+	// Seq returns the sequence number of the last mutation visible in the
+	// snapshot.
+	Seq() uint64
+
+	// Release unpins the snapshot; the storage is free to drop the data
+	// only the snapshot still refers to. The snapshot must not be used
+	// afterwards.
+	Release() error
+}
+
+// Snapshot is a read-only graph seeing the state of the graph at the time
+// the snapshot was taken. Traversals see a consistent graph, no matter what
+// is written to the graph in the meantime. All mutations fail with
+// ErrReadOnly.
+//
+// Snapshots must be released (using Release or Close) before the graph is
+// closed.
+type Snapshot struct {
+	*Graph
+	ss StorageSnapshot
+}
+
+// Snapshot takes a snapshot of the graph. The storage driver has to
+// implement SnapshotStorage.
+func (g *Graph) Snapshot() (*Snapshot, error) {
+	sst, ok := g.s.(SnapshotStorage)
+	if !ok {
+		return nil, ErrSnapshotNotSupported
+	}
+	ss, err := sst.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	ro := readOnly{ss}
+	return &Snapshot{
+		Graph: &Graph{
+			name: g.name,
+			s:    ro,
+			cs:   WithContext(ro),
+			ctx:  context.Background(),
+		},
+		ss: ss,
+	}, nil
+}
+
+// Seq returns the sequence number the snapshot is pinned to.
+func (sn *Snapshot) Seq() uint64 {
+	return sn.ss.Seq()
+}
+
+// Release releases the snapshot, it's the same as Close.
+func (sn *Snapshot) Release() error {
+	return sn.Close()
+}
+
+// readOnly turns a snapshot into a Storage; stopping it releases the
+// snapshot.
+type readOnly struct {
+	StorageSnapshot
+}
+
+func (r readOnly) Start(attrs string, dbname string) error {
+	return nil
+}
+
+func (r readOnly) Stop() error {
+	return r.Release()
+}
+
+func (r readOnly) EnsureIndexNodes(labels []string, attrName string) error {
+	return ErrReadOnly
+}
+
+func (r readOnly) EnsureIndexLinks(labels []string, attrName string) error {
+	return ErrReadOnly
+}
+
+func (r readOnly) EnsureUnique(labels []string, attrName string) error {
+	return ErrReadOnly
+}
+
+func (r readOnly) Add(labels []string, attrs Attrs) (NodeID, error) {
+	return 0, ErrReadOnly
+}
+
+func (r readOnly) Merge(labels []string, attrs Attrs) (NodeID, error) {
+	return 0, ErrReadOnly
+}
+
+func (r readOnly) Link(from, to NodeID, typ string, attrs Attrs) (EdgeID, error) {
+	return 0, ErrReadOnly
+}
+
+func (r readOnly) Unlink(from, to NodeID, attrs Attrs) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (r readOnly) Remove(id NodeID) error {
+	return ErrReadOnly
+}
+
+func (r readOnly) AddLabel(id NodeID, label string) error {
+	return ErrReadOnly
+}
+
+func (r readOnly) RemoveLabel(id NodeID, label string) error {
+	return ErrReadOnly
+}
+
+func (r readOnly) Set(id NodeID, key string, value interface{}) error {
+	return ErrReadOnly
+}
+
+func (r readOnly) SetEdgeAttr(id EdgeID, key string, value interface{}) error {
+	return ErrReadOnly
+}
+
+func (r readOnly) RemoveEdge(id EdgeID) error {
+	return ErrReadOnly
+}
@@ -3,6 +3,8 @@ package graphie
 type Attrs map[string]interface{}
 
 type Storage interface {
+	StorageReader
+
 	// Initializes the underlying storage, creates appropriate indexes and
 	// establishes a connection, if not done yet
 	Start(attrs string, dbname string) error
@@ -13,29 +15,119 @@ type Storage interface {
 	EnsureIndexNodes(labels []string, attrName string) error
 	EnsureIndexLinks(labels []string, attrName string) error
 
+	// EnsureUnique makes sure no two nodes carrying one of the labels have
+	// the same value for attrName. Mutations breaking this constraint fail
+	// with a *ConstraintViolationError, so does EnsureUnique if existing
+	// nodes break it already. Unique attributes are key attributes for
+	// Merge.
+	EnsureUnique(labels []string, attrName string) error
+
 	// Elementary CRUD operations for nodes
 	Add(labels []string, attrs Attrs) (NodeID, error)
+	// Merge returns the node carrying all labels whose key attributes equal
+	// the ones in attrs and sets its remaining attributes; if there's no such
+	// node, it is added. Key attributes are declared by EnsureIndexNodes
+	// (see SplitKeys). Merge is atomic. It fails with ErrNoKeys if attrs are
+	// empty.
 	Merge(labels []string, attrs Attrs) (NodeID, error)
-	Link(from, to NodeID, attrs Attrs) error
-	Unlink(from, to NodeID, attrs Attrs) error
+	// Link adds a link of the given type ("" for an untyped link) and
+	// returns its id; the id is unique within the graph and never handed
+	// out again, even if the link is removed.
+	Link(from, to NodeID, typ string, attrs Attrs) (EdgeID, error)
+	// Unlink removes all links from -> to matching attrs (nil matches all
+	// links, see Attrs.Match) and returns the number of removed links.
+	Unlink(from, to NodeID, attrs Attrs) (int, error)
 	Remove(id NodeID) error
 
+	// AddLabel and RemoveLabel are no-ops if the node already carries (or
+	// doesn't carry) the label; AddLabel fails with a
+	// *ConstraintViolationError if the node breaks a unique constraint of
+	// the label.
+	AddLabel(id NodeID, label string) error
+	RemoveLabel(id NodeID, label string) error
+
+	Set(id NodeID, key string, value interface{}) error
+
+	// SetEdgeAttr sets an attribute of the link on both of its ends;
+	// RemoveEdge removes the link. Both fail with ErrEdgeNotFound if there's
+	// no such link.
+	SetEdgeAttr(id EdgeID, key string, value interface{}) error
+	RemoveEdge(id EdgeID) error
+}
+
+// StorageReader contains the read operations of a storage; they're shared
+// by storages and their snapshots.
+type StorageReader interface {
+	// FindByAttr returns all nodes carrying all labels whose attribute key
+	// equals value (see ValueEqual), sorted by id. Drivers use the indexes
+	// created by EnsureIndexNodes if there are any.
+	FindByAttr(labels []string, key string, value interface{}) ([]NodeID, error)
+
+	// Label handling. WalkNodes calls fn for the id of every node carrying
+	// all labels (all nodes if there are none) in ascending order until fn
+	// returns an error, which is returned by the walk.
+	WalkNodes(labels []string, fn func(id NodeID) error) error
+	Labels(id NodeID) ([]string, error)
+
 	// Edge handling
 	In(id NodeID) ([]*Link, error)
 	Out(id NodeID) ([]*Link, error)
 
+	// Streaming variants of In and Out for nodes with lots of links; fn is
+	// called for every link until it returns an error, which is returned
+	// by the walk.
+	WalkIn(id NodeID, fn func(l *Link) error) error
+	WalkOut(id NodeID, fn func(l *Link) error) error
+
+	// WalkInTypes and WalkOutTypes only walk the links of one of the types
+	// (all links if there are none). Drivers index the types, so the links
+	// of other types aren't read.
+	WalkInTypes(id NodeID, types []string, fn func(l *Link) error) error
+	WalkOutTypes(id NodeID, types []string, fn func(l *Link) error) error
+
+	// GetEdge returns the link with the given id including its ends
+	GetEdge(id EdgeID) (*Edge, error)
+
 	// Attribute handling
-	Set(id NodeID, key string, value interface{}) error
 	Get(id NodeID, key string) (interface{}, error)
 	Has(id NodeID, key string) (bool, error)
 	Attrs(id NodeID) (Attrs, error)
 }
 
+// Link is a link as seen from one of its ends; Other is the node on the other
+// end.
 type Link struct {
+	ID    EdgeID
+	Type  string
 	Other NodeID
 	Attrs Attrs
 }
 
+// Edge is a link with both of its ends (see GetEdge).
+type Edge struct {
+	ID    EdgeID
+	Type  string
+	From  NodeID
+	To    NodeID
+	Attrs Attrs
+}
+
+// MatchType reports whether typ is one of the types; every type matches if
+// there are none.
+func MatchType(types []string, typ string) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, t := range types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+type EdgeID uint64
+
 type NodeID uint64
 type Node interface {
 	//ID() NodeID
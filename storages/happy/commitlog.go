@@ -0,0 +1,492 @@
+package happy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/flosch/graphie"
+)
+
+const (
+	commitlogExtension  = ".log"
+	commitlogHeaderSize = 4 + 4 // length + checksum
+)
+
+var (
+	ErrCorruptCommitlog = errors.New("Commit log is corrupt")
+
+	commitlogTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// syncMode controls when the commit log is synced to disk
+type syncMode int
+
+const (
+	// Every write is synced before it is acknowledged
+	syncAlways syncMode = iota
+
+	// Concurrent writes share a sync (group commit); every write is synced
+	// before it is acknowledged, but writers don't have to wait for each other's
+	// syncs one after the other
+	syncBatch
+
+	// The commit log is never synced explicitly; a crash of the OS (not of the
+	// process) can lose acknowledged writes
+	syncNone
+)
+
+func parseSyncMode(s string) (syncMode, error) {
+	switch s {
+	case "always":
+		return syncAlways, nil
+	case "batch":
+		return syncBatch, nil
+	case "none":
+		return syncNone, nil
+	}
+	return 0, fmt.Errorf("Unknown sync mode '%s' (must be one of always, batch, none)", s)
+}
+
+// A commitLog is an append-only write-ahead log. It is made of segments; a
+// new segment is started for every memtable. A segment is removed as soon as
+// its memtable is persisted in a nodetable.
+//
+// Every record in a segment is:
+//
+//	length (uint32) | crc32-c of the payload (uint32) | payload
+//
+// The payload contains all labels and node versions a single mutation
+// creates:
+//
+//	count (uint16) | count * (label id (uint16) | name length (uint16) | name)
+//	count (uint32) | count * (node id (uint64) | node record (see node.write))
+type commitLog struct {
+	path string
+	mode syncMode
+
+	lock     sync.Mutex
+	fd       *os.File
+	filename string
+	seq      uint64 // sequence number of the current segment
+	size     int64  // bytes written to the current segment
+	written  int64  // bytes written in total (over all segments)
+	err      error  // set if a record couldn't be written or removed again
+
+	syncing  sync.Mutex // serializes group commits in wait()
+	syncLock sync.Mutex
+	synced   int64 // bytes synced in total (over all segments)
+}
+
+func segmentFilename(path string, seq uint64) string {
+	return filepath.Join(path, fmt.Sprintf("%016x%s", seq, commitlogExtension))
+}
+
+// listSegments returns all segments in path ordered by their sequence number
+func listSegments(path string) ([]string, uint64, error) {
+	filenames, err := filepath.Glob(filepath.Join(path, "*"+commitlogExtension))
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Strings(filenames)
+
+	var seq uint64
+	for _, filename := range filenames {
+		base := strings.TrimSuffix(filepath.Base(filename), commitlogExtension)
+		n, err := strconv.ParseUint(base, 16, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Invalid commit log segment name '%s'", filename)
+		}
+		if n > seq {
+			seq = n
+		}
+	}
+	return filenames, seq, nil
+}
+
+func openCommitLog(path string, mode syncMode, lastSeq uint64) (*commitLog, error) {
+	l := &commitLog{
+		path: path,
+		mode: mode,
+		seq:  lastSeq,
+	}
+	err := l.openSegment()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Does not hold l.lock; must be held outside
+func (l *commitLog) openSegment() error {
+	l.seq++
+	filename := segmentFilename(l.path, l.seq)
+	fd, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = syncDir(l.path)
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	l.fd = fd
+	l.filename = filename
+	l.size = 0
+	return nil
+}
+
+// Does not hold l.lock; must be held outside
+func (l *commitLog) closeSegment() error {
+	if l.mode != syncNone {
+		err := l.fd.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	err := l.fd.Close()
+	if err != nil {
+		return err
+	}
+
+	// Everything written so far has been synced with the segment
+	l.syncLock.Lock()
+	if l.written > l.synced {
+		l.synced = l.written
+	}
+	l.syncLock.Unlock()
+	return nil
+}
+
+// rotate closes the current segment and starts a new one. It returns the
+// filename of the closed segment.
+func (l *commitLog) rotate() (string, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	old := l.filename
+	err := l.closeSegment()
+	if err != nil {
+		return "", err
+	}
+	err = l.openSegment()
+	if err != nil {
+		return "", err
+	}
+	return old, nil
+}
+
+// current returns the filename of the segment currently written to
+func (l *commitLog) current() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.filename
+}
+
+func (l *commitLog) close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.closeSegment()
+}
+
+// append writes a record to the current segment. In syncAlways mode the
+// record is synced before append returns; in syncBatch mode the caller has to
+// call wait with the returned position before acknowledging the write.
+//
+// A record written partially is cut off again, replay would stop at it and
+// lose all records after it. If that fails too, or a sync fails, it's
+// unknown what the segment contains; the log refuses all further records.
+func (l *commitLog) append(payload []byte) (int64, error) {
+	buf := make([]byte, commitlogHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(payload, commitlogTable))
+	copy(buf[commitlogHeaderSize:], payload)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.err != nil {
+		return 0, l.err
+	}
+
+	_, err := l.fd.Write(buf)
+	if err != nil {
+		l.truncate()
+		return 0, err
+	}
+	l.size += int64(len(buf))
+	l.written += int64(len(buf))
+
+	if l.mode == syncAlways {
+		err = l.fd.Sync()
+		if err != nil {
+			l.err = fmt.Errorf("Commit log failed: %w", err)
+			return 0, err
+		}
+		l.syncLock.Lock()
+		l.synced = l.written
+		l.syncLock.Unlock()
+	}
+
+	return l.written, nil
+}
+
+// truncate cuts the current segment back to the end of its last complete
+// record after a failed write.
+//
+// Does not hold l.lock; must be held outside
+func (l *commitLog) truncate() {
+	err := l.fd.Truncate(l.size)
+	if err == nil {
+		_, err = l.fd.Seek(l.size, io.SeekStart)
+	}
+	if err != nil {
+		l.err = fmt.Errorf("Commit log failed: %w", err)
+	}
+}
+
+// wait blocks until the commit log is synced up to pos. All writers waiting
+// at the same time share a single sync.
+func (l *commitLog) wait(pos int64) error {
+	if l.mode != syncBatch {
+		return nil
+	}
+
+	l.syncing.Lock()
+	defer l.syncing.Unlock()
+
+	if l.isSynced(pos) {
+		// Someone else synced for us in the meantime
+		return nil
+	}
+
+	l.lock.Lock()
+	fd, written := l.fd, l.written
+	l.lock.Unlock()
+
+	err := fd.Sync()
+	if err != nil {
+		// The segment might have been rotated (and synced) concurrently
+		if l.isSynced(pos) {
+			return nil
+		}
+		return err
+	}
+
+	l.syncLock.Lock()
+	if written > l.synced {
+		l.synced = written
+	}
+	l.syncLock.Unlock()
+	return nil
+}
+
+func (l *commitLog) isSynced(pos int64) bool {
+	l.syncLock.Lock()
+	defer l.syncLock.Unlock()
+	return l.synced >= pos
+}
+
+// replaySegment calls fn for every complete record of the segment. A torn
+// record at the end of the segment (a crash while writing it) is cut off.
+func replaySegment(filename string, fn func(payload []byte) error) error {
+	fd, err := os.OpenFile(filename, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	fi, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+
+	r := bufio.NewReader(fd)
+	var offset int64
+	var header [commitlogHeaderSize]byte
+
+	for {
+		_, err = io.ReadFull(r, header[:])
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return fd.Truncate(offset)
+		}
+		if err != nil {
+			return err
+		}
+
+		// A length beyond the end of the segment is garbage as well; it
+		// mustn't make us allocate up to 4 GiB
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		if length > size-offset-commitlogHeaderSize {
+			return fd.Truncate(offset)
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(r, payload)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return fd.Truncate(offset)
+		}
+		if err != nil {
+			return err
+		}
+		if crc32.Checksum(payload, commitlogTable) != binary.BigEndian.Uint32(header[4:8]) {
+			// A torn write (or garbage after it); nothing after this record can
+			// be trusted
+			return fd.Truncate(offset)
+		}
+
+		err = fn(payload)
+		if err != nil {
+			return err
+		}
+
+		offset += commitlogHeaderSize + int64(len(payload))
+	}
+}
+
+// logMutation writes all pending labels and the given node versions to the
+// commit log and stamps them with the next sequence number. It must be
+// called (while s.lock is held) before the nodes are put into the memtable.
+// The returned position must be passed to s.log.wait() after s.lock has
+// been released. Attributes msgpack can't encode are rejected with
+// graphie.ErrInvalidAttr; after a background worker failed, all mutations
+// fail with its error (see fail).
+func (s *storage) logMutation(nodes ...*node) (int64, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	var buf bytes.Buffer
+
+	err := binary.Write(&buf, binary.BigEndian, uint16(len(s.pendingLabels)))
+	if err != nil {
+		return 0, err
+	}
+	for _, lbl := range s.pendingLabels {
+		err = binary.Write(&buf, binary.BigEndian, s.labelIndex[lbl])
+		if err != nil {
+			return 0, err
+		}
+		err = binary.Write(&buf, binary.BigEndian, uint16(len(lbl)))
+		if err != nil {
+			return 0, err
+		}
+		buf.WriteString(lbl)
+	}
+
+	err = binary.Write(&buf, binary.BigEndian, uint32(len(nodes)))
+	if err != nil {
+		return 0, err
+	}
+	for _, n := range nodes {
+		err = binary.Write(&buf, binary.BigEndian, n.id)
+		if err != nil {
+			return 0, err
+		}
+		err = n.write(&buf)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %v", graphie.ErrInvalidAttr, err)
+		}
+	}
+
+	pos, err := s.log.append(buf.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	s.pendingLabels = s.pendingLabels[:0]
+
+	s.seq++
+	for _, n := range nodes {
+		n.seq = s.seq
+	}
+	return pos, nil
+}
+
+// applyLogRecord puts the labels and nodes of a commit log record into the
+// current memtable.
+func (s *storage) applyLogRecord(payload []byte) error {
+	r := bytes.NewReader(payload)
+
+	var labelCount uint16
+	err := binary.Read(r, binary.BigEndian, &labelCount)
+	if err != nil {
+		return ErrCorruptCommitlog
+	}
+	for i := uint16(0); i < labelCount; i++ {
+		var hdr [2]uint16
+		err = binary.Read(r, binary.BigEndian, &hdr)
+		if err != nil {
+			return ErrCorruptCommitlog
+		}
+		name := make([]byte, hdr[1])
+		_, err = io.ReadFull(r, name)
+		if err != nil {
+			return ErrCorruptCommitlog
+		}
+		s.labelIndex[string(name)] = hdr[0]
+		s.labelNames[hdr[0]] = string(name)
+		if hdr[0] > s.counterLabels {
+			s.counterLabels = hdr[0]
+		}
+	}
+
+	s.seq++
+
+	var nodeCount uint32
+	err = binary.Read(r, binary.BigEndian, &nodeCount)
+	if err != nil {
+		return ErrCorruptCommitlog
+	}
+	for i := uint32(0); i < nodeCount; i++ {
+		n := &node{
+			s: s,
+		}
+		err = binary.Read(r, binary.BigEndian, &n.id)
+		if err != nil {
+			return ErrCorruptCommitlog
+		}
+		err = n.read(r)
+		if err != nil {
+			return ErrCorruptCommitlog
+		}
+		n.seq = s.seq
+		s.put(n)
+		if n.id > s.counterNodes {
+			s.counterNodes = n.id
+		}
+		for _, lnk := range n.linksOut {
+			if lnk.id > s.counterEdges {
+				s.counterEdges = lnk.id
+			}
+		}
+	}
+
+	return nil
+}
+
+// syncDir makes changes of directory entries (new, renamed or removed files)
+// durable.
+func syncDir(path string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = fd.Sync()
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
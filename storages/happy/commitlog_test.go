@@ -0,0 +1,50 @@
+package happy
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestCommitlogTornWrite makes sure a record written partially doesn't hide
+// the records appended after it from replay.
+func TestCommitlogTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	l, err := openCommitLog(dir, syncAlways, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.append([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A write failing after the header and some of the payload
+	l.lock.Lock()
+	if _, err := l.fd.Write([]byte{0, 0, 0, 10, 1, 2, 3, 4, 's', 'e'}); err != nil {
+		t.Fatal(err)
+	}
+	l.truncate()
+	l.lock.Unlock()
+	if l.err != nil {
+		t.Fatal(l.err)
+	}
+
+	if _, err := l.append([]byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	filename := l.current()
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []string
+	err = replaySegment(filename, func(payload []byte) error {
+		records = append(records, string(payload))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"first", "second"}; !reflect.DeepEqual(records, want) {
+		t.Errorf("replayed %q, want %q", records, want)
+	}
+}
@@ -0,0 +1,271 @@
+package happy
+
+import (
+	"os"
+	"sort"
+)
+
+const (
+	// Compact as soon as there's a run of at least this many tables (see
+	// pickCompaction)
+	compactionTrigger = 4
+)
+
+// compactor runs in the background and merges nodetables whenever it's
+// notified through s.compactionChan. An error stops the compaction for good;
+// it's reported by all following mutations and by Stop.
+func (s *storage) compactor() {
+	defer close(s.compactorDone)
+
+	for range s.compactionChan {
+		for s.failure() == nil {
+			compacted, err := s.compact()
+			if err != nil {
+				s.fail(err)
+				break
+			}
+			if !compacted {
+				break
+			}
+		}
+	}
+}
+
+// triggerCompaction notifies the compactor without blocking
+func (s *storage) triggerCompaction() {
+	select {
+	case s.compactionChan <- struct{}{}:
+	default:
+		// The compactor has a pending notification already
+	}
+}
+
+// pickCompaction returns a run of adjacent tables (newest first, like
+// s.tables) which should be merged or nil if there's nothing to do. Merging
+// adjacent tables only keeps the order of all versions of a node intact.
+//
+// The tables are merged in tiers: a run is extended by the next older table
+// as long as that one isn't larger than the whole run, so tables of similar
+// size are merged into the next larger size class. Without a run of
+// compactionTrigger tables, the tables grow geometrically from the newest to
+// the oldest one; the number of tables and the number of times a node is
+// rewritten stay logarithmic in the size of the database. Tables smaller than
+// a full memtable count as full ones.
+//
+// s.lock must be held outside (at least for reading).
+func (s *storage) pickCompaction() nodetables {
+	size := func(nt *nodetable) int64 {
+		if nt.count < int64(s.opts.memtable) {
+			return int64(s.opts.memtable)
+		}
+		return nt.count
+	}
+
+	for start := 0; start < len(s.tables); start++ {
+		nodes := size(s.tables[start])
+		end := start + 1
+		for end < len(s.tables) && size(s.tables[end]) <= nodes {
+			nodes += size(s.tables[end])
+			end++
+		}
+		if end-start >= compactionTrigger {
+			run := make(nodetables, end-start)
+			copy(run, s.tables[start:end])
+			return run
+		}
+	}
+	return nil
+}
+
+// A tableCursor walks the index of a nodetable in the order of the ids.
+type tableCursor struct {
+	nt     *nodetable
+	i      int64
+	id     uint64
+	offset int64
+	done   bool
+}
+
+func (c *tableCursor) next() error {
+	if c.i >= c.nt.count {
+		c.done = true
+		return nil
+	}
+	var err error
+	c.id, c.offset, err = c.nt.entry(c.i)
+	c.i++
+	return err
+}
+
+// compact merges one run of tables into a single new one. Only the newest
+// version of every node is kept. The merged table gets the creation date of
+// the newest table in the run, so it takes exactly the run's place in the
+// order of all tables. The tables are merged by id, so only one node of every
+// table is in memory at a time.
+func (s *storage) compact() (bool, error) {
+	s.lock.RLock()
+	run := s.pickCompaction()
+	// Tombstones can only be dropped if there's no older table outside of the
+	// run which still holds a version of the node
+	includesOldest := len(run) > 0 && run[len(run)-1] == s.tables[len(s.tables)-1]
+	// Rebuild the attribute indexes; the ones of the old tables point to
+	// outdated versions
+	keys := s.indexes.copy()
+	s.lock.RUnlock()
+
+	if run == nil {
+		return false, nil
+	}
+
+	// The tables are immutable and only the compactor removes tables, so they
+	// can be read without holding s.lock
+	filename, err := s.nodetableFilename()
+	if err != nil {
+		return false, err
+	}
+	nodes := int64(0)
+	for _, nt := range run {
+		nodes += nt.count
+	}
+	w, err := newNodetableWriter(filename, run[0].created, int(nodes), keys)
+	if err != nil {
+		return false, err
+	}
+	err = mergeTables(run, func(n *node) error {
+		if n.deleted && includesOldest {
+			return nil
+		}
+		return w.add(n)
+	})
+	if err != nil {
+		w.abort()
+		return false, err
+	}
+
+	// Nothing but tombstones left; the run can simply be dropped
+	var nt *nodetable
+	if w.count() > 0 {
+		nt, err = w.finish()
+		if err != nil {
+			return false, err
+		}
+	} else {
+		w.abort()
+	}
+
+	obsolete := make(map[*nodetable]struct{}, len(run))
+	for _, old := range run {
+		obsolete[old] = struct{}{}
+	}
+
+	s.lock.Lock()
+	if nt != nil {
+		// Indexes might have been declared in the meantime
+		err := nt.ensureIndex(s.indexes)
+		if err != nil {
+			s.lock.Unlock()
+			return false, err
+		}
+	}
+	tables := make(nodetables, 0, len(s.tables)-len(run)+1)
+	for _, old := range s.tables {
+		if _, has := obsolete[old]; !has {
+			tables = append(tables, old)
+		}
+	}
+	if nt != nil {
+		tables = append(tables, nt)
+	}
+	s.tables = tables
+	sort.Sort(s.tables)
+
+	// From now on the merged table replaces the old ones, even after a crash
+	err = s.writeManifest()
+
+	// Tables still used by snapshots are dropped once they're released
+	drop := make(nodetables, 0, len(run))
+	for _, old := range run {
+		if old.pins > 0 {
+			old.obsolete = true
+			continue
+		}
+		drop = append(drop, old)
+	}
+	s.lock.Unlock()
+	if err != nil {
+		return false, err
+	}
+
+	for _, old := range drop {
+		err = old.drop()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, syncDir(s.path)
+}
+
+// mergeTables calls fn for the newest version of every node in the tables
+// (newest first) in the order of the ids.
+func mergeTables(tables nodetables, fn func(n *node) error) error {
+	cursors := make([]*tableCursor, 0, len(tables))
+	for _, nt := range tables {
+		c := &tableCursor{nt: nt}
+		if err := c.next(); err != nil {
+			return err
+		}
+		cursors = append(cursors, c)
+	}
+
+	for {
+		// The newest table holding the smallest id has the newest version
+		var newest *tableCursor
+		for _, c := range cursors {
+			if !c.done && (newest == nil || c.id < newest.id) {
+				newest = c
+			}
+		}
+		if newest == nil {
+			return nil
+		}
+
+		n, err := newest.nt.readNode(newest.id, newest.offset)
+		if err != nil {
+			return err
+		}
+		id := newest.id
+		for _, c := range cursors {
+			if !c.done && c.id == id {
+				if err := c.next(); err != nil {
+					return err
+				}
+			}
+		}
+
+		err = fn(n)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// drop closes and removes a table which isn't part of the database anymore.
+func (nt *nodetable) drop() error {
+	// Wait for readers which found the table before it was replaced
+	nt.refs.Wait()
+
+	err := nt.close()
+	if err != nil {
+		return err
+	}
+	err = os.Remove(nt.filename)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(indexFilename(nt.filename))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package happy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flosch/graphie"
+)
+
+func TestPickCompaction(t *testing.T) {
+	tests := []struct {
+		counts []int64 // newest first
+		want   []int   // indexes of the run
+	}{
+		{[]int64{10, 10, 10}, nil},
+		{[]int64{10, 10, 10, 10}, []int{0, 1, 2, 3}},
+		{[]int64{1, 3, 10, 2}, []int{0, 1, 2, 3}}, // small tables count as full ones
+		{[]int64{10, 10, 10, 30, 60}, []int{0, 1, 2, 3, 4}},
+		{[]int64{10, 10, 10, 40, 80}, nil}, // tables growing geometrically stay
+		{[]int64{10, 40, 10, 10, 10, 160}, []int{1, 2, 3, 4}},
+		{[]int64{10, 40, 40, 40, 40, 160}, []int{1, 2, 3, 4, 5}},
+	}
+	for _, test := range tests {
+		s := &storage{opts: &options{memtable: 10}}
+		for i, count := range test.counts {
+			s.tables = append(s.tables, &nodetable{count: count, created: uint64(len(test.counts) - i)})
+		}
+
+		run := s.pickCompaction()
+		var got []int
+		for _, nt := range run {
+			for i, other := range s.tables {
+				if nt == other {
+					got = append(got, i)
+				}
+			}
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("pickCompaction(%v) = %v, want %v", test.counts, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("pickCompaction(%v) = %v, want %v", test.counts, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+// TestCompaction writes versions of nodes to several tables and checks that
+// only the newest ones survive the compaction.
+func TestCompaction(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *storage {
+		st, err := registerHappy(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := st.(*storage)
+		if err := s.Start(dir, ""); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	s := open()
+	var ids, live []graphie.NodeID
+	for round := 0; round < compactionTrigger; round++ {
+		id, err := s.Add([]string{"n"}, graphie.Attrs{"round": round})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		live = append(live, id)
+		for _, id := range live {
+			if err := s.Set(id, "last", round); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if round == 1 {
+			if err := s.Remove(ids[0]); err != nil {
+				t.Fatal(err)
+			}
+			live = live[1:]
+		}
+		if err := s.memtableFlush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The compaction is triggered when the tables are opened
+	s = open()
+	defer s.Stop()
+	for i := 0; ; i++ {
+		s.lock.RLock()
+		tables := len(s.tables)
+		s.lock.RUnlock()
+		if tables == 1 {
+			break
+		}
+		if i == 500 {
+			t.Fatalf("%d tables left after the compaction, want 1", tables)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := s.Attrs(ids[0]); err != ErrNotFound {
+		t.Fatalf("Attrs of a removed node returned %v, want ErrNotFound", err)
+	}
+	for round, id := range ids[1:] {
+		attrs, err := s.Attrs(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := graphie.Attrs{"round": round + 1, "last": compactionTrigger - 1}
+		if !attrs.Match(want) || len(attrs) != len(want) {
+			t.Fatalf("Node %d has %v, want %v", id, attrs, want)
+		}
+	}
+	if _, err := s.getVersion(ids[0]); err != ErrNotFound {
+		t.Fatalf("The tombstone survived the compaction of all tables (%v)", err)
+	}
+}
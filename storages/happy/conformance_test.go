@@ -0,0 +1,30 @@
+package happy
+
+import (
+	"testing"
+
+	"github.com/flosch/graphie/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Suite{
+		Driver: "happy",
+		DriverAttrs: func(t *testing.T) string {
+			return t.TempDir()
+		},
+		Persistent: true,
+	})
+}
+
+// TestConformanceSmallMemtable runs the suite with a memtable which is flushed
+// every few mutations, so most reads go to the nodetables and compaction runs
+// along.
+func TestConformanceSmallMemtable(t *testing.T) {
+	storagetest.Run(t, storagetest.Suite{
+		Driver: "happy",
+		DriverAttrs: func(t *testing.T) string {
+			return t.TempDir() + "?memtable=8"
+		},
+		Persistent: true,
+	})
+}
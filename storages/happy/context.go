@@ -0,0 +1,164 @@
+package happy
+
+import (
+	"context"
+
+	"github.com/flosch/graphie"
+)
+
+// The scans (FindByAttr, WalkNodes, Merge and EnsureUnique without index)
+// and the link walks check ctx for every node or link. All other operations
+// only check ctx before they start; they are short and mutations must not be
+// left half-done.
+
+func (s *storage) LabelsContext(ctx context.Context, id graphie.NodeID) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Labels(id)
+}
+
+func (s *storage) InContext(ctx context.Context, id graphie.NodeID) ([]*graphie.Link, error) {
+	links := make([]*graphie.Link, 0)
+	err := s.WalkInContext(ctx, id, func(l *graphie.Link) error {
+		links = append(links, l)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (s *storage) OutContext(ctx context.Context, id graphie.NodeID) ([]*graphie.Link, error) {
+	links := make([]*graphie.Link, 0)
+	err := s.WalkOutContext(ctx, id, func(l *graphie.Link) error {
+		links = append(links, l)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (s *storage) WalkInContext(ctx context.Context, id graphie.NodeID, fn func(l *graphie.Link) error) error {
+	return s.walkLinks(ctx, id, false, nil, fn)
+}
+
+func (s *storage) WalkOutContext(ctx context.Context, id graphie.NodeID, fn func(l *graphie.Link) error) error {
+	return s.walkLinks(ctx, id, true, nil, fn)
+}
+
+func (s *storage) WalkInTypesContext(ctx context.Context, id graphie.NodeID, types []string, fn func(l *graphie.Link) error) error {
+	return s.walkLinks(ctx, id, false, types, fn)
+}
+
+func (s *storage) WalkOutTypesContext(ctx context.Context, id graphie.NodeID, types []string, fn func(l *graphie.Link) error) error {
+	return s.walkLinks(ctx, id, true, types, fn)
+}
+
+func (s *storage) GetEdgeContext(ctx context.Context, id graphie.EdgeID) (*graphie.Edge, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GetEdge(id)
+}
+
+func (s *storage) GetContext(ctx context.Context, id graphie.NodeID, key string) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Get(id, key)
+}
+
+func (s *storage) HasContext(ctx context.Context, id graphie.NodeID, key string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return s.Has(id, key)
+}
+
+func (s *storage) AttrsContext(ctx context.Context, id graphie.NodeID) (graphie.Attrs, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Attrs(id)
+}
+
+func (s *storage) EnsureIndexNodesContext(ctx context.Context, labels []string, attrName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.EnsureIndexNodes(labels, attrName)
+}
+
+func (s *storage) EnsureIndexLinksContext(ctx context.Context, labels []string, attrName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.EnsureIndexLinks(labels, attrName)
+}
+
+func (s *storage) AddContext(ctx context.Context, labels []string, attrs graphie.Attrs) (graphie.NodeID, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.Add(labels, attrs)
+}
+
+func (s *storage) LinkContext(ctx context.Context, from, to graphie.NodeID, typ string, attrs graphie.Attrs) (graphie.EdgeID, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.Link(from, to, typ, attrs)
+}
+
+func (s *storage) UnlinkContext(ctx context.Context, from, to graphie.NodeID, attrs graphie.Attrs) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.Unlink(from, to, attrs)
+}
+
+func (s *storage) RemoveContext(ctx context.Context, id graphie.NodeID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Remove(id)
+}
+
+func (s *storage) AddLabelContext(ctx context.Context, id graphie.NodeID, label string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.AddLabel(id, label)
+}
+
+func (s *storage) RemoveLabelContext(ctx context.Context, id graphie.NodeID, label string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.RemoveLabel(id, label)
+}
+
+func (s *storage) SetContext(ctx context.Context, id graphie.NodeID, key string, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Set(id, key, value)
+}
+
+func (s *storage) SetEdgeAttrContext(ctx context.Context, id graphie.EdgeID, key string, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.SetEdgeAttr(id, key, value)
+}
+
+func (s *storage) RemoveEdgeContext(ctx context.Context, id graphie.EdgeID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.RemoveEdge(id)
+}
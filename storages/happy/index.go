@@ -1 +1,692 @@
 package happy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/flosch/graphie"
+	"github.com/vmihailenco/msgpack"
+)
+
+const (
+	indexExtension = ".idx"
+)
+
+// labelAttrs maps label ids to a set of attributes; used for the declared
+// key and unique attributes.
+type labelAttrs map[uint16]map[string]struct{}
+
+func (la labelAttrs) add(lid uint16, attr string) bool {
+	attrs, has := la[lid]
+	if !has {
+		attrs = make(map[string]struct{})
+		la[lid] = attrs
+	}
+	if _, has := attrs[attr]; has {
+		return false
+	}
+	attrs[attr] = struct{}{}
+	return true
+}
+
+func (la labelAttrs) has(lid uint16, attr string) bool {
+	_, has := la[lid][attr]
+	return has
+}
+
+// attrIndex maps the values of one attribute to the nodes (or links) having
+// it.
+type attrIndex map[interface{}]map[uint64]struct{} // value -> node ids
+
+func (idx attrIndex) add(id uint64, value interface{}) {
+	key := graphie.ValueKey(value)
+	ids, has := idx[key]
+	if !has {
+		ids = make(map[uint64]struct{})
+		idx[key] = ids
+	}
+	ids[id] = struct{}{}
+}
+
+func (idx attrIndex) lookup(value interface{}) map[uint64]struct{} {
+	return idx[graphie.ValueKey(value)]
+}
+
+// indexKey identifies the index of one attribute of all nodes carrying a
+// label or, if links is set, of all links starting at them.
+type indexKey struct {
+	label uint16
+	attr  string
+	links bool
+}
+
+// edgeKey is the index of the out-links of a memtable mapping their ids to
+// the from-nodes (see findEdge); nodetables store them on disk. Label ids
+// start at 1, so it can't be taken by a declared index.
+var edgeKey = indexKey{0, "", false}
+
+// indexKeys is a set of declared indexes
+type indexKeys map[indexKey]struct{}
+
+func (ks indexKeys) copy() indexKeys {
+	c := make(indexKeys, len(ks))
+	for k := range ks {
+		c[k] = struct{}{}
+	}
+	return c
+}
+
+// A tableIndex holds the attribute indexes of the nodes in a memtable. Entries
+// are never removed; a node's newer version might live in another table, so
+// every hit has to be checked against the newest version.
+type tableIndex map[indexKey]attrIndex
+
+// newTableIndex returns a tableIndex with an (empty) index for every key.
+func newTableIndex(keys indexKeys) tableIndex {
+	ti := make(tableIndex, len(keys))
+	for k := range keys {
+		ti[k] = make(attrIndex)
+	}
+	return ti
+}
+
+func (ti tableIndex) index(k indexKey) attrIndex {
+	idx, has := ti[k]
+	if !has {
+		idx = make(attrIndex)
+		ti[k] = idx
+	}
+	return idx
+}
+
+// add indexes all attributes of n and its out-links declared in keys.
+func (ti tableIndex) add(n *node, keys indexKeys) {
+	if n.deleted {
+		return
+	}
+	for k := range keys {
+		if !n.hasLabels([]uint16{k.label}) {
+			continue
+		}
+		if !k.links {
+			if v, has := n.attrs[k.attr]; has {
+				ti.index(k).add(n.id, v)
+			}
+			continue
+		}
+		for _, lnk := range n.linksOut {
+			if v, has := lnk.attrs[k.attr]; has {
+				ti.index(k).add(lnk.id, v)
+			}
+		}
+	}
+}
+
+// addLinks indexes the out-links of n in the edge index.
+func (ti tableIndex) addLinks(n *node) {
+	if n.deleted {
+		return
+	}
+	for _, lnk := range n.linksOut {
+		ti.index(edgeKey).add(n.id, lnk.id)
+	}
+}
+
+// buildTableIndex indexes all nodes passed to fn by each; there's an (empty)
+// index for every key, even if no node has the attribute.
+func buildTableIndex(each func(fn func(n *node) error) error, keys indexKeys) (tableIndex, error) {
+	ti := newTableIndex(keys)
+	err := each(func(n *node) error {
+		ti.add(n, keys)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ti, nil
+}
+
+// An indexRun holds attribute indexes on disk, either as a section of a
+// nodetable or in the index file next to it. Its layout is:
+//
+//	keys: count (uint32) | count * (label id (uint16) | links (uint8) | attr length (uint16) | attr)
+//	entries: count (uint64) | count * offset (uint64) | count * (key length (uint32) | key | id (uint64))
+//
+// The keys list the indexes of the run, even the empty ones. The key of an
+// entry is the encoded index key followed by the msgpack encoding of
+// graphie.ValueKey of the value (see runKey). The offsets of the entries are
+// relative to the start of the run and sorted by the key and the id of their
+// entry, so the ids having a value are found by a binary search.
+//
+// All integers are stored in big endian.
+type indexRun struct {
+	r       io.ReaderAt
+	start   int64
+	size    int64
+	keys    indexKeys
+	count   int64
+	offsets int64 // position of the offsets relative to start
+}
+
+// encodeIndexKey appends the encoding of k to buf
+func encodeIndexKey(buf []byte, k indexKey) []byte {
+	var links byte
+	if k.links {
+		links = 1
+	}
+	buf = append(buf, byte(k.label>>8), byte(k.label), links, byte(len(k.attr)>>8), byte(len(k.attr)))
+	return append(buf, k.attr...)
+}
+
+// runKey returns the key of the entries of the index k having value
+func runKey(k indexKey, value interface{}) ([]byte, error) {
+	v, err := msgpack.Marshal(graphie.ValueKey(value))
+	if err != nil {
+		return nil, err
+	}
+	return append(encodeIndexKey(nil, k), v...), nil
+}
+
+// writeIndexRun writes all indexes of ti but the edge index as run
+func writeIndexRun(w io.Writer, ti tableIndex) error {
+	type entry struct {
+		key []byte
+		id  uint64
+	}
+
+	var header []byte
+	keys := 0
+	var entries []entry
+	for k, idx := range ti {
+		if k == edgeKey {
+			continue
+		}
+		if len(k.attr) > math.MaxUint16 {
+			return fmt.Errorf("Attribute name too long to be indexed: %.32s...", k.attr)
+		}
+		header = encodeIndexKey(header, k)
+		keys++
+		for v, ids := range idx {
+			key, err := runKey(k, v)
+			if err != nil {
+				return err
+			}
+			for id := range ids {
+				entries = append(entries, entry{key, id})
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if c := bytes.Compare(entries[i].key, entries[j].key); c != 0 {
+			return c < 0
+		}
+		return entries[i].id < entries[j].id
+	})
+
+	err := binary.Write(w, binary.BigEndian, uint32(keys))
+	if err == nil {
+		_, err = w.Write(header)
+	}
+	if err == nil {
+		err = binary.Write(w, binary.BigEndian, uint64(len(entries)))
+	}
+	offset := uint64(4 + len(header) + 8 + 8*len(entries))
+	for i := 0; err == nil && i < len(entries); i++ {
+		err = binary.Write(w, binary.BigEndian, offset)
+		offset += uint64(4 + len(entries[i].key) + 8)
+	}
+	for i := 0; err == nil && i < len(entries); i++ {
+		err = binary.Write(w, binary.BigEndian, uint32(len(entries[i].key)))
+		if err == nil {
+			_, err = w.Write(entries[i].key)
+		}
+		if err == nil {
+			err = binary.Write(w, binary.BigEndian, entries[i].id)
+		}
+	}
+	return err
+}
+
+// readIndexRun reads the keys of the run of size bytes at start; the entries
+// stay on disk.
+func readIndexRun(r io.ReaderAt, start, size int64) (*indexRun, error) {
+	cr := &countingReader{r: bufio.NewReader(io.NewSectionReader(r, start, size))}
+
+	var count uint32
+	err := binary.Read(cr, binary.BigEndian, &count)
+	if err != nil {
+		return nil, ErrCorruptNodetable
+	}
+	run := &indexRun{
+		r:     r,
+		start: start,
+		size:  size,
+		keys:  make(indexKeys, count),
+	}
+	for i := uint32(0); i < count; i++ {
+		var head [5]byte
+		_, err = io.ReadFull(cr, head[:])
+		if err != nil {
+			return nil, ErrCorruptNodetable
+		}
+		attr := make([]byte, binary.BigEndian.Uint16(head[3:]))
+		_, err = io.ReadFull(cr, attr)
+		if err != nil {
+			return nil, ErrCorruptNodetable
+		}
+		run.keys[indexKey{binary.BigEndian.Uint16(head[:2]), string(attr), head[2] == 1}] = struct{}{}
+	}
+
+	var entries uint64
+	err = binary.Read(cr, binary.BigEndian, &entries)
+	if err != nil || entries > uint64(size) {
+		return nil, ErrCorruptNodetable
+	}
+	run.count = int64(entries)
+	run.offsets = cr.n
+	if run.offsets+run.count*8 > size {
+		return nil, ErrCorruptNodetable
+	}
+	return run, nil
+}
+
+// countingReader counts the bytes read
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// entry reads the key and the id of the i-th entry
+func (run *indexRun) entry(i int64) ([]byte, uint64, error) {
+	var buf [8]byte
+	_, err := run.r.ReadAt(buf[:], run.start+run.offsets+i*8)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset := int64(binary.BigEndian.Uint64(buf[:]))
+	if offset < run.offsets || offset+4 > run.size {
+		return nil, 0, ErrCorruptNodetable
+	}
+	_, err = run.r.ReadAt(buf[:4], run.start+offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	length := int64(binary.BigEndian.Uint32(buf[:4]))
+	if offset+4+length+8 > run.size {
+		return nil, 0, ErrCorruptNodetable
+	}
+	entry := make([]byte, length+8)
+	_, err = run.r.ReadAt(entry, run.start+offset+4)
+	if err != nil {
+		return nil, 0, err
+	}
+	return entry[:length], binary.BigEndian.Uint64(entry[length:]), nil
+}
+
+// lookup calls fn for the ids of all entries of the index k having value. It
+// reports whether the run holds the index at all.
+func (run *indexRun) lookup(k indexKey, value interface{}, fn func(id uint64)) (bool, error) {
+	if _, has := run.keys[k]; !has {
+		return false, nil
+	}
+	key, err := runKey(k, value)
+	if err != nil {
+		return true, err
+	}
+
+	i := sort.Search(int(run.count), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		entryKey, _, e := run.entry(int64(i))
+		if e != nil {
+			err = e
+			return true
+		}
+		return bytes.Compare(entryKey, key) >= 0
+	})
+	for j := int64(i); err == nil && j < run.count; j++ {
+		entryKey, id, e := run.entry(j)
+		if e != nil {
+			return true, e
+		}
+		if !bytes.Equal(entryKey, key) {
+			break
+		}
+		fn(id)
+	}
+	return true, err
+}
+
+func indexFilename(nodetableFilename string) string {
+	return strings.TrimSuffix(nodetableFilename, nodetableExtension) + indexExtension
+}
+
+// indexed reports whether the nodetable holds the index k
+func (nt *nodetable) indexed(k indexKey) bool {
+	if _, has := nt.indexes.keys[k]; has {
+		return true
+	}
+	if nt.extraIndexes != nil {
+		_, has := nt.extraIndexes.keys[k]
+		return has
+	}
+	return false
+}
+
+// lookupIndex calls fn for the ids of all nodes (or links) having value in
+// the index k of the nodetable.
+func (nt *nodetable) lookupIndex(k indexKey, value interface{}, fn func(id uint64)) error {
+	found, err := nt.indexes.lookup(k, value, fn)
+	if err != nil || found || nt.extraIndexes == nil {
+		return err
+	}
+	_, err = nt.extraIndexes.lookup(k, value, fn)
+	return err
+}
+
+// writeIndex stores the indexes declared after the nodetable was written in
+// the index file next to it. The index file is not crucial, it's rebuilt when
+// it's missing or broken.
+//
+// Does not hold s.lock; must be held outside (or the table is not in use yet)
+func (nt *nodetable) writeIndex(ti tableIndex) error {
+	filename := indexFilename(nt.filename)
+	tmpFilename := filename + ".tmp"
+	fd, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(fd)
+	err = writeIndexRun(bw, ti)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+
+	err = os.Rename(tmpFilename, filename)
+	if err != nil {
+		return err
+	}
+	return nt.readIndex()
+}
+
+// readIndex opens the index file of the nodetable; a missing or broken index
+// file leaves the nodetable with the indexes written with it only.
+//
+// Does not hold s.lock; must be held outside (or the table is not in use yet)
+func (nt *nodetable) readIndex() error {
+	fd, err := os.Open(indexFilename(nt.filename))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	run, err := readIndexRun(fd, 0, fi.Size())
+	if err != nil {
+		fd.Close()
+		return nil
+	}
+
+	if nt.extraFd != nil {
+		nt.extraFd.Close()
+	}
+	nt.extraFd, nt.extraIndexes = fd, run
+	return nil
+}
+
+// ensureIndex builds the missing indexes of the nodetable. They're written to
+// the index file along with the ones it holds already.
+//
+// Does not hold s.lock; must be held outside (or the table is not in use yet)
+func (nt *nodetable) ensureIndex(keys indexKeys) error {
+	extra := make(indexKeys)
+	for k := range keys {
+		if !nt.indexed(k) {
+			extra[k] = struct{}{}
+		}
+	}
+	if len(extra) == 0 {
+		return nil
+	}
+	if nt.extraIndexes != nil {
+		for k := range nt.extraIndexes.keys {
+			extra[k] = struct{}{}
+		}
+	}
+
+	ti, err := buildTableIndex(nt.each, extra)
+	if err != nil {
+		return err
+	}
+	return nt.writeIndex(ti)
+}
+
+// labelIDs maps label names to their ids. If one of the labels is unknown, no
+// node carries it.
+//
+// Does not hold s.lock; must be held outside
+func (s *storage) labelIDs(labels []string) ([]uint16, bool) {
+	lids := make([]uint16, 0, len(labels))
+	for _, lbl := range labels {
+		lid, has := s.labelIndex[lbl]
+		if !has {
+			return nil, false
+		}
+		lids = append(lids, lid)
+	}
+	return lids, true
+}
+
+// ensureIndex declares the indexes of attr for all labels and builds the
+// missing ones; the attribute of the nodes is a key attribute, too (see
+// Merge). It reports whether anything changed.
+//
+// Does not hold s.lock; must be held outside
+func (s *storage) ensureIndex(labels []string, attr string, links bool) (bool, error) {
+	added := make(indexKeys)
+	for _, lbl := range labels {
+		k := indexKey{s.labelindex(lbl), attr, links}
+		if _, has := s.indexes[k]; has {
+			continue
+		}
+		s.indexes[k] = struct{}{}
+		if !links {
+			s.keys.add(k.label, attr)
+		}
+		added[k] = struct{}{}
+	}
+	if len(added) == 0 {
+		return false, nil
+	}
+
+	for _, n := range s.memtable {
+		s.memtableIndex.add(n, added)
+	}
+	s.memtableQueueLock.Lock()
+	for f := s.memtableQueue.Front(); f != nil; f = f.Next() {
+		m := f.Value.(*frozenMemtable)
+		for _, n := range m.nodes {
+			m.index.add(n, added)
+		}
+	}
+	s.memtableQueueLock.Unlock()
+
+	for _, nt := range s.tables {
+		err := nt.ensureIndex(s.indexes)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// findByAttr returns the ids of all nodes carrying all labels whose attribute
+// attr equals value, sorted by id. It uses the indexes of the first label
+// with attr declared as key, otherwise it scans the whole database.
+//
+// Does not hold s.lock; must be held outside
+func (s *storage) findByAttr(ctx context.Context, lids []uint16, attr string, value interface{}) ([]uint64, error) {
+	ids := make(uint64s, 0)
+	match := func(n *node) bool {
+		v, has := n.attrs[attr]
+		return has && graphie.ValueEqual(v, value) && n.hasLabels(lids)
+	}
+
+	var k *indexKey
+	for _, lid := range lids {
+		if s.keys.has(lid, attr) {
+			k = &indexKey{lid, attr, false}
+			break
+		}
+	}
+	if k == nil {
+		err := s.scan(ctx, func(n *node) error {
+			if match(n) {
+				ids = append(ids, n.id)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.Sort(ids)
+		return ids, nil
+	}
+
+	// The hits might be outdated by newer versions
+	candidates, err := s.lookupIndex(*k, value)
+	if err != nil {
+		return nil, err
+	}
+	for id := range candidates {
+		n, err := s.getRaw(graphie.NodeID(id))
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if match(n) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(ids)
+	return ids, nil
+}
+
+// lookupIndex returns the ids of all nodes (or links) having value in the
+// index k of one of the tables.
+//
+// Does not hold s.lock; must be held outside
+func (s *storage) lookupIndex(k indexKey, value interface{}) (map[uint64]struct{}, error) {
+	candidates := make(map[uint64]struct{})
+	add := func(id uint64) {
+		candidates[id] = struct{}{}
+	}
+	collect := func(ti tableIndex) {
+		for id := range ti[k].lookup(value) {
+			add(id)
+		}
+	}
+	collect(s.memtableIndex)
+	s.memtableQueueLock.Lock()
+	for f := s.memtableQueue.Front(); f != nil; f = f.Next() {
+		collect(f.Value.(*frozenMemtable).index)
+	}
+	s.memtableQueueLock.Unlock()
+	for _, nt := range s.tables {
+		err := nt.lookupIndex(k, value, add)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return candidates, nil
+}
+
+// checkDuplicates fails if two nodes carrying the label lid have the same
+// value for attr.
+//
+// Does not hold s.lock; must be held outside
+func (s *storage) checkDuplicates(ctx context.Context, lid uint16, attr string) error {
+	values := make(map[interface{}]struct{})
+	return s.scan(ctx, func(n *node) error {
+		if !n.hasLabels([]uint16{lid}) {
+			return nil
+		}
+		v, has := n.attrs[attr]
+		if !has {
+			return nil
+		}
+		key := graphie.ValueKey(v)
+		if _, has := values[key]; has {
+			return &graphie.ConstraintViolationError{
+				Label: s.labelNames[lid],
+				Attr:  attr,
+				Value: v,
+			}
+		}
+		values[key] = struct{}{}
+		return nil
+	})
+}
+
+// checkUnique makes sure no node but id carrying one of the labels has one of
+// the unique attributes in attrs. Unique attributes are indexed, so there's
+// no scan to cancel.
+//
+// Does not hold s.lock; must be held outside
+func (s *storage) checkUnique(id uint64, labels []uint16, attrs graphie.Attrs) error {
+	for _, lid := range labels {
+		for attr := range s.uniques[lid] {
+			v, has := attrs[attr]
+			if !has {
+				continue
+			}
+			ids, err := s.findByAttr(context.Background(), []uint16{lid}, attr, v)
+			if err != nil {
+				return err
+			}
+			for _, other := range ids {
+				if other != id {
+					return &graphie.ConstraintViolationError{
+						Label: s.labelNames[lid],
+						Attr:  attr,
+						Value: v,
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
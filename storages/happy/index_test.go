@@ -0,0 +1,92 @@
+package happy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/flosch/graphie"
+)
+
+// TestIndexes makes sure the indexes are stored in the nodetables, the ones
+// declared later in the index files next to them, and both are searched.
+func TestIndexes(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *storage {
+		st, err := registerHappy(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := st.(*storage)
+		if err := s.Start(dir, ""); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	find := func(s *storage, attr string, value interface{}, want ...graphie.NodeID) {
+		t.Helper()
+		ids, err := s.FindByAttr([]string{"x"}, attr, value)
+		must(err)
+		if len(ids) != len(want) || (len(ids) > 0 && !reflect.DeepEqual(ids, want)) {
+			t.Errorf("FindByAttr(%s=%v) = %v, want %v", attr, value, ids, want)
+		}
+	}
+	links := func(s *storage, value interface{}) map[uint64]struct{} {
+		t.Helper()
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		ids, err := s.lookupIndex(indexKey{s.labelIndex["x"], "since", true}, value)
+		must(err)
+		return ids
+	}
+
+	s := open()
+	must(s.EnsureIndexNodes([]string{"x"}, "name"))
+	must(s.EnsureIndexLinks([]string{"x"}, "since"))
+	a, err := s.Add([]string{"x"}, graphie.Attrs{"name": "a", "age": 1})
+	must(err)
+	b, err := s.Add([]string{"x"}, graphie.Attrs{"name": "b", "age": 2})
+	must(err)
+	lnk, err := s.Link(a, b, "", graphie.Attrs{"since": 1845})
+	must(err)
+	must(s.Stop())
+
+	s = open()
+	if len(s.tables) != 1 {
+		t.Fatalf("%d tables, want 1", len(s.tables))
+	}
+	nt := s.tables[0]
+	if nt.extraIndexes != nil || len(nt.indexes.keys) != 2 || nt.indexes.count != 3 {
+		t.Fatalf("table holds %d entries of %d indexes", nt.indexes.count, len(nt.indexes.keys))
+	}
+	find(s, "name", "a", a)
+	find(s, "name", "c")
+	if _, has := links(s, 1845.0)[uint64(lnk)]; !has {
+		t.Errorf("link index doesn't hold link %d", lnk)
+	}
+
+	// Declared after the table was written
+	must(s.EnsureIndexNodes([]string{"x"}, "age"))
+	if nt.extraIndexes == nil || len(nt.extraIndexes.keys) != 1 {
+		t.Fatal("the index of age isn't stored next to the table")
+	}
+	find(s, "age", 2, b)
+	must(s.Set(b, "age", 3))
+	find(s, "age", 2)
+	find(s, "age", 3, b)
+	must(s.Stop())
+
+	s = open()
+	defer s.Stop()
+	if len(s.tables) != 2 || s.tables[1].extraIndexes == nil {
+		t.Fatal("the index file wasn't loaded")
+	}
+	find(s, "age", 1, a)
+	find(s, "age", 3, b)
+	find(s, "name", "b", b)
+}
@@ -0,0 +1,150 @@
+package happy
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+const (
+	manifestFilename = "MANIFEST"
+)
+
+// manifest holds the state of a database which isn't part of any nodetable.
+type manifest struct {
+	CounterNodes  uint64
+	CounterEdges  uint64
+	CounterLabels uint16
+	Labels        map[string]uint16
+	Keys          map[string][]string // label -> key attributes
+	LinkKeys      map[string][]string // label -> indexed link attributes
+	Uniques       map[string][]string // label -> unique attributes
+
+	// Filenames of all nodetables which are part of the database
+	Tables []string
+}
+
+// tableSet holds the nodetables listed in the manifest
+type tableSet map[string]struct{}
+
+func (ts tableSet) has(filename string) bool {
+	_, has := ts[filename]
+	return has
+}
+
+// Does not hold s.lock; must be held outside
+func (s *storage) writeManifest() error {
+	m := &manifest{
+		CounterNodes:  s.counterNodes,
+		CounterEdges:  s.counterEdges,
+		CounterLabels: s.counterLabels,
+		Labels:        s.labelIndex,
+		Keys:          make(map[string][]string, len(s.keys)),
+		Tables:        make([]string, 0, len(s.tables)),
+	}
+	for lbl, lid := range s.labelIndex {
+		for attr := range s.keys[lid] {
+			m.Keys[lbl] = append(m.Keys[lbl], attr)
+		}
+		for k := range s.indexes {
+			if k.links && k.label == lid {
+				if m.LinkKeys == nil {
+					m.LinkKeys = make(map[string][]string)
+				}
+				m.LinkKeys[lbl] = append(m.LinkKeys[lbl], k.attr)
+			}
+		}
+		for attr := range s.uniques[lid] {
+			if m.Uniques == nil {
+				m.Uniques = make(map[string][]string)
+			}
+			m.Uniques[lbl] = append(m.Uniques[lbl], attr)
+		}
+	}
+	for _, nt := range s.tables {
+		m.Tables = append(m.Tables, filepath.Base(nt.filename))
+	}
+
+	filename := filepath.Join(s.path, manifestFilename)
+	tmpFilename := filename + ".tmp"
+
+	fd, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(fd)
+	err = msgpack.NewEncoder(bw).Encode(m)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+
+	err = os.Rename(tmpFilename, filename)
+	if err != nil {
+		return err
+	}
+
+	// Callers remove files the old manifest needs (commit log segments or
+	// compacted tables) right after; the new one must be durable by then
+	return syncDir(s.path)
+}
+
+// readManifest restores the counters and the label dictionary. A missing
+// manifest is not an error (the database is new).
+func (s *storage) readManifest() error {
+	fd, err := os.Open(filepath.Join(s.path, manifestFilename))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	m := new(manifest)
+	err = msgpack.NewDecoder(bufio.NewReader(fd)).Decode(m)
+	if err != nil {
+		return err
+	}
+
+	s.counterNodes = m.CounterNodes
+	s.counterEdges = m.CounterEdges
+	s.counterLabels = m.CounterLabels
+	for lbl, lid := range m.Labels {
+		s.labelIndex[lbl] = lid
+		s.labelNames[lid] = lbl
+	}
+	for lbl, attrs := range m.Keys {
+		for _, attr := range attrs {
+			s.keys.add(s.labelIndex[lbl], attr)
+			s.indexes[indexKey{s.labelIndex[lbl], attr, false}] = struct{}{}
+		}
+	}
+	for lbl, attrs := range m.LinkKeys {
+		for _, attr := range attrs {
+			s.indexes[indexKey{s.labelIndex[lbl], attr, true}] = struct{}{}
+		}
+	}
+	for lbl, attrs := range m.Uniques {
+		for _, attr := range attrs {
+			s.uniques.add(s.labelIndex[lbl], attr)
+		}
+	}
+	s.manifestTables = make(tableSet, len(m.Tables))
+	for _, filename := range m.Tables {
+		s.manifestTables[filename] = struct{}{}
+	}
+
+	return nil
+}
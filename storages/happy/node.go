@@ -1,32 +1,159 @@
 package happy
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"sort"
 
 	"github.com/flosch/graphie"
 
 	"github.com/vmihailenco/msgpack"
 )
 
+// Both ends of a link have their own link with the same id, type and attrs.
+// The type is a label id (0 for untyped links).
 type link struct {
+	id    uint64
+	typ   uint16
 	other uint64
 	attrs graphie.Attrs
 }
 
+// A link is encoded as an array of its fields, so it's a single msgpack value
+// which can be skipped as a whole. The type isn't part of it; links are
+// written in groups of one type (see writeLinkGroups).
+func (l *link) EncodeMsgpack(enc *msgpack.Encoder) error {
+	err := enc.EncodeArrayLen(3)
+	if err != nil {
+		return err
+	}
+	return enc.EncodeMulti(l.id, l.other, l.attrs)
+}
+
+func (l *link) DecodeMsgpack(dec *msgpack.Decoder) error {
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return err
+	}
+	if n != 3 {
+		return fmt.Errorf("Invalid link (%d fields)", n)
+	}
+	return dec.DecodeMulti(&l.id, &l.other, &l.attrs)
+}
+
+const (
+	// A removed node; it shadows all older versions of the node
+	nodeFlagDeleted = 1 << iota
+)
+
+// copyAttrs makes sure the caller can't change attributes stored in the
+// memtable.
+func copyAttrs(attrs graphie.Attrs) graphie.Attrs {
+	if attrs == nil {
+		return nil
+	}
+	c := make(graphie.Attrs, len(attrs))
+	for k, v := range attrs {
+		c[k] = v
+	}
+	return c
+}
+
 type node struct {
-	s      *storage
-	id     uint64
-	labels []uint16
-	attrs  graphie.Attrs
+	s       *storage
+	id      uint64
+	deleted bool
+	labels  []uint16
+	attrs   graphie.Attrs
 
 	linksOut []*link
 	linksIn  []*link
+
+	// Versions in memory are stamped with the sequence number of their
+	// mutation; prev is the replaced version in the same memtable, kept for
+	// snapshots (see put)
+	seq  uint64
+	prev *node
+}
+
+// hasLabels reports whether the node carries all labels
+func (n *node) hasLabels(labels []uint16) bool {
+	for _, lid := range labels {
+		found := false
+		for _, l := range n.labels {
+			if l == lid {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// clone copies the node, so a new version can be written
+func (n *node) clone() *node {
+	c := &node{
+		s:        n.s,
+		id:       n.id,
+		attrs:    make(graphie.Attrs, len(n.attrs)),
+		linksOut: make([]*link, 0, len(n.linksOut)),
+		linksIn:  make([]*link, 0, len(n.linksIn)),
+		labels:   make([]uint16, len(n.labels)),
+	}
+	copy(c.labels, n.labels)
+
+	for _, lnk := range n.linksOut {
+		c.linksOut = append(c.linksOut, &link{
+			id:    lnk.id,
+			typ:   lnk.typ,
+			other: lnk.other,
+			attrs: lnk.attrs,
+		})
+	}
+
+	for _, lnk := range n.linksIn {
+		c.linksIn = append(c.linksIn, &link{
+			id:    lnk.id,
+			typ:   lnk.typ,
+			other: lnk.other,
+			attrs: lnk.attrs,
+		})
+	}
+
+	for k, v := range n.attrs {
+		c.attrs[k] = v
+	}
+
+	return c
+}
+
+// newTombstone returns the version of a node which marks it as removed
+func newTombstone(id uint64) *node {
+	return &node{
+		id:      id,
+		deleted: true,
+	}
 }
 
 func (n *node) write(w io.Writer) error {
+	// Write flags; tombstones don't have any other data
+	var flags uint8
+	if n.deleted {
+		flags |= nodeFlagDeleted
+	}
+	err := binary.Write(w, binary.BigEndian, flags)
+	if err != nil || n.deleted {
+		return err
+	}
+
 	// Write number of labels
-	err := binary.Write(w, binary.BigEndian, uint16(len(n.labels)))
+	err = binary.Write(w, binary.BigEndian, uint16(len(n.labels)))
 	if err != nil {
 		return err
 	}
@@ -52,7 +179,7 @@ func (n *node) write(w io.Writer) error {
 			return err
 		}
 	}*/
-	err = enc.Encode(n.linksOut)
+	err = writeLinkGroups(w, n.linksOut)
 	if err != nil {
 		return err
 	}
@@ -68,7 +195,7 @@ func (n *node) write(w io.Writer) error {
 			return err
 		}
 	}*/
-	err = enc.Encode(n.linksIn)
+	err = writeLinkGroups(w, n.linksIn)
 	if err != nil {
 		return err
 	}
@@ -82,50 +209,370 @@ func (n *node) write(w io.Writer) error {
 	return nil
 }
 
-func (n *node) writeNeighbours(w *bufferedWriteCounter, memtable map[uint64]*node, index map[uint64]int, todoList map[uint64]struct{}) error {
+// read decodes a node previously written by write. The id isn't part of the
+// record and must be set by the caller.
+func (n *node) read(r io.Reader) error {
+	var flags uint8
+	err := binary.Read(r, binary.BigEndian, &flags)
+	if err != nil {
+		return err
+	}
+	if flags&nodeFlagDeleted != 0 {
+		n.deleted = true
+		return nil
+	}
+
+	var count uint16
+	err = binary.Read(r, binary.BigEndian, &count)
+	if err != nil {
+		return err
+	}
+
+	n.labels = make([]uint16, count)
+	err = binary.Read(r, binary.BigEndian, n.labels)
+	if err != nil {
+		return err
+	}
+
+	n.linksOut, err = readLinkGroups(r)
+	if err != nil {
+		return err
+	}
+	n.linksIn, err = readLinkGroups(r)
+	if err != nil {
+		return err
+	}
+	return msgpack.NewDecoder(r).Decode(&n.attrs)
+}
+
+// A link group holds the links of one type; its header is followed by size
+// bytes holding the msgpack array of the links.
+type linkGroupHeader struct {
+	Type uint16
+	Size uint32
+}
+
+// writeLinkGroups writes the number of groups followed by the groups. The
+// links are sorted by type (see insertLink), so every type is one group.
+func writeLinkGroups(w io.Writer, links []*link) error {
+	var groups uint32
+	for i := range links {
+		if i == 0 || links[i].typ != links[i-1].typ {
+			groups++
+		}
+	}
+	err := binary.Write(w, binary.BigEndian, groups)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < len(links); {
+		j := i + 1
+		for j < len(links) && links[j].typ == links[i].typ {
+			j++
+		}
+
+		buf.Reset()
+		err = msgpack.NewEncoder(&buf).Encode(links[i:j])
+		if err != nil {
+			return err
+		}
+		err = binary.Write(w, binary.BigEndian, &linkGroupHeader{
+			Type: links[i].typ,
+			Size: uint32(buf.Len()),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(buf.Bytes())
+		if err != nil {
+			return err
+		}
+
+		i = j
+	}
+	return nil
+}
+
+// readLinkGroups reads the links written by writeLinkGroups
+func readLinkGroups(r io.Reader) ([]*link, error) {
+	var groups uint32
+	err := binary.Read(r, binary.BigEndian, &groups)
+	if err != nil {
+		return nil, err
+	}
+
+	links := make([]*link, 0)
+	for i := uint32(0); i < groups; i++ {
+		var hdr linkGroupHeader
+		err = binary.Read(r, binary.BigEndian, &hdr)
+		if err != nil {
+			return nil, err
+		}
+		var group []*link
+		err = msgpack.NewDecoder(io.LimitReader(r, int64(hdr.Size))).Decode(&group)
+		if err != nil {
+			return nil, err
+		}
+		for _, lnk := range group {
+			lnk.typ = hdr.Type
+		}
+		links = append(links, group...)
+	}
+	return links, nil
+}
+
+// A skipper skips bytes without reading them (see recordReader)
+type skipper interface {
+	skip(n int64) error
+}
+
+func skip(r io.Reader, n int64) error {
+	if s, ok := r.(skipper); ok {
+		return s.skip(n)
+	}
+	_, err := io.CopyN(ioutil.Discard, r, n)
+	return err
+}
+
+// insertLink adds lnk after all links of its type
+func insertLink(links []*link, lnk *link) []*link {
+	i := sort.Search(len(links), func(i int) bool { return links[i].typ > lnk.typ })
+	links = append(links, nil)
+	copy(links[i+1:], links[i:])
+	links[i] = lnk
+	return links
+}
+
+// hasType reports whether typ is one of the types; all types match if types
+// is nil
+func hasType(types []uint16, typ uint16) bool {
+	if types == nil {
+		return true
+	}
+	for _, t := range types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// linksOfTypes calls fn for the links having one of the types (all links if
+// types is nil) until fn returns an error
+func linksOfTypes(links []*link, types []uint16, fn func(lnk *link) error) error {
+	if types == nil {
+		for _, lnk := range links {
+			if err := fn(lnk); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i, typ := range types {
+		if hasType(types[:i], typ) {
+			continue
+		}
+		j := sort.Search(len(links), func(j int) bool { return links[j].typ >= typ })
+		for ; j < len(links) && links[j].typ == typ; j++ {
+			if err := fn(links[j]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeLinks drops all links to other
+func removeLinks(links []*link, other uint64) []*link {
+	kept := links[:0]
+	for _, lnk := range links {
+		if lnk.other != other {
+			kept = append(kept, lnk)
+		}
+	}
+	return kept
+}
+
+// linkByID returns the link with the given id or nil
+func linkByID(links []*link, id uint64) *link {
+	for _, lnk := range links {
+		if lnk.id == id {
+			return lnk
+		}
+	}
+	return nil
+}
+
+// removeLink drops the link with the given id
+func removeLink(links []*link, id uint64) []*link {
+	kept := links[:0]
+	for _, lnk := range links {
+		if lnk.id != id {
+			kept = append(kept, lnk)
+		}
+	}
+	return kept
+}
+
+// unlinkFrom drops the links of a from -> to edge matching attrs, returns the
+// remaining links and the number of dropped ones
+func unlinkFrom(links []*link, other uint64, attrs graphie.Attrs) ([]*link, int) {
+	kept := links[:0]
+	removed := 0
+	for _, lnk := range links {
+		if lnk.other == other && lnk.attrs.Match(attrs) {
+			removed++
+			continue
+		}
+		kept = append(kept, lnk)
+	}
+	return kept, removed
+}
+
+// walkLinks streams the in- or out-links of a node record written by write
+// without decoding all of them at once. Only the links having one of the
+// types (all links if types is nil) are decoded; the groups of other types
+// are skipped. It returns ErrNotFound for tombstones.
+func walkLinks(r io.Reader, out bool, types []uint16, fn func(lnk *link) error) error {
+	var flags uint8
+	err := binary.Read(r, binary.BigEndian, &flags)
+	if err != nil {
+		return err
+	}
+	if flags&nodeFlagDeleted != 0 {
+		return ErrNotFound
+	}
+
+	var count uint16
+	err = binary.Read(r, binary.BigEndian, &count)
+	if err != nil {
+		return err
+	}
+	err = skip(r, 2*int64(count))
+	if err != nil {
+		return err
+	}
+
+	// In-links follow the out-links
+	if !out {
+		err = skipLinkGroups(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	var groups uint32
+	err = binary.Read(r, binary.BigEndian, &groups)
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < groups; i++ {
+		var hdr linkGroupHeader
+		err = binary.Read(r, binary.BigEndian, &hdr)
+		if err != nil {
+			return err
+		}
+		if !hasType(types, hdr.Type) {
+			err = skip(r, int64(hdr.Size))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		dec := msgpack.NewDecoder(io.LimitReader(r, int64(hdr.Size)))
+		err = walkLinkArray(dec, hdr.Type, fn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// walkLinkArray decodes an array of links of the type typ and calls fn for
+// every link.
+func walkLinkArray(dec *msgpack.Decoder, typ uint16, fn func(lnk *link) error) error {
+	l, err := dec.DecodeArrayLen()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < l; i++ {
+		lnk := new(link)
+		err = dec.Decode(lnk)
+		if err != nil {
+			return err
+		}
+		lnk.typ = typ
+		err = fn(lnk)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// skipLinkGroups skips the link groups written by writeLinkGroups
+func skipLinkGroups(r io.Reader) error {
+	var groups uint32
+	err := binary.Read(r, binary.BigEndian, &groups)
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < groups; i++ {
+		var hdr linkGroupHeader
+		err = binary.Read(r, binary.BigEndian, &hdr)
+		if err != nil {
+			return err
+		}
+		err = skip(r, int64(hdr.Size))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *node) writeNeighbours(w *nodetableWriter, memtable map[uint64]*node, todoList map[uint64]struct{}) error {
 	toVisit := make([]*node, 0, 10)
 
 	// Write all connected nodes close together (outgoing)
 	for _, lnk := range n.linksOut {
-		// Visited? Ignore
-		_, has := index[lnk.other]
-		if has {
+		// Visited or not in current memtable? Ignore
+		if _, todo := todoList[lnk.other]; !todo {
 			continue
 		}
 
-		// In current memtable?
-		neighbour, has := memtable[lnk.other]
-		if has {
-			// TODO: Optimize this (for example by looking at in/out-degrees of the connected nodes)
-			index[neighbour.id] = w.Size()
-			delete(todoList, neighbour.id)
-			neighbour.write(w)
-
-			toVisit = append(toVisit, neighbour)
+		// TODO: Optimize this (for example by looking at in/out-degrees of the connected nodes)
+		neighbour := memtable[lnk.other]
+		delete(todoList, neighbour.id)
+		if err := w.add(neighbour); err != nil {
+			return err
 		}
+
+		toVisit = append(toVisit, neighbour)
 	}
 
 	for _, lnk := range n.linksIn {
-		// Visited? Ignore
-		_, has := index[lnk.other]
-		if has {
+		// Visited or not in current memtable? Ignore
+		if _, todo := todoList[lnk.other]; !todo {
 			continue
 		}
 
-		// In current memtable?
-		neighbour, has := memtable[lnk.other]
-		if has {
-			// TODO: Optimize this (for example by looking at in/out-degrees of the connected nodes)
-			index[neighbour.id] = w.Size()
-			delete(todoList, neighbour.id)
-			neighbour.write(w)
-
-			toVisit = append(toVisit, neighbour)
+		// TODO: Optimize this (for example by looking at in/out-degrees of the connected nodes)
+		neighbour := memtable[lnk.other]
+		delete(todoList, neighbour.id)
+		if err := w.add(neighbour); err != nil {
+			return err
 		}
+
+		toVisit = append(toVisit, neighbour)
 	}
 
 	for _, neighbour := range toVisit {
-		err := neighbour.writeNeighbours(w, memtable, index, todoList)
+		err := neighbour.writeNeighbours(w, memtable, todoList)
 		if err != nil {
 			return err
 		}
@@ -3,39 +3,418 @@ package happy
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"hash/fnv"
 	"io"
 	"os"
-	"time"
+	"path/filepath"
+	"sort"
+	"sync"
 
 	//"github.com/petar/GoLLRB/llrb"
 )
 
 const (
-	nodetableVersion             = uint16(1)
-	nodetablePersistentThreshold = 1e6
-	nodetableBloomSize           = 5e8
-	nodetableBloomIterations     = 3
-	nodetableBloomArraysize      = nodetableBloomSize / 8
+	nodetableExtension       = ".nt"
+	nodetableVersion         = uint16(6)
+	nodetableBloomBits       = 10 // bits of the bloom bitmap per node
+	nodetableBloomIterations = 3
+	nodetableHeaderSize      = 2 + 8 + 8     // version + created + size of the bloom bitmap
+	nodetableIndexEntrySize  = 8 + 8         // node id + offset
+	nodetableEdgeEntrySize   = 8 + 8         // link id + id of the from-node
+	nodetableLabelEntrySize  = 8 + 8         // label id + node id
+	nodetableFooterSize      = 8 + 8 + 8 + 8 // offsets of the index, the edges, the labels and the attribute indexes
 )
 
-// TODO:
-// - Add commit log and log removal on nodetable write-to-disk
+var (
+	ErrCorruptNodetable = errors.New("Nodetable is corrupt")
+)
 
 type nodetableIdx int
 
+// A nodetable is an immutable file containing nodes written from a memtable.
+// Its layout is:
+//
+//	version (uint16) | created (uint64) | size of the bloom bitmap (uint64) | bloom bitmap
+//	node records (see node.write)
+//	index: count (uint64) | count * (node id (uint64) | offset (uint64)), sorted by id
+//	edges: count (uint64) | count * (link id (uint64) | from-node id (uint64)), sorted by link id
+//	labels: count (uint64) | count * (label id (uint64) | node id (uint64)), sorted by label and node id
+//	attribute indexes (see indexRun)
+//	offset of the index (uint64) | offset of the edges (uint64) | offset of the labels (uint64) |
+//	offset of the attribute indexes (uint64)
+//
+// The edges hold the out-links of all nodes which aren't deleted, so a link
+// can be found by its id (see findEdge). The labels hold the labels of all
+// nodes which aren't deleted, so the nodes carrying a label can be walked
+// without reading their records (see WalkNodes); every one of them has an
+// entry of label 0 as well. The attribute indexes hold the indexes declared
+// when the table was written; the ones declared later are stored in the
+// index file next to it (see ensureIndex).
+//
+// The bloom bitmap is sized by the number of nodes the table was written for
+// (see bloomSize).
+//
+// All integers are stored in big endian.
 type nodetable struct {
 	filename string
 	created  uint64 // timestamp in ns
 	bitmap   []byte
 	idx      nodetableIdx
+
+	fd           *os.File
+	indexOffset  int64
+	count        int64 // number of index entries
+	edgesOffset  int64
+	edgeCount    int64 // number of edge entries
+	labelsOffset int64
+	labelCount   int64 // number of label entries
+
+	indexes      *indexRun // attribute indexes written with the table
+	extraIndexes *indexRun // attribute indexes in the index file, if any
+	extraFd      *os.File
+
+	// Snapshots using the table; a table replaced by compaction is dropped
+	// by the last of them (both guarded by s.lock, see snapshot.go)
+	pins     int
+	obsolete bool
+
+	// Readers which use the table without holding s.lock; a table must
+	// not be closed before all of them are done
+	refs sync.WaitGroup
+}
+
+func loadNodetable(filename string) (*nodetable, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	nt := &nodetable{
+		filename: filename,
+		fd:       fd,
+	}
+	err = nt.readMeta()
+	if err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	return nt, nil
+}
+
+// readMeta reads the header, the bitmap, the locations of the index, the
+// edges and the labels and the keys of the attribute indexes
+func (nt *nodetable) readMeta() error {
+	fi, err := nt.fd.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < nodetableHeaderSize+8+8+8+4+8+nodetableFooterSize {
+		return ErrCorruptNodetable
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(nt.fd, 0, fi.Size()))
+
+	var version uint16
+	err = binary.Read(r, binary.BigEndian, &version)
+	if err != nil {
+		return err
+	}
+	if version != nodetableVersion {
+		return fmt.Errorf("Unsupported nodetable version %d", version)
+	}
+
+	err = binary.Read(r, binary.BigEndian, &nt.created)
+	if err != nil {
+		return err
+	}
+
+	var bitmapSize uint64
+	err = binary.Read(r, binary.BigEndian, &bitmapSize)
+	if err != nil {
+		return err
+	}
+	if bitmapSize == 0 || bitmapSize > uint64(fi.Size()) {
+		return ErrCorruptNodetable
+	}
+	nt.bitmap = make([]byte, bitmapSize)
+	_, err = io.ReadFull(r, nt.bitmap)
+	if err != nil {
+		return err
+	}
+
+	var footer [nodetableFooterSize]byte
+	_, err = nt.fd.ReadAt(footer[:], fi.Size()-nodetableFooterSize)
+	if err != nil {
+		return err
+	}
+	nt.indexOffset = int64(binary.BigEndian.Uint64(footer[:8]))
+	nt.edgesOffset = int64(binary.BigEndian.Uint64(footer[8:16]))
+	nt.labelsOffset = int64(binary.BigEndian.Uint64(footer[16:24]))
+	indexesOffset := int64(binary.BigEndian.Uint64(footer[24:]))
+	if nt.indexOffset < nt.recordsOffset() || nt.edgesOffset < nt.indexOffset+8 ||
+		nt.labelsOffset < nt.edgesOffset+8 || indexesOffset < nt.labelsOffset+8 ||
+		indexesOffset > fi.Size()-nodetableFooterSize {
+		return ErrCorruptNodetable
+	}
+
+	var buf [8]byte
+	_, err = nt.fd.ReadAt(buf[:], nt.indexOffset)
+	if err != nil {
+		return err
+	}
+	nt.count = int64(binary.BigEndian.Uint64(buf[:]))
+	if nt.indexOffset+8+nt.count*nodetableIndexEntrySize != nt.edgesOffset {
+		return ErrCorruptNodetable
+	}
+
+	_, err = nt.fd.ReadAt(buf[:], nt.edgesOffset)
+	if err != nil {
+		return err
+	}
+	nt.edgeCount = int64(binary.BigEndian.Uint64(buf[:]))
+	if nt.edgesOffset+8+nt.edgeCount*nodetableEdgeEntrySize != nt.labelsOffset {
+		return ErrCorruptNodetable
+	}
+
+	_, err = nt.fd.ReadAt(buf[:], nt.labelsOffset)
+	if err != nil {
+		return err
+	}
+	nt.labelCount = int64(binary.BigEndian.Uint64(buf[:]))
+	if nt.labelsOffset+8+nt.labelCount*nodetableLabelEntrySize != indexesOffset {
+		return ErrCorruptNodetable
+	}
+
+	nt.indexes, err = readIndexRun(nt.fd, indexesOffset, fi.Size()-nodetableFooterSize-indexesOffset)
+	return err
+}
+
+// recordsOffset returns the offset of the first node record
+func (nt *nodetable) recordsOffset() int64 {
+	return nodetableHeaderSize + int64(len(nt.bitmap))
+}
+
+func (nt *nodetable) close() error {
+	if nt.extraFd != nil {
+		nt.extraFd.Close()
+	}
+	return nt.fd.Close()
+}
+
+// readEntry reads the i-th pair of a sorted on-disk section (the entries of
+// all sections have the same size)
+func (nt *nodetable) readEntry(section int64, i int64) (key, value uint64, err error) {
+	var buf [nodetableIndexEntrySize]byte
+	_, err = nt.fd.ReadAt(buf[:], section+8+i*nodetableIndexEntrySize)
+	if err != nil {
+		return 0, 0, err
+	}
+	return binary.BigEndian.Uint64(buf[:8]), binary.BigEndian.Uint64(buf[8:]), nil
+}
+
+// find does a binary search on a sorted on-disk section of count entries and
+// returns the index of the first entry not less than (key, value).
+func (nt *nodetable) find(section int64, count int64, key, value uint64) (int64, error) {
+	var err error
+	i := sort.Search(int(count), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		k, v, e := nt.readEntry(section, int64(i))
+		if e != nil {
+			err = e
+			return true
+		}
+		return k > key || (k == key && v >= value)
+	})
+	return int64(i), err
+}
+
+// search returns the value stored for key in a sorted on-disk section of
+// count entries with unique keys.
+func (nt *nodetable) search(section int64, count int64, key uint64) (uint64, bool, error) {
+	i, err := nt.find(section, count, key, 0)
+	if err != nil || i >= count {
+		return 0, false, err
+	}
+
+	k, value, err := nt.readEntry(section, i)
+	if err != nil {
+		return 0, false, err
+	}
+	return value, k == key, nil
+}
+
+// entry returns the i-th entry of the on-disk index
+func (nt *nodetable) entry(i int64) (id uint64, offset int64, err error) {
+	id, off, err := nt.readEntry(nt.indexOffset, i)
+	return id, int64(off), err
+}
+
+// lookup does a binary search on the on-disk index and returns the offset of
+// the node's record or -1 if the node is not part of this nodetable.
+func (nt *nodetable) lookup(id uint64) (int64, error) {
+	offset, found, err := nt.search(nt.indexOffset, nt.count, id)
+	if err != nil || !found {
+		return -1, err
+	}
+	return int64(offset), nil
+}
+
+// lookupEdge returns the id of the from-node of the link with the given id
+// if it's an out-link of one of the table's nodes.
+func (nt *nodetable) lookupEdge(id uint64) (uint64, bool, error) {
+	return nt.search(nt.edgesOffset, nt.edgeCount, id)
+}
+
+// hasLabel reports whether the node carries the label in this nodetable
+func (nt *nodetable) hasLabel(lid uint16, id uint64) (bool, error) {
+	i, err := nt.find(nt.labelsOffset, nt.labelCount, uint64(lid), id)
+	if err != nil || i >= nt.labelCount {
+		return false, err
+	}
+	k, v, err := nt.readEntry(nt.labelsOffset, i)
+	if err != nil {
+		return false, err
+	}
+	return k == uint64(lid) && v == id, nil
+}
+
+// A labelCursor walks the ids of the nodes carrying one label in a nodetable
+// in ascending order.
+type labelCursor struct {
+	nt   *nodetable
+	lid  uint16
+	i    int64
+	id   uint64
+	done bool
+}
+
+func (nt *nodetable) labelCursor(lid uint16) (*labelCursor, error) {
+	i, err := nt.find(nt.labelsOffset, nt.labelCount, uint64(lid), 0)
+	if err != nil {
+		return nil, err
+	}
+	c := &labelCursor{nt: nt, lid: lid, i: i}
+	return c, c.next()
+}
+
+func (c *labelCursor) next() error {
+	if c.i >= c.nt.labelCount {
+		c.done = true
+		return nil
+	}
+	lid, id, err := c.nt.readEntry(c.nt.labelsOffset, c.i)
+	if err != nil {
+		return err
+	}
+	c.i++
+	c.id = id
+	c.done = lid != uint64(c.lid)
+	return nil
+}
+
+// maxEdgeID returns the highest link id of the table
+func (nt *nodetable) maxEdgeID() (uint64, error) {
+	if nt.edgeCount == 0 {
+		return 0, nil
+	}
+	id, _, err := nt.readEntry(nt.edgesOffset, nt.edgeCount-1)
+	return id, err
+}
+
+// readNode decodes the node record at the given offset
+func (nt *nodetable) readNode(id uint64, offset int64) (*node, error) {
+	if offset < nt.recordsOffset() || offset >= nt.indexOffset {
+		return nil, ErrCorruptNodetable
+	}
+	r := bufio.NewReader(io.NewSectionReader(nt.fd, offset, nt.indexOffset-offset))
+
+	n := &node{
+		id: id,
+	}
+	err := n.read(r)
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// each calls fn for every node of the nodetable in the order of their ids
+func (nt *nodetable) each(fn func(n *node) error) error {
+	r := bufio.NewReader(io.NewSectionReader(nt.fd, nt.indexOffset+8, nt.count*nodetableIndexEntrySize))
+	for i := int64(0); i < nt.count; i++ {
+		var entry [2]uint64
+		err := binary.Read(r, binary.BigEndian, &entry)
+		if err != nil {
+			return err
+		}
+		n, err := nt.readNode(entry[0], int64(entry[1]))
+		if err != nil {
+			return err
+		}
+		err = fn(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkLinks streams the links of the types of the node record at the given
+// offset
+func (nt *nodetable) walkLinks(offset int64, out bool, types []uint16, fn func(lnk *link) error) error {
+	if offset < nt.recordsOffset() || offset >= nt.indexOffset {
+		return ErrCorruptNodetable
+	}
+	return walkLinks(newRecordReader(io.NewSectionReader(nt.fd, offset, nt.indexOffset-offset)), out, types, fn)
 }
 
-func loadNodetable(filename string) *nodetable {
-	// TODO
+// recordReader is a buffered reader of a record which seeks over the parts
+// being skipped, so the links of other types aren't read from disk.
+type recordReader struct {
+	sr *io.SectionReader
+	br *bufio.Reader
+}
+
+func newRecordReader(sr *io.SectionReader) *recordReader {
+	return &recordReader{
+		sr: sr,
+		br: bufio.NewReader(sr),
+	}
+}
+
+func (rr *recordReader) Read(p []byte) (int, error) {
+	return rr.br.Read(p)
+}
+
+func (rr *recordReader) skip(n int64) error {
+	buffered := int64(rr.br.Buffered())
+	if n <= buffered {
+		_, err := rr.br.Discard(int(n))
+		return err
+	}
+
+	_, err := rr.sr.Seek(n-buffered, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	rr.br.Reset(rr.sr)
 	return nil
 }
 
+// locate returns the offset of the node's record or -1 if it isn't stored in
+// this nodetable.
+func (nt *nodetable) locate(id uint64) (int64, error) {
+	if !checkBitmap(id, nt) {
+		return -1, nil
+	}
+	return nt.lookup(id)
+}
+
 type bufferedWriteCounter struct {
 	bw   *bufio.Writer
 	size int
@@ -60,104 +439,223 @@ func (wc *bufferedWriteCounter) Flush() error {
 	return wc.bw.Flush()
 }
 
-func createNodetable(memtable map[uint64]*node, filename string) (*nodetable, error) {
-	nt := &nodetable{
-		filename: filename,
-		created:  uint64(time.Now().Nanosecond()),
-		bitmap:   make([]byte, nodetableBloomArraysize),
+// A nodetableWriter writes a new nodetable into a temporary file, so an
+// incomplete nodetable never shows up under its real name. Nodes can be added
+// in any order; the index is sorted by finish. The attribute indexes of keys
+// are built along the way.
+type nodetableWriter struct {
+	nt          *nodetable
+	fd          *os.File
+	tmpFilename string
+	wc          *bufferedWriteCounter
+	entries     [][2]uint64 // node id, offset
+	edges       [][2]uint64 // link id, from-node id
+	labels      [][2]uint64 // label id, node id
+	keys        indexKeys
+	index       tableIndex
+}
+
+// newNodetableWriter starts a nodetable for about the given number of nodes;
+// it sizes the bloom bitmap.
+func newNodetableWriter(filename string, created uint64, nodes int, keys indexKeys) (*nodetableWriter, error) {
+	tmpFilename := filename + ".tmp"
+	fd, err := os.Create(tmpFilename)
+	if err != nil {
+		return nil, err
+	}
+	w := &nodetableWriter{
+		nt: &nodetable{
+			filename: filename,
+			created:  created,
+			bitmap:   make([]byte, bloomSize(nodes)),
+		},
+		fd:          fd,
+		tmpFilename: tmpFilename,
+		wc:          newBufferedWriteCounter(fd),
+		keys:        keys,
+		index:       newTableIndex(keys),
 	}
 
-	fd, err := os.Create(filename)
+	// Version nodetable_version
+	err = binary.Write(w.wc, binary.BigEndian, nodetableVersion)
+	if err == nil {
+		// Timestamp
+		err = binary.Write(w.wc, binary.BigEndian, created)
+	}
+	if err == nil {
+		err = binary.Write(w.wc, binary.BigEndian, uint64(len(w.nt.bitmap)))
+	}
+	if err == nil {
+		// The bitmap is filled in by finish
+		_, err = w.wc.Write(w.nt.bitmap)
+	}
 	if err != nil {
+		w.abort()
 		return nil, err
 	}
-	defer func() {
-		err := fd.Close()
-		if err != nil {
-			panic(err)
-		}
-	}()
+	return w, nil
+}
 
-	wd := newBufferedWriteCounter(fd)
-	defer func() {
-		err := wd.Flush()
-		if err != nil {
-			panic(err)
+// count returns the number of nodes added so far
+func (w *nodetableWriter) count() int {
+	return len(w.entries)
+}
+
+func (w *nodetableWriter) add(n *node) error {
+	w.entries = append(w.entries, [2]uint64{n.id, uint64(w.wc.Size())})
+	markBitmap(n.id, w.nt)
+	if !n.deleted {
+		for _, lnk := range n.linksOut {
+			w.edges = append(w.edges, [2]uint64{lnk.id, n.id})
+		}
+		w.labels = append(w.labels, [2]uint64{0, n.id})
+		for _, lid := range n.labels {
+			w.labels = append(w.labels, [2]uint64{uint64(lid), n.id})
 		}
-	}()
+		w.index.add(n, w.keys)
+	}
+	return n.write(w.wc)
+}
 
-	// Version nodetable_version
-	err = binary.Write(wd, binary.BigEndian, nodetableVersion)
+// finish writes the index, the edges, the labels and the attribute indexes,
+// syncs the nodetable and moves it to its real name.
+func (w *nodetableWriter) finish() (*nodetable, error) {
+	nt := w.nt
+	nt.indexOffset = int64(w.wc.Size())
+	nt.count = int64(len(w.entries))
+	err := writeSection(w.wc, w.entries)
+
+	if err == nil {
+		nt.edgesOffset = int64(w.wc.Size())
+		nt.edgeCount = int64(len(w.edges))
+		err = writeSection(w.wc, w.edges)
+	}
+	if err == nil {
+		nt.labelsOffset = int64(w.wc.Size())
+		nt.labelCount = int64(len(w.labels))
+		err = writeSection(w.wc, w.labels)
+	}
+	indexesOffset := int64(w.wc.Size())
+	if err == nil {
+		err = writeIndexRun(w.wc, w.index)
+	}
+	indexesSize := int64(w.wc.Size()) - indexesOffset
+
+	// Write footer
+	if err == nil {
+		err = binary.Write(w.wc, binary.BigEndian, [4]uint64{uint64(nt.indexOffset), uint64(nt.edgesOffset), uint64(nt.labelsOffset), uint64(indexesOffset)})
+	}
+	if err == nil {
+		err = w.wc.Flush()
+	}
+	if err == nil {
+		_, err = w.fd.WriteAt(nt.bitmap, nodetableHeaderSize)
+	}
+	if err == nil {
+		err = w.fd.Sync()
+	}
+	if cerr := w.fd.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
+		os.Remove(w.tmpFilename)
 		return nil, err
 	}
 
-	// Timestamp
-	err = binary.Write(wd, binary.BigEndian, nt.created)
+	err = os.Rename(w.tmpFilename, nt.filename)
 	if err != nil {
 		return nil, err
 	}
-
-	// Build the bitmap
-	for k := range memtable {
-		markBitmap(k, nt)
+	err = syncDir(filepath.Dir(nt.filename))
+	if err != nil {
+		return nil, err
 	}
 
-	// Write bitmap
-	_, err = wd.Write(nt.bitmap)
+	nt.fd, err = os.Open(nt.filename)
 	if err != nil {
 		return nil, err
 	}
+	nt.indexes, err = readIndexRun(nt.fd, indexesOffset, indexesSize)
+	if err != nil {
+		nt.fd.Close()
+		return nil, err
+	}
+	return nt, nil
+}
 
-	todoList := make(map[uint64]struct{})
-	empty := struct{}{}
+// writeSection sorts the entries and writes them with their count in front
+func writeSection(w io.Writer, entries [][2]uint64) error {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i][0] != entries[j][0] {
+			return entries[i][0] < entries[j][0]
+		}
+		return entries[i][1] < entries[j][1]
+	})
+	err := binary.Write(w, binary.BigEndian, uint64(len(entries)))
+	for i := 0; err == nil && i < len(entries); i++ {
+		err = binary.Write(w, binary.BigEndian, entries[i])
+	}
+	return err
+}
 
-	index := make(map[uint64]int)
+// abort removes the incomplete nodetable
+func (w *nodetableWriter) abort() {
+	w.fd.Close()
+	os.Remove(w.tmpFilename)
+}
 
-	var start *node
-	for k, v := range memtable {
-		if start == nil {
-			start = v
-		}
+// createNodetable writes a memtable as nodetable with the attribute indexes
+// of keys. Connected nodes are written close together.
+func createNodetable(memtable map[uint64]*node, filename string, created uint64, keys indexKeys) (*nodetable, error) {
+	w, err := newNodetableWriter(filename, created, len(memtable), keys)
+	if err != nil {
+		return nil, err
+	}
 
-		todoList[k] = empty
+	todoList := make(map[uint64]struct{}, len(memtable))
+	for k := range memtable {
+		todoList[k] = struct{}{}
 	}
 
-	for {
-		// Remove from todo list
-		delete(todoList, start.id)
+	for _, start := range memtable {
+		if _, todo := todoList[start.id]; !todo {
+			continue
+		}
 
 		// Write start node
-		index[start.id] = wd.Size()
-		err := start.write(wd)
-		if err != nil {
-			return nil, err
+		delete(todoList, start.id)
+		err = w.add(start)
+		if err == nil {
+			// Write all connected nodes recursively
+			err = start.writeNeighbours(w, memtable, todoList)
 		}
-
-		// Write all connected nodes recursively
-		err = start.writeNeighbours(wd, memtable, index, todoList)
 		if err != nil {
+			w.abort()
 			return nil, err
 		}
+	}
 
-		// TODO: Optimize this bookkeeping and checking
-		if len(index) == len(memtable) {
-			break
-		}
+	return w.finish()
+}
 
-		// We still have a node left which is not recorded yet
-		for k := range todoList {
-			start = memtable[k]
-			break
-		}
-	}
+type uint64s []uint64
 
-	// Write index
+func (u uint64s) Len() int           { return len(u) }
+func (u uint64s) Less(i, j int) bool { return u[i] < u[j] }
+func (u uint64s) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
 
-	return nt, nil
+// bloomSize returns the size of the bloom bitmap of a table of the given
+// number of nodes in bytes
+func bloomSize(nodes int) int {
+	size := (nodes*nodetableBloomBits + 7) / 8
+	if size < 8 {
+		size = 8
+	}
+	return size
 }
 
-func markBitmap(x uint64, n *nodetable) {
+func bitmapPositions(x uint64, bits uint64) [nodetableBloomIterations]uint64 {
+	var pos [nodetableBloomIterations]uint64
 	for i := 0; i < nodetableBloomIterations; i++ {
 		h := fnv.New64a()
 		err := binary.Write(h, binary.BigEndian, x)
@@ -166,8 +664,24 @@ func markBitmap(x uint64, n *nodetable) {
 		}
 		x = h.Sum64()
 
-		bitpos := x % nodetableBloomSize
+		pos[i] = x % bits
+	}
+	return pos
+}
+
+func markBitmap(x uint64, n *nodetable) {
+	for _, bitpos := range bitmapPositions(x, uint64(len(n.bitmap))*8) {
 		arraypos := bitpos / 8
 		n.bitmap[arraypos] = n.bitmap[arraypos] | (1 << (bitpos % 8))
 	}
 }
+
+// checkBitmap returns false if x is definitely not stored in the nodetable
+func checkBitmap(x uint64, n *nodetable) bool {
+	for _, bitpos := range bitmapPositions(x, uint64(len(n.bitmap))*8) {
+		if n.bitmap[bitpos/8]&(1<<(bitpos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
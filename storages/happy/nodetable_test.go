@@ -0,0 +1,59 @@
+package happy
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestNodetableEdges checks that the out-links of a nodetable can be found by
+// their ids, also after the table has been opened again.
+func TestNodetableEdges(t *testing.T) {
+	memtable := map[uint64]*node{
+		1: {id: 1, linksOut: []*link{{id: 7, other: 2}, {id: 3, other: 1}}, linksIn: []*link{{id: 3, other: 1}}},
+		2: {id: 2, linksIn: []*link{{id: 7, other: 1}}},
+		3: {id: 3, linksOut: []*link{{id: 9, other: 2}}, deleted: true},
+		4: {id: 4, linksOut: []*link{{id: 5, other: 2}}},
+	}
+	filename := filepath.Join(t.TempDir(), "1"+nodetableExtension)
+	nt, err := createNodetable(memtable, filename, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nt.close()
+
+	nt, err = loadNodetable(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nt.close()
+
+	tests := []struct {
+		edge  uint64
+		from  uint64
+		found bool
+	}{
+		{3, 1, true},
+		{5, 4, true},
+		{7, 1, true},
+		{9, 0, false}, // out-link of a deleted node
+		{1, 0, false},
+		{10, 0, false},
+	}
+	for _, test := range tests {
+		from, found, err := nt.lookupEdge(test.edge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != test.found || (found && from != test.from) {
+			t.Errorf("lookupEdge(%d) = %d, %t; want %d, %t", test.edge, from, found, test.from, test.found)
+		}
+	}
+
+	max, err := nt.maxEdgeID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if max != 7 {
+		t.Errorf("maxEdgeID() = %d, want 7", max)
+	}
+}
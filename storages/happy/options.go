@@ -0,0 +1,71 @@
+package happy
+
+import (
+	"github.com/flosch/graphie"
+)
+
+const (
+	defaultMemtable = 1e6
+	defaultWorkers  = 4
+)
+
+// options are passed to happy as driverAttrs in the form of a DSN (see
+// graphie.DSN)
+//
+//	[happy://]path[?key=value&...]
+//
+// for example happy:///data/g?memtable=1000000&workers=8&sync=batch.
+// Supported keys:
+//
+//	sync		always, batch (default) or none; see syncMode
+//	memtable	number of nodes in the memtable before it's written to a
+//			nodetable (default 1000000)
+//	workers		number of memtables written to nodetables concurrently
+//			(default 4)
+type options struct {
+	path     string
+	sync     syncMode
+	memtable int
+	workers  int
+}
+
+func parseOptions(attrs string) (*options, error) {
+	dsn, err := graphie.ParseDSN(attrs)
+	if err != nil {
+		return nil, err
+	}
+	err = dsn.CheckDriver("happy")
+	if err != nil {
+		return nil, err
+	}
+	if dsn.Host != "" {
+		return nil, &graphie.DSNError{Reason: "happy expects a path, not a host (use happy:///path)"}
+	}
+	if dsn.Path == "" {
+		return nil, &graphie.DSNError{Reason: "path is missing"}
+	}
+	err = dsn.CheckParams("sync", "memtable", "workers")
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &options{
+		path: dsn.Path,
+	}
+
+	val := dsn.Param("sync", "batch")
+	opts.sync, err = parseSyncMode(val)
+	if err != nil {
+		return nil, &graphie.DSNError{Param: "sync", Value: val, Reason: err.Error()}
+	}
+	opts.memtable, err = dsn.Int("memtable", defaultMemtable, 1)
+	if err != nil {
+		return nil, err
+	}
+	opts.workers, err = dsn.Int("workers", defaultWorkers, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return opts, nil
+}
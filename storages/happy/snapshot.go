@@ -0,0 +1,624 @@
+package happy
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/flosch/graphie"
+)
+
+var (
+	ErrSnapshotReleased = errors.New("Snapshot has been released")
+)
+
+// A snapshot sees the memtable, the frozen memtables and the nodetables as
+// they were when it was taken. Versions written to the memtable afterwards
+// are skipped by their sequence number, the replaced ones are kept as long
+// as a snapshot sees them (see put and pruneVersions). The nodetables are
+// pinned, so compaction doesn't drop them.
+//
+// The indexes declared when the snapshot was taken cover all versions it
+// sees: the entries of the memtables are never removed and the tables are
+// immutable. Their hits are checked against the versions visible at seq.
+type snapshot struct {
+	s             *storage
+	seq           uint64
+	memtable      map[uint64]*node  // still written to; must be read holding s.lock
+	memtableIndex tableIndex        // likewise
+	frozen        []*frozenMemtable // newest first
+	tables        nodetables
+	indexes       indexKeys
+	released      bool // guarded by s.lock
+}
+
+func (s *storage) Snapshot() (graphie.StorageSnapshot, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return nil, graphie.ErrClosed
+	}
+
+	sn := &snapshot{
+		s:             s,
+		seq:           s.seq,
+		memtable:      s.memtable,
+		memtableIndex: s.memtableIndex,
+		tables:        make(nodetables, len(s.tables)),
+		indexes:       s.indexes.copy(),
+	}
+	copy(sn.tables, s.tables)
+	for _, nt := range sn.tables {
+		nt.pins++
+	}
+
+	s.memtableQueueLock.Lock()
+	for f := s.memtableQueue.Back(); f != nil; f = f.Prev() {
+		sn.frozen = append(sn.frozen, f.Value.(*frozenMemtable))
+	}
+	s.memtableQueueLock.Unlock()
+
+	s.snapshots[sn] = struct{}{}
+	return sn, nil
+}
+
+func (sn *snapshot) Seq() uint64 {
+	return sn.seq
+}
+
+func (sn *snapshot) Release() error {
+	sn.s.lock.Lock()
+	if sn.released {
+		sn.s.lock.Unlock()
+		return nil
+	}
+	drop := sn.release()
+	sn.s.lock.Unlock()
+
+	return sn.s.dropTables(drop)
+}
+
+// release unpins the tables and returns the ones which have to be dropped.
+//
+// Does not hold s.lock; must be held outside
+func (sn *snapshot) release() nodetables {
+	sn.released = true
+	delete(sn.s.snapshots, sn)
+	sn.s.pruneVersions()
+
+	var drop nodetables
+	for _, nt := range sn.tables {
+		nt.pins--
+		if nt.pins == 0 && nt.obsolete {
+			drop = append(drop, nt)
+		}
+	}
+	sn.memtable, sn.memtableIndex, sn.frozen, sn.tables = nil, nil, nil, nil
+	return drop
+}
+
+// pruneVersions drops the replaced versions in the memtable which no live
+// snapshot sees anymore. The frozen memtables are read without holding
+// s.lock; their versions go away with them.
+//
+// Does not hold s.lock; must be held outside
+func (s *storage) pruneVersions() {
+	oldest := uint64(math.MaxUint64)
+	for sn := range s.snapshots {
+		if sn.seq < oldest {
+			oldest = sn.seq
+		}
+	}
+	for _, n := range s.memtable {
+		// The version the oldest snapshot sees is the last one needed
+		for v := n; v != nil; v = v.prev {
+			if v.seq <= oldest {
+				v.prev = nil
+				break
+			}
+		}
+	}
+}
+
+// dropTables drops the tables released by the last snapshot using them.
+func (s *storage) dropTables(drop nodetables) error {
+	if len(drop) == 0 {
+		return nil
+	}
+	for _, nt := range drop {
+		err := nt.drop()
+		if err != nil {
+			return err
+		}
+	}
+	return syncDir(s.path)
+}
+
+// acquire registers a reader of the snapshot's frozen memtables and tables;
+// the tables must be handed to unref afterwards. Stop waits for the readers
+// before it closes the tables.
+func (sn *snapshot) acquire() ([]*frozenMemtable, nodetables, error) {
+	sn.s.lock.RLock()
+	defer sn.s.lock.RUnlock()
+
+	if sn.released {
+		return nil, nil, ErrSnapshotReleased
+	}
+	for _, nt := range sn.tables {
+		nt.refs.Add(1)
+	}
+	return sn.frozen, sn.tables, nil
+}
+
+// unref unregisters a reader registered by acquire.
+func unref(tables nodetables) {
+	for _, nt := range tables {
+		nt.refs.Done()
+	}
+}
+
+// visible returns the newest version visible at seq of a node in memory
+func visible(n *node, seq uint64) *node {
+	for n != nil && n.seq > seq {
+		n = n.prev
+	}
+	return n
+}
+
+// locate is storage.locate for the snapshot; frozen and tables are the ones
+// returned by acquire.
+func (sn *snapshot) locate(id uint64, frozen []*frozenMemtable, tables nodetables) (*node, *nodetable, int64, error) {
+	sn.s.lock.RLock()
+	if sn.released {
+		sn.s.lock.RUnlock()
+		return nil, nil, 0, ErrSnapshotReleased
+	}
+	n := visible(sn.memtable[id], sn.seq)
+	sn.s.lock.RUnlock()
+	if n != nil {
+		return n, nil, 0, nil
+	}
+
+	for _, m := range frozen {
+		n = visible(m.nodes[id], sn.seq)
+		if n != nil {
+			return n, nil, 0, nil
+		}
+	}
+
+	for _, nt := range tables {
+		offset, err := nt.locate(id)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if offset >= 0 {
+			return nil, nt, offset, nil
+		}
+	}
+
+	return nil, nil, 0, ErrNotFound
+}
+
+// get returns the version of a node visible in the snapshot; it must not be
+// modified.
+func (sn *snapshot) get(id graphie.NodeID) (*node, error) {
+	frozen, tables, err := sn.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer unref(tables)
+
+	n, nt, offset, err := sn.locate(uint64(id), frozen, tables)
+	if err != nil {
+		return nil, err
+	}
+	if nt != nil {
+		n, err = nt.readNode(uint64(id), offset)
+		if err != nil {
+			return nil, err
+		}
+		n.s = sn.s
+	}
+	if n.deleted {
+		return nil, ErrNotFound
+	}
+	return n, nil
+}
+
+// scan is storage.scan for the snapshot; fn is called without holding
+// s.lock.
+func (sn *snapshot) scan(fn func(n *node) error) error {
+	seen := make(map[uint64]struct{})
+	visit := func(n *node) error {
+		if _, has := seen[n.id]; has {
+			return nil
+		}
+		seen[n.id] = struct{}{}
+		if n.deleted {
+			return nil
+		}
+		return fn(n)
+	}
+
+	frozen, tables, err := sn.acquire()
+	if err != nil {
+		return err
+	}
+	defer unref(tables)
+
+	sn.s.lock.RLock()
+	if sn.released {
+		sn.s.lock.RUnlock()
+		return ErrSnapshotReleased
+	}
+	nodes := make([]*node, 0, len(sn.memtable))
+	for _, n := range sn.memtable {
+		n = visible(n, sn.seq)
+		if n != nil {
+			nodes = append(nodes, n)
+		}
+	}
+	sn.s.lock.RUnlock()
+
+	for _, n := range nodes {
+		if err := visit(n); err != nil {
+			return err
+		}
+	}
+	for _, m := range frozen {
+		for _, n := range m.nodes {
+			if err := visit(n); err != nil {
+				return err
+			}
+		}
+	}
+	for _, nt := range tables {
+		if err := nt.each(visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindByAttr uses the indexes declared when the snapshot was taken,
+// otherwise it scans the whole snapshot.
+func (sn *snapshot) FindByAttr(labels []string, key string, value interface{}) ([]graphie.NodeID, error) {
+	sn.s.lock.RLock()
+	lids, known := sn.s.labelIDs(labels)
+	sn.s.lock.RUnlock()
+	result := make([]graphie.NodeID, 0)
+	if !known {
+		return result, nil
+	}
+	match := func(n *node) bool {
+		v, has := n.attrs[key]
+		return has && graphie.ValueEqual(v, value) && n.hasLabels(lids)
+	}
+
+	ids := make(uint64s, 0)
+	indexed := false
+	for _, lid := range lids {
+		k := indexKey{lid, key, false}
+		if _, has := sn.indexes[k]; !has {
+			continue
+		}
+		candidates, err := sn.lookupIndex(k, value)
+		if err != nil {
+			return nil, err
+		}
+		for id := range candidates {
+			n, err := sn.get(graphie.NodeID(id))
+			if err == ErrNotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			if match(n) {
+				ids = append(ids, id)
+			}
+		}
+		indexed = true
+		break
+	}
+	if !indexed {
+		err := sn.scan(func(n *node) error {
+			if match(n) {
+				ids = append(ids, n.id)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Sort(ids)
+	for _, id := range ids {
+		result = append(result, graphie.NodeID(id))
+	}
+	return result, nil
+}
+
+// lookupIndex is storage.lookupIndex for the snapshot.
+func (sn *snapshot) lookupIndex(k indexKey, value interface{}) (map[uint64]struct{}, error) {
+	frozen, tables, err := sn.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer unref(tables)
+
+	// The indexes of the memtables and the index files of the tables are
+	// replaced holding s.lock
+	sn.s.lock.RLock()
+	defer sn.s.lock.RUnlock()
+	if sn.released {
+		return nil, ErrSnapshotReleased
+	}
+
+	candidates := make(map[uint64]struct{})
+	add := func(id uint64) {
+		candidates[id] = struct{}{}
+	}
+	for id := range sn.memtableIndex[k].lookup(value) {
+		add(id)
+	}
+	for _, m := range frozen {
+		for id := range m.index[k].lookup(value) {
+			add(id)
+		}
+	}
+	for _, nt := range tables {
+		err := nt.lookupIndex(k, value, add)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return candidates, nil
+}
+
+// WalkNodes walks the label sections of the tables like storage.WalkNodes;
+// the nodes in memory are the versions visible in the snapshot.
+func (sn *snapshot) WalkNodes(labels []string, fn func(id graphie.NodeID) error) error {
+	frozen, tables, err := sn.acquire()
+	if err != nil {
+		return err
+	}
+	defer unref(tables)
+
+	inMemory := make(map[uint64]struct{})
+	ids := make(uint64s, 0)
+	collect := func(nodes map[uint64]*node, lids []uint16) {
+		for id, n := range nodes {
+			if _, has := inMemory[id]; has {
+				continue
+			}
+			n = visible(n, sn.seq)
+			if n == nil {
+				continue
+			}
+			inMemory[id] = struct{}{}
+			if !n.deleted && n.hasLabels(lids) {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	sn.s.lock.RLock()
+	if sn.released {
+		sn.s.lock.RUnlock()
+		return ErrSnapshotReleased
+	}
+	lids, known := sn.s.labelIDs(labels)
+	if !known {
+		sn.s.lock.RUnlock()
+		return nil
+	}
+	collect(sn.memtable, lids)
+	sn.s.lock.RUnlock()
+	for _, m := range frozen {
+		collect(m.nodes, lids)
+	}
+
+	return sn.s.walkNodes(context.Background(), ids, inMemory, tables, lids, fn)
+}
+
+func (sn *snapshot) Labels(id graphie.NodeID) ([]string, error) {
+	n, err := sn.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	sn.s.lock.RLock()
+	defer sn.s.lock.RUnlock()
+
+	labels := make([]string, 0, len(n.labels))
+	for _, lid := range n.labels {
+		labels = append(labels, sn.s.labelNames[lid])
+	}
+	return labels, nil
+}
+
+func (sn *snapshot) In(id graphie.NodeID) ([]*graphie.Link, error) {
+	links := make([]*graphie.Link, 0)
+	err := sn.WalkIn(id, func(l *graphie.Link) error {
+		links = append(links, l)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (sn *snapshot) Out(id graphie.NodeID) ([]*graphie.Link, error) {
+	links := make([]*graphie.Link, 0)
+	err := sn.WalkOut(id, func(l *graphie.Link) error {
+		links = append(links, l)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (sn *snapshot) WalkIn(id graphie.NodeID, fn func(l *graphie.Link) error) error {
+	return sn.walkLinks(id, false, nil, fn)
+}
+
+func (sn *snapshot) WalkOut(id graphie.NodeID, fn func(l *graphie.Link) error) error {
+	return sn.walkLinks(id, true, nil, fn)
+}
+
+func (sn *snapshot) WalkInTypes(id graphie.NodeID, types []string, fn func(l *graphie.Link) error) error {
+	return sn.walkLinks(id, false, types, fn)
+}
+
+func (sn *snapshot) WalkOutTypes(id graphie.NodeID, types []string, fn func(l *graphie.Link) error) error {
+	return sn.walkLinks(id, true, types, fn)
+}
+
+// walkLinks is storage.walkLinks for the snapshot.
+func (sn *snapshot) walkLinks(id graphie.NodeID, out bool, types []string, fn func(l *graphie.Link) error) error {
+	frozen, tables, err := sn.acquire()
+	if err != nil {
+		return err
+	}
+	defer unref(tables)
+
+	n, nt, offset, err := sn.locate(uint64(id), frozen, tables)
+	if err != nil {
+		return err
+	}
+
+	sn.s.lock.RLock()
+	tids := sn.s.typeIDs(types)
+	sn.s.lock.RUnlock()
+	typeName := sn.s.typeNamer()
+
+	if nt != nil {
+		return nt.walkLinks(offset, out, tids, func(lnk *link) error {
+			return fn(&graphie.Link{
+				ID:    graphie.EdgeID(lnk.id),
+				Type:  typeName(lnk.typ),
+				Other: graphie.NodeID(lnk.other),
+				Attrs: lnk.attrs,
+			})
+		})
+	}
+
+	if n.deleted {
+		return ErrNotFound
+	}
+	links := n.linksIn
+	if out {
+		links = n.linksOut
+	}
+	return linksOfTypes(links, tids, func(lnk *link) error {
+		return fn(&graphie.Link{
+			ID:    graphie.EdgeID(lnk.id),
+			Type:  typeName(lnk.typ),
+			Other: graphie.NodeID(lnk.other),
+			Attrs: copyAttrs(lnk.attrs),
+		})
+	})
+}
+
+// GetEdge finds the from-node of the link like storage.GetEdge and reads the
+// version visible in the snapshot.
+func (sn *snapshot) GetEdge(id graphie.EdgeID) (*graphie.Edge, error) {
+	from, found, err := sn.edgeFrom(uint64(id))
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrEdgeNotFound
+	}
+	n, err := sn.get(graphie.NodeID(from))
+	if err == ErrNotFound {
+		return nil, ErrEdgeNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	out := linkByID(n.linksOut, uint64(id))
+	if out == nil {
+		return nil, ErrEdgeNotFound
+	}
+
+	sn.s.lock.RLock()
+	typ := sn.s.typeName(out.typ)
+	sn.s.lock.RUnlock()
+	return &graphie.Edge{
+		ID:    id,
+		Type:  typ,
+		From:  graphie.NodeID(n.id),
+		To:    graphie.NodeID(out.other),
+		Attrs: copyAttrs(out.attrs),
+	}, nil
+}
+
+// edgeFrom is storage.edgeFrom for the snapshot.
+func (sn *snapshot) edgeFrom(id uint64) (uint64, bool, error) {
+	frozen, tables, err := sn.acquire()
+	if err != nil {
+		return 0, false, err
+	}
+	defer unref(tables)
+
+	sn.s.lock.RLock()
+	defer sn.s.lock.RUnlock()
+	if sn.released {
+		return 0, false, ErrSnapshotReleased
+	}
+
+	for from := range sn.memtableIndex[edgeKey].lookup(id) {
+		return from, true, nil
+	}
+	for _, m := range frozen {
+		for from := range m.index[edgeKey].lookup(id) {
+			return from, true, nil
+		}
+	}
+	for _, nt := range tables {
+		from, found, err := nt.lookupEdge(id)
+		if err != nil || found {
+			return from, found, err
+		}
+	}
+	return 0, false, nil
+}
+
+func (sn *snapshot) Get(id graphie.NodeID, key string) (interface{}, error) {
+	n, err := sn.get(id)
+	if err != nil {
+		return nil, err
+	}
+	v, has := n.attrs[key]
+	if !has {
+		return nil, ErrAttrNotFound
+	}
+	return v, nil
+}
+
+func (sn *snapshot) Has(id graphie.NodeID, key string) (bool, error) {
+	n, err := sn.get(id)
+	if err != nil {
+		return false, err
+	}
+	_, has := n.attrs[key]
+	return has, nil
+}
+
+func (sn *snapshot) Attrs(id graphie.NodeID) (graphie.Attrs, error) {
+	n, err := sn.get(id)
+	if err != nil {
+		return nil, err
+	}
+	attrs := copyAttrs(n.attrs)
+	if attrs == nil {
+		attrs = make(graphie.Attrs)
+	}
+	return attrs, nil
+}
@@ -5,26 +5,29 @@ package happy
 
 import (
 	"container/list"
+	"context"
 	"crypto/md5"
 	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/flosch/graphie"
 )
 
-const (
-	maxWorkers = 4
-)
-
 var (
-	ErrNotFound = errors.New("Node not found")
+	ErrNotFound     = graphie.ErrNodeNotFound
+	ErrEdgeNotFound = graphie.ErrEdgeNotFound
+	ErrAttrNotFound = graphie.ErrAttrNotFound
+
+	errStopScan = errors.New("stop scan")
 )
 
 type nodetables []*nodetable
@@ -41,23 +44,56 @@ func (nt nodetables) Swap(i, j int) {
 	nt[i], nt[j] = nt[j], nt[i]
 }
 
+// A frozenMemtable is a memtable which is being written to a nodetable. It
+// stays readable in the memtable queue until its nodetable is in place.
+type frozenMemtable struct {
+	nodes   map[uint64]*node
+	index   tableIndex
+	logs    []string // commit log segments holding the nodes
+	created uint64   // creation timestamp of the nodetable
+	table   *nodetable
+}
+
 type storage struct {
 	g    *graphie.Graph
 	path string
+	opts *options
+	log  *commitLog
 
-	wg sync.WaitGroup
+	wg      sync.WaitGroup
+	flushes sync.WaitGroup // memtables being handed to the workers
 
 	counterNodes  uint64
+	counterEdges  uint64
 	counterLabels uint16
+	seq           uint64 // sequence number of the last mutation
 
-	lock sync.RWMutex
+	lock    sync.RWMutex
+	started bool  // Start succeeded and the background workers are running
+	closed  bool  // all operations fail with graphie.ErrClosed after Stop
+	err     error // the first error of a background worker (see fail)
 
 	labelIndex          map[string]uint16
+	labelNames          map[uint16]string // reverse of labelIndex
+	pendingLabels       []string          // new labels not yet written to the commit log
 	memtable            map[uint64]*node
+	memtableLogs        []string // replayed commit log segments holding nodes of memtable
+	manifestTables      tableSet // nodetables listed in the manifest when opened
+	lastCreated         uint64
 	memtableQueueLock   sync.Mutex
 	memtableQueue       *list.List
 	memtableWorkersChan chan *list.Element
 	tables              nodetables
+
+	indexes       indexKeys  // declared indexes (see EnsureIndexNodes and EnsureIndexLinks)
+	keys          labelAttrs // indexed key attributes (see EnsureIndexNodes)
+	uniques       labelAttrs // unique attributes (see EnsureUnique)
+	memtableIndex tableIndex
+
+	snapshots map[*snapshot]struct{} // live snapshots
+
+	compactionChan chan struct{}
+	compactorDone  chan struct{}
 }
 
 func init() {
@@ -69,15 +105,29 @@ func registerHappy(g *graphie.Graph) (graphie.Storage, error) {
 	return &storage{
 		g:                   g,
 		labelIndex:          make(map[string]uint16),
+		labelNames:          make(map[uint16]string),
+		indexes:             make(indexKeys),
+		keys:                make(labelAttrs),
+		uniques:             make(labelAttrs),
+		memtableIndex:       make(tableIndex),
+		snapshots:           make(map[*snapshot]struct{}),
 		memtable:            make(map[uint64]*node),
 		memtableQueue:       list.New(),
 		memtableWorkersChan: make(chan *list.Element),
+		compactionChan:      make(chan struct{}, 1),
+		compactorDone:       make(chan struct{}),
 	}, nil
 }
 
 func (s *storage) Start(attrs string, dbname string) error {
+	opts, err := parseOptions(attrs)
+	if err != nil {
+		return err
+	}
+	s.opts = opts
+
 	// Load all table indexes (bitmaps)
-	path, err := filepath.Abs(attrs)
+	path, err := filepath.Abs(opts.path)
 	if err != nil {
 		return err
 	}
@@ -93,85 +143,380 @@ func (s *storage) Start(attrs string, dbname string) error {
 		return err
 	} else {
 		if !fi.IsDir() {
-			return fmt.Errorf("Path '%s' is not a directory.", attrs)
+			return fmt.Errorf("Path '%s' is not a directory.", opts.path)
 		}
 	}
 
+	err = s.load()
+	if err != nil {
+		return err
+	}
+
 	// Start all workers
-	for i := 0; i < maxWorkers; i++ {
+	for i := 0; i < s.opts.workers; i++ {
 		s.wg.Add(1)
 		go s.memtableWorker()
 	}
 
+	go s.compactor()
+	s.triggerCompaction()
+
+	s.started = true
 	return nil
 }
 
 func (s *storage) Stop() error {
-	s.lock.RLock()
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+
+	// All mutations fail from now on, so the memtable doesn't change anymore
+	// and no other flush is started
+	s.closed = true
+	if !s.started {
+		// Start wasn't called or failed; nothing runs in the background and
+		// whatever was loaded is still in the commit log
+		s.lock.Unlock()
+		return s.closeFiles()
+	}
 	if len(s.memtable) > 0 {
-		s.lock.RUnlock()
-		s.memtableFlush()
+		err := s.freezeMemtable()
+		if err != nil {
+			return err
+		}
 	} else {
-		s.lock.RUnlock()
+		s.lock.Unlock()
 	}
 
+	// Flushes started before are handing their memtables to the workers
+	s.flushes.Wait()
 	close(s.memtableWorkersChan)
 	s.wg.Wait()
+
+	close(s.compactionChan)
+	<-s.compactorDone
+
+	// Snapshots which are still around can't be used anymore
+	s.lock.Lock()
+	var drop nodetables
+	for sn := range s.snapshots {
+		drop = append(drop, sn.release()...)
+	}
+	err := s.writeManifest()
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	err = s.dropTables(drop)
+	if err != nil {
+		return err
+	}
+
+	// The memtable is empty, so is the current commit log segment
+	current := s.log.current()
+	err = s.log.close()
+	if err != nil {
+		return err
+	}
+	s.log = nil
+	err = os.Remove(current)
+	if err != nil {
+		return err
+	}
+
+	err = s.closeFiles()
+	if err != nil {
+		return err
+	}
+
+	// The data of a failed flush is still in the commit log
+	return s.err
+}
+
+// closeFiles closes the commit log, if it's still open, and all nodetables
+// once their readers are done. Readers register with the tables while
+// holding s.lock and checking s.closed, so no new ones come along.
+func (s *storage) closeFiles() error {
+	if s.log != nil {
+		err := s.log.close()
+		if err != nil {
+			return err
+		}
+	}
+	for _, nt := range s.tables {
+		nt.refs.Wait()
+		err := nt.close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load restores the manifest and opens all nodetables of an existing database
+func (s *storage) load() error {
+	err := s.readManifest()
+	if err != nil {
+		return err
+	}
+
+	// Leftovers of nodetables which were being written when the process died
+	leftovers, err := filepath.Glob(filepath.Join(s.path, "*.tmp"))
+	if err != nil {
+		return err
+	}
+	for _, filename := range leftovers {
+		err = os.Remove(filename)
+		if err != nil {
+			return err
+		}
+	}
+
+	filenames, err := filepath.Glob(filepath.Join(s.path, "*"+nodetableExtension))
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range filenames {
+		if !s.manifestTables.has(filepath.Base(filename)) {
+			// Written, but never became part of the database (a flush whose
+			// commit log still exists or the result of an incomplete compaction)
+			err = os.Remove(filename)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		nt, err := loadNodetable(filename)
+		if err != nil {
+			return err
+		}
+		s.tables = append(s.tables, nt)
+		if nt.created > s.lastCreated {
+			s.lastCreated = nt.created
+		}
+
+		// The manifest might be older than the nodetable; make sure we never
+		// hand out an id twice
+		if nt.count > 0 {
+			id, _, err := nt.entry(nt.count - 1)
+			if err != nil {
+				return err
+			}
+			if id > s.counterNodes {
+				s.counterNodes = id
+			}
+		}
+		id, err := nt.maxEdgeID()
+		if err != nil {
+			return err
+		}
+		if id > s.counterEdges {
+			s.counterEdges = id
+		}
+	}
+
+	// It is important to keep all tables sorted by their creation date
+	sort.Sort(s.tables)
+
+	loaded := make(map[string]struct{}, len(s.tables))
+	for _, nt := range s.tables {
+		err = nt.readIndex()
+		if err == nil {
+			err = nt.ensureIndex(s.indexes)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", indexFilename(nt.filename), err)
+		}
+		loaded[indexFilename(nt.filename)] = struct{}{}
+	}
+	indexes, err := filepath.Glob(filepath.Join(s.path, "*"+indexExtension))
+	if err != nil {
+		return err
+	}
+	for _, filename := range indexes {
+		if _, has := loaded[filename]; !has {
+			err = os.Remove(filename)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Replay everything which didn't make it into a nodetable before
+	segments, lastSeq, err := listSegments(s.path)
+	if err != nil {
+		return err
+	}
+	for _, filename := range segments {
+		err = replaySegment(filename, s.applyLogRecord)
+		if err != nil {
+			return fmt.Errorf("%s: %s", filename, err)
+		}
+	}
+
+	s.log, err = openCommitLog(s.path, s.opts.sync, lastSeq)
+	if err != nil {
+		return err
+	}
+
+	if len(s.memtable) > 0 {
+		s.memtableLogs = segments
+	} else {
+		for _, filename := range segments {
+			err = os.Remove(filename)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
 // memtable_flush manages the lock itself!
-func (s *storage) memtableFlush() {
+func (s *storage) memtableFlush() error {
 	s.lock.Lock()
+	if s.closed {
+		// Stop flushes the memtable itself
+		s.lock.Unlock()
+		return nil
+	}
+	return s.freezeMemtable()
+}
+
+// freezeMemtable hands the memtable to the workers and starts a new one.
+//
+// s.lock must be held outside; it's released.
+func (s *storage) freezeMemtable() error {
+	// All following mutations go into a new commit log segment
+	segment, err := s.log.rotate()
+	if err != nil {
+		s.lock.Unlock()
+		return err
+	}
+
+	// The nodetable must be newer than all previous ones, even if the clock
+	// goes backwards
+	created := uint64(time.Now().UnixNano())
+	if created <= s.lastCreated {
+		created = s.lastCreated + 1
+	}
+	s.lastCreated = created
 
 	// Make old one persistent
-	oldMemtable := s.memtable
+	frozen := &frozenMemtable{
+		nodes:   s.memtable,
+		index:   s.memtableIndex,
+		logs:    append(s.memtableLogs, segment),
+		created: created,
+	}
 
 	// Make the memtables accessible while they are being written on disk
 	s.memtableQueueLock.Lock()
-	el := s.memtableQueue.PushBack(oldMemtable)
+	el := s.memtableQueue.PushBack(frozen)
 	s.memtableQueueLock.Unlock()
 
 	// Create an empty memtable for new nodes
 	s.memtable = make(map[uint64]*node)
+	s.memtableIndex = make(tableIndex)
+	s.memtableLogs = nil
 
+	s.flushes.Add(1)
 	s.lock.Unlock()
 
 	// This blocks when all workers are busy and there's no chance to full the memory
 	// Otherwise it will pass the memtable to a worker who will write the memtable down
 	// in nodetable format
 	s.memtableWorkersChan <- el
+	s.flushes.Done()
+
+	return nil
 }
 
 func (s *storage) Add(labels []string, attrs graphie.Attrs) (graphie.NodeID, error) {
-	// Add to memtable
 	s.lock.Lock()
+	n, pos, err := s.add(labels, attrs)
+	full := len(s.memtable) >= s.opts.memtable
+	s.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	err = s.written(pos, full)
+	if err != nil {
+		return 0, err
+	}
+	return graphie.NodeID(n.id), nil
+}
+
+// Does not hold s.lock; must be held outside
+func (s *storage) add(labels []string, attrs graphie.Attrs) (*node, int64, error) {
+	if s.closed {
+		return nil, 0, graphie.ErrClosed
+	}
+
+	lids := make([]uint16, 0, len(labels))
+	for _, lbl := range labels {
+		lids = append(lids, s.labelindex(lbl))
+	}
+
+	err := s.checkUnique(0, lids, attrs)
+	if err != nil {
+		return nil, 0, err
+	}
 
 	s.counterNodes++
 
 	n := &node{
 		s:        s,
 		id:       s.counterNodes,
-		attrs:    attrs,
-		labels:   make([]uint16, 0, len(labels)),
+		attrs:    copyAttrs(attrs),
+		labels:   lids,
 		linksOut: make([]*link, 0, 10), // some guesses with 10 outlinks on avg
 		linksIn:  make([]*link, 0, 10), // same
 	}
 
-	for _, lbl := range labels {
-		n.labels = append(n.labels, s.labelindex(lbl))
+	pos, err := s.logMutation(n)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	s.memtable[s.counterNodes] = n
+	// Add to memtable
+	s.put(n)
 
-	s.lock.Unlock()
+	return n, pos, nil
+}
+
+// written waits until the mutation at pos is durable and flushes the
+// memtable if it reached the threshold.
+func (s *storage) written(pos int64, full bool) error {
+	err := s.log.wait(pos)
+	if err != nil {
+		return err
+	}
 
-	// Check if we reached the treshold
-	if len(s.memtable) >= nodetablePersistentThreshold {
-		s.memtableFlush()
+	if full {
+		return s.memtableFlush()
 	}
+	return nil
+}
 
-	return graphie.NodeID(s.counterNodes), nil
+// put makes n the newest version of its node in the memtable. While there
+// are snapshots, the replaced version is kept, they might still see it.
+//
+// Does not hold s.lock; must be held outside
+func (s *storage) put(n *node) {
+	old, has := s.memtable[n.id]
+	if has && old != n && len(s.snapshots) > 0 {
+		n.prev = old
+	}
+	s.memtable[n.id] = n
+	s.memtableIndex.add(n, s.indexes)
+	s.memtableIndex.addLinks(n)
 }
 
 // s.lock must be held outside of get()
@@ -183,199 +528,1325 @@ func (s *storage) get(id graphie.NodeID) (*node, error) {
 	}
 
 	// Second, make a copy of this node
-	newNode := &node{
-		s:        s,
-		id:       n.id,
-		attrs:    make(graphie.Attrs),
-		linksOut: make([]*link, 0, len(n.linksOut)),
-		linksIn:  make([]*link, 0, len(n.linksIn)),
-	}
-	copy(newNode.labels, n.labels)
+	return n.clone(), nil
+}
 
-	for _, lnk := range n.linksOut {
-		newNode.linksOut = append(newNode.linksOut, &link{
-			other: lnk.other,
-			attrs: lnk.attrs,
-		})
+func (s *storage) getRaw(id graphie.NodeID) (*node, error) {
+	n, err := s.getVersion(id)
+	if err != nil {
+		return nil, err
 	}
-
-	for _, lnk := range n.linksIn {
-		newNode.linksIn = append(newNode.linksIn, &link{
-			other: lnk.other,
-			attrs: lnk.attrs,
-		})
+	if n.deleted {
+		return nil, ErrNotFound
 	}
+	return n, nil
+}
 
-	for k, v := range n.attrs {
-		newNode.attrs[k] = v
+// getVersion returns the newest version of the node which might be a
+// tombstone.
+func (s *storage) getVersion(id graphie.NodeID) (*node, error) {
+	n, nt, offset, err := s.locate(id)
+	if err != nil || n != nil {
+		return n, err
 	}
 
-	return newNode, nil
+	n, err = nt.readNode(uint64(id), offset)
+	if err != nil {
+		return nil, err
+	}
+	n.s = s
+	return n, nil
 }
 
-func (s *storage) getRaw(id graphie.NodeID) (*node, error) {
+// locate finds the newest version of a node. It's either in memory (n) or
+// in a nodetable at the given offset. The version might be a tombstone.
+func (s *storage) locate(id graphie.NodeID) (n *node, nt *nodetable, offset int64, err error) {
+	if s.closed {
+		return nil, nil, 0, graphie.ErrClosed
+	}
+
 	// First, check current memtable
 	n, has := s.memtable[uint64(id)]
 	if has {
 		// We were lucky
-		return n, nil
+		return n, nil, 0, nil
 	}
 
-	// Second, check all remaining memtables in the persisting-queue
+	// Second, check all remaining memtables in the persisting-queue (newest first)
 	s.memtableQueueLock.Lock()
-	f := s.memtableQueue.Front()
+	f := s.memtableQueue.Back()
 	for f != nil {
-		m := f.Value.(map[uint64]*node)
-		n, has = m[uint64(id)]
+		m := f.Value.(*frozenMemtable)
+		n, has = m.nodes[uint64(id)]
 		if has {
 			s.memtableQueueLock.Unlock()
-			return n, nil
+			return n, nil, 0, nil
 		}
-		f = f.Next()
+		f = f.Prev()
 	}
 	s.memtableQueueLock.Unlock()
 
-	// Last, check all persistent nodetables; (1) using bitmap (2) using binary search on disk
-	// something like
-
-	panic("not implemented yet")
-}
+	// Last, check all persistent nodetables; (1) using bitmap (2) using binary search on disk.
+	// The tables are sorted by their creation date (newest first), so the first
+	// hit is the most recent version of the node.
+	for _, nt := range s.tables {
+		offset, err := nt.locate(uint64(id))
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if offset >= 0 {
+			return nil, nt, offset, nil
+		}
+	}
 
-func (s *storage) Unlink(from, to graphie.NodeID, attrs graphie.Attrs) error {
-	panic("not implemented")
+	return nil, nil, 0, ErrNotFound
 }
 
-func (s *storage) Link(from, to graphie.NodeID, attrs graphie.Attrs) error {
-	// Get both nodes
-
+func (s *storage) Unlink(from, to graphie.NodeID, attrs graphie.Attrs) (int, error) {
 	// TODO: Do locking on a per node-id basis, not using a global lock
 	s.lock.Lock()
-	defer s.lock.Unlock()
+	pos, removed, err := s.unlink(from, to, attrs)
+	full := len(s.memtable) >= s.opts.memtable
+	s.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return removed, s.written(pos, full)
+}
 
-	// Receive a copy of the node's data
+// Does not hold s.lock; must be held outside
+func (s *storage) unlink(from, to graphie.NodeID, attrs graphie.Attrs) (int64, int, error) {
 	nodeFrom, err := s.get(from)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
-	nodeTo, err := s.get(to)
-	if err != nil {
-		return err
+	nodeTo := nodeFrom
+	if from != to {
+		nodeTo, err = s.get(to)
+		if err != nil {
+			return 0, 0, err
+		}
 	}
 
-	nodeFrom.linksOut = append(nodeFrom.linksOut, &link{
-		other: nodeTo.id,
-		attrs: attrs,
-	})
+	var removed int
+	nodeFrom.linksOut, removed = unlinkFrom(nodeFrom.linksOut, nodeTo.id, attrs)
+	if removed == 0 {
+		return 0, 0, nil
+	}
+	nodeTo.linksIn, _ = unlinkFrom(nodeTo.linksIn, nodeFrom.id, attrs)
 
-	nodeTo.linksIn = append(nodeTo.linksIn, &link{
-		other: nodeFrom.id,
-		attrs: attrs,
-	})
+	nodes := []*node{nodeFrom}
+	if nodeTo != nodeFrom {
+		nodes = append(nodes, nodeTo)
+	}
 
-	// Both nodes must be rewritten, add them to the memtable
-	s.memtable[nodeFrom.id] = nodeFrom
-	s.memtable[nodeTo.id] = nodeTo
+	pos, err := s.logMutation(nodes...)
+	if err != nil {
+		return 0, 0, err
+	}
 
-	return nil
+	for _, n := range nodes {
+		s.put(n)
+	}
+
+	return pos, removed, nil
 }
 
-func (s *storage) memtableWorker() {
-	defer s.wg.Done()
+func (s *storage) Link(from, to graphie.NodeID, typ string, attrs graphie.Attrs) (graphie.EdgeID, error) {
+	// TODO: Do locking on a per node-id basis, not using a global lock
+	s.lock.Lock()
+	id, pos, err := s.link(from, to, typ, attrs)
+	full := len(s.memtable) >= s.opts.memtable
+	s.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return graphie.EdgeID(id), s.written(pos, full)
+}
 
-	for el := range s.memtableWorkersChan {
-		mem := el.Value.(map[uint64]*node)
+// Does not hold s.lock; must be held outside
+func (s *storage) link(from, to graphie.NodeID, typ string, attrs graphie.Attrs) (uint64, int64, error) {
+	// Get both nodes
 
-		// Make the memtable persistent
-		h := md5.New()
-		_, err := io.CopyN(h, rand.Reader, 32)
-		if err != nil {
-			panic(err)
-		}
-		nt, err := createNodetable(mem, filepath.Join(s.path, fmt.Sprintf("%x.nt", h.Sum(nil))))
+	// Receive a copy of the node's data
+	nodeFrom, err := s.get(from)
+	if err != nil {
+		return 0, 0, err
+	}
+	nodeTo := nodeFrom
+	if from != to {
+		nodeTo, err = s.get(to)
 		if err != nil {
-			panic(err)
+			return 0, 0, err
 		}
+	}
 
-		// Remove it now from the memtable-queue and add it to the nodetables atomically
-		s.lock.Lock()
-
-		s.memtableQueueLock.Lock()
-		s.memtableQueue.Remove(el)
-		s.memtableQueueLock.Unlock()
+	s.counterEdges++
+	id := s.counterEdges
+	tid := s.typeindex(typ)
 
-		s.tables = append(s.tables, nt)
+	attrs = copyAttrs(attrs)
+	nodeFrom.linksOut = insertLink(nodeFrom.linksOut, &link{
+		id:    id,
+		typ:   tid,
+		other: nodeTo.id,
+		attrs: attrs,
+	})
 
-		// It is important to keep all tables sorted by their creation date
-		sort.Sort(s.tables)
+	nodeTo.linksIn = insertLink(nodeTo.linksIn, &link{
+		id:    id,
+		typ:   tid,
+		other: nodeFrom.id,
+		attrs: attrs,
+	})
 
-		s.lock.Unlock()
+	pos, err := s.writeLink(nodeFrom, nodeTo)
+	if err != nil {
+		return 0, 0, err
 	}
+	return id, pos, nil
 }
 
+// writeLink writes the new versions of both ends of a link.
+//
 // Does not hold s.lock; must be held outside
-func (s *storage) labelindex(l string) uint16 {
-	i, has := s.labelIndex[l]
-	if has {
-		return i
+func (s *storage) writeLink(nodeFrom, nodeTo *node) (int64, error) {
+	nodes := []*node{nodeFrom}
+	if nodeTo != nodeFrom {
+		nodes = append(nodes, nodeTo)
 	}
 
-	if s.counterLabels >= 2^16-1 {
-		panic("Too many labels; max supported by happy is 2^16-1")
+	pos, err := s.logMutation(nodes...)
+	if err != nil {
+		return 0, err
 	}
 
-	s.counterLabels++
-	s.labelIndex[l] = s.counterLabels
+	// Both nodes must be rewritten, add them to the memtable
+	for _, n := range nodes {
+		s.put(n)
+	}
+
+	return pos, nil
+}
+
+// findEdge returns copies of both ends of the link id. The edge index might
+// be outdated like the attribute indexes, so the from-nodes found are
+// checked.
+//
+// Does not hold s.lock; must be held outside
+func (s *storage) findEdge(id graphie.EdgeID) (nodeFrom, nodeTo *node, err error) {
+	if s.closed {
+		return nil, nil, graphie.ErrClosed
+	}
+
+	from, found, err := s.edgeFrom(uint64(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !found {
+		return nil, nil, ErrEdgeNotFound
+	}
+	n, err := s.getRaw(graphie.NodeID(from))
+	if err == ErrNotFound {
+		return nil, nil, ErrEdgeNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+	out := linkByID(n.linksOut, uint64(id))
+	if out == nil {
+		// Removed since
+		return nil, nil, ErrEdgeNotFound
+	}
+
+	nodeFrom = n.clone()
+	nodeTo = nodeFrom
+	if out.other != n.id {
+		nodeTo, err = s.get(graphie.NodeID(out.other))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return nodeFrom, nodeTo, nil
+}
+
+// edgeFrom returns the id of the from-node of the link with the given id. A
+// link never moves to another node, so the newest table knowing the link is
+// enough; whether the node still has it must be checked by the caller.
+//
+// Does not hold s.lock; must be held outside
+func (s *storage) edgeFrom(id uint64) (uint64, bool, error) {
+	lookup := func(ti tableIndex) (uint64, bool) {
+		for from := range ti[edgeKey].lookup(id) {
+			return from, true
+		}
+		return 0, false
+	}
+	if from, found := lookup(s.memtableIndex); found {
+		return from, true, nil
+	}
+	s.memtableQueueLock.Lock()
+	for f := s.memtableQueue.Front(); f != nil; f = f.Next() {
+		if from, found := lookup(f.Value.(*frozenMemtable).index); found {
+			s.memtableQueueLock.Unlock()
+			return from, true, nil
+		}
+	}
+	s.memtableQueueLock.Unlock()
+	for _, nt := range s.tables {
+		from, found, err := nt.lookupEdge(id)
+		if err != nil || found {
+			return from, found, err
+		}
+	}
+	return 0, false, nil
+}
+
+func (s *storage) GetEdge(id graphie.EdgeID) (*graphie.Edge, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	nodeFrom, nodeTo, err := s.findEdge(id)
+	if err != nil {
+		return nil, err
+	}
+	out := linkByID(nodeFrom.linksOut, uint64(id))
+	return &graphie.Edge{
+		ID:    id,
+		Type:  s.typeName(out.typ),
+		From:  graphie.NodeID(nodeFrom.id),
+		To:    graphie.NodeID(nodeTo.id),
+		Attrs: copyAttrs(out.attrs),
+	}, nil
+}
+
+func (s *storage) SetEdgeAttr(id graphie.EdgeID, key string, value interface{}) error {
+	s.lock.Lock()
+	pos, err := s.setEdgeAttr(id, key, value)
+	full := len(s.memtable) >= s.opts.memtable
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.written(pos, full)
+}
+
+// Does not hold s.lock; must be held outside
+func (s *storage) setEdgeAttr(id graphie.EdgeID, key string, value interface{}) (int64, error) {
+	nodeFrom, nodeTo, err := s.findEdge(id)
+	if err != nil {
+		return 0, err
+	}
+
+	// The attributes are shared with older versions; replace them
+	out := linkByID(nodeFrom.linksOut, uint64(id))
+	attrs := copyAttrs(out.attrs)
+	if attrs == nil {
+		attrs = make(graphie.Attrs)
+	}
+	attrs[key] = value
+	out.attrs = attrs
+	linkByID(nodeTo.linksIn, uint64(id)).attrs = attrs
+
+	return s.writeLink(nodeFrom, nodeTo)
+}
+
+func (s *storage) RemoveEdge(id graphie.EdgeID) error {
+	s.lock.Lock()
+	pos, err := s.removeEdge(id)
+	full := len(s.memtable) >= s.opts.memtable
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.written(pos, full)
+}
+
+// Does not hold s.lock; must be held outside
+func (s *storage) removeEdge(id graphie.EdgeID) (int64, error) {
+	nodeFrom, nodeTo, err := s.findEdge(id)
+	if err != nil {
+		return 0, err
+	}
+
+	nodeFrom.linksOut = removeLink(nodeFrom.linksOut, uint64(id))
+	nodeTo.linksIn = removeLink(nodeTo.linksIn, uint64(id))
+
+	return s.writeLink(nodeFrom, nodeTo)
+}
+
+// memtableWorker writes the memtables passed by memtableFlush to
+// nodetables. If that fails, the memtable stays in the queue (and all newer
+// ones, they're retired in order) and its commit log segments are kept, so
+// it's replayed on the next start.
+func (s *storage) memtableWorker() {
+	defer s.wg.Done()
+
+	for el := range s.memtableWorkersChan {
+		err := s.persistMemtable(el.Value.(*frozenMemtable))
+		if err != nil {
+			s.fail(err)
+		}
+	}
+}
+
+func (s *storage) persistMemtable(mem *frozenMemtable) error {
+	// Make the memtable persistent
+	filename, err := s.nodetableFilename()
+	if err != nil {
+		return err
+	}
+	s.lock.RLock()
+	keys := s.indexes.copy()
+	s.lock.RUnlock()
+	nt, err := createNodetable(mem.nodes, filename, mem.created, keys)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	mem.table = nt
+	// Indexes might have been declared in the meantime
+	err = nt.ensureIndex(s.indexes)
+	if err != nil {
+		return err
+	}
+	return s.retireMemtables()
+}
+
+// fail records the error of a background worker. The storage can't persist
+// its data anymore; all following mutations fail with the error, so does
+// Stop.
+func (s *storage) fail(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// failure returns the error recorded by fail
+func (s *storage) failure() error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.err
+}
+
+// nodetableFilename returns a new random filename for a nodetable
+func (s *storage) nodetableFilename() (string, error) {
+	h := md5.New()
+	_, err := io.CopyN(h, rand.Reader, 32)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.path, fmt.Sprintf("%x%s", h.Sum(nil), nodetableExtension)), nil
+}
+
+// retireMemtables moves all persisted memtables from the front of the queue
+// to the nodetables and removes their commit log segments. Memtables are
+// retired strictly in the order they were flushed; a memtable persisted early
+// by a fast worker waits (and stays readable in the queue) until all older
+// ones are persisted, too. Otherwise a replay after a crash could bring back
+// older versions of a node on top of newer ones.
+//
+// s.lock must be held outside.
+func (s *storage) retireMemtables() error {
+	var logs []string
+
+	s.memtableQueueLock.Lock()
+	for {
+		f := s.memtableQueue.Front()
+		if f == nil || f.Value.(*frozenMemtable).table == nil {
+			break
+		}
+		mem := s.memtableQueue.Remove(f).(*frozenMemtable)
+		s.tables = append(s.tables, mem.table)
+		logs = append(logs, mem.logs...)
+	}
+	s.memtableQueueLock.Unlock()
+
+	if len(logs) == 0 {
+		return nil
+	}
+
+	// It is important to keep all tables sorted by their creation date
+	sort.Sort(s.tables)
+
+	// The labels and counters must be safe before the commit log goes away
+	err := s.writeManifest()
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range logs {
+		err = os.Remove(filename)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.triggerCompaction()
+
+	return syncDir(s.path)
+}
+
+// Does not hold s.lock; must be held outside
+func (s *storage) labelindex(l string) uint16 {
+	i, has := s.labelIndex[l]
+	if has {
+		return i
+	}
+
+	if s.counterLabels >= math.MaxUint16 {
+		panic("Too many labels; max supported by happy is 2^16-1")
+	}
+
+	s.counterLabels++
+	s.labelIndex[l] = s.counterLabels
+	s.labelNames[s.counterLabels] = l
+	s.pendingLabels = append(s.pendingLabels, l)
 	return s.counterLabels
 
 }
 
+// Link types share the label ids; untyped links have type 0.
+//
+// Does not hold s.lock; must be held outside
+func (s *storage) typeindex(typ string) uint16 {
+	if typ == "" {
+		return 0
+	}
+	return s.labelindex(typ)
+}
+
+// typeIDs maps link types to their ids; nil stands for all types. Unknown
+// types are dropped, no link has them.
+//
+// Does not hold s.lock; must be held outside
+func (s *storage) typeIDs(types []string) []uint16 {
+	if len(types) == 0 {
+		return nil
+	}
+	ids := make([]uint16, 0, len(types))
+	for _, typ := range types {
+		if typ == "" {
+			ids = append(ids, 0)
+		} else if id, has := s.labelIndex[typ]; has {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Does not hold s.lock; must be held outside
+func (s *storage) typeName(typ uint16) string {
+	if typ == 0 {
+		return ""
+	}
+	return s.labelNames[typ]
+}
+
+// typeNamer returns a typeName which holds s.lock itself and caches the
+// names, so walks can resolve the types of their links cheaply.
+func (s *storage) typeNamer() func(typ uint16) string {
+	names := make(map[uint16]string)
+	return func(typ uint16) string {
+		name, has := names[typ]
+		if !has {
+			s.lock.RLock()
+			name = s.typeName(typ)
+			s.lock.RUnlock()
+			names[typ] = name
+		}
+		return name
+	}
+}
+
 func (s *storage) Merge(labels []string, attrs graphie.Attrs) (graphie.NodeID, error) {
-	return s.Add(labels, attrs)
+	return s.MergeContext(context.Background(), labels, attrs)
+}
+
+// MergeContext can be cancelled while looking for the node; once it's
+// found, the mutation is written in any case.
+func (s *storage) MergeContext(ctx context.Context, labels []string, attrs graphie.Attrs) (graphie.NodeID, error) {
+	s.lock.Lock()
+	id, pos, err := s.merge(ctx, labels, attrs)
+	full := len(s.memtable) >= s.opts.memtable
+	s.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	err = s.written(pos, full)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// Does not hold s.lock; must be held outside
+func (s *storage) merge(ctx context.Context, labels []string, attrs graphie.Attrs) (graphie.NodeID, int64, error) {
+	if s.closed {
+		return 0, 0, graphie.ErrClosed
+	}
+
+	lids, known := s.labelIDs(labels)
+	keys, rest := graphie.SplitKeys(attrs, func(attr string) bool {
+		for _, lid := range lids {
+			if s.keys.has(lid, attr) {
+				return true
+			}
+		}
+		return false
+	})
+	if len(keys) == 0 {
+		return 0, 0, graphie.ErrNoKeys
+	}
+
+	var old *node
+	if known {
+		var err error
+		old, err = s.findNode(ctx, lids, keys)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if old == nil {
+		n, pos, err := s.add(labels, attrs)
+		if err != nil {
+			return 0, 0, err
+		}
+		return graphie.NodeID(n.id), pos, nil
+	}
+
+	id := graphie.NodeID(old.id)
+	if len(rest) == 0 {
+		return id, 0, nil
+	}
+
+	err := s.checkUnique(old.id, old.labels, rest)
+	if err != nil {
+		return 0, 0, err
+	}
+	n := old.clone()
+	for k, v := range rest {
+		n.attrs[k] = v
+	}
+
+	pos, err := s.logMutation(n)
+	if err != nil {
+		return 0, 0, err
+	}
+	s.put(n)
+
+	return id, pos, nil
+}
+
+// findNode returns the newest version of a node carrying all labels and
+// matching all attrs or nil. Without an indexed attribute it has to scan the
+// whole database.
+//
+// Does not hold s.lock; must be held outside
+func (s *storage) findNode(ctx context.Context, lids []uint16, attrs graphie.Attrs) (*node, error) {
+	for attr, v := range attrs {
+		indexed := false
+		for _, lid := range lids {
+			if s.keys.has(lid, attr) {
+				indexed = true
+				break
+			}
+		}
+		if !indexed {
+			continue
+		}
+
+		ids, err := s.findByAttr(ctx, lids, attr, v)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			n, err := s.getRaw(graphie.NodeID(id))
+			if err != nil {
+				return nil, err
+			}
+			if n.attrs.Match(attrs) {
+				return n, nil
+			}
+		}
+		return nil, nil
+	}
+
+	var found *node
+	err := s.scan(ctx, func(n *node) error {
+		if !n.hasLabels(lids) || !n.attrs.Match(attrs) {
+			return nil
+		}
+		found = n
+		return errStopScan
+	})
+	if err != nil && err != errStopScan {
+		return nil, err
+	}
+	return found, nil
+}
+
+// scan calls fn for the newest version of every node, skipping removed
+// nodes. The nodes must not be modified. The scan stops with ctx.Err() once
+// ctx is done.
+//
+// Does not hold s.lock; must be held outside
+func (s *storage) scan(ctx context.Context, fn func(n *node) error) error {
+	seen := make(map[uint64]struct{})
+	visit := func(n *node) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, has := seen[n.id]; has {
+			return nil
+		}
+		seen[n.id] = struct{}{}
+		if n.deleted {
+			return nil
+		}
+		return fn(n)
+	}
+
+	for _, n := range s.memtable {
+		if err := visit(n); err != nil {
+			return err
+		}
+	}
+
+	// Newest first, as in locate()
+	s.memtableQueueLock.Lock()
+	frozen := make([]*frozenMemtable, 0, s.memtableQueue.Len())
+	for f := s.memtableQueue.Back(); f != nil; f = f.Prev() {
+		frozen = append(frozen, f.Value.(*frozenMemtable))
+	}
+	s.memtableQueueLock.Unlock()
+	for _, m := range frozen {
+		for _, n := range m.nodes {
+			if err := visit(n); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, nt := range s.tables {
+		if err := nt.each(visit); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *storage) Remove(id graphie.NodeID) error {
 	s.lock.Lock()
-	defer s.lock.Unlock()
+	pos, err := s.remove(id)
+	full := len(s.memtable) >= s.opts.memtable
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.written(pos, full)
+}
+
+// Does not hold s.lock; must be held outside
+func (s *storage) remove(id graphie.NodeID) (int64, error) {
+	n, err := s.getRaw(id)
+	if err != nil {
+		return 0, err
+	}
 
-	// TODO (important):
 	// To keep the database consistent, we have to remove all references to this
-	// node (outgoing and incoming nodes in other nodes and we have to write them
-	// again)
+	// node in its neighbours and write them again
+	neighbours := make(map[uint64]*node)
+	neighbour := func(other uint64) (*node, error) {
+		nb, has := neighbours[other]
+		if has {
+			return nb, nil
+		}
+		nb, err := s.get(graphie.NodeID(other))
+		if err != nil {
+			return nil, err
+		}
+		neighbours[other] = nb
+		return nb, nil
+	}
 
-	// TODO: We're currently ignoring that the node might not exist
-	s.memtable[uint64(id)] = nil
-	return nil
+	for _, lnk := range n.linksOut {
+		if lnk.other == n.id {
+			continue
+		}
+		nb, err := neighbour(lnk.other)
+		if err != nil {
+			return 0, err
+		}
+		nb.linksIn = removeLinks(nb.linksIn, n.id)
+	}
+	for _, lnk := range n.linksIn {
+		if lnk.other == n.id {
+			continue
+		}
+		nb, err := neighbour(lnk.other)
+		if err != nil {
+			return 0, err
+		}
+		nb.linksOut = removeLinks(nb.linksOut, n.id)
+	}
+
+	nodes := make([]*node, 0, len(neighbours)+1)
+	nodes = append(nodes, newTombstone(n.id))
+	for _, nb := range neighbours {
+		nodes = append(nodes, nb)
+	}
+
+	pos, err := s.logMutation(nodes...)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, nn := range nodes {
+		s.put(nn)
+	}
+
+	return pos, nil
 }
 
+// EnsureIndexNodes declares attrName as a key attribute of all nodes carrying
+// one of the labels (see Merge) and indexes it. The indexes of a nodetable
+// are stored in it; the ones declared later are stored next to it until
+// compaction rewrites the table.
 func (s *storage) EnsureIndexNodes(labels []string, attrName string) error {
-	return nil
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return graphie.ErrClosed
+	}
+
+	changed, err := s.ensureIndex(labels, attrName, false)
+	if err != nil || !changed {
+		return err
+	}
+	return s.writeManifest()
+}
+
+// EnsureUnique indexes the attribute like EnsureIndexNodes; the indexes are
+// used to look for duplicates.
+func (s *storage) EnsureUnique(labels []string, attrName string) error {
+	return s.EnsureUniqueContext(context.Background(), labels, attrName)
+}
+
+// EnsureUniqueContext can be cancelled while looking for duplicates; the
+// attribute is indexed anyway, but not unique.
+func (s *storage) EnsureUniqueContext(ctx context.Context, labels []string, attrName string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return graphie.ErrClosed
+	}
+
+	changed, err := s.ensureIndex(labels, attrName, false)
+	if err != nil {
+		return err
+	}
+
+	for _, lbl := range labels {
+		lid := s.labelIndex[lbl]
+		if s.uniques.has(lid, attrName) {
+			continue
+		}
+		err = s.checkDuplicates(ctx, lid, attrName)
+		if err != nil {
+			break
+		}
+		s.uniques.add(lid, attrName)
+		changed = true
+	}
+
+	if changed {
+		if merr := s.writeManifest(); err == nil {
+			err = merr
+		}
+	}
+	return err
+}
+
+// FindByAttr uses the indexes created by EnsureIndexNodes if there are any
+// for one of the labels; otherwise it has to scan the whole database.
+func (s *storage) FindByAttr(labels []string, key string, value interface{}) ([]graphie.NodeID, error) {
+	return s.FindByAttrContext(context.Background(), labels, key, value)
+}
+
+func (s *storage) FindByAttrContext(ctx context.Context, labels []string, key string, value interface{}) ([]graphie.NodeID, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.closed {
+		return nil, graphie.ErrClosed
+	}
+
+	result := make([]graphie.NodeID, 0)
+	lids, known := s.labelIDs(labels)
+	if !known {
+		return result, nil
+	}
+
+	ids, err := s.findByAttr(ctx, lids, key, value)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		result = append(result, graphie.NodeID(id))
+	}
+	return result, nil
+}
+
+// WalkNodes doesn't read any records: the ids of the nodes in memory are
+// merged with the label sections of the nodetables. The walk sees the nodes
+// as they were when it started; fn is called without holding s.lock.
+func (s *storage) WalkNodes(labels []string, fn func(id graphie.NodeID) error) error {
+	return s.WalkNodesContext(context.Background(), labels, fn)
+}
+
+func (s *storage) WalkNodesContext(ctx context.Context, labels []string, fn func(id graphie.NodeID) error) error {
+	s.lock.RLock()
+	if s.closed {
+		s.lock.RUnlock()
+		return graphie.ErrClosed
+	}
+	lids, known := s.labelIDs(labels)
+	if !known {
+		s.lock.RUnlock()
+		return nil
+	}
+
+	// The memtables are small, their matches are collected while holding
+	// s.lock. Every node in memory shadows its versions in the tables.
+	inMemory := make(map[uint64]struct{})
+	ids := make(uint64s, 0)
+	collect := func(nodes map[uint64]*node) {
+		for id, n := range nodes {
+			if _, has := inMemory[id]; has {
+				continue
+			}
+			inMemory[id] = struct{}{}
+			if !n.deleted && n.hasLabels(lids) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	collect(s.memtable)
+	s.memtableQueueLock.Lock()
+	for f := s.memtableQueue.Back(); f != nil; f = f.Prev() {
+		collect(f.Value.(*frozenMemtable).nodes)
+	}
+	s.memtableQueueLock.Unlock()
+
+	tables := make(nodetables, len(s.tables))
+	copy(tables, s.tables)
+	for _, nt := range tables {
+		nt.refs.Add(1)
+	}
+	s.lock.RUnlock()
+	defer unref(tables)
+
+	return s.walkNodes(ctx, ids, inMemory, tables, lids, fn)
+}
+
+// walkNodes calls fn for the ids of all nodes carrying all labels in the order
+// of the ids. ids are the matching nodes in memory, inMemory holds all nodes
+// in memory; they shadow their versions in the tables (newest first).
+func (s *storage) walkNodes(ctx context.Context, ids uint64s, inMemory map[uint64]struct{}, tables nodetables, lids []uint16, fn func(id graphie.NodeID) error) error {
+	sort.Sort(ids)
+
+	// The tables are walked by the first label; all nodes carry label 0
+	var first uint16
+	if len(lids) > 0 {
+		first = lids[0]
+	}
+	cursors := make([]*labelCursor, 0, len(tables))
+	for _, nt := range tables {
+		c, err := nt.labelCursor(first)
+		if err != nil {
+			return err
+		}
+		cursors = append(cursors, c)
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// The smallest id left in memory or in one of the tables
+		var id uint64
+		found := len(ids) > 0
+		if found {
+			id = ids[0]
+		}
+		for _, c := range cursors {
+			if !c.done && (!found || c.id < id) {
+				id, found = c.id, true
+			}
+		}
+		if !found {
+			return nil
+		}
+
+		match, err := s.walkMatch(id, ids, inMemory, tables, cursors, lids)
+		if err != nil {
+			return err
+		}
+		if len(ids) > 0 && ids[0] == id {
+			ids = ids[1:]
+		}
+		for _, c := range cursors {
+			if !c.done && c.id == id {
+				if err := c.next(); err != nil {
+					return err
+				}
+			}
+		}
+
+		if match {
+			err = fn(graphie.NodeID(id))
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// walkMatch reports whether the newest version of the node id found by
+// WalkNodes carries all labels. The tables and the cursors are newest first.
+func (s *storage) walkMatch(id uint64, ids uint64s, inMemory map[uint64]struct{}, tables nodetables, cursors []*labelCursor, lids []uint16) (bool, error) {
+	if len(ids) > 0 && ids[0] == id {
+		return true, nil
+	}
+	if _, has := inMemory[id]; has {
+		return false, nil
+	}
+
+	for i, c := range cursors {
+		if c.done || c.id != id {
+			// A newer table without the label might hold the node
+			offset, err := tables[i].locate(id)
+			if err != nil || offset >= 0 {
+				return false, err
+			}
+			continue
+		}
+
+		// The newest version; it carries the first label
+		for j := 1; j < len(lids); j++ {
+			has, err := tables[i].hasLabel(lids[j], id)
+			if err != nil || !has {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func (s *storage) Labels(id graphie.NodeID) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	n, err := s.getRaw(id)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := make([]string, 0, len(n.labels))
+	for _, lid := range n.labels {
+		labels = append(labels, s.labelNames[lid])
+	}
+	return labels, nil
 }
 
+func (s *storage) AddLabel(id graphie.NodeID, label string) error {
+	s.lock.Lock()
+	pos, err := s.addLabel(id, label)
+	full := len(s.memtable) >= s.opts.memtable
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.written(pos, full)
+}
+
+// Does not hold s.lock; must be held outside
+func (s *storage) addLabel(id graphie.NodeID, label string) (int64, error) {
+	old, err := s.getRaw(id)
+	if err != nil {
+		return 0, err
+	}
+	lid := s.labelindex(label)
+	if old.hasLabels([]uint16{lid}) {
+		return 0, nil
+	}
+	err = s.checkUnique(old.id, []uint16{lid}, old.attrs)
+	if err != nil {
+		return 0, err
+	}
+
+	n := old.clone()
+	n.labels = append(n.labels, lid)
+	return s.relabel(n)
+}
+
+func (s *storage) RemoveLabel(id graphie.NodeID, label string) error {
+	s.lock.Lock()
+	pos, err := s.removeLabel(id, label)
+	full := len(s.memtable) >= s.opts.memtable
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.written(pos, full)
+}
+
+// Does not hold s.lock; must be held outside
+func (s *storage) removeLabel(id graphie.NodeID, label string) (int64, error) {
+	old, err := s.getRaw(id)
+	if err != nil {
+		return 0, err
+	}
+	lid, has := s.labelIndex[label]
+	if !has || !old.hasLabels([]uint16{lid}) {
+		return 0, nil
+	}
+
+	n := old.clone()
+	n.labels = n.labels[:0]
+	for _, l := range old.labels {
+		if l != lid {
+			n.labels = append(n.labels, l)
+		}
+	}
+	return s.relabel(n)
+}
+
+// relabel writes the new version of a node whose labels changed. The old
+// version stays in the indexes of its label; lookups check the labels of the
+// newest version anyway.
+//
+// Does not hold s.lock; must be held outside
+func (s *storage) relabel(n *node) (int64, error) {
+	pos, err := s.logMutation(n)
+	if err != nil {
+		return 0, err
+	}
+
+	s.put(n)
+
+	return pos, nil
+}
+
+// EnsureIndexLinks indexes attrName of all links starting at nodes carrying
+// one of the labels like EnsureIndexNodes.
 func (s *storage) EnsureIndexLinks(labels []string, attrName string) error {
-	return nil
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return graphie.ErrClosed
+	}
+
+	changed, err := s.ensureIndex(labels, attrName, true)
+	if err != nil || !changed {
+		return err
+	}
+	return s.writeManifest()
 }
 
 func (s *storage) In(id graphie.NodeID) ([]*graphie.Link, error) {
-	return nil, nil
+	links := make([]*graphie.Link, 0)
+	err := s.WalkIn(id, func(l *graphie.Link) error {
+		links = append(links, l)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
 }
 
 func (s *storage) Out(id graphie.NodeID) ([]*graphie.Link, error) {
-	return nil, nil
+	links := make([]*graphie.Link, 0)
+	err := s.WalkOut(id, func(l *graphie.Link) error {
+		links = append(links, l)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (s *storage) WalkIn(id graphie.NodeID, fn func(l *graphie.Link) error) error {
+	return s.walkLinks(context.Background(), id, false, nil, fn)
+}
+
+func (s *storage) WalkOut(id graphie.NodeID, fn func(l *graphie.Link) error) error {
+	return s.walkLinks(context.Background(), id, true, nil, fn)
+}
+
+func (s *storage) WalkInTypes(id graphie.NodeID, types []string, fn func(l *graphie.Link) error) error {
+	return s.walkLinks(context.Background(), id, false, types, fn)
+}
+
+func (s *storage) WalkOutTypes(id graphie.NodeID, types []string, fn func(l *graphie.Link) error) error {
+	return s.walkLinks(context.Background(), id, true, types, fn)
+}
+
+// walkLinks calls fn for every in- or out-link of one of the types of the
+// newest version of the node until ctx is done. s.lock is not held while fn
+// is called, so fn may use the storage.
+func (s *storage) walkLinks(ctx context.Context, id graphie.NodeID, out bool, types []string, fn func(l *graphie.Link) error) error {
+	s.lock.RLock()
+	n, nt, offset, err := s.locate(id)
+	if nt != nil {
+		nt.refs.Add(1)
+	}
+	tids := s.typeIDs(types)
+	s.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	typeName := s.typeNamer()
+
+	if nt != nil {
+		// Stream the links from disk
+		defer nt.refs.Done()
+		return nt.walkLinks(offset, out, tids, func(lnk *link) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return fn(&graphie.Link{
+				ID:    graphie.EdgeID(lnk.id),
+				Type:  typeName(lnk.typ),
+				Other: graphie.NodeID(lnk.other),
+				Attrs: lnk.attrs,
+			})
+		})
+	}
+
+	// Versions in memory are immutable, they can be read without the lock
+	if n.deleted {
+		return ErrNotFound
+	}
+	links := n.linksIn
+	if out {
+		links = n.linksOut
+	}
+	return linksOfTypes(links, tids, func(lnk *link) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// The attributes are shared between all versions of the node
+		var attrs graphie.Attrs
+		if lnk.attrs != nil {
+			attrs = make(graphie.Attrs, len(lnk.attrs))
+			for k, v := range lnk.attrs {
+				attrs[k] = v
+			}
+		}
+
+		return fn(&graphie.Link{
+			ID:    graphie.EdgeID(lnk.id),
+			Type:  typeName(lnk.typ),
+			Other: graphie.NodeID(lnk.other),
+			Attrs: attrs,
+		})
+	})
 }
 
 // Attribute handling
 func (s *storage) Set(id graphie.NodeID, key string, value interface{}) error {
-	return nil
+	s.lock.Lock()
+	pos, err := s.set(id, key, value)
+	full := len(s.memtable) >= s.opts.memtable
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.written(pos, full)
+}
+
+// Does not hold s.lock; must be held outside
+func (s *storage) set(id graphie.NodeID, key string, value interface{}) (int64, error) {
+	old, err := s.getRaw(id)
+	if err != nil {
+		return 0, err
+	}
+	err = s.checkUnique(old.id, old.labels, graphie.Attrs{key: value})
+	if err != nil {
+		return 0, err
+	}
+
+	// Write a copy of the node's data back with the new value
+	n := old.clone()
+	n.attrs[key] = value
+
+	pos, err := s.logMutation(n)
+	if err != nil {
+		return 0, err
+	}
+
+	s.put(n)
+
+	return pos, nil
 }
 
 func (s *storage) Get(id graphie.NodeID, key string) (interface{}, error) {
-	return nil, nil
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	n, err := s.getRaw(id)
+	if err != nil {
+		return nil, err
+	}
+	v, has := n.attrs[key]
+	if !has {
+		return nil, ErrAttrNotFound
+	}
+	return v, nil
 }
 
 func (s *storage) Has(id graphie.NodeID, key string) (bool, error) {
-	return false, nil
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	n, err := s.getRaw(id)
+	if err != nil {
+		return false, err
+	}
+	_, has := n.attrs[key]
+	return has, nil
 }
 
 func (s *storage) Attrs(id graphie.NodeID) (graphie.Attrs, error) {
-	return nil, nil
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	n, err := s.getRaw(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Versions of a node are immutable; hand out a copy
+	attrs := make(graphie.Attrs, len(n.attrs))
+	for k, v := range n.attrs {
+		attrs[k] = v
+	}
+	return attrs, nil
 }
@@ -0,0 +1,325 @@
+package happy
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/flosch/graphie"
+)
+
+// TestFailure makes sure the error of a background worker isn't lost: it's
+// returned by all following mutations and by Stop.
+func TestFailure(t *testing.T) {
+	st, err := registerHappy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := st.(*storage)
+	if err := s.Start(t.TempDir(), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	failure := errors.New("disk on fire")
+	s.fail(failure)
+	if _, err := s.Add(nil, nil); err != failure {
+		t.Fatalf("Add after a failure returned %v, want %v", err, failure)
+	}
+	if err := s.Stop(); err != failure {
+		t.Fatalf("Stop after a failure returned %v, want %v", err, failure)
+	}
+}
+
+// TestWalkNodes walks labels whose nodes are spread over several tables and
+// the memtable; only the newest versions count.
+func TestWalkNodes(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *storage {
+		st, err := registerHappy(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := st.(*storage)
+		if err := s.Start(dir, ""); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	add := func(s *storage, labels ...string) graphie.NodeID {
+		t.Helper()
+		id, err := s.Add(labels, nil)
+		must(err)
+		return id
+	}
+
+	// Every round ends up in its own table
+	s := open()
+	a, b, c, d := add(s, "x"), add(s, "x", "y"), add(s, "x"), add(s, "y")
+	must(s.Stop())
+
+	s = open()
+	must(s.RemoveLabel(b, "x"))
+	must(s.Remove(c))
+	e := add(s, "x")
+	must(s.Stop())
+
+	s = open()
+	must(s.AddLabel(a, "y"))
+	f := add(s, "x", "y")
+	must(s.Stop())
+
+	s = open()
+	defer s.Stop()
+	must(s.AddLabel(d, "x"))
+	g := add(s, "x")
+	must(s.Remove(e))
+
+	tests := []struct {
+		labels []string
+		want   []graphie.NodeID
+	}{
+		{nil, []graphie.NodeID{a, b, d, f, g}},
+		{[]string{"x"}, []graphie.NodeID{a, d, f, g}},
+		{[]string{"y"}, []graphie.NodeID{a, b, d, f}},
+		{[]string{"x", "y"}, []graphie.NodeID{a, d, f}},
+		{[]string{"y", "x"}, []graphie.NodeID{a, d, f}},
+		{[]string{"z"}, nil},
+	}
+	for _, test := range tests {
+		var ids []graphie.NodeID
+		err := s.WalkNodes(test.labels, func(id graphie.NodeID) error {
+			ids = append(ids, id)
+			return nil
+		})
+		must(err)
+		if !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("WalkNodes(%v) = %v, want %v", test.labels, ids, test.want)
+		}
+	}
+}
+
+// TestMutationsFlush makes sure every kind of mutation flushes a full
+// memtable, not only Add.
+func TestMutationsFlush(t *testing.T) {
+	dir := t.TempDir()
+	open := func(attrs string) *storage {
+		st, err := registerHappy(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := st.(*storage)
+		if err := s.Start(attrs, ""); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := open(dir)
+	ids := make([]graphie.NodeID, 10)
+	for i := range ids {
+		id, err := s.Add(nil, nil)
+		must(err)
+		ids[i] = id
+	}
+	must(s.Stop())
+
+	tests := []struct {
+		name   string
+		mutate func(s *storage, id graphie.NodeID) error
+	}{
+		{"Set", func(s *storage, id graphie.NodeID) error {
+			return s.Set(id, "x", 1)
+		}},
+		{"Link", func(s *storage, id graphie.NodeID) error {
+			_, err := s.Link(id, id, "", nil)
+			return err
+		}},
+		{"AddLabel", func(s *storage, id graphie.NodeID) error {
+			return s.AddLabel(id, "x")
+		}},
+		{"Remove", func(s *storage, id graphie.NodeID) error {
+			return s.Remove(id)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := open(dir + "?memtable=4")
+			defer s.Stop()
+			for _, id := range ids {
+				must(test.mutate(s, id))
+			}
+			s.lock.RLock()
+			size := len(s.memtable)
+			s.lock.RUnlock()
+			if size >= 4 {
+				t.Errorf("%d nodes in the memtable after mutating %d nodes, want less than 4", size, len(ids))
+			}
+		})
+	}
+}
+
+func TestStopBeforeStart(t *testing.T) {
+	st, err := registerHappy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Stop(); err != nil {
+		t.Fatalf("Stop before Start returned %v", err)
+	}
+}
+
+// TestStopWaitsForReaders makes sure Stop doesn't close the tables under a
+// reader of a snapshot.
+func TestStopWaitsForReaders(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *storage {
+		st, err := registerHappy(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := st.(*storage)
+		if err := s.Start(dir, ""); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	s := open()
+	if _, err := s.Add(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = open()
+	sn, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, tables, err := sn.(*snapshot).acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) == 0 {
+		t.Fatal("the snapshot has no tables")
+	}
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- s.Stop()
+	}()
+	select {
+	case err := <-stopped:
+		t.Fatalf("Stop returned %v while a reader was active", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unref(tables)
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSnapshotReads reads a snapshot by the indexes, the label sections and
+// the edge sections and makes sure the replaced versions are dropped once the
+// snapshot is released.
+func TestSnapshotReads(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *storage {
+		st, err := registerHappy(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := st.(*storage)
+		if err := s.Start(dir, ""); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	add := func(s *storage, name string) graphie.NodeID {
+		t.Helper()
+		id, err := s.Add([]string{"x"}, graphie.Attrs{"name": name})
+		must(err)
+		return id
+	}
+
+	s := open()
+	must(s.EnsureIndexNodes([]string{"x"}, "name"))
+	a, b := add(s, "a"), add(s, "b")
+	lnk, err := s.Link(a, b, "knows", nil)
+	must(err)
+	must(s.Stop())
+
+	s = open()
+	defer s.Stop()
+	c := add(s, "a")
+	must(s.Set(b, "name", "a"))
+
+	st, err := s.Snapshot()
+	must(err)
+	sn := st.(*snapshot)
+	must(s.Set(a, "name", "z"))
+	must(s.Set(b, "name", "b"))
+	must(s.Remove(c))
+	add(s, "a")
+	must(s.RemoveEdge(lnk))
+	later, err := s.Link(b, a, "knows", nil)
+	must(err)
+
+	ids, err := sn.FindByAttr([]string{"x"}, "name", "a")
+	must(err)
+	if want := []graphie.NodeID{a, b, c}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("FindByAttr = %v, want %v", ids, want)
+	}
+	ids = nil
+	must(sn.WalkNodes([]string{"x"}, func(id graphie.NodeID) error {
+		ids = append(ids, id)
+		return nil
+	}))
+	if want := []graphie.NodeID{a, b, c}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("WalkNodes = %v, want %v", ids, want)
+	}
+	edge, err := sn.GetEdge(lnk)
+	must(err)
+	if edge.From != a || edge.To != b || edge.Type != "knows" {
+		t.Errorf("GetEdge = %+v", edge)
+	}
+	if _, err := sn.GetEdge(later); err != ErrEdgeNotFound {
+		t.Errorf("GetEdge of a link added later returned %v, want %v", err, ErrEdgeNotFound)
+	}
+
+	s.lock.RLock()
+	kept := s.memtable[uint64(b)].prev != nil
+	s.lock.RUnlock()
+	if !kept {
+		t.Fatal("the version seen by the snapshot wasn't kept")
+	}
+	must(sn.Release())
+	s.lock.RLock()
+	for id, n := range s.memtable {
+		if n.prev != nil {
+			t.Errorf("node %d keeps its replaced versions after the snapshot was released", id)
+		}
+	}
+	s.lock.RUnlock()
+}
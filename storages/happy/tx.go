@@ -0,0 +1,249 @@
+package happy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/flosch/graphie"
+)
+
+func (s *storage) ReserveID() (graphie.NodeID, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return 0, graphie.ErrClosed
+	}
+
+	s.counterNodes++
+	return graphie.NodeID(s.counterNodes), nil
+}
+
+func (s *storage) ReserveEdgeID() (graphie.EdgeID, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return 0, graphie.ErrClosed
+	}
+
+	s.counterEdges++
+	return graphie.EdgeID(s.counterEdges), nil
+}
+
+// Apply writes the new versions of all nodes touched by the operations as a
+// single commit log record, so a transaction is replayed completely or not
+// at all.
+func (s *storage) Apply(ops []graphie.TxOp) error {
+	s.lock.Lock()
+	pos, err := s.apply(ops)
+	full := len(s.memtable) >= s.opts.memtable
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.written(pos, full)
+}
+
+// Does not hold s.lock; must be held outside
+func (s *storage) apply(ops []graphie.TxOp) (int64, error) {
+	if s.closed {
+		return 0, graphie.ErrClosed
+	}
+
+	st := &stage{
+		s:     s,
+		nodes: make(map[uint64]*node),
+	}
+	for _, op := range ops {
+		err := st.apply(op)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err := st.checkUnique()
+	if err != nil {
+		return 0, err
+	}
+
+	nodes := make([]*node, 0, len(st.nodes))
+	for _, n := range st.nodes {
+		nodes = append(nodes, n)
+	}
+	pos, err := s.logMutation(nodes...)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, n := range nodes {
+		s.put(n)
+	}
+	return pos, nil
+}
+
+// A stage holds the new versions of the nodes changed by a transaction;
+// removed nodes are staged as tombstones.
+type stage struct {
+	s     *storage
+	nodes map[uint64]*node
+}
+
+func (st *stage) get(id uint64) (*node, error) {
+	n, has := st.nodes[id]
+	if has {
+		if n.deleted {
+			return nil, ErrNotFound
+		}
+		return n, nil
+	}
+
+	old, err := st.s.getRaw(graphie.NodeID(id))
+	if err != nil {
+		return nil, err
+	}
+	n = old.clone()
+	st.nodes[id] = n
+	return n, nil
+}
+
+func (st *stage) apply(op graphie.TxOp) error {
+	id := uint64(op.ID)
+	switch op.Kind {
+	case graphie.TxAdd:
+		if id > st.s.counterNodes {
+			return fmt.Errorf("Node id %d has not been reserved", id)
+		}
+		lids := make([]uint16, 0, len(op.Labels))
+		for _, lbl := range op.Labels {
+			lids = append(lids, st.s.labelindex(lbl))
+		}
+		st.nodes[id] = &node{
+			s:        st.s,
+			id:       id,
+			attrs:    copyAttrs(op.Attrs),
+			labels:   lids,
+			linksOut: make([]*link, 0),
+			linksIn:  make([]*link, 0),
+		}
+
+	case graphie.TxSet:
+		n, err := st.get(id)
+		if err != nil {
+			return err
+		}
+		if n.attrs == nil {
+			n.attrs = make(graphie.Attrs)
+		}
+		n.attrs[op.Key] = op.Value
+
+	case graphie.TxLink:
+		from, err := st.get(id)
+		if err != nil {
+			return err
+		}
+		to, err := st.get(uint64(op.To))
+		if err != nil {
+			return err
+		}
+		edge := uint64(op.Edge)
+		if edge == 0 || edge > st.s.counterEdges {
+			return fmt.Errorf("Edge id %d has not been reserved", edge)
+		}
+		typ := st.s.typeindex(op.Type)
+		attrs := copyAttrs(op.Attrs)
+		from.linksOut = insertLink(from.linksOut, &link{id: edge, typ: typ, other: to.id, attrs: attrs})
+		to.linksIn = insertLink(to.linksIn, &link{id: edge, typ: typ, other: from.id, attrs: attrs})
+
+	case graphie.TxUnlink:
+		from, err := st.get(id)
+		if err != nil {
+			return err
+		}
+		to, err := st.get(uint64(op.To))
+		if err != nil {
+			return err
+		}
+		from.linksOut, _ = unlinkFrom(from.linksOut, to.id, op.Attrs)
+		to.linksIn, _ = unlinkFrom(to.linksIn, from.id, op.Attrs)
+
+	case graphie.TxRemove:
+		n, err := st.get(id)
+		if err != nil {
+			return err
+		}
+		for _, lnk := range n.linksOut {
+			if lnk.other == n.id {
+				continue
+			}
+			nb, err := st.get(lnk.other)
+			if err != nil {
+				return err
+			}
+			nb.linksIn = removeLinks(nb.linksIn, n.id)
+		}
+		for _, lnk := range n.linksIn {
+			if lnk.other == n.id {
+				continue
+			}
+			nb, err := st.get(lnk.other)
+			if err != nil {
+				return err
+			}
+			nb.linksOut = removeLinks(nb.linksOut, n.id)
+		}
+		st.nodes[id] = newTombstone(id)
+
+	default:
+		return fmt.Errorf("Unknown transaction operation %d", op.Kind)
+	}
+	return nil
+}
+
+// checkUnique checks the staged nodes against each other and against all
+// nodes which aren't staged.
+//
+// Does not hold s.lock; must be held outside
+func (st *stage) checkUnique() error {
+	type uniqueKey struct {
+		label uint16
+		attr  string
+		value interface{}
+	}
+	seen := make(map[uniqueKey]struct{})
+
+	for _, n := range st.nodes {
+		if n.deleted {
+			continue
+		}
+		for _, lid := range n.labels {
+			for attr := range st.s.uniques[lid] {
+				v, has := n.attrs[attr]
+				if !has {
+					continue
+				}
+				violation := &graphie.ConstraintViolationError{
+					Label: st.s.labelNames[lid],
+					Attr:  attr,
+					Value: v,
+				}
+
+				k := uniqueKey{lid, attr, graphie.ValueKey(v)}
+				if _, has := seen[k]; has {
+					return violation
+				}
+				seen[k] = struct{}{}
+
+				ids, err := st.s.findByAttr(context.Background(), []uint16{lid}, attr, v)
+				if err != nil {
+					return err
+				}
+				for _, other := range ids {
+					if _, staged := st.nodes[other]; !staged {
+						return violation
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/flosch/graphie/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Suite{
+		Driver: "memory",
+	})
+}
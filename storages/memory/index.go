@@ -0,0 +1,183 @@
+package memory
+
+import (
+	"github.com/flosch/graphie"
+)
+
+// nodeIndex is a hash index over one attribute of all nodes carrying a label
+type nodeIndex map[interface{}]map[graphie.NodeID]struct{} // value -> node ids
+
+func (idx nodeIndex) add(id graphie.NodeID, value interface{}) {
+	key := graphie.ValueKey(value)
+	ids, has := idx[key]
+	if !has {
+		ids = make(map[graphie.NodeID]struct{})
+		idx[key] = ids
+	}
+	ids[id] = struct{}{}
+}
+
+func (idx nodeIndex) remove(id graphie.NodeID, value interface{}) {
+	key := graphie.ValueKey(value)
+	ids := idx[key]
+	delete(ids, id)
+	if len(ids) == 0 {
+		delete(idx, key)
+	}
+}
+
+func (idx nodeIndex) lookup(value interface{}) map[graphie.NodeID]struct{} {
+	return idx[graphie.ValueKey(value)]
+}
+
+// linkIndex is a hash index over one attribute of all links starting at
+// nodes carrying a label.
+type linkIndex map[interface{}]map[graphie.EdgeID]struct{} // value -> link ids
+
+func (idx linkIndex) add(id graphie.EdgeID, value interface{}) {
+	key := graphie.ValueKey(value)
+	ids, has := idx[key]
+	if !has {
+		ids = make(map[graphie.EdgeID]struct{})
+		idx[key] = ids
+	}
+	ids[id] = struct{}{}
+}
+
+func (idx linkIndex) remove(id graphie.EdgeID, value interface{}) {
+	key := graphie.ValueKey(value)
+	ids := idx[key]
+	delete(ids, id)
+	if len(ids) == 0 {
+		delete(idx, key)
+	}
+}
+
+// Does not hold s.m; must be held outside
+func (s *storage) indexNode(n *node) {
+	for _, lbl := range n.labels {
+		for attr, idx := range s.indexesNodes[lbl] {
+			if v, has := n.attrs[attr]; has {
+				idx.add(n.id, v)
+			}
+		}
+	}
+}
+
+// Does not hold s.m; must be held outside
+func (s *storage) unindexNode(n *node) {
+	for _, lbl := range n.labels {
+		for attr, idx := range s.indexesNodes[lbl] {
+			if v, has := n.attrs[attr]; has {
+				idx.remove(n.id, v)
+			}
+		}
+	}
+}
+
+// Does not hold s.m; must be held outside
+func (s *storage) indexLink(from *node, lnk *link) {
+	for _, lbl := range from.labels {
+		for attr, idx := range s.indexesLinks[lbl] {
+			if v, has := lnk.attrs[attr]; has {
+				idx.add(lnk.id, v)
+			}
+		}
+	}
+}
+
+// Does not hold s.m; must be held outside
+func (s *storage) unindexLink(from *node, lnk *link) {
+	for _, lbl := range from.labels {
+		for attr, idx := range s.indexesLinks[lbl] {
+			if v, has := lnk.attrs[attr]; has {
+				idx.remove(lnk.id, v)
+			}
+		}
+	}
+}
+
+// findNodes returns all nodes carrying all labels whose attribute attr equals
+// value. It uses an index if there's one, otherwise it scans all nodes.
+//
+// Does not hold s.m; must be held outside
+func (s *storage) findNodes(labels []string, attr string, value interface{}) []*node {
+	var candidates []*node
+
+	indexed := false
+	for _, lbl := range labels {
+		idx, has := s.indexesNodes[lbl][attr]
+		if !has {
+			continue
+		}
+		for id := range idx.lookup(value) {
+			candidates = append(candidates, s.nodes[id])
+		}
+		indexed = true
+		break
+	}
+	if !indexed {
+		for _, n := range s.nodes {
+			candidates = append(candidates, n)
+		}
+	}
+
+	result := candidates[:0]
+	for _, n := range candidates {
+		v, has := n.attrs[attr]
+		if !has || !graphie.ValueEqual(v, value) {
+			continue
+		}
+		if n.hasLabels(labels) {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+// findNode returns a node carrying all labels and matching all attrs or nil.
+//
+// Does not hold s.m; must be held outside
+func (s *storage) findNode(labels []string, attrs graphie.Attrs) *node {
+	for key, value := range attrs {
+		for _, n := range s.findNodes(labels, key, value) {
+			if n.attrs.Match(attrs) {
+				return n
+			}
+		}
+		return nil
+	}
+
+	// No attributes given; any node carrying all labels will do
+	for _, n := range s.nodes {
+		if n.hasLabels(labels) {
+			return n
+		}
+	}
+	return nil
+}
+
+// checkUnique makes sure no node but id carrying one of the labels has one of
+// the unique attributes in attrs.
+//
+// Does not hold s.m; must be held outside
+func (s *storage) checkUnique(id graphie.NodeID, labels []string, attrs graphie.Attrs) error {
+	for _, lbl := range labels {
+		for attr := range s.uniques[lbl] {
+			v, has := attrs[attr]
+			if !has {
+				continue
+			}
+			for other := range s.indexesNodes[lbl][attr].lookup(v) {
+				if other != id {
+					return &graphie.ConstraintViolationError{
+						Label: lbl,
+						Attr:  attr,
+						Value: v,
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
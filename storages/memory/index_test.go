@@ -0,0 +1,114 @@
+package memory
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/flosch/graphie"
+)
+
+// indexedLinks returns the ids of the links the index of label and attr
+// holds for value.
+func indexedLinks(s *storage, label, attr string, value interface{}) []graphie.EdgeID {
+	var ids []graphie.EdgeID
+	for id := range s.indexesLinks[label][attr][graphie.ValueKey(value)] {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func TestLinkIndex(t *testing.T) {
+	g, err := graphie.NewGraph("memory", "", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	s := g.Storage().(*storage)
+
+	a, err := s.Add([]string{"person"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.Add([]string{"person"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := s.Link(a, b, "", graphie.Attrs{"since": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EnsureIndexLinks([]string{"person"}, "since"); err != nil {
+		t.Fatal(err)
+	}
+	after, err := s.Link(b, a, "", graphie.Attrs{"since": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(step string, value interface{}, want ...graphie.EdgeID) {
+		t.Helper()
+		s.m.RLock()
+		got := indexedLinks(s, "person", "since", value)
+		s.m.RUnlock()
+		if len(got) != len(want) || (len(got) > 0 && !reflect.DeepEqual(got, want)) {
+			t.Errorf("%s: index holds %v for %v, want %v", step, got, value, want)
+		}
+	}
+	check("link", 1, before, after)
+
+	if err := s.SetEdgeAttr(before, "since", 2); err != nil {
+		t.Fatal(err)
+	}
+	check("set edge attr", 1, after)
+	check("set edge attr", 2, before)
+
+	if err := s.RemoveLabel(a, "person"); err != nil {
+		t.Fatal(err)
+	}
+	check("remove label", 2)
+	if err := s.AddLabel(a, "person"); err != nil {
+		t.Fatal(err)
+	}
+	check("add label", 2, before)
+
+	if err := s.RemoveEdge(before); err != nil {
+		t.Fatal(err)
+	}
+	check("remove edge", 2)
+
+	if _, err := s.Unlink(b, a, nil); err != nil {
+		t.Fatal(err)
+	}
+	check("unlink", 1)
+
+	if _, err := s.Link(a, b, "", graphie.Attrs{"since": 3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Link(b, a, "", graphie.Attrs{"since": 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove(a); err != nil {
+		t.Fatal(err)
+	}
+	check("remove", 3)
+
+	tx, err := g.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := tx.Add([]string{"person"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := tx.Link(b, c, "", graphie.Attrs{"since": 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("tx not applied", 4)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	check("tx", 4, id)
+}
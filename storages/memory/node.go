@@ -1,25 +1,129 @@
-package happy
+package memory
 
 import (
+	"sort"
+
 	"github.com/flosch/graphie"
-	//"sync"
 )
 
+type nodeIDs []graphie.NodeID
+
+func (ids nodeIDs) Len() int           { return len(ids) }
+func (ids nodeIDs) Less(i, j int) bool { return ids[i] < ids[j] }
+func (ids nodeIDs) Swap(i, j int)      { ids[i], ids[j] = ids[j], ids[i] }
+
+// Both ends of a link have their own link with the same id and attrs
 type link struct {
-	to    *node
+	id    graphie.EdgeID
+	typ   string
+	other graphie.NodeID
 	attrs graphie.Attrs
 }
 
+// The links of a node are sorted by their type (see insertLink), so the
+// links of one type are found by binary search.
 type node struct {
-	attrs graphie.Attrs
-	links []*link
+	id       graphie.NodeID
+	labels   []string
+	attrs    graphie.Attrs
+	linksOut []*link
+	linksIn  []*link
+}
+
+func (n *node) hasLabel(label string) bool {
+	for _, lbl := range n.labels {
+		if lbl == label {
+			return true
+		}
+	}
+	return false
 }
 
-func (n *node) Link(to graphie.Node, attrs graphie.Attrs) error {
-	l := &link{
-		to:    to.(*node),
-		attrs: attrs,
+func (n *node) hasLabels(labels []string) bool {
+	for _, lbl := range labels {
+		if !n.hasLabel(lbl) {
+			return false
+		}
+	}
+	return true
+}
+
+// copyAttrs makes sure nobody outside of the storage holds a reference to
+// the stored attributes.
+func copyAttrs(attrs graphie.Attrs) graphie.Attrs {
+	if attrs == nil {
+		return nil
+	}
+	c := make(graphie.Attrs, len(attrs))
+	for k, v := range attrs {
+		c[k] = v
+	}
+	return c
+}
+
+// insertLink adds lnk after all links of its type
+func insertLink(links []*link, lnk *link) []*link {
+	i := sort.Search(len(links), func(i int) bool { return links[i].typ > lnk.typ })
+	links = append(links, nil)
+	copy(links[i+1:], links[i:])
+	links[i] = lnk
+	return links
+}
+
+// linksOfTypes calls fn for the links having one of the types (all links if
+// there are none)
+func linksOfTypes(links []*link, types []string, fn func(lnk *link)) {
+	if len(types) == 0 {
+		for _, lnk := range links {
+			fn(lnk)
+		}
+		return
+	}
+	seen := make(map[string]struct{}, len(types))
+	for _, typ := range types {
+		if _, has := seen[typ]; has {
+			continue
+		}
+		seen[typ] = struct{}{}
+		i := sort.Search(len(links), func(i int) bool { return links[i].typ >= typ })
+		for ; i < len(links) && links[i].typ == typ; i++ {
+			fn(links[i])
+		}
+	}
+}
+
+// linkByID returns the link with the given id or nil
+func linkByID(links []*link, id graphie.EdgeID) *link {
+	for _, lnk := range links {
+		if lnk.id == id {
+			return lnk
+		}
 	}
-	n.links = append(n.links, l)
 	return nil
-}
\ No newline at end of file
+}
+
+// removeLink drops the link with the given id
+func removeLink(links []*link, id graphie.EdgeID) []*link {
+	kept := links[:0]
+	for _, lnk := range links {
+		if lnk.id != id {
+			kept = append(kept, lnk)
+		}
+	}
+	return kept
+}
+
+// unlinkFrom drops the links to other matching attrs, returns the remaining
+// links and the dropped ones
+func unlinkFrom(links []*link, other graphie.NodeID, attrs graphie.Attrs) ([]*link, []*link) {
+	kept := links[:0]
+	var removed []*link
+	for _, lnk := range links {
+		if lnk.other == other && lnk.attrs.Match(attrs) {
+			removed = append(removed, lnk)
+			continue
+		}
+		kept = append(kept, lnk)
+	}
+	return kept, removed
+}
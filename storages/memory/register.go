@@ -1,4 +1,4 @@
-package happy
+package memory
 
 import (
 	"github.com/flosch/graphie"
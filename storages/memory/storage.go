@@ -1,60 +1,655 @@
-package happy
+// Package memory is a non-persistent storage for graphie keeping the whole
+// graph in memory. It's mainly used as a reference driver for testing.
+package memory
 
 import (
-	"github.com/flosch/graphie"
+	"sort"
 	"sync"
+
+	"github.com/flosch/graphie"
+)
+
+var (
+	ErrNotFound     = graphie.ErrNodeNotFound
+	ErrAttrNotFound = graphie.ErrAttrNotFound
 )
 
 type storage struct {
-	c             int
-	g             *graphie.Graph
-	nodes         []*node
-	indexes_nodes map[string]map[string]struct{} // label -> attr-key
-	indexes_links map[string]map[string]struct{} // label -> attr-key
-	m             sync.RWMutex
+	g            *graphie.Graph
+	m            sync.RWMutex
+	counter      graphie.NodeID
+	counterEdges graphie.EdgeID
+	nodes        map[graphie.NodeID]*node
+	edges        map[graphie.EdgeID]graphie.NodeID // link id -> from-node
+	indexesNodes map[string]map[string]nodeIndex   // label -> attr-key -> index
+	indexesLinks map[string]map[string]linkIndex   // label -> attr-key -> index
+	uniques      map[string]map[string]struct{}    // label -> attr-key
 }
 
+// Start ignores the path of the DSN in attrs, every graph is a new one. There
+// are no parameters.
 func (s *storage) Start(attrs string, dbname string) error {
-	s.indexes_nodes = make(map[string]map[string]struct{})
-	s.indexes_links = make(map[string]map[string]struct{})
+	dsn, err := graphie.ParseDSN(attrs)
+	if err != nil {
+		return err
+	}
+	err = dsn.CheckDriver("memory")
+	if err != nil {
+		return err
+	}
+	err = dsn.CheckParams()
+	if err != nil {
+		return err
+	}
+
+	s.nodes = make(map[graphie.NodeID]*node)
+	s.edges = make(map[graphie.EdgeID]graphie.NodeID)
+	s.indexesNodes = make(map[string]map[string]nodeIndex)
+	s.indexesLinks = make(map[string]map[string]linkIndex)
+	s.uniques = make(map[string]map[string]struct{})
 	return nil
 }
 
 func (s *storage) Stop() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.nodes = nil
+	s.edges = nil
+	s.indexesNodes = nil
+	s.indexesLinks = nil
+	s.uniques = nil
 	return nil
 }
 
-func (s *storage) Add(labels []string, attrs graphie.Attrs) (graphie.Node, error) {
-	n := &node{
-		attrs: attrs,
+func (s *storage) EnsureIndexNodes(labels []string, attrName string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.nodes == nil {
+		return graphie.ErrClosed
 	}
-	return n, nil
+	for _, lbl := range labels {
+		s.ensureIndexNodes(lbl, attrName)
+	}
+	return nil
 }
 
-func (s *storage) Merge(labels []string, attrs graphie.Attrs) (graphie.Node, error) {
-	return nil, nil
-}
+// Does not hold s.m; must be held outside
+func (s *storage) ensureIndexNodes(label, attrName string) nodeIndex {
+	m, has := s.indexesNodes[label]
+	if !has {
+		m = make(map[string]nodeIndex)
+		s.indexesNodes[label] = m
+	}
+	if idx, has := m[attrName]; has {
+		return idx
+	}
 
-func (s *storage) Link(labels []string, from, to graphie.Node, attrs graphie.Attrs) (*graphie.Link, error) {
-	return nil, nil
+	idx := make(nodeIndex)
+	for _, n := range s.nodes {
+		if !n.hasLabel(label) {
+			continue
+		}
+		if v, has := n.attrs[attrName]; has {
+			idx.add(n.id, v)
+		}
+	}
+	m[attrName] = idx
+	return idx
 }
 
-func (s *storage) Remove(labels []string, name string, attrs map[string]interface{}) error {
+// EnsureUnique uses the node index of each label to find duplicates.
+func (s *storage) EnsureUnique(labels []string, attrName string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.nodes == nil {
+		return graphie.ErrClosed
+	}
+	for _, lbl := range labels {
+		idx := s.ensureIndexNodes(lbl, attrName)
+		for _, ids := range idx {
+			if len(ids) < 2 {
+				continue
+			}
+			for id := range ids {
+				return &graphie.ConstraintViolationError{
+					Label: lbl,
+					Attr:  attrName,
+					Value: s.nodes[id].attrs[attrName],
+				}
+			}
+		}
+	}
+
+	for _, lbl := range labels {
+		m, has := s.uniques[lbl]
+		if !has {
+			m = make(map[string]struct{})
+			s.uniques[lbl] = m
+		}
+		m[attrName] = struct{}{}
+	}
 	return nil
 }
 
-func (s *storage) EnsureIndexNodes(labels []string, attr_name string) error {
+// EnsureIndexLinks indexes the attribute of all links starting at nodes
+// carrying one of the labels.
+func (s *storage) EnsureIndexLinks(labels []string, attrName string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.nodes == nil {
+		return graphie.ErrClosed
+	}
 	for _, lbl := range labels {
-		m, has := s.indexes_nodes[lbl]
+		m, has := s.indexesLinks[lbl]
 		if !has {
-			m = make(map[string]struct{})
-			s.indexes_nodes[lbl] = m
+			m = make(map[string]linkIndex)
+			s.indexesLinks[lbl] = m
+		}
+		if _, has := m[attrName]; has {
+			continue
+		}
+
+		idx := make(linkIndex)
+		for _, n := range s.nodes {
+			if !n.hasLabel(lbl) {
+				continue
+			}
+			for _, lnk := range n.linksOut {
+				if v, has := lnk.attrs[attrName]; has {
+					idx.add(lnk.id, v)
+				}
+			}
+		}
+		m[attrName] = idx
+	}
+	return nil
+}
+
+func (s *storage) Add(labels []string, attrs graphie.Attrs) (graphie.NodeID, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.nodes == nil {
+		return 0, graphie.ErrClosed
+	}
+	if err := s.checkUnique(0, labels, attrs); err != nil {
+		return 0, err
+	}
+	return s.add(labels, attrs), nil
+}
+
+// lookup returns the node; all operations fail with graphie.ErrClosed once
+// the storage has been stopped.
+//
+// Does not hold s.m; must be held outside
+func (s *storage) lookup(id graphie.NodeID) (*node, error) {
+	if s.nodes == nil {
+		return nil, graphie.ErrClosed
+	}
+	n, has := s.nodes[id]
+	if !has {
+		return nil, ErrNotFound
+	}
+	return n, nil
+}
+
+// Does not hold s.m; must be held outside
+func (s *storage) add(labels []string, attrs graphie.Attrs) graphie.NodeID {
+	s.counter++
+	n := &node{
+		id:     s.counter,
+		labels: append([]string(nil), labels...),
+		attrs:  copyAttrs(attrs),
+	}
+	if n.attrs == nil {
+		n.attrs = make(graphie.Attrs)
+	}
+	s.nodes[n.id] = n
+	s.indexNode(n)
+	return n.id
+}
+
+// Merge returns the node carrying all labels whose key attributes equal the
+// ones in attrs and sets the remaining attributes; if there's no such node,
+// it is added.
+func (s *storage) Merge(labels []string, attrs graphie.Attrs) (graphie.NodeID, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.nodes == nil {
+		return 0, graphie.ErrClosed
+	}
+	keys, rest := graphie.SplitKeys(attrs, func(attr string) bool {
+		for _, lbl := range labels {
+			if _, has := s.indexesNodes[lbl][attr]; has {
+				return true
+			}
+		}
+		return false
+	})
+	if len(keys) == 0 {
+		return 0, graphie.ErrNoKeys
+	}
+
+	n := s.findNode(labels, keys)
+	if n == nil {
+		if err := s.checkUnique(0, labels, attrs); err != nil {
+			return 0, err
+		}
+		return s.add(labels, attrs), nil
+	}
+
+	if len(rest) > 0 {
+		if err := s.checkUnique(n.id, n.labels, rest); err != nil {
+			return 0, err
+		}
+		s.unindexNode(n)
+		for k, v := range rest {
+			n.attrs[k] = v
+		}
+		s.indexNode(n)
+	}
+	return n.id, nil
+}
+
+func (s *storage) Link(from, to graphie.NodeID, typ string, attrs graphie.Attrs) (graphie.EdgeID, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	nFrom, err := s.lookup(from)
+	if err != nil {
+		return 0, err
+	}
+	nTo, err := s.lookup(to)
+	if err != nil {
+		return 0, err
+	}
+
+	s.counterEdges++
+	s.link(nFrom, nTo, s.counterEdges, typ, attrs)
+	return s.counterEdges, nil
+}
+
+// Does not hold s.m; must be held outside
+func (s *storage) link(from, to *node, id graphie.EdgeID, typ string, attrs graphie.Attrs) {
+	attrs = copyAttrs(attrs)
+	out := &link{id: id, typ: typ, other: to.id, attrs: attrs}
+	from.linksOut = insertLink(from.linksOut, out)
+	to.linksIn = insertLink(to.linksIn, &link{id: id, typ: typ, other: from.id, attrs: attrs})
+	s.edges[id] = from.id
+	s.indexLink(from, out)
+}
+
+// findEdge returns the ends of the link and the link as seen by the
+// from-node.
+//
+// Does not hold s.m; must be held outside
+func (s *storage) findEdge(id graphie.EdgeID) (*node, *node, *link, error) {
+	if s.nodes == nil {
+		return nil, nil, nil, graphie.ErrClosed
+	}
+	from, has := s.nodes[s.edges[id]]
+	if !has {
+		return nil, nil, nil, graphie.ErrEdgeNotFound
+	}
+	out := linkByID(from.linksOut, id)
+	if out == nil {
+		return nil, nil, nil, graphie.ErrEdgeNotFound
+	}
+	return from, s.nodes[out.other], out, nil
+}
+
+func (s *storage) GetEdge(id graphie.EdgeID) (*graphie.Edge, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	from, to, out, err := s.findEdge(id)
+	if err != nil {
+		return nil, err
+	}
+	return &graphie.Edge{
+		ID:    id,
+		Type:  out.typ,
+		From:  from.id,
+		To:    to.id,
+		Attrs: copyAttrs(out.attrs),
+	}, nil
+}
+
+// SetEdgeAttr replaces the attributes shared by both ends of the link.
+func (s *storage) SetEdgeAttr(id graphie.EdgeID, key string, value interface{}) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	from, to, out, err := s.findEdge(id)
+	if err != nil {
+		return err
+	}
+
+	s.unindexLink(from, out)
+	attrs := copyAttrs(out.attrs)
+	if attrs == nil {
+		attrs = make(graphie.Attrs)
+	}
+	attrs[key] = value
+	out.attrs = attrs
+	linkByID(to.linksIn, id).attrs = attrs
+	s.indexLink(from, out)
+	return nil
+}
+
+func (s *storage) RemoveEdge(id graphie.EdgeID) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	from, to, out, err := s.findEdge(id)
+	if err != nil {
+		return err
+	}
+
+	s.unindexLink(from, out)
+	from.linksOut = removeLink(from.linksOut, id)
+	to.linksIn = removeLink(to.linksIn, id)
+	delete(s.edges, id)
+	return nil
+}
+
+func (s *storage) Unlink(from, to graphie.NodeID, attrs graphie.Attrs) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	nFrom, err := s.lookup(from)
+	if err != nil {
+		return 0, err
+	}
+	nTo, err := s.lookup(to)
+	if err != nil {
+		return 0, err
+	}
+
+	var removed []*link
+	nFrom.linksOut, removed = unlinkFrom(nFrom.linksOut, to, attrs)
+	nTo.linksIn, _ = unlinkFrom(nTo.linksIn, from, attrs)
+	for _, lnk := range removed {
+		s.unindexLink(nFrom, lnk)
+		delete(s.edges, lnk.id)
+	}
+	return len(removed), nil
+}
+
+// Remove deletes the node and all links from and to it.
+func (s *storage) Remove(id graphie.NodeID) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	n, err := s.lookup(id)
+	if err != nil {
+		return err
+	}
+
+	for _, lnk := range n.linksOut {
+		s.unindexLink(n, lnk)
+		delete(s.edges, lnk.id)
+		if other, has := s.nodes[lnk.other]; has {
+			other.linksIn, _ = unlinkFrom(other.linksIn, id, nil)
+		}
+	}
+	for _, lnk := range n.linksIn {
+		other, has := s.nodes[lnk.other]
+		if !has || other == n {
+			continue
+		}
+		var removed []*link
+		other.linksOut, removed = unlinkFrom(other.linksOut, id, nil)
+		for _, r := range removed {
+			s.unindexLink(other, r)
+			delete(s.edges, r.id)
 		}
-		m[attr_name] = struct{}{}
 	}
+
+	s.unindexNode(n)
+	delete(s.nodes, id)
 	return nil
 }
 
-func (s *storage) EnsureIndexLinks(labels []string, attr_name string) error {
+func (s *storage) FindByAttr(labels []string, key string, value interface{}) ([]graphie.NodeID, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	if s.nodes == nil {
+		return nil, graphie.ErrClosed
+	}
+	nodes := s.findNodes(labels, key, value)
+	ids := make(nodeIDs, 0, len(nodes))
+	for _, n := range nodes {
+		ids = append(ids, n.id)
+	}
+	sort.Sort(ids)
+	return ids, nil
+}
+
+// WalkNodes copies the ids while holding s.m and calls fn without holding
+// it, like walkLinks.
+func (s *storage) WalkNodes(labels []string, fn func(id graphie.NodeID) error) error {
+	s.m.RLock()
+	if s.nodes == nil {
+		s.m.RUnlock()
+		return graphie.ErrClosed
+	}
+	ids := make(nodeIDs, 0)
+	for _, n := range s.nodes {
+		if n.hasLabels(labels) {
+			ids = append(ids, n.id)
+		}
+	}
+	s.m.RUnlock()
+
+	sort.Sort(ids)
+	for _, id := range ids {
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *storage) AddLabel(id graphie.NodeID, label string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	n, err := s.lookup(id)
+	if err != nil {
+		return err
+	}
+	if n.hasLabel(label) {
+		return nil
+	}
+	if err := s.checkUnique(id, []string{label}, n.attrs); err != nil {
+		return err
+	}
+
+	s.relabel(n, append(n.labels, label))
+	return nil
+}
+
+func (s *storage) RemoveLabel(id graphie.NodeID, label string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	n, err := s.lookup(id)
+	if err != nil {
+		return err
+	}
+	if !n.hasLabel(label) {
+		return nil
+	}
+
+	labels := make([]string, 0, len(n.labels)-1)
+	for _, lbl := range n.labels {
+		if lbl != label {
+			labels = append(labels, lbl)
+		}
+	}
+	s.relabel(n, labels)
 	return nil
 }
+
+// relabel replaces the labels of the node; the node and its out-links are
+// indexed by label, so they're indexed again.
+//
+// Does not hold s.m; must be held outside
+func (s *storage) relabel(n *node, labels []string) {
+	s.unindexNode(n)
+	for _, lnk := range n.linksOut {
+		s.unindexLink(n, lnk)
+	}
+	n.labels = labels
+	s.indexNode(n)
+	for _, lnk := range n.linksOut {
+		s.indexLink(n, lnk)
+	}
+}
+
+func (s *storage) In(id graphie.NodeID) ([]*graphie.Link, error) {
+	links := make([]*graphie.Link, 0)
+	err := s.WalkIn(id, func(l *graphie.Link) error {
+		links = append(links, l)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (s *storage) Out(id graphie.NodeID) ([]*graphie.Link, error) {
+	links := make([]*graphie.Link, 0)
+	err := s.WalkOut(id, func(l *graphie.Link) error {
+		links = append(links, l)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (s *storage) WalkIn(id graphie.NodeID, fn func(l *graphie.Link) error) error {
+	return s.walkLinks(id, false, nil, fn)
+}
+
+func (s *storage) WalkOut(id graphie.NodeID, fn func(l *graphie.Link) error) error {
+	return s.walkLinks(id, true, nil, fn)
+}
+
+func (s *storage) WalkInTypes(id graphie.NodeID, types []string, fn func(l *graphie.Link) error) error {
+	return s.walkLinks(id, false, types, fn)
+}
+
+func (s *storage) WalkOutTypes(id graphie.NodeID, types []string, fn func(l *graphie.Link) error) error {
+	return s.walkLinks(id, true, types, fn)
+}
+
+// walkLinks copies the links of the types while holding s.m and calls fn
+// without holding it, so fn is free to use the storage.
+func (s *storage) walkLinks(id graphie.NodeID, out bool, types []string, fn func(l *graphie.Link) error) error {
+	s.m.RLock()
+	n, err := s.lookup(id)
+	if err != nil {
+		s.m.RUnlock()
+		return err
+	}
+	src := n.linksIn
+	if out {
+		src = n.linksOut
+	}
+	var links []*graphie.Link
+	linksOfTypes(src, types, func(lnk *link) {
+		links = append(links, &graphie.Link{
+			ID:    lnk.id,
+			Type:  lnk.typ,
+			Other: lnk.other,
+			Attrs: copyAttrs(lnk.attrs),
+		})
+	})
+	s.m.RUnlock()
+
+	for _, l := range links {
+		if err := fn(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *storage) Set(id graphie.NodeID, key string, value interface{}) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	n, err := s.lookup(id)
+	if err != nil {
+		return err
+	}
+	if err := s.checkUnique(id, n.labels, graphie.Attrs{key: value}); err != nil {
+		return err
+	}
+
+	s.unindexNode(n)
+	n.attrs[key] = value
+	s.indexNode(n)
+	return nil
+}
+
+func (s *storage) Get(id graphie.NodeID, key string) (interface{}, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	n, err := s.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	v, has := n.attrs[key]
+	if !has {
+		return nil, ErrAttrNotFound
+	}
+	return v, nil
+}
+
+func (s *storage) Has(id graphie.NodeID, key string) (bool, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	n, err := s.lookup(id)
+	if err != nil {
+		return false, err
+	}
+	_, has := n.attrs[key]
+	return has, nil
+}
+
+func (s *storage) Attrs(id graphie.NodeID) (graphie.Attrs, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	n, err := s.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	return copyAttrs(n.attrs), nil
+}
+
+// Labels returns the labels the node carries.
+func (s *storage) Labels(id graphie.NodeID) ([]string, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	n, err := s.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string(nil), n.labels...), nil
+}
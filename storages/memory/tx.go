@@ -0,0 +1,241 @@
+package memory
+
+import (
+	"fmt"
+
+	"github.com/flosch/graphie"
+)
+
+func (s *storage) ReserveID() (graphie.NodeID, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.nodes == nil {
+		return 0, graphie.ErrClosed
+	}
+	s.counter++
+	return s.counter, nil
+}
+
+func (s *storage) ReserveEdgeID() (graphie.EdgeID, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.nodes == nil {
+		return 0, graphie.ErrClosed
+	}
+	s.counterEdges++
+	return s.counterEdges, nil
+}
+
+// Apply works on copies of all nodes touched by the operations and swaps them
+// in once all operations succeeded and no unique constraint is violated.
+func (s *storage) Apply(ops []graphie.TxOp) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.nodes == nil {
+		return graphie.ErrClosed
+	}
+	st := &stage{
+		s:     s,
+		nodes: make(map[graphie.NodeID]*node),
+	}
+	for _, op := range ops {
+		if err := st.apply(op); err != nil {
+			return err
+		}
+	}
+	if err := st.checkUnique(); err != nil {
+		return err
+	}
+	st.commit()
+	return nil
+}
+
+// A stage holds the new versions of the nodes changed by a transaction; nil
+// marks removed nodes.
+type stage struct {
+	s     *storage
+	nodes map[graphie.NodeID]*node
+}
+
+func (st *stage) get(id graphie.NodeID) (*node, error) {
+	n, has := st.nodes[id]
+	if has {
+		if n == nil {
+			return nil, ErrNotFound
+		}
+		return n, nil
+	}
+
+	old, has := st.s.nodes[id]
+	if !has {
+		return nil, ErrNotFound
+	}
+	n = &node{
+		id:       old.id,
+		labels:   append([]string(nil), old.labels...),
+		attrs:    copyAttrs(old.attrs),
+		linksOut: append([]*link(nil), old.linksOut...),
+		linksIn:  append([]*link(nil), old.linksIn...),
+	}
+	st.nodes[id] = n
+	return n, nil
+}
+
+func (st *stage) apply(op graphie.TxOp) error {
+	switch op.Kind {
+	case graphie.TxAdd:
+		if _, has := st.s.nodes[op.ID]; has {
+			return fmt.Errorf("Node %d exists already", op.ID)
+		}
+		n := &node{
+			id:     op.ID,
+			labels: append([]string(nil), op.Labels...),
+			attrs:  copyAttrs(op.Attrs),
+		}
+		if n.attrs == nil {
+			n.attrs = make(graphie.Attrs)
+		}
+		st.nodes[n.id] = n
+
+	case graphie.TxSet:
+		n, err := st.get(op.ID)
+		if err != nil {
+			return err
+		}
+		n.attrs[op.Key] = op.Value
+
+	case graphie.TxLink:
+		from, err := st.get(op.ID)
+		if err != nil {
+			return err
+		}
+		to, err := st.get(op.To)
+		if err != nil {
+			return err
+		}
+		attrs := copyAttrs(op.Attrs)
+		from.linksOut = insertLink(from.linksOut, &link{id: op.Edge, typ: op.Type, other: to.id, attrs: attrs})
+		to.linksIn = insertLink(to.linksIn, &link{id: op.Edge, typ: op.Type, other: from.id, attrs: attrs})
+
+	case graphie.TxUnlink:
+		from, err := st.get(op.ID)
+		if err != nil {
+			return err
+		}
+		to, err := st.get(op.To)
+		if err != nil {
+			return err
+		}
+		from.linksOut, _ = unlinkFrom(from.linksOut, to.id, op.Attrs)
+		to.linksIn, _ = unlinkFrom(to.linksIn, from.id, op.Attrs)
+
+	case graphie.TxRemove:
+		n, err := st.get(op.ID)
+		if err != nil {
+			return err
+		}
+		for _, lnk := range n.linksOut {
+			if lnk.other == n.id {
+				continue
+			}
+			other, err := st.get(lnk.other)
+			if err != nil {
+				return err
+			}
+			other.linksIn, _ = unlinkFrom(other.linksIn, n.id, nil)
+		}
+		for _, lnk := range n.linksIn {
+			if lnk.other == n.id {
+				continue
+			}
+			other, err := st.get(lnk.other)
+			if err != nil {
+				return err
+			}
+			other.linksOut, _ = unlinkFrom(other.linksOut, n.id, nil)
+		}
+		st.nodes[n.id] = nil
+
+	default:
+		return fmt.Errorf("Unknown transaction operation %d", op.Kind)
+	}
+	return nil
+}
+
+// checkUnique checks the staged nodes against each other and against all
+// nodes which aren't staged.
+//
+// Does not hold s.m; must be held outside
+func (st *stage) checkUnique() error {
+	type uniqueKey struct {
+		label, attr string
+		value       interface{}
+	}
+	seen := make(map[uniqueKey]struct{})
+
+	for _, n := range st.nodes {
+		if n == nil {
+			continue
+		}
+		for _, lbl := range n.labels {
+			for attr := range st.s.uniques[lbl] {
+				v, has := n.attrs[attr]
+				if !has {
+					continue
+				}
+				violation := &graphie.ConstraintViolationError{
+					Label: lbl,
+					Attr:  attr,
+					Value: v,
+				}
+
+				k := uniqueKey{lbl, attr, graphie.ValueKey(v)}
+				if _, has := seen[k]; has {
+					return violation
+				}
+				seen[k] = struct{}{}
+
+				for _, other := range st.s.findNodes([]string{lbl}, attr, v) {
+					if _, staged := st.nodes[other.id]; !staged {
+						return violation
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// commit replaces the nodes by their staged versions. Links are changed on
+// their from-node, so it's staged for every changed link.
+//
+// Does not hold s.m; must be held outside
+func (st *stage) commit() {
+	for id := range st.nodes {
+		old, has := st.s.nodes[id]
+		if !has {
+			continue
+		}
+		st.s.unindexNode(old)
+		for _, lnk := range old.linksOut {
+			st.s.unindexLink(old, lnk)
+			delete(st.s.edges, lnk.id)
+		}
+	}
+
+	for id, n := range st.nodes {
+		if n == nil {
+			delete(st.s.nodes, id)
+			continue
+		}
+		st.s.nodes[id] = n
+		st.s.indexNode(n)
+		for _, lnk := range n.linksOut {
+			st.s.indexLink(n, lnk)
+			st.s.edges[lnk.id] = n.id
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package mongo
+
+import (
+	"os"
+	"testing"
+
+	"github.com/flosch/graphie/storagetest"
+)
+
+// TestConformance needs a mongod; set GRAPHIE_MONGODB to its address, for
+// example "mongodb://localhost:27017". Every test creates its own database.
+func TestConformance(t *testing.T) {
+	attrs := os.Getenv("GRAPHIE_MONGODB")
+	if attrs == "" {
+		t.Skip("GRAPHIE_MONGODB isn't set")
+	}
+	storagetest.Run(t, storagetest.Suite{
+		Driver: "mongodb",
+		DriverAttrs: func(t *testing.T) string {
+			return attrs
+		},
+		Persistent: true,
+	})
+}
+
+// TestConformanceFake runs the suite against the in-memory stand-in of a
+// mongod (see fake_test.go).
+func TestConformanceFake(t *testing.T) {
+	defer func(d func(url string) (session, error)) { dial = d }(dial)
+	dial = newFakeServer().dial
+
+	storagetest.Run(t, storagetest.Suite{
+		Driver: "mongodb",
+		DriverAttrs: func(t *testing.T) string {
+			return "mongodb://localhost:27017"
+		},
+		Persistent: true,
+	})
+}
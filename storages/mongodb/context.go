@@ -0,0 +1,171 @@
+package mongo
+
+import (
+	"context"
+
+	"github.com/flosch/graphie"
+)
+
+// The scans (FindByAttr, WalkNodes and the search for duplicates in
+// EnsureUnique) and the link walks check ctx for every document they read.
+// All other operations only check ctx before they start; mgo can't cancel a
+// single request.
+
+func (s *mongodbStorage) LabelsContext(ctx context.Context, id graphie.NodeID) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Labels(id)
+}
+
+func (s *mongodbStorage) InContext(ctx context.Context, id graphie.NodeID) ([]*graphie.Link, error) {
+	links := make([]*graphie.Link, 0)
+	err := s.WalkInContext(ctx, id, func(l *graphie.Link) error {
+		links = append(links, l)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (s *mongodbStorage) OutContext(ctx context.Context, id graphie.NodeID) ([]*graphie.Link, error) {
+	links := make([]*graphie.Link, 0)
+	err := s.WalkOutContext(ctx, id, func(l *graphie.Link) error {
+		links = append(links, l)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (s *mongodbStorage) WalkInContext(ctx context.Context, id graphie.NodeID, fn func(l *graphie.Link) error) error {
+	return s.walkLinks(ctx, id, "_to", "_from", nil, fn)
+}
+
+func (s *mongodbStorage) WalkOutContext(ctx context.Context, id graphie.NodeID, fn func(l *graphie.Link) error) error {
+	return s.walkLinks(ctx, id, "_from", "_to", nil, fn)
+}
+
+func (s *mongodbStorage) WalkInTypesContext(ctx context.Context, id graphie.NodeID, types []string, fn func(l *graphie.Link) error) error {
+	return s.walkLinks(ctx, id, "_to", "_from", types, fn)
+}
+
+func (s *mongodbStorage) WalkOutTypesContext(ctx context.Context, id graphie.NodeID, types []string, fn func(l *graphie.Link) error) error {
+	return s.walkLinks(ctx, id, "_from", "_to", types, fn)
+}
+
+func (s *mongodbStorage) GetEdgeContext(ctx context.Context, id graphie.EdgeID) (*graphie.Edge, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.GetEdge(id)
+}
+
+func (s *mongodbStorage) GetContext(ctx context.Context, id graphie.NodeID, key string) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Get(id, key)
+}
+
+func (s *mongodbStorage) HasContext(ctx context.Context, id graphie.NodeID, key string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return s.Has(id, key)
+}
+
+func (s *mongodbStorage) AttrsContext(ctx context.Context, id graphie.NodeID) (graphie.Attrs, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Attrs(id)
+}
+
+func (s *mongodbStorage) EnsureIndexNodesContext(ctx context.Context, labels []string, attrName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.EnsureIndexNodes(labels, attrName)
+}
+
+func (s *mongodbStorage) EnsureIndexLinksContext(ctx context.Context, labels []string, attrName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.EnsureIndexLinks(labels, attrName)
+}
+
+func (s *mongodbStorage) AddContext(ctx context.Context, labels []string, attrs graphie.Attrs) (graphie.NodeID, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.Add(labels, attrs)
+}
+
+func (s *mongodbStorage) MergeContext(ctx context.Context, labels []string, attrs graphie.Attrs) (graphie.NodeID, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.Merge(labels, attrs)
+}
+
+func (s *mongodbStorage) LinkContext(ctx context.Context, from, to graphie.NodeID, typ string, attrs graphie.Attrs) (graphie.EdgeID, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.Link(from, to, typ, attrs)
+}
+
+func (s *mongodbStorage) UnlinkContext(ctx context.Context, from, to graphie.NodeID, attrs graphie.Attrs) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.Unlink(from, to, attrs)
+}
+
+func (s *mongodbStorage) RemoveContext(ctx context.Context, id graphie.NodeID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Remove(id)
+}
+
+func (s *mongodbStorage) AddLabelContext(ctx context.Context, id graphie.NodeID, label string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.AddLabel(id, label)
+}
+
+func (s *mongodbStorage) RemoveLabelContext(ctx context.Context, id graphie.NodeID, label string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.RemoveLabel(id, label)
+}
+
+func (s *mongodbStorage) SetContext(ctx context.Context, id graphie.NodeID, key string, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Set(id, key, value)
+}
+
+func (s *mongodbStorage) SetEdgeAttrContext(ctx context.Context, id graphie.EdgeID, key string, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.SetEdgeAttr(id, key, value)
+}
+
+func (s *mongodbStorage) RemoveEdgeContext(ctx context.Context, id graphie.EdgeID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.RemoveEdge(id)
+}
@@ -0,0 +1,556 @@
+package mongo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/flosch/graphie"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A fakeServer is an in-memory stand-in for a mongod. It understands the
+// part of the query language the driver uses: equality, $exists, $ne, $in
+// and $or in selectors, $set, $unset, $inc and $setOnInsert in updates and
+// sparse unique indexes. Documents are stored the way mongod returns them
+// (they are encoded to BSON and back), so the driver sees the same types.
+type fakeServer struct {
+	lock  sync.Mutex
+	colls map[string]*fakeCollection // <dbname>.<name>
+}
+
+type fakeCollection struct {
+	docs    []bson.M // in the order of insertion
+	indexes []mgo.Index
+}
+
+func newFakeServer() *fakeServer {
+	return &fakeServer{
+		colls: make(map[string]*fakeCollection),
+	}
+}
+
+// dial connects a new session; it replaces the package's dial.
+func (srv *fakeServer) dial(url string) (session, error) {
+	return &fakeSession{srv: srv}, nil
+}
+
+type fakeSession struct {
+	srv    *fakeServer
+	closed bool // guarded by srv.lock
+}
+
+func (sess *fakeSession) C(dbname, name string) collection {
+	return &fakeHandle{sess: sess, name: dbname + "." + name}
+}
+
+func (sess *fakeSession) Close() {
+	sess.srv.lock.Lock()
+	defer sess.srv.lock.Unlock()
+	sess.closed = true
+}
+
+// fakeHandle is a collection used by one session
+type fakeHandle struct {
+	sess *fakeSession
+	name string
+}
+
+// coll locks the server and returns the collection; like mgo it panics if
+// the session has been closed.
+func (h *fakeHandle) coll() *fakeCollection {
+	h.sess.srv.lock.Lock()
+	if h.sess.closed {
+		h.sess.srv.lock.Unlock()
+		panic("Session already closed")
+	}
+	c, has := h.sess.srv.colls[h.name]
+	if !has {
+		c = &fakeCollection{
+			indexes: []mgo.Index{{Key: []string{"_id"}, Unique: true}},
+		}
+		h.sess.srv.colls[h.name] = c
+	}
+	return c
+}
+
+func (h *fakeHandle) unlock() {
+	h.sess.srv.lock.Unlock()
+}
+
+// normalize encodes v to BSON and decodes it again
+func normalize(v interface{}) bson.M {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	d := make(bson.M)
+	if err := bson.Unmarshal(data, &d); err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// decode stores d in result like mgo does
+func decode(d bson.M, result interface{}) error {
+	data, err := bson.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, result)
+}
+
+func equal(a, b interface{}) bool {
+	return graphie.ValueKey(a) == graphie.ValueKey(b)
+}
+
+func less(a, b interface{}) bool {
+	ka, kb := graphie.ValueKey(a), graphie.ValueKey(b)
+	switch x := ka.(type) {
+	case int64:
+		if y, ok := kb.(int64); ok {
+			return x < y
+		}
+	case string:
+		if y, ok := kb.(string); ok {
+			return x < y
+		}
+	}
+	return fmt.Sprint(ka) < fmt.Sprint(kb)
+}
+
+// lookup returns the value of the field given by a dotted path
+func lookup(d bson.M, path string) (interface{}, bool) {
+	parts := strings.Split(path, ".")
+	for _, p := range parts[:len(parts)-1] {
+		sub, ok := d[p].(bson.M)
+		if !ok {
+			return nil, false
+		}
+		d = sub
+	}
+	v, has := d[parts[len(parts)-1]]
+	return v, has
+}
+
+func unsetField(d bson.M, path string) {
+	parts := strings.Split(path, ".")
+	for _, p := range parts[:len(parts)-1] {
+		sub, ok := d[p].(bson.M)
+		if !ok {
+			return
+		}
+		d = sub
+	}
+	delete(d, parts[len(parts)-1])
+}
+
+func match(d bson.M, selector bson.M) bool {
+	for field, cond := range selector {
+		if field == "$or" {
+			found := false
+			for _, alt := range cond.([]interface{}) {
+				if match(d, alt.(bson.M)) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+			continue
+		}
+
+		v, has := lookup(d, field)
+		ops, ok := cond.(bson.M)
+		if !ok {
+			if !has || !equal(v, cond) {
+				return false
+			}
+			continue
+		}
+		for op, arg := range ops {
+			switch op {
+			case "$exists":
+				if has != arg.(bool) {
+					return false
+				}
+			case "$ne":
+				if has && equal(v, arg) {
+					return false
+				}
+			case "$in":
+				found := false
+				for _, a := range arg.([]interface{}) {
+					if has && equal(v, a) {
+						found = true
+					}
+				}
+				if !found {
+					return false
+				}
+			default:
+				panic("unsupported operator " + op)
+			}
+		}
+	}
+	return true
+}
+
+// update applies the update operators to d; $setOnInsert only if the
+// document is inserted.
+func update(d bson.M, upd bson.M, insert bool) {
+	for op, arg := range upd {
+		fields := arg.(bson.M)
+		switch op {
+		case "$set":
+			for path, v := range fields {
+				setField(d, path, v)
+			}
+		case "$setOnInsert":
+			if insert {
+				for path, v := range fields {
+					setField(d, path, v)
+				}
+			}
+		case "$unset":
+			for path := range fields {
+				unsetField(d, path)
+			}
+		case "$inc":
+			for path, v := range fields {
+				cur, _ := lookup(d, path)
+				a, _ := graphie.ValueKey(cur).(int64)
+				b := graphie.ValueKey(v).(int64)
+				setField(d, path, a+b)
+			}
+		default:
+			panic("unsupported operator " + op)
+		}
+	}
+}
+
+var errDup = &mgo.LastError{Code: 11000, Err: "E11000 duplicate key error"}
+
+// checkUnique fails if d has the value of a unique index another document
+// has, except for the one at position skip.
+func (c *fakeCollection) checkUnique(d bson.M, skip int) error {
+	for _, idx := range c.indexes {
+		if !idx.Unique {
+			continue
+		}
+		v, has := lookup(d, idx.Key[0])
+		if !has {
+			continue
+		}
+		for i, other := range c.docs {
+			if i == skip {
+				continue
+			}
+			if w, has := lookup(other, idx.Key[0]); has && equal(v, w) {
+				return errDup
+			}
+		}
+	}
+	return nil
+}
+
+func (c *fakeCollection) find(id interface{}) int {
+	for i, d := range c.docs {
+		if equal(d["_id"], id) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (h *fakeHandle) Find(selector interface{}) query {
+	q := &fakeQuery{h: h}
+	if selector != nil {
+		q.selector = normalize(selector)
+	}
+	return q
+}
+
+func (h *fakeHandle) FindId(id interface{}) query {
+	return h.Find(bson.M{"_id": id})
+}
+
+func (h *fakeHandle) Insert(docs ...interface{}) error {
+	c := h.coll()
+	defer h.unlock()
+
+	for _, doc := range docs {
+		d := normalize(doc)
+		if _, has := d["_id"]; !has {
+			d["_id"] = bson.NewObjectId()
+		}
+		if err := c.checkUnique(d, -1); err != nil {
+			return err
+		}
+		c.docs = append(c.docs, d)
+	}
+	return nil
+}
+
+// updateAt updates the document at position i
+func (c *fakeCollection) updateAt(i int, upd bson.M) error {
+	d := normalize(c.docs[i])
+	update(d, upd, false)
+	d = normalize(d)
+	if err := c.checkUnique(d, i); err != nil {
+		return err
+	}
+	c.docs[i] = d
+	return nil
+}
+
+func (h *fakeHandle) UpdateId(id interface{}, upd interface{}) error {
+	c := h.coll()
+	defer h.unlock()
+
+	i := c.find(normalize(bson.M{"id": id})["id"])
+	if i < 0 {
+		return mgo.ErrNotFound
+	}
+	return c.updateAt(i, normalize(upd))
+}
+
+func (h *fakeHandle) UpdateAll(selector interface{}, upd interface{}) (*mgo.ChangeInfo, error) {
+	c := h.coll()
+	defer h.unlock()
+
+	sel, u := normalize(selector), normalize(upd)
+	info := new(mgo.ChangeInfo)
+	for i, d := range c.docs {
+		if !match(d, sel) {
+			continue
+		}
+		if err := c.updateAt(i, u); err != nil {
+			return info, err
+		}
+		info.Matched++
+		info.Updated++
+	}
+	return info, nil
+}
+
+func (h *fakeHandle) RemoveId(id interface{}) error {
+	c := h.coll()
+	defer h.unlock()
+
+	i := c.find(normalize(bson.M{"id": id})["id"])
+	if i < 0 {
+		return mgo.ErrNotFound
+	}
+	c.docs = append(c.docs[:i], c.docs[i+1:]...)
+	return nil
+}
+
+func (h *fakeHandle) RemoveAll(selector interface{}) (*mgo.ChangeInfo, error) {
+	c := h.coll()
+	defer h.unlock()
+
+	sel := normalize(selector)
+	info := new(mgo.ChangeInfo)
+	kept := c.docs[:0]
+	for _, d := range c.docs {
+		if match(d, sel) {
+			info.Matched++
+			info.Removed++
+			continue
+		}
+		kept = append(kept, d)
+	}
+	c.docs = kept
+	return info, nil
+}
+
+func (h *fakeHandle) EnsureIndex(index mgo.Index) error {
+	c := h.coll()
+	defer h.unlock()
+
+	for _, idx := range c.indexes {
+		if strings.Join(idx.Key, ",") == strings.Join(index.Key, ",") {
+			return nil
+		}
+	}
+	if index.Unique {
+		for i, d := range c.docs {
+			c.indexes = append(c.indexes, index)
+			err := c.checkUnique(d, i)
+			c.indexes = c.indexes[:len(c.indexes)-1]
+			if err != nil {
+				return err
+			}
+		}
+	}
+	c.indexes = append(c.indexes, index)
+	return nil
+}
+
+func (h *fakeHandle) EnsureIndexKey(key ...string) error {
+	return h.EnsureIndex(mgo.Index{Key: key})
+}
+
+func (h *fakeHandle) Indexes() ([]mgo.Index, error) {
+	c := h.coll()
+	defer h.unlock()
+
+	return append([]mgo.Index(nil), c.indexes...), nil
+}
+
+type fakeQuery struct {
+	h          *fakeHandle
+	selector   bson.M
+	projection bson.M
+	sort       []string
+}
+
+func (q *fakeQuery) Select(selector interface{}) query {
+	q.projection = normalize(selector)
+	return q
+}
+
+func (q *fakeQuery) Sort(fields ...string) query {
+	q.sort = fields
+	return q
+}
+
+// matches returns the positions of the matching documents in the order of
+// the query.
+//
+// The collection must be locked
+func (q *fakeQuery) matches(c *fakeCollection) []int {
+	var found []int
+	for i, d := range c.docs {
+		if match(d, q.selector) {
+			found = append(found, i)
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		for _, field := range q.sort {
+			desc := strings.HasPrefix(field, "-")
+			field = strings.TrimPrefix(field, "-")
+			a, _ := lookup(c.docs[found[i]], field)
+			b, _ := lookup(c.docs[found[j]], field)
+			if equal(a, b) {
+				continue
+			}
+			return less(a, b) != desc
+		}
+		return false
+	})
+	return found
+}
+
+// project returns a copy of d holding the selected fields
+func (q *fakeQuery) project(d bson.M) bson.M {
+	d = normalize(d)
+	if q.projection == nil {
+		return d
+	}
+	p := bson.M{"_id": d["_id"]}
+	for field := range q.projection {
+		if v, has := d[field]; has {
+			p[field] = v
+		}
+	}
+	return p
+}
+
+func (q *fakeQuery) all() []bson.M {
+	c := q.h.coll()
+	defer q.h.unlock()
+
+	var docs []bson.M
+	for _, i := range q.matches(c) {
+		docs = append(docs, q.project(c.docs[i]))
+	}
+	return docs
+}
+
+func (q *fakeQuery) One(result interface{}) error {
+	docs := q.all()
+	if len(docs) == 0 {
+		return mgo.ErrNotFound
+	}
+	return decode(docs[0], result)
+}
+
+func (q *fakeQuery) Count() (int, error) {
+	return len(q.all()), nil
+}
+
+func (q *fakeQuery) Iter() iter {
+	return &fakeIter{docs: q.all()}
+}
+
+func (q *fakeQuery) Apply(change mgo.Change, result interface{}) (*mgo.ChangeInfo, error) {
+	c := q.h.coll()
+	defer q.h.unlock()
+
+	upd := normalize(change.Update)
+	found := q.matches(c)
+	if len(found) == 0 {
+		if !change.Upsert {
+			return nil, mgo.ErrNotFound
+		}
+		// The new document gets the fields the selector tests for equality
+		d := make(bson.M)
+		for field, v := range q.selector {
+			if _, isOp := v.(bson.M); !isOp && !strings.HasPrefix(field, "$") {
+				setField(d, field, v)
+			}
+		}
+		update(d, upd, true)
+		d = normalize(d)
+		if _, has := d["_id"]; !has {
+			d["_id"] = bson.NewObjectId()
+		}
+		if err := c.checkUnique(d, -1); err != nil {
+			return nil, err
+		}
+		c.docs = append(c.docs, d)
+		if change.ReturnNew {
+			if err := decode(q.project(d), result); err != nil {
+				return nil, err
+			}
+		}
+		return &mgo.ChangeInfo{UpsertedId: d["_id"]}, nil
+	}
+
+	i := found[0]
+	old := q.project(c.docs[i])
+	if err := c.updateAt(i, upd); err != nil {
+		return nil, err
+	}
+	d := old
+	if change.ReturnNew {
+		d = q.project(c.docs[i])
+	}
+	if err := decode(d, result); err != nil {
+		return nil, err
+	}
+	return &mgo.ChangeInfo{Matched: 1, Updated: 1}, nil
+}
+
+type fakeIter struct {
+	docs []bson.M
+}
+
+func (it *fakeIter) Next(result interface{}) bool {
+	if len(it.docs) == 0 {
+		return false
+	}
+	d := it.docs[0]
+	it.docs = it.docs[1:]
+	return decode(d, result) == nil
+}
+
+func (it *fakeIter) Close() error {
+	return nil
+}
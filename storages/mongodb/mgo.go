@@ -0,0 +1,86 @@
+package mongo
+
+import (
+	"gopkg.in/mgo.v2"
+)
+
+// The driver uses mgo through the following interfaces only, so it can be
+// tested against an in-memory stand-in instead of a mongod. They are
+// implemented by thin wrappers around the mgo types.
+
+type session interface {
+	C(dbname, name string) collection
+	Close()
+}
+
+type collection interface {
+	Find(query interface{}) query
+	FindId(id interface{}) query
+	Insert(docs ...interface{}) error
+	UpdateId(id interface{}, update interface{}) error
+	UpdateAll(selector interface{}, update interface{}) (*mgo.ChangeInfo, error)
+	RemoveId(id interface{}) error
+	RemoveAll(selector interface{}) (*mgo.ChangeInfo, error)
+	EnsureIndex(index mgo.Index) error
+	EnsureIndexKey(key ...string) error
+	Indexes() ([]mgo.Index, error)
+}
+
+type query interface {
+	Select(selector interface{}) query
+	Sort(fields ...string) query
+	One(result interface{}) error
+	Count() (int, error)
+	Iter() iter
+	Apply(change mgo.Change, result interface{}) (*mgo.ChangeInfo, error)
+}
+
+type iter interface {
+	Next(result interface{}) bool
+	Close() error
+}
+
+// dial connects to the mongod given by url; tests replace it.
+var dial = func(url string) (session, error) {
+	sess, err := mgo.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return mgoSession{sess}, nil
+}
+
+type mgoSession struct {
+	*mgo.Session
+}
+
+func (s mgoSession) C(dbname, name string) collection {
+	return mgoCollection{s.DB(dbname).C(name)}
+}
+
+type mgoCollection struct {
+	*mgo.Collection
+}
+
+func (c mgoCollection) Find(q interface{}) query {
+	return mgoQuery{c.Collection.Find(q)}
+}
+
+func (c mgoCollection) FindId(id interface{}) query {
+	return mgoQuery{c.Collection.FindId(id)}
+}
+
+type mgoQuery struct {
+	*mgo.Query
+}
+
+func (q mgoQuery) Select(selector interface{}) query {
+	return mgoQuery{q.Query.Select(selector)}
+}
+
+func (q mgoQuery) Sort(fields ...string) query {
+	return mgoQuery{q.Query.Sort(fields...)}
+}
+
+func (q mgoQuery) Iter() iter {
+	return q.Query.Iter()
+}
@@ -1,9 +1,12 @@
 package mongo
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/flosch/graphie"
 
@@ -11,155 +14,677 @@ import (
 	"gopkg.in/mgo.v2/bson"
 )
 
+const (
+	labelPrefix  = "_lbl_"
+	uniquePrefix = "_unq." // _unq.<label>.<attr> holds the values of unique attributes
+	mergeField   = "_mrg"  // the labels and keys of a node added by Merge (see mergeKey)
+
+	errNamespaceNotFound = 26 // mongod error code
+)
+
+var (
+	ErrNotFound     = graphie.ErrNodeNotFound
+	ErrEdgeNotFound = graphie.ErrEdgeNotFound
+	ErrAttrNotFound = graphie.ErrAttrNotFound
+	ErrReservedAttr = fmt.Errorf("%w: attributes with '_'-prefix are reserved", graphie.ErrInvalidAttr)
+
+	// ErrInvalidDocument is returned if a document in the database lacks
+	// one of the internal fields or has one of an unexpected type.
+	ErrInvalidDocument = errors.New("Invalid document in the database")
+)
+
 type mongodbStorage struct {
-	g          *graphie.Graph
-	hostname   string
-	session    *mgo.Session
-	coll_nodes *mgo.Collection
-	coll_edges *mgo.Collection
+	g             *graphie.Graph
+	session       session
+	coll_nodes    collection
+	coll_edges    collection
+	coll_counters collection
+
+	keysLock sync.RWMutex
+	keys     map[string]map[string]struct{} // label -> key attributes (see EnsureIndexNodes)
+	uniques  map[string]map[string]struct{} // label -> unique attributes
+
+	// The session is used by operations between acquire and release; Stop
+	// waits for them before it closes the session
+	closedLock sync.Mutex
+	closed     bool
+	active     sync.WaitGroup
 }
 
-func (s *mongodbStorage) Init(hostname, dbname string) error {
-	sess, err := mgo.Dial(s.hostname)
+// Start connects to the mongod given by attrs, a DSN of the form
+//
+//	[mongodb://]host[:port][,host...][/?key=value&...]
+//
+// for example "mongodb://localhost:27017". The parameters are the ones
+// supported by mgo.Dial.
+func (s *mongodbStorage) Start(attrs string, dbname string) error {
+	dsn, err := graphie.ParseDSN(attrs)
 	if err != nil {
 		return err
 	}
-	s.session = sess
-	s.coll_nodes = sess.DB(dbname).C("nodes")
-	s.coll_edges = sess.DB(dbname).C("edges")
+	err = dsn.CheckDriver("mongodb")
+	if err != nil {
+		return err
+	}
+	if dsn.Driver == "" {
+		// host[:port] without a path; ParseDSN takes it as path
+		dsn.Host, dsn.Path = dsn.Path, ""
+	}
+	if dsn.Host == "" {
+		return &graphie.DSNError{Reason: "host is missing"}
+	}
+	if dsn.Path != "" && dsn.Path != "/" {
+		return &graphie.DSNError{Reason: "the database is given by dbname, not by the DSN path"}
+	}
 
-	s.coll_edges.EnsureIndexKey("_from")
-	s.coll_edges.EnsureIndexKey("_to")
+	// mgo validates its own parameters
+	_, err = mgo.ParseURL(attrs)
+	if err != nil {
+		return &graphie.DSNError{Reason: err.Error()}
+	}
+	sess, err := dial(attrs)
+	if err != nil {
+		return err
+	}
+	s.coll_nodes = sess.C(dbname, "nodes")
+	s.coll_edges = sess.C(dbname, "edges")
+	s.coll_counters = sess.C(dbname, "counters")
 
+	// The types are part of the indexes, so walking the links of one type
+	// doesn't read the others
+	if err := s.coll_edges.EnsureIndexKey("_from", "_type"); err != nil {
+		sess.Close()
+		return err
+	}
+	if err := s.coll_edges.EnsureIndexKey("_to", "_type"); err != nil {
+		sess.Close()
+		return err
+	}
+	err = s.coll_nodes.EnsureIndex(mgo.Index{
+		Key:    []string{mergeField},
+		Unique: true,
+		Sparse: true,
+	})
+	if err != nil {
+		sess.Close()
+		return err
+	}
+
+	// Restore the key attributes from the indexes created by EnsureIndexNodes
+	indexes, err := s.coll_nodes.Indexes()
+	if qerr, ok := err.(*mgo.QueryError); ok && qerr.Code == errNamespaceNotFound {
+		// New database
+		err = nil
+	}
+	if err != nil {
+		sess.Close()
+		return err
+	}
+	s.keys = make(map[string]map[string]struct{})
+	s.uniques = make(map[string]map[string]struct{})
+	for _, idx := range indexes {
+		if idx.Unique && len(idx.Key) == 1 && strings.HasPrefix(idx.Key[0], uniquePrefix) {
+			parts := strings.SplitN(strings.TrimPrefix(idx.Key[0], uniquePrefix), ".", 2)
+			if len(parts) == 2 {
+				s.addUnique(parts[0], parts[1])
+			}
+			continue
+		}
+		if len(idx.Key) < 2 || strings.HasPrefix(idx.Key[0], "_") {
+			continue
+		}
+		for _, key := range idx.Key[1:] {
+			if strings.HasPrefix(key, labelPrefix) {
+				s.addKey(strings.TrimPrefix(key, labelPrefix), idx.Key[0])
+			}
+		}
+	}
+
+	s.closedLock.Lock()
+	s.session = sess
+	s.closedLock.Unlock()
 	return nil
 }
 
-func (s *mongodbStorage) Shutdown() error {
+func (s *mongodbStorage) addKey(label, attr string) {
+	s.keysLock.Lock()
+	defer s.keysLock.Unlock()
+
+	attrs, has := s.keys[label]
+	if !has {
+		attrs = make(map[string]struct{})
+		s.keys[label] = attrs
+	}
+	attrs[attr] = struct{}{}
+}
+
+func (s *mongodbStorage) addUnique(label, attr string) {
+	s.addKey(label, attr)
+
+	s.keysLock.Lock()
+	defer s.keysLock.Unlock()
+
+	attrs, has := s.uniques[label]
+	if !has {
+		attrs = make(map[string]struct{})
+		s.uniques[label] = attrs
+	}
+	attrs[attr] = struct{}{}
+}
+
+func (s *mongodbStorage) isUnique(attr string) bool {
+	s.keysLock.RLock()
+	defer s.keysLock.RUnlock()
+
+	for _, attrs := range s.uniques {
+		if _, has := attrs[attr]; has {
+			return true
+		}
+	}
+	return false
+}
+
+func uniqueField(label, attr string) string {
+	return uniquePrefix + label + "." + attr
+}
+
+// uniqueFields returns the fields holding the values of all unique attributes
+// in attrs.
+func (s *mongodbStorage) uniqueFields(labels []string, attrs graphie.Attrs) bson.M {
+	s.keysLock.RLock()
+	defer s.keysLock.RUnlock()
+
+	d := make(bson.M)
+	for _, lbl := range labels {
+		for attr := range s.uniques[lbl] {
+			if v, has := attrs[attr]; has {
+				d[uniqueField(lbl, attr)] = v
+			}
+		}
+	}
+	return d
+}
+
+// violation turns a duplicate key error caused by the node id into a
+// *graphie.ConstraintViolationError.
+func (s *mongodbStorage) violation(err error, id graphie.NodeID, labels []string, attrs graphie.Attrs) error {
+	if !mgo.IsDup(err) {
+		return err
+	}
+
+	for field, v := range s.uniqueFields(labels, attrs) {
+		n, cerr := s.coll_nodes.Find(bson.M{
+			field: v,
+			"_id": bson.M{"$ne": id},
+		}).Count()
+		if cerr != nil {
+			return cerr
+		}
+		if n > 0 {
+			parts := strings.SplitN(strings.TrimPrefix(field, uniquePrefix), ".", 2)
+			return &graphie.ConstraintViolationError{
+				Label: parts[0],
+				Attr:  parts[1],
+				Value: v,
+			}
+		}
+	}
+	return err
+}
+
+func (s *mongodbStorage) isKey(labels []string) func(attr string) bool {
+	return func(attr string) bool {
+		s.keysLock.RLock()
+		defer s.keysLock.RUnlock()
+
+		for _, lbl := range labels {
+			if _, has := s.keys[lbl][attr]; has {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Stop waits for the running operations and closes the session. It must not
+// be called by the fn of a walk.
+func (s *mongodbStorage) Stop() error {
+	s.closedLock.Lock()
+	if s.session == nil || s.closed {
+		s.closedLock.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.closedLock.Unlock()
+
+	s.active.Wait()
 	s.session.Close()
 	return nil
 }
 
-func (s *mongodbStorage) Add(labels []string, attrs graphie.Attrs) (graphie.Node, error) {
-	id := bson.NewObjectId()
+// acquire fails with graphie.ErrClosed unless the storage has been started
+// and not stopped yet; mgo panics if a closed session is used. Otherwise the
+// session stays open until the caller calls release.
+func (s *mongodbStorage) acquire() error {
+	s.closedLock.Lock()
+	defer s.closedLock.Unlock()
+
+	if s.session == nil || s.closed {
+		return graphie.ErrClosed
+	}
+	s.active.Add(1)
+	return nil
+}
+
+func (s *mongodbStorage) release() {
+	s.active.Done()
+}
+
+// nextID allocates a new NodeID atomically using the counters collection.
+func (s *mongodbStorage) nextID() (graphie.NodeID, error) {
+	seq, err := s.nextSeq("nodes")
+	return graphie.NodeID(seq), err
+}
+
+// nextEdgeID allocates a new EdgeID like nextID.
+func (s *mongodbStorage) nextEdgeID() (graphie.EdgeID, error) {
+	seq, err := s.nextSeq("edges")
+	return graphie.EdgeID(seq), err
+}
 
-	d := bson.M{
-		"_id": id,
+func (s *mongodbStorage) nextSeq(counterName string) (int64, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	change := mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"seq": 1}},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+	_, err := s.coll_counters.FindId(counterName).Apply(change, &counter)
+	if err != nil {
+		return 0, err
 	}
+	return counter.Seq, nil
+}
 
+// document builds the document holding labels and attrs. Attributes starting
+// with '_' are reserved for internal use.
+func document(labels []string, attrs graphie.Attrs) (bson.M, error) {
+	d := make(bson.M, len(labels)+len(attrs))
 	for _, lbl := range labels {
-		d[fmt.Sprintf("_lbl_%s", lbl)] = true
+		d[labelPrefix+lbl] = true
+	}
+	for k, v := range attrs {
+		if strings.HasPrefix(k, "_") {
+			return nil, ErrReservedAttr
+		}
+		d[k] = v
 	}
+	return d, nil
+}
 
-	if attrs != nil {
-		for k, v := range attrs {
-			if strings.HasPrefix(k, "_") {
-				return nil, errors.New("Attribute with '_'-prefix is not allowed.")
-			}
-			d[k] = v
+// setField sets the field given by a dotted path (see uniqueField) in d.
+// Unlike the update operators, an inserted document takes dots as part of the
+// field name, so the nested documents have to be built.
+func setField(d bson.M, path string, v interface{}) {
+	parts := strings.Split(path, ".")
+	for _, p := range parts[:len(parts)-1] {
+		sub, ok := d[p].(bson.M)
+		if !ok {
+			sub = make(bson.M)
+			d[p] = sub
 		}
+		d = sub
 	}
+	d[parts[len(parts)-1]] = v
+}
 
-	err := s.coll_nodes.Insert(d)
+// userAttrs strips all internal fields from a document.
+func userAttrs(d bson.M) graphie.Attrs {
+	attrs := make(graphie.Attrs, len(d))
+	for k, v := range d {
+		if strings.HasPrefix(k, "_") {
+			continue
+		}
+		attrs[k] = v
+	}
+	return attrs
+}
+
+// toNodeID converts an id read from a document; it's stored as int64, but
+// might come back as any numeric type.
+func toNodeID(v interface{}) (graphie.NodeID, error) {
+	switch id := v.(type) {
+	case int64:
+		return graphie.NodeID(id), nil
+	case int:
+		return graphie.NodeID(id), nil
+	case int32:
+		return graphie.NodeID(id), nil
+	case float64:
+		return graphie.NodeID(id), nil
+	}
+	return 0, fmt.Errorf("%w: id %#v", ErrInvalidDocument, v)
+}
+
+// toEdge converts an edge document.
+func toEdge(d bson.M) (*graphie.Edge, error) {
+	id, err := toNodeID(d["_id"])
 	if err != nil {
 		return nil, err
 	}
-
-	return &graphie.Node{
-		G:      s.g,
-		Labels: labels,
-		Id:     string(id),
-		Attrs:  attrs,
+	typ, ok := d["_type"].(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: type %#v of edge %d", ErrInvalidDocument, d["_type"], id)
+	}
+	from, err := toNodeID(d["_from"])
+	if err != nil {
+		return nil, err
+	}
+	to, err := toNodeID(d["_to"])
+	if err != nil {
+		return nil, err
+	}
+	return &graphie.Edge{
+		ID:    graphie.EdgeID(id),
+		Type:  typ,
+		From:  from,
+		To:    to,
+		Attrs: userAttrs(d),
 	}, nil
 }
 
-func (s *mongodbStorage) Merge(labels []string, attrs graphie.Attrs) (graphie.Node, error) {
-	d := make(bson.M)
+func (s *mongodbStorage) Add(labels []string, attrs graphie.Attrs) (graphie.NodeID, error) {
+	if err := s.acquire(); err != nil {
+		return 0, err
+	}
+	defer s.release()
 
-	for _, lbl := range labels {
-		d[fmt.Sprintf("_lbl_%s", lbl)] = true
+	d, err := document(labels, attrs)
+	if err != nil {
+		return 0, err
 	}
 
-	if attrs != nil {
-		for k, v := range attrs {
-			if strings.HasPrefix(k, "_") {
-				return nil, errors.New("Attribute with '_'-prefix is not allowed.")
-			}
+	id, err := s.nextID()
+	if err != nil {
+		return 0, err
+	}
+	d["_id"] = id
+	for field, v := range s.uniqueFields(labels, attrs) {
+		setField(d, field, v)
+	}
+
+	err = s.coll_nodes.Insert(d)
+	if err != nil {
+		return 0, s.violation(err, id, labels, attrs)
+	}
+
+	return id, nil
+}
+
+// mergeKey identifies the node merged with labels and keys. It's stored in
+// mergeField, which has a unique index, so concurrent Merges can't add the
+// same node twice.
+func mergeKey(labels []string, keys graphie.Attrs) string {
+	sorted := append([]string(nil), labels...)
+	sort.Strings(sorted)
+	names := make([]string, 0, len(keys))
+	for k := range keys {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%q", sorted)
+	for _, k := range names {
+		fmt.Fprintf(&b, ",%q=%#v", k, graphie.ValueKey(keys[k]))
+	}
+	return b.String()
+}
+
+// Merge upserts the node using findAndModify. A node it adds gets its
+// mergeKey; the unique index on it makes concurrent Merges of the same node
+// fail with a duplicate key error, so they retry and find the node.
+func (s *mongodbStorage) Merge(labels []string, attrs graphie.Attrs) (graphie.NodeID, error) {
+	if err := s.acquire(); err != nil {
+		return 0, err
+	}
+	defer s.release()
+
+	keys, rest := graphie.SplitKeys(attrs, s.isKey(labels))
+	if len(keys) == 0 {
+		return 0, graphie.ErrNoKeys
+	}
+	selector, err := document(labels, keys)
+	if err != nil {
+		return 0, err
+	}
+	set, err := document(nil, rest)
+	if err != nil {
+		return 0, err
+	}
+
+	// The id is allocated in advance; it's wasted if the node exists
+	id, err := s.nextID()
+	if err != nil {
+		return 0, err
+	}
+	insert := s.uniqueFields(labels, attrs)
+	insert["_id"] = id
+	insert[mergeField] = mergeKey(labels, keys)
+	update := bson.M{
+		"$setOnInsert": insert,
+	}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+
+	var t struct {
+		ID int64 `bson:"_id"`
+	}
+	change := mgo.Change{
+		Update:    update,
+		Upsert:    true,
+		ReturnNew: true,
+	}
+	_, err = s.coll_nodes.Find(selector).Select(bson.M{"_id": 1}).Apply(change, &t)
+	if mgo.IsDup(err) {
+		// A concurrent Merge inserted the node in the meantime; the unique
+		// index on mergeField prevented a duplicate, so it's found now
+		_, err = s.coll_nodes.Find(selector).Select(bson.M{"_id": 1}).Apply(change, &t)
+	}
+	if err != nil {
+		return 0, s.violation(err, id, labels, attrs)
+	}
+	return graphie.NodeID(t.ID), nil
+}
+
+// Link stores the labels of the from-node along with the edge, so edges can
+// be indexed by EnsureIndexLinks.
+//
+// Nodes and edges live in different collections and mongodb doesn't write
+// both atomically. The edge is inserted last, after both nodes were found, so
+// a failing Link leaves nothing behind. A Remove running concurrently might
+// take one of the nodes before the edge is inserted; Link looks for the nodes
+// once more afterwards and takes the edge back in this case, while Remove
+// removes the edges of the node once more after the node itself (see
+// Remove). Between the insert and this check, readers might see an edge to a
+// node which is gone.
+func (s *mongodbStorage) Link(from, to graphie.NodeID, typ string, attrs graphie.Attrs) (graphie.EdgeID, error) {
+	if err := s.acquire(); err != nil {
+		return 0, err
+	}
+	defer s.release()
+
+	var fromNode bson.M
+	err := s.coll_nodes.FindId(from).One(&fromNode)
+	if err == mgo.ErrNotFound {
+		return 0, ErrNotFound
+	} else if err != nil {
+		return 0, err
+	}
+	n, err := s.coll_nodes.FindId(to).Count()
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, ErrNotFound
+	}
+
+	d, err := document(nil, attrs)
+	if err != nil {
+		return 0, err
+	}
+	id, err := s.nextEdgeID()
+	if err != nil {
+		return 0, err
+	}
+	d["_id"] = id
+	d["_type"] = typ
+	d["_from"] = from
+	d["_to"] = to
+	for k, v := range fromNode {
+		if strings.HasPrefix(k, labelPrefix) {
 			d[k] = v
 		}
 	}
 
-	inf, err := s.coll_nodes.Upsert(d, d)
-	if err != nil {
-		return nil, err
+	if err := s.coll_edges.Insert(d); err != nil {
+		return 0, err
 	}
-	if inf.UpsertedId != nil {
-		// We have an ID
-		return &graphie.Node{
-			G:      s.g,
-			Labels: labels,
-			Id:     string(inf.UpsertedId.(bson.ObjectId)),
-			Attrs:  attrs,
-		}, nil
-	} else {
-		// We have to fetch the ID
-		var t bson.M
-		err = s.coll_nodes.Find(d).One(&t)
+
+	for _, nid := range []graphie.NodeID{from, to} {
+		n, err := s.coll_nodes.FindId(nid).Count()
 		if err != nil {
-			return nil, err
+			return 0, err
+		}
+		if n == 0 {
+			err = s.coll_edges.RemoveId(id)
+			if err != nil && err != mgo.ErrNotFound {
+				return 0, err
+			}
+			return 0, ErrNotFound
 		}
+	}
+	return id, nil
+}
 
-		return &graphie.Node{
-			G:      s.g,
-			Labels: labels,
-			Id:     string(t["_id"].(bson.ObjectId)),
-			Attrs:  attrs,
-		}, nil
+func (s *mongodbStorage) GetEdge(id graphie.EdgeID) (*graphie.Edge, error) {
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	defer s.release()
 
+	var d bson.M
+	err := s.coll_edges.FindId(id).One(&d)
+	if err == mgo.ErrNotFound {
+		return nil, ErrEdgeNotFound
+	} else if err != nil {
+		return nil, err
 	}
+
+	return toEdge(d)
 }
 
-func (s *mongodbStorage) Link(labels []string, from, to *graphie.Node, attrs graphie.Attrs) error {
-	id := bson.NewObjectId()
+func (s *mongodbStorage) SetEdgeAttr(id graphie.EdgeID, key string, value interface{}) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
 
-	d := bson.M{
-		"_id":   id,
-		"_from": bson.ObjectId(from.Id),
-		"_to":   bson.ObjectId(to.Id),
+	if strings.HasPrefix(key, "_") {
+		return ErrReservedAttr
 	}
 
-	for _, lbl := range labels {
-		d[fmt.Sprintf("_lbl_%s", lbl)] = true
+	err := s.coll_edges.UpdateId(id, bson.M{"$set": bson.M{key: value}})
+	if err == mgo.ErrNotFound {
+		return ErrEdgeNotFound
 	}
+	return err
+}
 
-	if attrs != nil {
-		for k, v := range attrs {
-			if strings.HasPrefix(k, "_") {
-				return nil, errors.New("Attribute with '_'-prefix is not allowed.")
-			}
-			d[k] = v
-		}
+func (s *mongodbStorage) RemoveEdge(id graphie.EdgeID) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+
+	err := s.coll_edges.RemoveId(id)
+	if err == mgo.ErrNotFound {
+		return ErrEdgeNotFound
+	}
+	return err
+}
+
+func (s *mongodbStorage) Unlink(from, to graphie.NodeID, attrs graphie.Attrs) (int, error) {
+	if err := s.acquire(); err != nil {
+		return 0, err
 	}
+	defer s.release()
 
-	err := s.coll_edges.Insert(d)
+	d, err := document(nil, attrs)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
+	d["_from"] = from
+	d["_to"] = to
 
-	return nil
+	inf, err := s.coll_edges.RemoveAll(d)
+	if err != nil {
+		return 0, err
+	}
 
+	return inf.Removed, nil
+}
+
+// Remove deletes the node and all edges from and to it. The edges are
+// removed first, so a Remove failing half-way leaves a node without some of
+// its edges, but never an edge without its node; it can simply be repeated.
+// The edges are removed once more after the node, in case a concurrent Link
+// inserted one in the meantime (see Link).
+func (s *mongodbStorage) Remove(id graphie.NodeID) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+
+	edges := bson.M{
+		"$or": []bson.M{
+			{"_from": id},
+			{"_to": id},
+		},
+	}
+	_, err := s.coll_edges.RemoveAll(edges)
+	if err != nil {
+		return err
+	}
+
+	err = s.coll_nodes.RemoveId(id)
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	_, err = s.coll_edges.RemoveAll(edges)
+	return err
 }
 
 func (s *mongodbStorage) EnsureIndexNodes(labels []string, attr_name string) error {
-	if strings.HasPrefix(attr_name, "_") {
-		return errors.New("Attribute with '_'-prefix is not allowed.")
+	if err := s.acquire(); err != nil {
+		return err
 	}
+	defer s.release()
 
-	keys := make([]string, 0, 1)
+	if strings.HasPrefix(attr_name, "_") {
+		return ErrReservedAttr
+	}
 
+	keys := make([]string, 0, 1+len(labels))
 	keys = append(keys, attr_name)
-
 	for _, lbl := range labels {
-		keys = append(keys, fmt.Sprintf("_lbl_%s", lbl))
+		keys = append(keys, labelPrefix+lbl)
 	}
 
 	idx := mgo.Index{
@@ -167,19 +692,118 @@ func (s *mongodbStorage) EnsureIndexNodes(labels []string, attr_name string) err
 		Sparse: true,
 	}
 
-	return s.coll_nodes.EnsureIndex(idx)
+	err := s.coll_nodes.EnsureIndex(idx)
+	if err != nil {
+		return err
+	}
+	for _, lbl := range labels {
+		s.addKey(lbl, attr_name)
+	}
+	return nil
+}
+
+// EnsureUnique maintains the field _unq.<label>.<attr> holding the value of
+// attr for all nodes carrying the label and creates a unique index on it.
+func (s *mongodbStorage) EnsureUnique(labels []string, attr_name string) error {
+	return s.EnsureUniqueContext(context.Background(), labels, attr_name)
+}
+
+// EnsureUniqueContext can be cancelled while it looks for duplicates; once
+// the fields are filled, it finishes.
+func (s *mongodbStorage) EnsureUniqueContext(ctx context.Context, labels []string, attr_name string) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+
+	if strings.HasPrefix(attr_name, "_") {
+		return ErrReservedAttr
+	}
+
+	for _, lbl := range labels {
+		// Look for existing duplicates first, there's no way to find them
+		// once the index creation failed
+		values := make(map[interface{}]struct{})
+		var d bson.M
+		iter := s.coll_nodes.Find(bson.M{
+			labelPrefix + lbl: true,
+			attr_name:         bson.M{"$exists": true},
+		}).Select(bson.M{attr_name: 1}).Iter()
+		for iter.Next(&d) {
+			if err := ctx.Err(); err != nil {
+				iter.Close()
+				return err
+			}
+			key := graphie.ValueKey(d[attr_name])
+			if _, has := values[key]; has {
+				iter.Close()
+				return &graphie.ConstraintViolationError{
+					Label: lbl,
+					Attr:  attr_name,
+					Value: d[attr_name],
+				}
+			}
+			values[key] = struct{}{}
+			d = nil
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+
+	for _, lbl := range labels {
+		// Nodes added from now on get the field, fill it for all others
+		s.addUnique(lbl, attr_name)
+		field := uniqueField(lbl, attr_name)
+
+		var d bson.M
+		iter := s.coll_nodes.Find(bson.M{
+			labelPrefix + lbl: true,
+			attr_name:         bson.M{"$exists": true},
+		}).Select(bson.M{attr_name: 1}).Iter()
+		for iter.Next(&d) {
+			err := s.coll_nodes.UpdateId(d["_id"], bson.M{"$set": bson.M{field: d[attr_name]}})
+			if err != nil && err != mgo.ErrNotFound {
+				iter.Close()
+				return err
+			}
+			d = nil
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+
+		err := s.coll_nodes.EnsureIndex(mgo.Index{
+			Key:    []string{field},
+			Unique: true,
+			Sparse: true,
+		})
+		if mgo.IsDup(err) {
+			return &graphie.ConstraintViolationError{
+				Label: lbl,
+				Attr:  attr_name,
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *mongodbStorage) EnsureIndexLinks(labels []string, attr_name string) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+
 	if strings.HasPrefix(attr_name, "_") {
-		return errors.New("Attribute with '_'-prefix is not allowed.")
+		return ErrReservedAttr
 	}
 
-	keys := make([]string, 0, 1)
+	keys := make([]string, 0, 1+len(labels))
 	keys = append(keys, attr_name)
-
 	for _, lbl := range labels {
-		keys = append(keys, fmt.Sprintf("_lbl_%s", lbl))
+		keys = append(keys, labelPrefix+lbl)
 	}
 
 	idx := mgo.Index{
@@ -190,6 +814,339 @@ func (s *mongodbStorage) EnsureIndexLinks(labels []string, attr_name string) err
 	return s.coll_edges.EnsureIndex(idx)
 }
 
+func (s *mongodbStorage) FindByAttr(labels []string, key string, value interface{}) ([]graphie.NodeID, error) {
+	return s.FindByAttrContext(context.Background(), labels, key, value)
+}
+
+func (s *mongodbStorage) FindByAttrContext(ctx context.Context, labels []string, key string, value interface{}) ([]graphie.NodeID, error) {
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	defer s.release()
+
+	d, err := document(labels, graphie.Attrs{key: value})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]graphie.NodeID, 0)
+	var t struct {
+		ID int64 `bson:"_id"`
+	}
+	iter := s.coll_nodes.Find(d).Select(bson.M{"_id": 1}).Sort("_id").Iter()
+	for iter.Next(&t) {
+		if err := ctx.Err(); err != nil {
+			iter.Close()
+			return nil, err
+		}
+		ids = append(ids, graphie.NodeID(t.ID))
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (s *mongodbStorage) WalkNodes(labels []string, fn func(id graphie.NodeID) error) error {
+	return s.WalkNodesContext(context.Background(), labels, fn)
+}
+
+func (s *mongodbStorage) WalkNodesContext(ctx context.Context, labels []string, fn func(id graphie.NodeID) error) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+
+	d, err := document(labels, nil)
+	if err != nil {
+		return err
+	}
+
+	var t struct {
+		ID int64 `bson:"_id"`
+	}
+	iter := s.coll_nodes.Find(d).Select(bson.M{"_id": 1}).Sort("_id").Iter()
+	for iter.Next(&t) {
+		if err := ctx.Err(); err != nil {
+			iter.Close()
+			return err
+		}
+		if err := fn(graphie.NodeID(t.ID)); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+// AddLabel sets the label field of the node and its out-edges (see Link).
+func (s *mongodbStorage) AddLabel(id graphie.NodeID, label string) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+
+	var d bson.M
+	err := s.coll_nodes.FindId(id).One(&d)
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	labels := []string{label}
+	attrs := userAttrs(d)
+	set := s.uniqueFields(labels, attrs)
+	set[labelPrefix+label] = true
+
+	err = s.coll_nodes.UpdateId(id, bson.M{"$set": set})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	} else if err != nil {
+		return s.violation(err, id, labels, attrs)
+	}
+
+	_, err = s.coll_edges.UpdateAll(bson.M{"_from": id}, bson.M{
+		"$set": bson.M{labelPrefix + label: true},
+	})
+	return err
+}
+
+// RemoveLabel unsets the label field of the node and its out-edges as well
+// as the unique fields of the label and the merge key (see Set).
+func (s *mongodbStorage) RemoveLabel(id graphie.NodeID, label string) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+
+	unset := bson.M{labelPrefix + label: "", mergeField: ""}
+	s.keysLock.RLock()
+	for attr := range s.uniques[label] {
+		unset[uniqueField(label, attr)] = ""
+	}
+	s.keysLock.RUnlock()
+
+	err := s.coll_nodes.UpdateId(id, bson.M{"$unset": unset})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	_, err = s.coll_edges.UpdateAll(bson.M{"_from": id}, bson.M{
+		"$unset": bson.M{labelPrefix + label: ""},
+	})
+	return err
+}
+
+func (s *mongodbStorage) In(id graphie.NodeID) ([]*graphie.Link, error) {
+	links := make([]*graphie.Link, 0)
+	err := s.WalkIn(id, func(l *graphie.Link) error {
+		links = append(links, l)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (s *mongodbStorage) Out(id graphie.NodeID) ([]*graphie.Link, error) {
+	links := make([]*graphie.Link, 0)
+	err := s.WalkOut(id, func(l *graphie.Link) error {
+		links = append(links, l)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (s *mongodbStorage) WalkIn(id graphie.NodeID, fn func(l *graphie.Link) error) error {
+	return s.walkLinks(context.Background(), id, "_to", "_from", nil, fn)
+}
+
+func (s *mongodbStorage) WalkOut(id graphie.NodeID, fn func(l *graphie.Link) error) error {
+	return s.walkLinks(context.Background(), id, "_from", "_to", nil, fn)
+}
+
+func (s *mongodbStorage) WalkInTypes(id graphie.NodeID, types []string, fn func(l *graphie.Link) error) error {
+	return s.walkLinks(context.Background(), id, "_to", "_from", types, fn)
+}
+
+func (s *mongodbStorage) WalkOutTypes(id graphie.NodeID, types []string, fn func(l *graphie.Link) error) error {
+	return s.walkLinks(context.Background(), id, "_from", "_to", types, fn)
+}
+
+// walkLinks iterates over all edges of the types having id in the field self
+// and calls fn with the node in the field other until ctx is done.
+func (s *mongodbStorage) walkLinks(ctx context.Context, id graphie.NodeID, self, other string, types []string, fn func(l *graphie.Link) error) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+
+	n, err := s.coll_nodes.FindId(id).Count()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	query := bson.M{self: id}
+	if len(types) > 0 {
+		query["_type"] = bson.M{"$in": types}
+	}
+
+	iter := s.coll_edges.Find(query).Iter()
+	var d bson.M
+	for iter.Next(&d) {
+		if err := ctx.Err(); err != nil {
+			iter.Close()
+			return err
+		}
+		e, err := toEdge(d)
+		if err != nil {
+			iter.Close()
+			return err
+		}
+		l := &graphie.Link{
+			ID:    e.ID,
+			Type:  e.Type,
+			Other: e.To,
+			Attrs: e.Attrs,
+		}
+		if other == "_from" {
+			l.Other = e.From
+		}
+		err = fn(l)
+		if err != nil {
+			iter.Close()
+			return err
+		}
+		d = nil
+	}
+	return iter.Close()
+}
+
+func (s *mongodbStorage) Set(id graphie.NodeID, key string, value interface{}) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+
+	if strings.HasPrefix(key, "_") {
+		return ErrReservedAttr
+	}
+
+	set := bson.M{key: value}
+
+	// Unique attributes need the labels of the node to update their fields
+	var labels []string
+	attrs := graphie.Attrs{key: value}
+	if s.isUnique(key) {
+		var err error
+		labels, err = s.Labels(id)
+		if err != nil {
+			return err
+		}
+		for field, v := range s.uniqueFields(labels, attrs) {
+			set[field] = v
+		}
+	}
+
+	// The node might not match its merge key anymore; it mustn't keep a
+	// later Merge from adding a node with that key
+	err := s.coll_nodes.UpdateId(id, bson.M{
+		"$set":   set,
+		"$unset": bson.M{mergeField: ""},
+	})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	} else if err != nil {
+		return s.violation(err, id, labels, attrs)
+	}
+	return nil
+}
+
+func (s *mongodbStorage) Get(id graphie.NodeID, key string) (interface{}, error) {
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	defer s.release()
+
+	if strings.HasPrefix(key, "_") {
+		return nil, ErrReservedAttr
+	}
+
+	var d bson.M
+	err := s.coll_nodes.FindId(id).Select(bson.M{key: 1}).One(&d)
+	if err == mgo.ErrNotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	v, has := d[key]
+	if !has {
+		return nil, ErrAttrNotFound
+	}
+	return v, nil
+}
+
+func (s *mongodbStorage) Has(id graphie.NodeID, key string) (bool, error) {
+	_, err := s.Get(id, key)
+	if err == ErrAttrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *mongodbStorage) Attrs(id graphie.NodeID) (graphie.Attrs, error) {
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	defer s.release()
+
+	var d bson.M
+	err := s.coll_nodes.FindId(id).One(&d)
+	if err == mgo.ErrNotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return userAttrs(d), nil
+}
+
+// Labels returns the labels the node carries.
+func (s *mongodbStorage) Labels(id graphie.NodeID) ([]string, error) {
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	defer s.release()
+
+	var d bson.M
+	err := s.coll_nodes.FindId(id).One(&d)
+	if err == mgo.ErrNotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	labels := make([]string, 0)
+	for k := range d {
+		if strings.HasPrefix(k, labelPrefix) {
+			labels = append(labels, strings.TrimPrefix(k, labelPrefix))
+		}
+	}
+	return labels, nil
+}
+
 func registerMongodb(g *graphie.Graph) (graphie.Storage, error) {
 	return &mongodbStorage{
 		g: g,
@@ -0,0 +1,107 @@
+package mongo
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/flosch/graphie"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func startFake(t *testing.T) *mongodbStorage {
+	defer func(d func(url string) (session, error)) { dial = d }(dial)
+	dial = newFakeServer().dial
+
+	st, err := registerMongodb(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := st.(*mongodbStorage)
+	if err := s.Start("mongodb://localhost:27017", "graphie"); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStopBeforeStart(t *testing.T) {
+	st, err := registerMongodb(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Stop(); err != nil {
+		t.Fatalf("Stop before Start returned %v", err)
+	}
+	if _, err := st.Add(nil, nil); err != graphie.ErrClosed {
+		t.Fatalf("Add before Start returned %v, want ErrClosed", err)
+	}
+}
+
+// TestStopWaits makes sure Stop doesn't close the session while it's used;
+// the fake session panics like mgo if it's used after Close.
+func TestStopWaits(t *testing.T) {
+	s := startFake(t)
+	id, err := s.Add([]string{"person"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add([]string{"person"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan error)
+	err = s.WalkNodes([]string{"person"}, func(n graphie.NodeID) error {
+		if n != id {
+			return nil
+		}
+		go func() {
+			stopped <- s.Stop()
+		}()
+		time.Sleep(10 * time.Millisecond)
+		if _, err := s.Attrs(id); err != graphie.ErrClosed {
+			t.Errorf("Attrs while stopping returned %v, want ErrClosed", err)
+		}
+		select {
+		case <-stopped:
+			t.Error("Stop returned before the walk finished")
+		default:
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatalf("Stop returned %v when called twice", err)
+	}
+}
+
+// TestInvalidDocuments makes sure documents lacking internal fields are
+// reported as errors.
+func TestInvalidDocuments(t *testing.T) {
+	s := startFake(t)
+	defer s.Stop()
+	a, err := s.Add(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.coll_edges.Insert(bson.M{"_id": int64(100), "_from": a, "_to": a}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.coll_edges.Insert(bson.M{"_id": int64(101), "_type": "", "_from": a, "_to": "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.GetEdge(100); !errors.Is(err, ErrInvalidDocument) {
+		t.Errorf("GetEdge of an edge without type returned %v, want %v", err, ErrInvalidDocument)
+	}
+	if _, err := s.GetEdge(101); !errors.Is(err, ErrInvalidDocument) {
+		t.Errorf("GetEdge of an edge with an invalid id returned %v, want %v", err, ErrInvalidDocument)
+	}
+	if _, err := s.Out(a); !errors.Is(err, ErrInvalidDocument) {
+		t.Errorf("Out returned %v, want %v", err, ErrInvalidDocument)
+	}
+}
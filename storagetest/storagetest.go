@@ -0,0 +1,1518 @@
+// Package storagetest is a conformance suite for graphie storage drivers.
+// Every driver registered using graphie.RegisterDriver is expected to pass
+// it. Use it from a test of the driver package:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, storagetest.Suite{
+//			Driver: "happy",
+//			DriverAttrs: func(t *testing.T) string {
+//				dir, err := ioutil.TempDir("", "happy")
+//				...
+//				return dir
+//			},
+//			Persistent: true,
+//		})
+//	}
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flosch/graphie"
+)
+
+// Suite describes the driver under test.
+type Suite struct {
+	// Driver is the name the driver was registered with.
+	Driver string
+
+	// DriverAttrs returns the driverAttrs passed to graphie.NewGraph. It's
+	// called once per test; drivers which don't separate databases by
+	// dbname have to return the attrs of a fresh, empty database.
+	DriverAttrs func(t *testing.T) string
+
+	// Persistent drivers keep the graph when it's closed and opened again
+	// with the same driverAttrs and dbname.
+	Persistent bool
+}
+
+type env struct {
+	suite  Suite
+	attrs  string
+	dbname string
+	g      *graphie.Graph
+	s      graphie.Storage
+}
+
+func (e *env) open(t *testing.T) {
+	g, err := graphie.NewGraph(e.suite.Driver, e.attrs, e.dbname)
+	if err != nil {
+		t.Fatalf("Opening the graph failed: %s", err)
+	}
+	e.g = g
+	e.s = g.Storage()
+}
+
+func (e *env) close(t *testing.T) {
+	if e.g == nil {
+		return
+	}
+	err := e.g.Close()
+	e.g, e.s = nil, nil
+	if err != nil {
+		t.Fatalf("Closing the graph failed: %s", err)
+	}
+}
+
+var dbCounter struct {
+	sync.Mutex
+	n int
+}
+
+func dbname() string {
+	dbCounter.Lock()
+	defer dbCounter.Unlock()
+	dbCounter.n++
+	return fmt.Sprintf("storagetest_%d_%d", time.Now().UnixNano(), dbCounter.n)
+}
+
+// Run runs the whole suite against the driver. Every test uses its own
+// database.
+func Run(t *testing.T, suite Suite) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, e *env)
+	}{
+		{"AddAttrs", testAddAttrs},
+		{"SetGetHas", testSetGetHas},
+		{"Merge", testMerge},
+		{"LinkInOut", testLinkInOut},
+		{"SelfLoop", testSelfLoop},
+		{"Walk", testWalk},
+		{"Unlink", testUnlink},
+		{"Remove", testRemove},
+		{"Edges", testEdges},
+		{"LinkTypes", testLinkTypes},
+		{"Indexes", testIndexes},
+		{"Unique", testUnique},
+		{"FindByAttr", testFindByAttr},
+		{"Labels", testLabels},
+		{"Tx", testTx},
+		{"Snapshot", testSnapshot},
+		{"Errors", testErrors},
+		{"Context", testContext},
+		{"DSN", testDSN},
+		{"Concurrency", testConcurrency},
+		{"Persistence", testPersistence},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			e := &env{
+				suite:  suite,
+				dbname: dbname(),
+			}
+			if suite.DriverAttrs != nil {
+				e.attrs = suite.DriverAttrs(t)
+			}
+			e.open(t)
+			defer e.close(t)
+			test.fn(t, e)
+		})
+	}
+}
+
+func mustAdd(t *testing.T, s graphie.Storage, labels []string, attrs graphie.Attrs) graphie.NodeID {
+	id, err := s.Add(labels, attrs)
+	if err != nil {
+		t.Fatalf("Add(%v, %v) failed: %s", labels, attrs, err)
+	}
+	return id
+}
+
+func mustLink(t *testing.T, s graphie.Storage, from, to graphie.NodeID, attrs graphie.Attrs) graphie.EdgeID {
+	return mustLinkType(t, s, from, to, "", attrs)
+}
+
+func mustLinkType(t *testing.T, s graphie.Storage, from, to graphie.NodeID, typ string, attrs graphie.Attrs) graphie.EdgeID {
+	id, err := s.Link(from, to, typ, attrs)
+	if err != nil {
+		t.Fatalf("Link(%d, %d, %q, %v) failed: %s", from, to, typ, attrs, err)
+	}
+	return id
+}
+
+func expectAttrs(t *testing.T, s graphie.Storage, id graphie.NodeID, want graphie.Attrs) {
+	have, err := s.Attrs(id)
+	if err != nil {
+		t.Fatalf("Attrs(%d) failed: %s", id, err)
+	}
+	if len(have) != len(want) || !have.Match(want) {
+		t.Fatalf("Attrs(%d) = %v, want %v", id, have, want)
+	}
+}
+
+// expectLinks checks the links of one direction regardless of their order.
+// The ids of the links are only checked if they are set in want.
+func expectLinks(t *testing.T, what string, links []*graphie.Link, err error, want []*graphie.Link) {
+	if err != nil {
+		t.Fatalf("%s failed: %s", what, err)
+	}
+	if len(links) != len(want) {
+		t.Fatalf("%s returned %d links, want %d", what, len(links), len(want))
+	}
+	used := make([]bool, len(links))
+	for _, w := range want {
+		found := false
+		for i, l := range links {
+			if used[i] || l.Other != w.Other || (w.ID != 0 && l.ID != w.ID) {
+				continue
+			}
+			if len(l.Attrs) != len(w.Attrs) || !l.Attrs.Match(w.Attrs) {
+				continue
+			}
+			used[i] = true
+			found = true
+			break
+		}
+		if !found {
+			t.Fatalf("%s: link to %d with %v is missing", what, w.Other, w.Attrs)
+		}
+	}
+}
+
+func testAddAttrs(t *testing.T, e *env) {
+	attrs := graphie.Attrs{"name": "Euler", "born": 1707, "ratio": 0.5}
+	a := mustAdd(t, e.s, []string{"person"}, attrs)
+	b := mustAdd(t, e.s, []string{"person"}, nil)
+	if a == b {
+		t.Fatalf("Add returned the same id %d twice", a)
+	}
+
+	expectAttrs(t, e.s, a, attrs)
+	expectAttrs(t, e.s, b, graphie.Attrs{})
+
+	// The storage must not keep a reference to the passed attributes
+	attrs["name"] = "Gauss"
+	expectAttrs(t, e.s, a, graphie.Attrs{"name": "Euler", "born": 1707, "ratio": 0.5})
+
+	// Nor must the caller be able to change the stored ones
+	have, _ := e.s.Attrs(a)
+	have["name"] = "Gauss"
+	expectAttrs(t, e.s, a, graphie.Attrs{"name": "Euler", "born": 1707, "ratio": 0.5})
+
+	if _, err := e.s.Attrs(b + a + 1000); err == nil {
+		t.Fatal("Attrs of a non-existing node succeeded")
+	}
+}
+
+func testSetGetHas(t *testing.T, e *env) {
+	a := mustAdd(t, e.s, []string{"person"}, graphie.Attrs{"name": "Euler"})
+
+	if err := e.s.Set(a, "born", 1707); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	if err := e.s.Set(a, "name", "Leonhard Euler"); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	v, err := e.s.Get(a, "born")
+	if err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+	if !graphie.ValueEqual(v, 1707) {
+		t.Fatalf("Get returned %v, want 1707", v)
+	}
+	v, err = e.s.Get(a, "name")
+	if err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+	if v != "Leonhard Euler" {
+		t.Fatalf("Get returned %v, want 'Leonhard Euler'", v)
+	}
+	if _, err := e.s.Get(a, "died"); err == nil {
+		t.Fatal("Get of a missing attribute succeeded")
+	}
+
+	has, err := e.s.Has(a, "born")
+	if err != nil || !has {
+		t.Fatalf("Has(born) = %v, %v; want true", has, err)
+	}
+	has, err = e.s.Has(a, "died")
+	if err != nil || has {
+		t.Fatalf("Has(died) = %v, %v; want false", has, err)
+	}
+
+	missing := a + 1000
+	if err := e.s.Set(missing, "x", 1); err == nil {
+		t.Fatal("Set on a non-existing node succeeded")
+	}
+	if _, err := e.s.Get(missing, "x"); err == nil {
+		t.Fatal("Get on a non-existing node succeeded")
+	}
+	if _, err := e.s.Has(missing, "x"); err == nil {
+		t.Fatal("Has on a non-existing node succeeded")
+	}
+}
+
+func testMerge(t *testing.T, e *env) {
+	labels := []string{"person"}
+	a, err := e.s.Merge(labels, graphie.Attrs{"name": "Euler"})
+	if err != nil {
+		t.Fatalf("Merge failed: %s", err)
+	}
+	b, err := e.s.Merge(labels, graphie.Attrs{"name": "Euler"})
+	if err != nil {
+		t.Fatalf("Merge failed: %s", err)
+	}
+	if a != b {
+		t.Fatalf("Merging the same node twice returned %d and %d", a, b)
+	}
+
+	c, err := e.s.Merge(labels, graphie.Attrs{"name": "Gauss"})
+	if err != nil {
+		t.Fatalf("Merge failed: %s", err)
+	}
+	if c == a {
+		t.Fatal("Merging a different node returned the existing one")
+	}
+	d, err := e.s.Merge([]string{"city"}, graphie.Attrs{"name": "Euler"})
+	if err != nil {
+		t.Fatalf("Merge failed: %s", err)
+	}
+	if d == a {
+		t.Fatal("Merging a node with different labels returned the existing one")
+	}
+
+	expectAttrs(t, e.s, a, graphie.Attrs{"name": "Euler"})
+
+	if _, err := e.s.Merge(labels, nil); !errors.Is(err, graphie.ErrNoKeys) {
+		t.Fatalf("Merge without attributes returned %v, want ErrNoKeys", err)
+	}
+}
+
+func testLinkInOut(t *testing.T, e *env) {
+	a := mustAdd(t, e.s, []string{"person"}, graphie.Attrs{"name": "a"})
+	b := mustAdd(t, e.s, []string{"person"}, graphie.Attrs{"name": "b"})
+	c := mustAdd(t, e.s, []string{"person"}, graphie.Attrs{"name": "c"})
+
+	mustLink(t, e.s, a, b, graphie.Attrs{"type": "knows"})
+	mustLink(t, e.s, a, b, graphie.Attrs{"type": "likes"})
+	mustLink(t, e.s, a, c, nil)
+	mustLink(t, e.s, c, a, graphie.Attrs{"weight": 3})
+
+	out, err := e.s.Out(a)
+	expectLinks(t, "Out(a)", out, err, []*graphie.Link{
+		{Other: b, Attrs: graphie.Attrs{"type": "knows"}},
+		{Other: b, Attrs: graphie.Attrs{"type": "likes"}},
+		{Other: c, Attrs: graphie.Attrs{}},
+	})
+	in, err := e.s.In(a)
+	expectLinks(t, "In(a)", in, err, []*graphie.Link{
+		{Other: c, Attrs: graphie.Attrs{"weight": 3}},
+	})
+	in, err = e.s.In(b)
+	expectLinks(t, "In(b)", in, err, []*graphie.Link{
+		{Other: a, Attrs: graphie.Attrs{"type": "knows"}},
+		{Other: a, Attrs: graphie.Attrs{"type": "likes"}},
+	})
+	out, err = e.s.Out(b)
+	expectLinks(t, "Out(b)", out, err, nil)
+
+	// Linking doesn't touch the node attributes
+	expectAttrs(t, e.s, a, graphie.Attrs{"name": "a"})
+	expectAttrs(t, e.s, b, graphie.Attrs{"name": "b"})
+
+	missing := c + 1000
+	if _, err := e.s.Link(a, missing, "", nil); err == nil {
+		t.Fatal("Linking to a non-existing node succeeded")
+	}
+	if _, err := e.s.Link(missing, a, "", nil); err == nil {
+		t.Fatal("Linking from a non-existing node succeeded")
+	}
+	if _, err := e.s.Out(missing); err == nil {
+		t.Fatal("Out of a non-existing node succeeded")
+	}
+	if _, err := e.s.In(missing); err == nil {
+		t.Fatal("In of a non-existing node succeeded")
+	}
+}
+
+func expectEdge(t *testing.T, s graphie.Storage, id graphie.EdgeID, want *graphie.Edge) {
+	have, err := s.GetEdge(id)
+	if err != nil {
+		t.Fatalf("GetEdge(%d) failed: %s", id, err)
+	}
+	if have.ID != want.ID || have.Type != want.Type || have.From != want.From || have.To != want.To ||
+		len(have.Attrs) != len(want.Attrs) || !have.Attrs.Match(want.Attrs) {
+		t.Fatalf("GetEdge(%d) = %+v, want %+v", id, have, want)
+	}
+}
+
+func testEdges(t *testing.T, e *env) {
+	a := mustAdd(t, e.s, []string{"person"}, graphie.Attrs{"name": "a"})
+	b := mustAdd(t, e.s, []string{"person"}, graphie.Attrs{"name": "b"})
+
+	// Parallel links with the same attributes are told apart by their ids
+	ab1 := mustLink(t, e.s, a, b, graphie.Attrs{"type": "knows"})
+	ab2 := mustLink(t, e.s, a, b, graphie.Attrs{"type": "knows"})
+	aa := mustLink(t, e.s, a, a, nil)
+	if ab1 == 0 || ab1 == ab2 || aa == ab1 || aa == ab2 {
+		t.Fatalf("Link returned the ids %d, %d and %d", ab1, ab2, aa)
+	}
+
+	out, err := e.s.Out(a)
+	expectLinks(t, "Out(a)", out, err, []*graphie.Link{
+		{ID: ab1, Other: b, Attrs: graphie.Attrs{"type": "knows"}},
+		{ID: ab2, Other: b, Attrs: graphie.Attrs{"type": "knows"}},
+		{ID: aa, Other: a, Attrs: graphie.Attrs{}},
+	})
+	in, err := e.s.In(b)
+	expectLinks(t, "In(b)", in, err, []*graphie.Link{
+		{ID: ab1, Other: a, Attrs: graphie.Attrs{"type": "knows"}},
+		{ID: ab2, Other: a, Attrs: graphie.Attrs{"type": "knows"}},
+	})
+	expectEdge(t, e.s, ab1, &graphie.Edge{ID: ab1, From: a, To: b, Attrs: graphie.Attrs{"type": "knows"}})
+	expectEdge(t, e.s, aa, &graphie.Edge{ID: aa, From: a, To: a, Attrs: graphie.Attrs{}})
+
+	// SetEdgeAttr changes only this link; both ends see it
+	if err := e.s.SetEdgeAttr(ab2, "since", 2010); err != nil {
+		t.Fatalf("SetEdgeAttr failed: %s", err)
+	}
+	expectEdge(t, e.s, ab2, &graphie.Edge{ID: ab2, From: a, To: b, Attrs: graphie.Attrs{"type": "knows", "since": 2010}})
+	expectEdge(t, e.s, ab1, &graphie.Edge{ID: ab1, From: a, To: b, Attrs: graphie.Attrs{"type": "knows"}})
+	in, err = e.s.In(b)
+	expectLinks(t, "In(b)", in, err, []*graphie.Link{
+		{ID: ab1, Other: a, Attrs: graphie.Attrs{"type": "knows"}},
+		{ID: ab2, Other: a, Attrs: graphie.Attrs{"type": "knows", "since": 2010}},
+	})
+	if err := e.s.SetEdgeAttr(aa, "weight", 2); err != nil {
+		t.Fatalf("SetEdgeAttr of a self-loop failed: %s", err)
+	}
+	in, err = e.s.In(a)
+	expectLinks(t, "In(a)", in, err, []*graphie.Link{
+		{ID: aa, Other: a, Attrs: graphie.Attrs{"weight": 2}},
+	})
+
+	// RemoveEdge removes only this link
+	if err := e.s.RemoveEdge(ab1); err != nil {
+		t.Fatalf("RemoveEdge failed: %s", err)
+	}
+	out, err = e.s.Out(a)
+	expectLinks(t, "Out(a)", out, err, []*graphie.Link{
+		{ID: ab2, Other: b, Attrs: graphie.Attrs{"type": "knows", "since": 2010}},
+		{ID: aa, Other: a, Attrs: graphie.Attrs{"weight": 2}},
+	})
+	in, err = e.s.In(b)
+	expectLinks(t, "In(b)", in, err, []*graphie.Link{
+		{ID: ab2, Other: a, Attrs: graphie.Attrs{"type": "knows", "since": 2010}},
+	})
+
+	_, err = e.s.GetEdge(ab1)
+	expectErr(t, "GetEdge of a removed edge", err, graphie.ErrEdgeNotFound)
+	err = e.s.SetEdgeAttr(ab1, "since", 2000)
+	expectErr(t, "SetEdgeAttr of a removed edge", err, graphie.ErrEdgeNotFound)
+	err = e.s.RemoveEdge(ab1)
+	expectErr(t, "RemoveEdge of a removed edge", err, graphie.ErrEdgeNotFound)
+
+	// Ids aren't reused
+	if id := mustLink(t, e.s, a, b, nil); id == ab1 || id == ab2 || id == aa {
+		t.Fatalf("Link handed out id %d again", id)
+	}
+
+	// Removing a node removes its edges
+	if err := e.s.Remove(b); err != nil {
+		t.Fatalf("Remove failed: %s", err)
+	}
+	_, err = e.s.GetEdge(ab2)
+	expectErr(t, "GetEdge of an edge of a removed node", err, graphie.ErrEdgeNotFound)
+	expectEdge(t, e.s, aa, &graphie.Edge{ID: aa, From: a, To: a, Attrs: graphie.Attrs{"weight": 2}})
+}
+
+func collectLinks(walk func(id graphie.NodeID, types []string, fn func(l *graphie.Link) error) error, id graphie.NodeID, types ...string) ([]*graphie.Link, error) {
+	links := make([]*graphie.Link, 0)
+	err := walk(id, types, func(l *graphie.Link) error {
+		links = append(links, l)
+		return nil
+	})
+	return links, err
+}
+
+// expectTypes checks the types of the links; they are compared as sets
+// mapping the other node to its types.
+func expectTypes(t *testing.T, what string, links []*graphie.Link, err error, want map[graphie.NodeID][]string) {
+	if err != nil {
+		t.Fatalf("%s failed: %s", what, err)
+	}
+	have := make(map[graphie.NodeID][]string)
+	for _, l := range links {
+		have[l.Other] = append(have[l.Other], l.Type)
+	}
+	for other, types := range want {
+		sort.Strings(types)
+		sort.Strings(have[other])
+		if strings.Join(types, ",") != strings.Join(have[other], ",") || len(types) != len(have[other]) {
+			t.Fatalf("%s: links to %d have the types %q, want %q", what, other, have[other], types)
+		}
+		delete(have, other)
+	}
+	for other, types := range have {
+		t.Fatalf("%s: unexpected links to %d with the types %q", what, other, types)
+	}
+}
+
+func testLinkTypes(t *testing.T, e *env) {
+	a := mustAdd(t, e.s, []string{"person"}, graphie.Attrs{"name": "a"})
+	b := mustAdd(t, e.s, []string{"person"}, graphie.Attrs{"name": "b"})
+	c := mustAdd(t, e.s, []string{"person"}, graphie.Attrs{"name": "c"})
+
+	ab := mustLinkType(t, e.s, a, b, "knows", graphie.Attrs{"since": 2000})
+	mustLinkType(t, e.s, a, b, "likes", nil)
+	mustLinkType(t, e.s, a, c, "knows", nil)
+	mustLink(t, e.s, a, c, nil)
+	mustLinkType(t, e.s, c, a, "knows", nil)
+
+	// The type isn't an attribute
+	out, err := e.s.Out(a)
+	expectLinks(t, "Out(a)", out, err, []*graphie.Link{
+		{ID: ab, Other: b, Attrs: graphie.Attrs{"since": 2000}},
+		{Other: b, Attrs: graphie.Attrs{}},
+		{Other: c, Attrs: graphie.Attrs{}},
+		{Other: c, Attrs: graphie.Attrs{}},
+	})
+	expectTypes(t, "Out(a)", out, err, map[graphie.NodeID][]string{
+		b: {"knows", "likes"},
+		c: {"knows", ""},
+	})
+	expectEdge(t, e.s, ab, &graphie.Edge{ID: ab, Type: "knows", From: a, To: b, Attrs: graphie.Attrs{"since": 2000}})
+
+	links, err := collectLinks(e.s.WalkOutTypes, a, "knows")
+	expectTypes(t, "WalkOutTypes(a, knows)", links, err, map[graphie.NodeID][]string{
+		b: {"knows"},
+		c: {"knows"},
+	})
+	links, err = collectLinks(e.s.WalkOutTypes, a, "knows", "likes", "knows")
+	expectTypes(t, "WalkOutTypes(a, knows, likes)", links, err, map[graphie.NodeID][]string{
+		b: {"knows", "likes"},
+		c: {"knows"},
+	})
+	links, err = collectLinks(e.s.WalkOutTypes, a, "")
+	expectTypes(t, "WalkOutTypes(a, untyped)", links, err, map[graphie.NodeID][]string{
+		c: {""},
+	})
+	links, err = collectLinks(e.s.WalkOutTypes, a, "nosuchtype")
+	expectTypes(t, "WalkOutTypes(a, nosuchtype)", links, err, nil)
+	links, err = collectLinks(e.s.WalkOutTypes, a)
+	expectTypes(t, "WalkOutTypes(a)", links, err, map[graphie.NodeID][]string{
+		b: {"knows", "likes"},
+		c: {"knows", ""},
+	})
+	links, err = collectLinks(e.s.WalkInTypes, b, "likes")
+	expectTypes(t, "WalkInTypes(b, likes)", links, err, map[graphie.NodeID][]string{
+		a: {"likes"},
+	})
+	links, err = collectLinks(e.s.WalkInTypes, a, "knows")
+	expectTypes(t, "WalkInTypes(a, knows)", links, err, map[graphie.NodeID][]string{
+		c: {"knows"},
+	})
+	if _, err := collectLinks(e.s.WalkOutTypes, c+1000, "knows"); err == nil {
+		t.Fatal("WalkOutTypes of a non-existing node succeeded")
+	}
+
+	// Lots of links of one type don't hide the others
+	for i := 0; i < 100; i++ {
+		id := mustAdd(t, e.s, nil, nil)
+		mustLinkType(t, e.s, b, id, "many", nil)
+	}
+	links, err = collectLinks(e.s.WalkOutTypes, b, "one")
+	expectTypes(t, "WalkOutTypes(b, one)", links, err, nil)
+	mustLinkType(t, e.s, b, c, "one", nil)
+	links, err = collectLinks(e.s.WalkOutTypes, b, "one")
+	expectTypes(t, "WalkOutTypes(b, one)", links, err, map[graphie.NodeID][]string{
+		c: {"one"},
+	})
+	links, err = collectLinks(e.s.WalkOutTypes, b, "many")
+	if err != nil || len(links) != 100 {
+		t.Fatalf("WalkOutTypes(b, many) returned %d links, %v, want 100", len(links), err)
+	}
+
+	// Removing links keeps the others of the type
+	if err := e.s.RemoveEdge(ab); err != nil {
+		t.Fatalf("RemoveEdge failed: %s", err)
+	}
+	links, err = collectLinks(e.s.WalkOutTypes, a, "knows")
+	expectTypes(t, "WalkOutTypes(a, knows)", links, err, map[graphie.NodeID][]string{
+		c: {"knows"},
+	})
+
+	// Transactions
+	tx, err := e.g.Begin()
+	if err == graphie.ErrTxNotSupported {
+		return
+	} else if err != nil {
+		t.Fatalf("Begin failed: %s", err)
+	}
+	if _, err := tx.Link(b, a, "knows", nil); err != nil {
+		t.Fatalf("Link failed: %s", err)
+	}
+	links, err = tx.Out(b, "knows")
+	expectTypes(t, "Out(b, knows) in transaction", links, err, map[graphie.NodeID][]string{
+		a: {"knows"},
+	})
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+	links, err = collectLinks(e.s.WalkInTypes, a, "knows")
+	expectTypes(t, "WalkInTypes(a, knows)", links, err, map[graphie.NodeID][]string{
+		b: {"knows"},
+		c: {"knows"},
+	})
+}
+
+func testSelfLoop(t *testing.T, e *env) {
+	a := mustAdd(t, e.s, nil, graphie.Attrs{"name": "a"})
+	mustLink(t, e.s, a, a, graphie.Attrs{"type": "self"})
+
+	want := []*graphie.Link{{Other: a, Attrs: graphie.Attrs{"type": "self"}}}
+	out, err := e.s.Out(a)
+	expectLinks(t, "Out(a)", out, err, want)
+	in, err := e.s.In(a)
+	expectLinks(t, "In(a)", in, err, want)
+
+	n, err := e.s.Unlink(a, a, nil)
+	if err != nil || n != 1 {
+		t.Fatalf("Unlink(a, a) = %d, %v; want 1", n, err)
+	}
+	out, err = e.s.Out(a)
+	expectLinks(t, "Out(a)", out, err, nil)
+	in, err = e.s.In(a)
+	expectLinks(t, "In(a)", in, err, nil)
+}
+
+func testWalk(t *testing.T, e *env) {
+	a := mustAdd(t, e.s, nil, nil)
+	for i := 0; i < 10; i++ {
+		b := mustAdd(t, e.s, nil, nil)
+		mustLink(t, e.s, a, b, graphie.Attrs{"i": i})
+		mustLink(t, e.s, b, a, graphie.Attrs{"i": i})
+	}
+
+	for _, walk := range []struct {
+		name string
+		fn   func(graphie.NodeID, func(*graphie.Link) error) error
+	}{
+		{"WalkIn", e.s.WalkIn},
+		{"WalkOut", e.s.WalkOut},
+	} {
+		c := 0
+		err := walk.fn(a, func(l *graphie.Link) error {
+			c++
+			// The storage must be usable from within the callback
+			if _, err := e.s.Attrs(l.Other); err != nil {
+				return err
+			}
+			return nil
+		})
+		if err != nil || c != 10 {
+			t.Fatalf("%s visited %d links (%v), want 10", walk.name, c, err)
+		}
+
+		stop := errors.New("stop")
+		c = 0
+		err = walk.fn(a, func(l *graphie.Link) error {
+			c++
+			if c == 3 {
+				return stop
+			}
+			return nil
+		})
+		if err != stop || c != 3 {
+			t.Fatalf("%s didn't stop (visited %d links, err %v)", walk.name, c, err)
+		}
+	}
+}
+
+func testUnlink(t *testing.T, e *env) {
+	a := mustAdd(t, e.s, nil, nil)
+	b := mustAdd(t, e.s, nil, nil)
+	mustLink(t, e.s, a, b, graphie.Attrs{"type": "knows", "since": 2000})
+	mustLink(t, e.s, a, b, graphie.Attrs{"type": "knows", "since": 2010})
+	mustLink(t, e.s, a, b, graphie.Attrs{"type": "likes"})
+	mustLink(t, e.s, b, a, graphie.Attrs{"type": "knows"})
+
+	n, err := e.s.Unlink(a, b, graphie.Attrs{"type": "hates"})
+	if err != nil || n != 0 {
+		t.Fatalf("Unlink without matches = %d, %v; want 0", n, err)
+	}
+	n, err = e.s.Unlink(a, b, graphie.Attrs{"type": "knows", "since": 2010})
+	if err != nil || n != 1 {
+		t.Fatalf("Unlink(since=2010) = %d, %v; want 1", n, err)
+	}
+	out, err := e.s.Out(a)
+	expectLinks(t, "Out(a)", out, err, []*graphie.Link{
+		{Other: b, Attrs: graphie.Attrs{"type": "knows", "since": 2000}},
+		{Other: b, Attrs: graphie.Attrs{"type": "likes"}},
+	})
+	in, err := e.s.In(b)
+	expectLinks(t, "In(b)", in, err, []*graphie.Link{
+		{Other: a, Attrs: graphie.Attrs{"type": "knows", "since": 2000}},
+		{Other: a, Attrs: graphie.Attrs{"type": "likes"}},
+	})
+
+	n, err = e.s.Unlink(a, b, nil)
+	if err != nil || n != 2 {
+		t.Fatalf("Unlink(nil) = %d, %v; want 2", n, err)
+	}
+	out, err = e.s.Out(a)
+	expectLinks(t, "Out(a)", out, err, nil)
+	in, err = e.s.In(b)
+	expectLinks(t, "In(b)", in, err, nil)
+
+	// The opposite direction is untouched
+	out, err = e.s.Out(b)
+	expectLinks(t, "Out(b)", out, err, []*graphie.Link{
+		{Other: a, Attrs: graphie.Attrs{"type": "knows"}},
+	})
+}
+
+func testRemove(t *testing.T, e *env) {
+	a := mustAdd(t, e.s, []string{"person"}, graphie.Attrs{"name": "a"})
+	b := mustAdd(t, e.s, []string{"person"}, graphie.Attrs{"name": "b"})
+	c := mustAdd(t, e.s, []string{"person"}, graphie.Attrs{"name": "c"})
+	mustLink(t, e.s, a, b, nil)
+	mustLink(t, e.s, b, c, nil)
+	mustLink(t, e.s, c, b, nil)
+	mustLink(t, e.s, b, b, nil)
+
+	if err := e.s.Remove(b); err != nil {
+		t.Fatalf("Remove failed: %s", err)
+	}
+
+	if _, err := e.s.Attrs(b); err == nil {
+		t.Fatal("Attrs of a removed node succeeded")
+	}
+	if _, err := e.s.Get(b, "name"); err == nil {
+		t.Fatal("Get of a removed node succeeded")
+	}
+	if _, err := e.s.Link(a, b, "", nil); err == nil {
+		t.Fatal("Linking to a removed node succeeded")
+	}
+	if err := e.s.Remove(b); err == nil {
+		t.Fatal("Removing a node twice succeeded")
+	}
+
+	out, err := e.s.Out(a)
+	expectLinks(t, "Out(a)", out, err, nil)
+	in, err := e.s.In(c)
+	expectLinks(t, "In(c)", in, err, nil)
+	out, err = e.s.Out(c)
+	expectLinks(t, "Out(c)", out, err, nil)
+
+	expectAttrs(t, e.s, a, graphie.Attrs{"name": "a"})
+	expectAttrs(t, e.s, c, graphie.Attrs{"name": "c"})
+}
+
+func expectFind(t *testing.T, s graphie.Storage, labels []string, key string, value interface{}, want ...graphie.NodeID) {
+	ids, err := s.FindByAttr(labels, key, value)
+	if err != nil {
+		t.Fatalf("FindByAttr(%v, %s, %v) failed: %s", labels, key, value, err)
+	}
+	if len(ids) != len(want) {
+		t.Fatalf("FindByAttr(%v, %s, %v) = %v, want %v", labels, key, value, ids, want)
+	}
+	for i := range ids {
+		if ids[i] != want[i] {
+			t.Fatalf("FindByAttr(%v, %s, %v) = %v, want %v", labels, key, value, ids, want)
+		}
+	}
+}
+
+func testFindByAttr(t *testing.T, e *env) {
+	person := []string{"person"}
+	a := mustAdd(t, e.s, person, graphie.Attrs{"name": "a", "born": 1707})
+	b := mustAdd(t, e.s, person, graphie.Attrs{"name": "b", "born": 1707})
+	c := mustAdd(t, e.s, []string{"person", "mathematician"}, graphie.Attrs{"name": "c", "born": 1777})
+
+	// Without an index
+	expectFind(t, e.s, person, "born", 1707, a, b)
+	expectFind(t, e.s, person, "born", 1707.0, a, b)
+	expectFind(t, e.s, []string{"person", "mathematician"}, "born", 1777, c)
+	expectFind(t, e.s, []string{"mathematician"}, "born", 1707)
+	expectFind(t, e.s, []string{"unknown"}, "born", 1707)
+	expectFind(t, e.s, person, "died", 1783)
+
+	// With an index, including nodes changed after it was created
+	if err := e.s.EnsureIndexNodes(person, "born"); err != nil {
+		t.Fatalf("EnsureIndexNodes failed: %s", err)
+	}
+	expectFind(t, e.s, person, "born", 1707, a, b)
+	if err := e.s.Set(b, "born", 1777); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	d := mustAdd(t, e.s, person, graphie.Attrs{"born": 1707})
+	if err := e.s.Remove(a); err != nil {
+		t.Fatalf("Remove failed: %s", err)
+	}
+	expectFind(t, e.s, person, "born", 1707, d)
+	expectFind(t, e.s, person, "born", 1777, b, c)
+	expectFind(t, e.s, []string{"person", "mathematician"}, "born", 1777, c)
+
+	if e.suite.Persistent {
+		e.close(t)
+		e.open(t)
+
+		expectFind(t, e.s, person, "born", 1707, d)
+		expectFind(t, e.s, person, "born", 1777, b, c)
+	}
+}
+
+func testIndexes(t *testing.T, e *env) {
+	labels := []string{"person"}
+	a := mustAdd(t, e.s, labels, graphie.Attrs{"name": "a"})
+
+	if err := e.s.EnsureIndexNodes(labels, "name"); err != nil {
+		t.Fatalf("EnsureIndexNodes failed: %s", err)
+	}
+	if err := e.s.EnsureIndexNodes(labels, "name"); err != nil {
+		t.Fatalf("EnsureIndexNodes failed when called twice: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		err := e.s.EnsureIndexLinks(labels, "type")
+		if err != nil {
+			t.Fatalf("EnsureIndexLinks failed (call %d): %s", i+1, err)
+		}
+	}
+
+	// Indexes must cover nodes added before and after they were created
+	b := mustAdd(t, e.s, labels, graphie.Attrs{"name": "b"})
+	for name, want := range map[string]graphie.NodeID{"a": a, "b": b} {
+		id, err := e.s.Merge(labels, graphie.Attrs{"name": name})
+		if err != nil {
+			t.Fatalf("Merge failed: %s", err)
+		}
+		if id != want {
+			t.Fatalf("Merge(name=%s) returned %d, want %d", name, id, want)
+		}
+	}
+
+	// Changing an indexed attribute must update the index
+	if err := e.s.Set(b, "name", "c"); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	id, err := e.s.Merge(labels, graphie.Attrs{"name": "c"})
+	if err != nil {
+		t.Fatalf("Merge failed: %s", err)
+	}
+	if id != b {
+		t.Fatalf("Merge(name=c) returned %d, want %d", id, b)
+	}
+
+	city := mustAdd(t, e.s, []string{"city"}, graphie.Attrs{"name": "c"})
+	expectFind(t, e.s, labels, "name", "c", b)
+	expectFind(t, e.s, labels, "name", "b")
+	expectFind(t, e.s, labels, "name", "a", a)
+	expectFind(t, e.s, nil, "name", "c", b, city)
+
+	mustLink(t, e.s, a, b, graphie.Attrs{"type": "knows"})
+	n, err := e.s.Unlink(a, b, graphie.Attrs{"type": "knows"})
+	if err != nil || n != 1 {
+		t.Fatalf("Unlink of an indexed link = %d, %v; want 1", n, err)
+	}
+}
+
+func expectViolation(t *testing.T, what string, err error, label, attr string) {
+	if !errors.Is(err, graphie.ErrConstraintViolation) {
+		t.Fatalf("%s returned %v, want a constraint violation", what, err)
+	}
+	cerr, ok := err.(*graphie.ConstraintViolationError)
+	if !ok {
+		t.Fatalf("%s returned %T, want *graphie.ConstraintViolationError", what, err)
+	}
+	if cerr.Label != label || cerr.Attr != attr {
+		t.Fatalf("%s violated %s.%s, want %s.%s", what, cerr.Label, cerr.Attr, label, attr)
+	}
+}
+
+func testUnique(t *testing.T, e *env) {
+	person := []string{"person"}
+	a := mustAdd(t, e.s, person, graphie.Attrs{"fullname": "Leonhard Euler"})
+
+	if err := e.s.EnsureUnique(person, "fullname"); err != nil {
+		t.Fatalf("EnsureUnique failed: %s", err)
+	}
+	if err := e.s.EnsureUnique(person, "fullname"); err != nil {
+		t.Fatalf("EnsureUnique failed when called twice: %s", err)
+	}
+
+	_, err := e.s.Add(person, graphie.Attrs{"fullname": "Leonhard Euler"})
+	expectViolation(t, "Add", err, "person", "fullname")
+
+	b := mustAdd(t, e.s, person, graphie.Attrs{"fullname": "Carl Friedrich Gauss"})
+	mustAdd(t, e.s, person, nil)
+	mustAdd(t, e.s, person, nil)
+	mustAdd(t, e.s, []string{"city"}, graphie.Attrs{"fullname": "Leonhard Euler"})
+
+	err = e.s.Set(b, "fullname", "Leonhard Euler")
+	expectViolation(t, "Set", err, "person", "fullname")
+	expectAttrs(t, e.s, b, graphie.Attrs{"fullname": "Carl Friedrich Gauss"})
+	if err := e.s.Set(a, "fullname", "Leonhard Euler"); err != nil {
+		t.Fatalf("Setting the same value again failed: %s", err)
+	}
+
+	// Unique attributes identify nodes on Merge
+	id, err := e.s.Merge(person, graphie.Attrs{"fullname": "Leonhard Euler", "born": 1707})
+	if err != nil {
+		t.Fatalf("Merge failed: %s", err)
+	}
+	if id != a {
+		t.Fatalf("Merge returned %d, want %d", id, a)
+	}
+	expectAttrs(t, e.s, a, graphie.Attrs{"fullname": "Leonhard Euler", "born": 1707})
+
+	// Values of removed nodes are free again
+	if err := e.s.Remove(a); err != nil {
+		t.Fatalf("Remove failed: %s", err)
+	}
+	mustAdd(t, e.s, person, graphie.Attrs{"fullname": "Leonhard Euler"})
+	if err := e.s.Set(b, "fullname", "Carl Gauss"); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	mustAdd(t, e.s, person, graphie.Attrs{"fullname": "Carl Friedrich Gauss"})
+
+	// Existing duplicates make EnsureUnique fail
+	mustAdd(t, e.s, []string{"city"}, graphie.Attrs{"fullname": "Leonhard Euler"})
+	err = e.s.EnsureUnique([]string{"city"}, "fullname")
+	expectViolation(t, "EnsureUnique", err, "city", "fullname")
+	mustAdd(t, e.s, []string{"city"}, graphie.Attrs{"fullname": "Leonhard Euler"})
+
+	if e.suite.Persistent {
+		e.close(t)
+		e.open(t)
+
+		_, err = e.s.Add(person, graphie.Attrs{"fullname": "Carl Gauss"})
+		expectViolation(t, "Add after reopening", err, "person", "fullname")
+	}
+}
+
+func expectNodes(t *testing.T, s graphie.Storage, labels []string, want ...graphie.NodeID) {
+	ids := make([]graphie.NodeID, 0)
+	err := s.WalkNodes(labels, func(id graphie.NodeID) error {
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WalkNodes(%v) failed: %s", labels, err)
+	}
+	if fmt.Sprint(ids) != fmt.Sprint(want) {
+		t.Fatalf("WalkNodes(%v) = %v, want %v", labels, ids, want)
+	}
+}
+
+func expectLabels(t *testing.T, s graphie.Storage, id graphie.NodeID, want ...string) {
+	labels, err := s.Labels(id)
+	if err != nil {
+		t.Fatalf("Labels(%d) failed: %s", id, err)
+	}
+	sort.Strings(labels)
+	sort.Strings(want)
+	if fmt.Sprint(labels) != fmt.Sprint(want) {
+		t.Fatalf("Labels(%d) = %v, want %v", id, labels, want)
+	}
+}
+
+func testLabels(t *testing.T, e *env) {
+	a := mustAdd(t, e.s, []string{"person", "mathematician"}, graphie.Attrs{"name": "Euler"})
+	b := mustAdd(t, e.s, []string{"person"}, graphie.Attrs{"name": "Goethe"})
+	c := mustAdd(t, e.s, []string{"city"}, graphie.Attrs{"name": "Basel"})
+	d := mustAdd(t, e.s, nil, nil)
+
+	expectLabels(t, e.s, a, "person", "mathematician")
+	expectLabels(t, e.s, d)
+	expectNodes(t, e.s, []string{"person"}, a, b)
+	expectNodes(t, e.s, []string{"person", "mathematician"}, a)
+	expectNodes(t, e.s, []string{"unknown"})
+	expectNodes(t, e.s, nil, a, b, c, d)
+
+	// Stopping the walk
+	stop := errors.New("stop")
+	n := 0
+	err := e.s.WalkNodes(nil, func(id graphie.NodeID) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Fatalf("WalkNodes returned %v after %d nodes, want %v after 1", err, n, stop)
+	}
+
+	if err := e.s.AddLabel(b, "poet"); err != nil {
+		t.Fatalf("AddLabel failed: %s", err)
+	}
+	if err := e.s.AddLabel(b, "poet"); err != nil {
+		t.Fatalf("AddLabel failed: %s", err)
+	}
+	if err := e.s.RemoveLabel(a, "person"); err != nil {
+		t.Fatalf("RemoveLabel failed: %s", err)
+	}
+	if err := e.s.RemoveLabel(c, "unknown"); err != nil {
+		t.Fatalf("RemoveLabel failed: %s", err)
+	}
+	expectLabels(t, e.s, a, "mathematician")
+	expectLabels(t, e.s, b, "person", "poet")
+	expectAttrs(t, e.s, b, graphie.Attrs{"name": "Goethe"})
+	expectNodes(t, e.s, []string{"person"}, b)
+	expectNodes(t, e.s, []string{"poet"}, b)
+
+	if err := e.s.Remove(b); err != nil {
+		t.Fatalf("Remove failed: %s", err)
+	}
+	expectNodes(t, e.s, []string{"poet"})
+	if _, err := e.s.Labels(b); err == nil {
+		t.Fatalf("Labels of a removed node succeeded")
+	}
+	if err := e.s.AddLabel(b, "poet"); err == nil {
+		t.Fatalf("AddLabel to a removed node succeeded")
+	}
+
+	// Labels are indexed; the indexes have to follow
+	if err := e.s.EnsureIndexNodes([]string{"city"}, "name"); err != nil {
+		t.Fatalf("EnsureIndexNodes failed: %s", err)
+	}
+	if err := e.s.AddLabel(a, "city"); err != nil {
+		t.Fatalf("AddLabel failed: %s", err)
+	}
+	expectFind(t, e.s, []string{"city"}, "name", "Euler", a)
+	if err := e.s.RemoveLabel(a, "city"); err != nil {
+		t.Fatalf("RemoveLabel failed: %s", err)
+	}
+	expectFind(t, e.s, []string{"city"}, "name", "Euler")
+
+	// Unique constraints of the new label apply
+	if err := e.s.EnsureUnique([]string{"city"}, "name"); err != nil {
+		t.Fatalf("EnsureUnique failed: %s", err)
+	}
+	e2 := mustAdd(t, e.s, []string{"person"}, graphie.Attrs{"name": "Basel"})
+	expectViolation(t, "AddLabel", e.s.AddLabel(e2, "city"), "city", "name")
+	expectLabels(t, e.s, e2, "person")
+
+	if e.suite.Persistent {
+		e.close(t)
+		e.open(t)
+
+		expectLabels(t, e.s, a, "mathematician")
+		expectNodes(t, e.s, []string{"person"}, e2)
+		expectNodes(t, e.s, []string{"city"}, c)
+		expectViolation(t, "AddLabel", e.s.AddLabel(e2, "city"), "city", "name")
+	}
+}
+
+func testTx(t *testing.T, e *env) {
+	if _, ok := e.s.(graphie.TxStorage); !ok {
+		t.Skip("Driver does not support transactions")
+	}
+	person := []string{"person"}
+	a := mustAdd(t, e.s, person, graphie.Attrs{"name": "a"})
+	b := mustAdd(t, e.s, person, graphie.Attrs{"name": "b"})
+	mustLink(t, e.s, a, b, graphie.Attrs{"type": "knows"})
+
+	// Read-your-writes
+	tx, err := e.g.Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %s", err)
+	}
+	c, err := tx.Add(person, graphie.Attrs{"name": "c"})
+	if err != nil {
+		t.Fatalf("Add failed: %s", err)
+	}
+	ca, err := tx.Link(c, a, "", graphie.Attrs{"type": "knows"})
+	if err != nil {
+		t.Fatalf("Link failed: %s", err)
+	}
+	if err := tx.Set(a, "age", 3); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	if n, err := tx.Unlink(a, b, nil); err != nil || n != 1 {
+		t.Fatalf("Unlink = %d, %v, want 1", n, err)
+	}
+	if v, err := tx.Get(a, "age"); err != nil || !graphie.ValueEqual(v, 3) {
+		t.Fatalf("Get in transaction = %v, %v, want 3", v, err)
+	}
+	if v, err := tx.Get(a, "name"); err != nil || v != "a" {
+		t.Fatalf("Get of a stored attribute in transaction = %v, %v, want a", v, err)
+	}
+	if err := tx.Set(c, "age", 1); err != nil {
+		t.Fatalf("Set of an added node failed: %s", err)
+	}
+	if v, err := tx.Get(c, "age"); err != nil || !graphie.ValueEqual(v, 1) {
+		t.Fatalf("Get of an added node in transaction = %v, %v, want 1", v, err)
+	}
+	links, err := tx.In(a)
+	expectLinks(t, "In in transaction", links, err, []*graphie.Link{
+		{ID: ca, Other: c, Attrs: graphie.Attrs{"type": "knows"}},
+	})
+	links, err = tx.Out(a)
+	expectLinks(t, "Out in transaction", links, err, []*graphie.Link{})
+
+	// Nothing is visible outside before the commit
+	if has, err := e.s.Has(a, "age"); err != nil || has {
+		t.Fatalf("Has outside of the transaction = %v, %v, want false", has, err)
+	}
+	if _, err := e.s.Attrs(c); err == nil {
+		t.Fatalf("Node added by the transaction exists before the commit")
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+	if err := tx.Commit(); err != graphie.ErrTxDone {
+		t.Fatalf("Second Commit returned %v, want %v", err, graphie.ErrTxDone)
+	}
+	expectAttrs(t, e.s, a, graphie.Attrs{"name": "a", "age": 3})
+	expectAttrs(t, e.s, c, graphie.Attrs{"name": "c", "age": 1})
+	links, err = e.s.In(a)
+	expectLinks(t, "In", links, err, []*graphie.Link{
+		{ID: ca, Other: c, Attrs: graphie.Attrs{"type": "knows"}},
+	})
+	expectEdge(t, e.s, ca, &graphie.Edge{ID: ca, From: c, To: a, Attrs: graphie.Attrs{"type": "knows"}})
+	links, err = e.s.In(b)
+	expectLinks(t, "In", links, err, []*graphie.Link{})
+
+	// Rollback
+	tx, err = e.g.Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %s", err)
+	}
+	d, err := tx.Add(person, graphie.Attrs{"name": "d"})
+	if err != nil {
+		t.Fatalf("Add failed: %s", err)
+	}
+	if err := tx.Remove(a); err != nil {
+		t.Fatalf("Remove failed: %s", err)
+	}
+	if _, err := tx.Attrs(a); err == nil {
+		t.Fatalf("Removed node exists in the transaction")
+	}
+	if _, err := tx.Link(d, a, "", nil); err == nil {
+		t.Fatalf("Link to a removed node succeeded")
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %s", err)
+	}
+	expectAttrs(t, e.s, a, graphie.Attrs{"name": "a", "age": 3})
+	if _, err := e.s.Attrs(d); err == nil {
+		t.Fatalf("Node added by a rolled back transaction exists")
+	}
+
+	// Remove within a transaction cleans up the links
+	tx, err = e.g.Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %s", err)
+	}
+	if err := tx.Remove(c); err != nil {
+		t.Fatalf("Remove failed: %s", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+	links, err = e.s.In(a)
+	expectLinks(t, "In", links, err, []*graphie.Link{})
+
+	// A failing commit applies nothing
+	if err := e.s.EnsureUnique(person, "name"); err != nil {
+		t.Fatalf("EnsureUnique failed: %s", err)
+	}
+	tx, err = e.g.Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %s", err)
+	}
+	f, err := tx.Add(person, graphie.Attrs{"name": "f"})
+	if err != nil {
+		t.Fatalf("Add failed: %s", err)
+	}
+	if _, err := tx.Link(f, a, "", nil); err != nil {
+		t.Fatalf("Link failed: %s", err)
+	}
+	if err := tx.Set(b, "name", "a"); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	expectViolation(t, "Commit", tx.Commit(), "person", "name")
+	if _, err := e.s.Attrs(f); err == nil {
+		t.Fatalf("Node added by a failed transaction exists")
+	}
+	expectAttrs(t, e.s, b, graphie.Attrs{"name": "b"})
+	links, err = e.s.In(a)
+	expectLinks(t, "In", links, err, []*graphie.Link{})
+
+	// Swapping unique values within a transaction is fine
+	tx, err = e.g.Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %s", err)
+	}
+	if err := tx.Set(a, "name", "b"); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	if err := tx.Set(b, "name", "a"); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+	expectFind(t, e.s, person, "name", "a", b)
+
+	if e.suite.Persistent {
+		e.close(t)
+		e.open(t)
+
+		expectAttrs(t, e.s, a, graphie.Attrs{"name": "b", "age": 3})
+		expectFind(t, e.s, person, "name", "a", b)
+		if _, err := e.s.Attrs(c); err == nil {
+			t.Fatalf("Removed node exists after reopening")
+		}
+		id := mustAdd(t, e.s, person, nil)
+		if id <= f {
+			t.Fatalf("Add after reopening returned %d, ids up to %d are reserved", id, f)
+		}
+	}
+}
+
+func testSnapshot(t *testing.T, e *env) {
+	if _, ok := e.s.(graphie.SnapshotStorage); !ok {
+		t.Skip("Driver does not support snapshots")
+	}
+	person := []string{"person"}
+	a := mustAdd(t, e.s, person, graphie.Attrs{"name": "a"})
+	b := mustAdd(t, e.s, person, graphie.Attrs{"name": "b"})
+	mustLink(t, e.s, a, b, graphie.Attrs{"type": "knows"})
+
+	sn, err := e.g.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %s", err)
+	}
+	defer sn.Release()
+
+	// Change everything the snapshot has seen
+	c := mustAdd(t, e.s, person, graphie.Attrs{"name": "c"})
+	mustLink(t, e.s, a, c, nil)
+	mustLink(t, e.s, c, a, nil)
+	if err := e.s.Set(a, "name", "x"); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	if _, err := e.s.Unlink(a, b, nil); err != nil {
+		t.Fatalf("Unlink failed: %s", err)
+	}
+	if err := e.s.AddLabel(b, "poet"); err != nil {
+		t.Fatalf("AddLabel failed: %s", err)
+	}
+	if err := e.s.Remove(b); err != nil {
+		t.Fatalf("Remove failed: %s", err)
+	}
+
+	ss := sn.Storage()
+	expectAttrs(t, ss, a, graphie.Attrs{"name": "a"})
+	expectAttrs(t, ss, b, graphie.Attrs{"name": "b"})
+	if _, err := ss.Attrs(c); err == nil {
+		t.Fatalf("Node added after the snapshot is visible")
+	}
+	expectLabels(t, ss, b, "person")
+	links, err := ss.Out(a)
+	expectLinks(t, "Out in snapshot", links, err, []*graphie.Link{
+		{Other: b, Attrs: graphie.Attrs{"type": "knows"}},
+	})
+	links, err = ss.In(a)
+	expectLinks(t, "In in snapshot", links, err, []*graphie.Link{})
+	expectNodes(t, ss, person, a, b)
+	expectFind(t, ss, person, "name", "a", a)
+	n, err := sn.Labels("person").Nodes().Out().Count()
+	if err != nil || n != 1 {
+		t.Fatalf("Traversal in snapshot = %d, %v, want 1", n, err)
+	}
+	if err := ss.Set(a, "name", "y"); err != graphie.ErrReadOnly {
+		t.Fatalf("Set in snapshot returned %v, want %v", err, graphie.ErrReadOnly)
+	}
+
+	// The graph itself sees everything
+	expectAttrs(t, e.s, a, graphie.Attrs{"name": "x"})
+	expectNodes(t, e.s, person, a, c)
+
+	sn2, err := e.g.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %s", err)
+	}
+	if sn2.Seq() < sn.Seq() {
+		t.Fatalf("Second snapshot has sequence number %d < %d", sn2.Seq(), sn.Seq())
+	}
+	expectAttrs(t, sn2.Storage(), a, graphie.Attrs{"name": "x"})
+	if err := sn2.Release(); err != nil {
+		t.Fatalf("Release failed: %s", err)
+	}
+	if err := sn.Release(); err != nil {
+		t.Fatalf("Release failed: %s", err)
+	}
+}
+
+func expectErr(t *testing.T, what string, err error, want error) {
+	if !errors.Is(err, want) {
+		t.Fatalf("%s returned %v, want %v", what, err, want)
+	}
+}
+
+func testErrors(t *testing.T, e *env) {
+	a := mustAdd(t, e.s, []string{"person"}, graphie.Attrs{"name": "a"})
+	missing := a + 1000
+
+	_, err := e.s.Attrs(missing)
+	expectErr(t, "Attrs of a missing node", err, graphie.ErrNodeNotFound)
+	_, err = e.s.Get(missing, "name")
+	expectErr(t, "Get of a missing node", err, graphie.ErrNodeNotFound)
+	_, err = e.s.Has(missing, "name")
+	expectErr(t, "Has of a missing node", err, graphie.ErrNodeNotFound)
+	_, err = e.s.Labels(missing)
+	expectErr(t, "Labels of a missing node", err, graphie.ErrNodeNotFound)
+	_, err = e.s.Out(missing)
+	expectErr(t, "Out of a missing node", err, graphie.ErrNodeNotFound)
+	_, err = e.s.In(missing)
+	expectErr(t, "In of a missing node", err, graphie.ErrNodeNotFound)
+	err = e.s.Set(missing, "name", "x")
+	expectErr(t, "Set of a missing node", err, graphie.ErrNodeNotFound)
+	_, err = e.s.Link(a, missing, "", nil)
+	expectErr(t, "Link to a missing node", err, graphie.ErrNodeNotFound)
+	_, err = e.s.Link(missing, a, "", nil)
+	expectErr(t, "Link from a missing node", err, graphie.ErrNodeNotFound)
+	err = e.s.AddLabel(missing, "poet")
+	expectErr(t, "AddLabel of a missing node", err, graphie.ErrNodeNotFound)
+	err = e.s.Remove(missing)
+	expectErr(t, "Remove of a missing node", err, graphie.ErrNodeNotFound)
+
+	_, err = e.s.Get(a, "born")
+	expectErr(t, "Get of a missing attribute", err, graphie.ErrAttrNotFound)
+
+	if err := e.s.EnsureUnique([]string{"person"}, "name"); err != nil {
+		t.Fatalf("EnsureUnique failed: %s", err)
+	}
+	_, err = e.s.Add([]string{"person"}, graphie.Attrs{"name": "a"})
+	expectErr(t, "Add of a duplicate", err, graphie.ErrConstraintViolation)
+
+	s := e.s
+	e.close(t)
+	_, err = s.Attrs(a)
+	expectErr(t, "Attrs after Stop", err, graphie.ErrClosed)
+	_, err = s.Add([]string{"person"}, nil)
+	expectErr(t, "Add after Stop", err, graphie.ErrClosed)
+	err = s.Set(a, "name", "x")
+	expectErr(t, "Set after Stop", err, graphie.ErrClosed)
+	err = s.WalkNodes(nil, func(id graphie.NodeID) error {
+		return nil
+	})
+	expectErr(t, "WalkNodes after Stop", err, graphie.ErrClosed)
+	_, err = s.FindByAttr([]string{"person"}, "name", "a")
+	expectErr(t, "FindByAttr after Stop", err, graphie.ErrClosed)
+}
+
+func testContext(t *testing.T, e *env) {
+	person := []string{"person"}
+	hub := mustAdd(t, e.s, person, graphie.Attrs{"name": "hub"})
+	for i := 0; i < 10; i++ {
+		id := mustAdd(t, e.s, person, graphie.Attrs{"i": i})
+		mustLink(t, e.s, hub, id, nil)
+	}
+	cs := graphie.WithContext(e.s)
+
+	// Everything fails once the context is done
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := cs.FindByAttrContext(cancelled, person, "name", "hub")
+	expectErr(t, "FindByAttrContext", err, context.Canceled)
+	_, err = cs.AttrsContext(cancelled, hub)
+	expectErr(t, "AttrsContext", err, context.Canceled)
+	_, err = cs.OutContext(cancelled, hub)
+	expectErr(t, "OutContext", err, context.Canceled)
+	_, err = cs.AddContext(cancelled, person, nil)
+	expectErr(t, "AddContext", err, context.Canceled)
+	err = cs.SetContext(cancelled, hub, "name", "x")
+	expectErr(t, "SetContext", err, context.Canceled)
+	expectAttrs(t, e.s, hub, graphie.Attrs{"name": "hub"})
+
+	// Walks stop as soon as the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err = cs.WalkNodesContext(ctx, person, func(id graphie.NodeID) error {
+		calls++
+		cancel()
+		return nil
+	})
+	expectErr(t, "WalkNodesContext", err, context.Canceled)
+	if calls != 1 {
+		t.Fatalf("WalkNodesContext called fn %d times after cancel, want 1", calls)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	calls = 0
+	err = cs.WalkOutContext(ctx, hub, func(l *graphie.Link) error {
+		calls++
+		cancel()
+		return nil
+	})
+	expectErr(t, "WalkOutContext", err, context.Canceled)
+	if calls != 1 {
+		t.Fatalf("WalkOutContext called fn %d times after cancel, want 1", calls)
+	}
+
+	// Queries
+	n, err := e.g.Labels("person").Nodes().Out().CountContext(context.Background())
+	if err != nil || n != 10 {
+		t.Fatalf("CountContext = %d, %v, want 10", n, err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	calls = 0
+	err = e.g.Labels("person").Nodes().Out().IterateContext(ctx, func(id graphie.NodeID) bool {
+		calls++
+		cancel()
+		return true
+	})
+	expectErr(t, "IterateContext", err, context.Canceled)
+	if calls != 1 {
+		t.Fatalf("IterateContext called fn %d times after cancel, want 1", calls)
+	}
+	_, err = e.g.Query(hub).Out().AllContext(cancelled)
+	expectErr(t, "AllContext", err, context.Canceled)
+}
+
+func testDSN(t *testing.T, e *env) {
+	sep := "?"
+	if strings.Contains(e.attrs, "?") {
+		sep = "&"
+	}
+	_, err := graphie.NewGraph(e.suite.Driver, e.attrs+sep+"nosuchparam=1", dbname())
+	expectErr(t, "NewGraph with an unknown parameter", err, graphie.ErrInvalidDSN)
+
+	_, err = graphie.NewGraph(e.suite.Driver, "nosuchdriver:///graph", dbname())
+	expectErr(t, "NewGraph with the DSN of another driver", err, graphie.ErrInvalidDSN)
+}
+
+func testConcurrency(t *testing.T, e *env) {
+	const (
+		workers = 8
+		nodes   = 50
+	)
+
+	hub := mustAdd(t, e.s, []string{"hub"}, nil)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	ids := make(chan graphie.NodeID, workers*nodes)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < nodes; i++ {
+				id, err := e.s.Add([]string{"leaf"}, graphie.Attrs{"worker": w})
+				if err == nil {
+					err = e.s.Set(id, "i", i)
+				}
+				if err == nil {
+					_, err = e.s.Link(hub, id, "", graphie.Attrs{"worker": w})
+				}
+				if err == nil {
+					_, err = e.s.Link(id, hub, "", nil)
+				}
+				if err == nil {
+					_, err = e.s.Out(hub)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				ids <- id
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	close(ids)
+
+	for err := range errs {
+		t.Fatalf("Concurrent mutation failed: %s", err)
+	}
+
+	seen := make(map[graphie.NodeID]struct{})
+	for id := range ids {
+		if _, has := seen[id]; has || id == hub {
+			t.Fatalf("Id %d was handed out twice", id)
+		}
+		seen[id] = struct{}{}
+
+		has, err := e.s.Has(id, "i")
+		if err != nil || !has {
+			t.Fatalf("Has(%d, i) = %v, %v; want true", id, has, err)
+		}
+	}
+	if len(seen) != workers*nodes {
+		t.Fatalf("Added %d nodes, want %d", len(seen), workers*nodes)
+	}
+
+	out, err := e.s.Out(hub)
+	if err != nil || len(out) != workers*nodes {
+		t.Fatalf("Out(hub) returned %d links (%v), want %d", len(out), err, workers*nodes)
+	}
+	in, err := e.s.In(hub)
+	if err != nil || len(in) != workers*nodes {
+		t.Fatalf("In(hub) returned %d links (%v), want %d", len(in), err, workers*nodes)
+	}
+}
+
+func testPersistence(t *testing.T, e *env) {
+	if !e.suite.Persistent {
+		t.Skip("Driver is not persistent")
+	}
+
+	a := mustAdd(t, e.s, []string{"person"}, graphie.Attrs{"name": "a"})
+	b := mustAdd(t, e.s, []string{"person"}, graphie.Attrs{"name": "b"})
+	c := mustAdd(t, e.s, []string{"person"}, graphie.Attrs{"name": "c"})
+	ab := mustLink(t, e.s, a, b, graphie.Attrs{"type": "knows"})
+	mustLink(t, e.s, b, c, nil)
+	mustLinkType(t, e.s, b, a, "likes", nil)
+	if err := e.s.Set(a, "born", 1707); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	if err := e.s.Remove(c); err != nil {
+		t.Fatalf("Remove failed: %s", err)
+	}
+
+	e.close(t)
+	e.open(t)
+
+	expectAttrs(t, e.s, a, graphie.Attrs{"name": "a", "born": 1707})
+	expectAttrs(t, e.s, b, graphie.Attrs{"name": "b"})
+	if _, err := e.s.Attrs(c); err == nil {
+		t.Fatal("Removed node is back after reopening")
+	}
+	out, err := e.s.Out(a)
+	expectLinks(t, "Out(a)", out, err, []*graphie.Link{
+		{ID: ab, Other: b, Attrs: graphie.Attrs{"type": "knows"}},
+	})
+	out, err = e.s.Out(b)
+	expectTypes(t, "Out(b)", out, err, map[graphie.NodeID][]string{
+		a: {"likes"},
+	})
+	expectEdge(t, e.s, ab, &graphie.Edge{ID: ab, From: a, To: b, Attrs: graphie.Attrs{"type": "knows"}})
+	links, err := collectLinks(e.s.WalkOutTypes, b, "likes")
+	expectTypes(t, "WalkOutTypes(b, likes)", links, err, map[graphie.NodeID][]string{
+		a: {"likes"},
+	})
+
+	// New ids must not collide with the ones handed out before
+	d := mustAdd(t, e.s, nil, nil)
+	if d == a || d == b || d == c {
+		t.Fatalf("Add handed out id %d again after reopening", d)
+	}
+	if id := mustLink(t, e.s, a, d, nil); id <= ab {
+		t.Fatalf("Link handed out id %d after reopening, the last one was %d", id, ab)
+	}
+}
@@ -0,0 +1,363 @@
+package graphie
+
+import (
+	"errors"
+)
+
+var (
+	ErrTxDone         = errors.New("Transaction has already been committed or rolled back")
+	ErrTxNotSupported = errors.New("Transactions are not supported by the storage driver")
+)
+
+// TxStorage is implemented by storages supporting transactions (see
+// Graph.Begin).
+type TxStorage interface {
+	Storage
+
+	// ReserveID allocates the id of a node added by a transaction. The id is
+	// never handed out again, even if the transaction is rolled back.
+	ReserveID() (NodeID, error)
+
+	// ReserveEdgeID allocates the id of a link added by a transaction like
+	// ReserveID.
+	ReserveEdgeID() (EdgeID, error)
+
+	// Apply applies the operations of a transaction in the given order.
+	// Either all of them are applied or none; readers never see a part of
+	// them.
+	Apply(ops []TxOp) error
+}
+
+// TxOpKind is the kind of a buffered operation.
+type TxOpKind int
+
+const (
+	TxAdd TxOpKind = iota
+	TxSet
+	TxLink
+	TxUnlink
+	TxRemove
+)
+
+// TxOp is a buffered operation of a transaction.
+type TxOp struct {
+	Kind   TxOpKind
+	ID     NodeID      // the node; the from-node of TxLink and TxUnlink
+	To     NodeID      // TxLink, TxUnlink
+	Edge   EdgeID      // TxLink
+	Type   string      // TxLink
+	Labels []string    // TxAdd
+	Attrs  Attrs       // TxAdd, TxLink, TxUnlink
+	Key    string      // TxSet
+	Value  interface{} // TxSet
+}
+
+// Tx buffers mutations until they are committed. Reads done through the Tx
+// see the buffered mutations (read-your-writes), other readers see none of
+// them until Commit succeeds.
+//
+// A Tx must not be used concurrently.
+type Tx struct {
+	s     TxStorage
+	ops   []TxOp
+	nodes map[NodeID]*txNode
+	done  bool
+}
+
+// txNode is the staged view of a node touched by a transaction. It's
+// updated as the operations are buffered, so reads don't replay them.
+type txNode struct {
+	added   bool  // the node doesn't exist in the storage yet
+	removed bool  // the node was removed by the transaction
+	attrs   Attrs // all attributes of added nodes, the ones set otherwise
+}
+
+// Begin starts a transaction. The storage driver has to implement TxStorage.
+func (g *Graph) Begin() (*Tx, error) {
+	ts, ok := g.s.(TxStorage)
+	if !ok {
+		return nil, ErrTxNotSupported
+	}
+	return &Tx{s: ts, nodes: make(map[NodeID]*txNode)}, nil
+}
+
+// Commit applies all buffered mutations atomically. The transaction is done
+// afterwards, even if Commit fails; in this case none of the mutations was
+// applied.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	if len(tx.ops) == 0 {
+		return nil
+	}
+	return tx.s.Apply(tx.ops)
+}
+
+// Rollback discards all buffered mutations.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.ops = nil
+	tx.nodes = nil
+	return nil
+}
+
+func (tx *Tx) Add(labels []string, attrs Attrs) (NodeID, error) {
+	if tx.done {
+		return 0, ErrTxDone
+	}
+	id, err := tx.s.ReserveID()
+	if err != nil {
+		return 0, err
+	}
+	tx.ops = append(tx.ops, TxOp{
+		Kind:   TxAdd,
+		ID:     id,
+		Labels: append([]string(nil), labels...),
+		Attrs:  copyAttrs(attrs),
+	})
+	n := &txNode{added: true, attrs: copyAttrs(attrs)}
+	if n.attrs == nil {
+		n.attrs = make(Attrs)
+	}
+	tx.nodes[id] = n
+	return id, nil
+}
+
+func (tx *Tx) Set(id NodeID, key string, value interface{}) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if err := tx.exists(id); err != nil {
+		return err
+	}
+	tx.ops = append(tx.ops, TxOp{
+		Kind:  TxSet,
+		ID:    id,
+		Key:   key,
+		Value: value,
+	})
+	n := tx.stage(id)
+	if n.attrs == nil {
+		n.attrs = make(Attrs)
+	}
+	n.attrs[key] = value
+	return nil
+}
+
+func (tx *Tx) Link(from, to NodeID, typ string, attrs Attrs) (EdgeID, error) {
+	if tx.done {
+		return 0, ErrTxDone
+	}
+	for _, id := range []NodeID{from, to} {
+		if err := tx.exists(id); err != nil {
+			return 0, err
+		}
+	}
+	eid, err := tx.s.ReserveEdgeID()
+	if err != nil {
+		return 0, err
+	}
+	tx.ops = append(tx.ops, TxOp{
+		Kind:  TxLink,
+		ID:    from,
+		To:    to,
+		Edge:  eid,
+		Type:  typ,
+		Attrs: copyAttrs(attrs),
+	})
+	return eid, nil
+}
+
+// Unlink removes all links from -> to matching attrs like Storage.Unlink and
+// returns the number of links matching now. The count is provisional: the
+// links are matched again on commit, so links added or removed by others in
+// the meantime change which links are removed.
+func (tx *Tx) Unlink(from, to NodeID, attrs Attrs) (int, error) {
+	if tx.done {
+		return 0, ErrTxDone
+	}
+	if err := tx.exists(to); err != nil {
+		return 0, err
+	}
+	links, err := tx.Out(from)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, l := range links {
+		if l.Other == to && l.Attrs.Match(attrs) {
+			removed++
+		}
+	}
+	tx.ops = append(tx.ops, TxOp{
+		Kind:  TxUnlink,
+		ID:    from,
+		To:    to,
+		Attrs: copyAttrs(attrs),
+	})
+	return removed, nil
+}
+
+// Remove removes the node and all links from and to it.
+func (tx *Tx) Remove(id NodeID) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if err := tx.exists(id); err != nil {
+		return err
+	}
+	tx.ops = append(tx.ops, TxOp{
+		Kind: TxRemove,
+		ID:   id,
+	})
+	tx.stage(id).removed = true
+	return nil
+}
+
+// stage returns the staged view of the node, creating it if the node wasn't
+// touched yet.
+func (tx *Tx) stage(id NodeID) *txNode {
+	n, has := tx.nodes[id]
+	if !has {
+		n = &txNode{}
+		tx.nodes[id] = n
+	}
+	return n
+}
+
+// exists returns ErrNodeNotFound if the node neither exists in the storage
+// nor was added by the transaction, or if the transaction removed it.
+func (tx *Tx) exists(id NodeID) error {
+	if n, has := tx.nodes[id]; has {
+		if n.removed {
+			return ErrNodeNotFound
+		}
+		if n.added {
+			return nil
+		}
+	}
+	_, err := tx.s.Attrs(id)
+	return err
+}
+
+// Attrs returns the attributes of the node including the buffered changes.
+func (tx *Tx) Attrs(id NodeID) (Attrs, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+
+	n := tx.nodes[id]
+	if n != nil && n.removed {
+		return nil, ErrNodeNotFound
+	}
+	if n != nil && n.added {
+		return copyAttrs(n.attrs), nil
+	}
+	attrs, err := tx.s.Attrs(id)
+	if err != nil {
+		return nil, err
+	}
+	if n != nil && len(n.attrs) > 0 {
+		attrs = copyAttrs(attrs)
+		if attrs == nil {
+			attrs = make(Attrs)
+		}
+		for k, v := range n.attrs {
+			attrs[k] = v
+		}
+	}
+	return attrs, nil
+}
+
+func (tx *Tx) Get(id NodeID, key string) (interface{}, error) {
+	attrs, err := tx.Attrs(id)
+	if err != nil {
+		return nil, err
+	}
+	v, has := attrs[key]
+	if !has {
+		return nil, ErrAttrNotFound
+	}
+	return v, nil
+}
+
+func (tx *Tx) Has(id NodeID, key string) (bool, error) {
+	attrs, err := tx.Attrs(id)
+	if err != nil {
+		return false, err
+	}
+	_, has := attrs[key]
+	return has, nil
+}
+
+// In returns the in-links of the node having one of the types (all in-links
+// if there are none) including the buffered changes.
+func (tx *Tx) In(id NodeID, types ...string) ([]*Link, error) {
+	return tx.links(id, false, types)
+}
+
+// Out returns the out-links of the node having one of the types (all
+// out-links if there are none) including the buffered changes.
+func (tx *Tx) Out(id NodeID, types ...string) ([]*Link, error) {
+	return tx.links(id, true, types)
+}
+
+// links replays the buffered operations on the links of the node.
+func (tx *Tx) links(id NodeID, out bool, types []string) ([]*Link, error) {
+	if err := tx.exists(id); err != nil {
+		return nil, err
+	}
+
+	// Nodes added by the transaction don't exist in the storage yet
+	links := make([]*Link, 0)
+	if n := tx.nodes[id]; n == nil || !n.added {
+		walk := tx.s.WalkInTypes
+		if out {
+			walk = tx.s.WalkOutTypes
+		}
+		var err error
+		links, err = collectLinks(walk, id, types)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, op := range tx.ops {
+		self, other := op.To, op.ID
+		if out {
+			self, other = op.ID, op.To
+		}
+		switch op.Kind {
+		case TxLink:
+			if self == id && MatchType(types, op.Type) {
+				links = append(links, &Link{ID: op.Edge, Type: op.Type, Other: other, Attrs: copyAttrs(op.Attrs)})
+			}
+		case TxUnlink:
+			if self != id {
+				continue
+			}
+			kept := links[:0]
+			for _, l := range links {
+				if l.Other != other || !l.Attrs.Match(op.Attrs) {
+					kept = append(kept, l)
+				}
+			}
+			links = kept
+		case TxRemove:
+			kept := links[:0]
+			for _, l := range links {
+				if l.Other != op.ID {
+					kept = append(kept, l)
+				}
+			}
+			links = kept
+		}
+	}
+	return links, nil
+}